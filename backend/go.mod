@@ -15,3 +15,5 @@ require (
 require github.com/joho/godotenv v1.5.1 // direct
 
 require github.com/lib/pq v1.10.9
+
+require golang.org/x/text v0.29.0
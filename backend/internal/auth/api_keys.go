@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ScopeRecipesRead  = "recipes:read"
+	ScopeLikesRead    = "likes:read"
+	ScopeLikesWrite   = "likes:write"
+	ScopeProfileRead  = "profile:read"
+	ScopeProfileWrite = "profile:write"
+)
+
+var validScopes = map[string]bool{
+	ScopeRecipesRead:  true,
+	ScopeLikesRead:    true,
+	ScopeLikesWrite:   true,
+	ScopeProfileRead:  true,
+	ScopeProfileWrite: true,
+}
+
+const (
+	apiKeyPrefix      = "rk_"
+	maxAPIKeysPerUser = 25
+)
+
+var (
+	ErrInvalidAPIKey      = errors.New("invalid API key")
+	ErrAPIKeyNotFound     = errors.New("API key not found")
+	ErrInvalidScope       = errors.New("invalid scope")
+	ErrTooManyAPIKeys     = errors.New("too many API keys")
+	ErrAPIKeyExpiryInPast = errors.New("API key expiry is in the past")
+)
+
+// allows reports whether the key carries every one of the required scopes.
+// Endpoints that declare no scopes are closed to API keys entirely.
+func (k *APIKey) allows(required []string) bool {
+	if len(required) == 0 {
+		return false
+	}
+
+	granted := make(map[string]bool, len(k.Scopes))
+	for _, scope := range k.Scopes {
+		granted[scope] = true
+	}
+	for _, scope := range required {
+		if !granted[scope] {
+			return false
+		}
+	}
+	return true
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateAPIKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func normalizeScopes(scopes []string) ([]string, error) {
+	seen := make(map[string]bool, len(scopes))
+	normalized := make([]string, 0, len(scopes))
+
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if !validScopes[scope] {
+			return nil, ErrInvalidScope
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+
+	if len(normalized) == 0 {
+		return nil, ErrInvalidScope
+	}
+	return normalized, nil
+}
+
+func (s *AuthService) createAPIKey(userID string, request CreateAPIKeyRequest) (*CreateAPIKeyResponse, error) {
+	scopes, err := normalizeScopes(request.Scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		return nil, ErrAPIKeyExpiryInPast
+	}
+
+	var count int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM api_keys WHERE user_id = $1", userID).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+	if count >= maxAPIKeysPerUser {
+		return nil, ErrTooManyAPIKeys
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey := APIKey{
+		ID:        uuid.New().String(),
+		Name:      request.Name,
+		Prefix:    key[:len(apiKeyPrefix)+6],
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var expiresAt sql.NullTime
+	if request.ExpiresAt != nil {
+		utc := request.ExpiresAt.UTC()
+		apiKey.ExpiresAt = &utc
+		expiresAt = sql.NullTime{Time: utc, Valid: true}
+	}
+
+	query := `
+		INSERT INTO api_keys (id, user_id, name, prefix, key_hash, scopes, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err = s.db.Exec(query, apiKey.ID, userID, apiKey.Name, apiKey.Prefix, hashAPIKey(key),
+		strings.Join(scopes, ","), expiresAt, apiKey.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CreateAPIKeyResponse{
+		APIKey: apiKey,
+		Key:    key,
+	}, nil
+}
+
+func (s *AuthService) listAPIKeys(userID string) ([]APIKey, error) {
+	query := `
+		SELECT id, name, prefix, scopes, expires_at, last_used_at, created_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apiKeys := []APIKey{}
+	for rows.Next() {
+		var apiKey APIKey
+		var scopes string
+		var expiresAt, lastUsedAt sql.NullTime
+
+		err := rows.Scan(&apiKey.ID, &apiKey.Name, &apiKey.Prefix, &scopes, &expiresAt, &lastUsedAt, &apiKey.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		apiKey.Scopes = strings.Split(scopes, ",")
+		if expiresAt.Valid {
+			apiKey.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			apiKey.LastUsedAt = &lastUsedAt.Time
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return apiKeys, nil
+}
+
+func (s *AuthService) revokeAPIKey(userID, keyID string) error {
+	result, err := s.db.Exec("DELETE FROM api_keys WHERE id = $1 AND user_id = $2", keyID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// validateAPIKey resolves a presented key to its owner and scopes and records
+// when it was last used.
+func (s *AuthService) validateAPIKey(key string) (*APIKey, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	var apiKey APIKey
+	var scopes string
+	var expiresAt sql.NullTime
+
+	query := `
+		SELECT k.id, k.user_id, u.role, k.name, k.prefix, k.scopes, k.expires_at, k.created_at
+		FROM api_keys k
+		JOIN users u ON u.id = k.user_id
+		WHERE k.key_hash = $1 AND u.delete_after IS NULL AND (u.suspended_until IS NULL OR u.suspended_until <= $2)
+	`
+	err := s.db.QueryRow(query, hashAPIKey(key), time.Now().UTC()).Scan(
+		&apiKey.ID, &apiKey.UserID, &apiKey.Role, &apiKey.Name, &apiKey.Prefix, &scopes, &expiresAt, &apiKey.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if expiresAt.Valid {
+		if !expiresAt.Time.After(now) {
+			return nil, ErrInvalidAPIKey
+		}
+		apiKey.ExpiresAt = &expiresAt.Time
+	}
+	apiKey.Scopes = strings.Split(scopes, ",")
+
+	_, err = s.db.Exec("UPDATE api_keys SET last_used_at = $1 WHERE id = $2", now, apiKey.ID)
+	if err != nil {
+		return nil, err
+	}
+	apiKey.LastUsedAt = &now
+
+	return &apiKey, nil
+}
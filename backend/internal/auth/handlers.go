@@ -3,13 +3,18 @@ package auth
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/ngthecoder/go_web_api/internal/errors"
 )
 
 type AuthHandler struct {
-	service *AuthService
+	service        *AuthService
+	trustedProxies []*net.IPNet
 }
 
 func NewAuthHandler(service *AuthService) *AuthHandler {
@@ -18,8 +23,38 @@ func NewAuthHandler(service *AuthService) *AuthHandler {
 	}
 }
 
-func (h *AuthHandler) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// SetTrustedProxies lists the proxies whose X-Forwarded-For header is
+// believed. With none configured the header is ignored and the client is
+// identified by the connection's remote address.
+func (h *AuthHandler) SetTrustedProxies(proxies []*net.IPNet) {
+	h.trustedProxies = proxies
+}
+
+// AuthMiddleware authenticates the request with either a bearer JWT or an
+// X-API-Key header. API keys are only accepted on endpoints that list the
+// scopes they need, and the key must carry all of them.
+func (h *AuthHandler) AuthMiddleware(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			apiKey, err := h.service.validateAPIKey(key)
+			if err != nil {
+				if err == ErrInvalidAPIKey {
+					errors.WriteHTTPError(w, errors.NewUnauthorizedError("Invalid or expired API key"))
+					return
+				}
+				errors.WriteHTTPError(w, errors.NewInternalServerError("Failed to validate API key", err))
+				return
+			}
+
+			if !apiKey.allows(scopes) {
+				errors.WriteHTTPError(w, errors.NewForbiddenError("API key does not have the required scope"))
+				return
+			}
+
+			next(w, r.WithContext(apiKeyContext(r.Context(), apiKey)))
+			return
+		}
+
 		authHeader := r.Header.Get("Authorization")
 
 		if authHeader == "" {
@@ -33,14 +68,33 @@ func (h *AuthHandler) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
-		r = r.WithContext(ctx)
-		next(w, r)
+		err = h.service.checkSession(claims)
+		if err != nil {
+			if err == ErrSessionRevoked {
+				errors.WriteHTTPError(w, errors.NewUnauthorizedError("Session has been logged out"))
+				return
+			}
+			errors.WriteHTTPError(w, errors.NewInternalServerError("Failed to validate session", err))
+			return
+		}
+
+		next(w, r.WithContext(claimsContext(r.Context(), claims)))
 	}
 }
 
-func (h *AuthHandler) OptionalAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+func (h *AuthHandler) OptionalAuthMiddleware(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			apiKey, err := h.service.validateAPIKey(key)
+			if err != nil || !apiKey.allows(scopes) {
+				next(w, r)
+				return
+			}
+
+			next(w, r.WithContext(apiKeyContext(r.Context(), apiKey)))
+			return
+		}
+
 		authHeader := r.Header.Get("Authorization")
 
 		if authHeader == "" {
@@ -54,12 +108,64 @@ func (h *AuthHandler) OptionalAuthMiddleware(next http.HandlerFunc) http.Handler
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
-		r = r.WithContext(ctx)
-		next(w, r)
+		if err := h.service.checkSession(claims); err != nil {
+			next(w, r)
+			return
+		}
+
+		next(w, r.WithContext(claimsContext(r.Context(), claims)))
 	}
 }
 
+func claimsContext(ctx context.Context, claims *JWTClaims) context.Context {
+	ctx = context.WithValue(ctx, "user_id", claims.UserID)
+	ctx = context.WithValue(ctx, "role", claims.Role)
+	ctx = context.WithValue(ctx, "session_id", claims.SessionID)
+	return ctx
+}
+
+func apiKeyContext(ctx context.Context, apiKey *APIKey) context.Context {
+	ctx = context.WithValue(ctx, "user_id", apiKey.UserID)
+	ctx = context.WithValue(ctx, "role", apiKey.Role)
+	ctx = context.WithValue(ctx, "api_key_id", apiKey.ID)
+	return ctx
+}
+
+// SessionUserID returns the caller's user ID when the request was signed in
+// with a session token, and "" for anonymous and API key requests. Private
+// data that no API key scope covers must only be read through it.
+func SessionUserID(r *http.Request) string {
+	if r.Context().Value("api_key_id") != nil {
+		return ""
+	}
+	userID, _ := r.Context().Value("user_id").(string)
+	return userID
+}
+
+// RequireRole authenticates the request like AuthMiddleware and additionally
+// rejects callers whose role does not grant at least the required one. The
+// role is read afresh rather than trusted from the token, so a demotion takes
+// effect immediately.
+func (h *AuthHandler) RequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return h.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		callerRole, err := h.service.currentRole(r.Context().Value("user_id").(string))
+		if err == ErrUserNotFound {
+			errors.WriteHTTPError(w, errors.NewUnauthorizedError("Invalid or expired token"))
+			return
+		}
+		if err != nil {
+			errors.WriteHTTPError(w, errors.NewInternalServerError("Failed to check permissions", err))
+			return
+		}
+		if !HasRole(callerRole, role) {
+			errors.WriteHTTPError(w, errors.NewForbiddenError("Insufficient permissions"))
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), "role", callerRole)))
+	})
+}
+
 func (h *AuthHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
@@ -78,7 +184,28 @@ func (h *AuthHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := h.service.registerUser(request)
+	var fields []errors.FieldError
+	if username, err := NormalizeUsername(request.Username); err != nil {
+		fields = append(fields, NewIdentityFieldError("username", err))
+	} else {
+		request.Username = username
+	}
+	if email, err := NormalizeEmail(request.Email); err != nil {
+		fields = append(fields, NewIdentityFieldError("email", err))
+	} else {
+		request.Email = email
+	}
+	if len(fields) > 0 {
+		errors.WriteHTTPError(w, errors.NewValidationError("Invalid username or email", fields))
+		return
+	}
+
+	if violations := h.service.policy.Validate(request.Password, request.Username, request.Email); len(violations) > 0 {
+		errors.WriteHTTPError(w, NewPolicyViolationError("password", violations))
+		return
+	}
+
+	response, err := h.service.registerUser(request, h.clientInfo(r))
 	if err != nil {
 		if err == ErrUserExists {
 			errors.WriteHTTPError(w, errors.NewConflictError("User already exists"))
@@ -106,15 +233,30 @@ func (h *AuthHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if request.Email == "" || request.Password == "" {
-		errors.WriteHTTPError(w, errors.NewBadRequestError("Email and password are required"))
+	if request.Identifier == "" {
+		request.Identifier = request.Email
+	}
+	if request.Identifier == "" || request.Password == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Email or username and password are required"))
 		return
 	}
 
-	response, err := h.service.loginUser(request)
+	response, err := h.service.loginUser(request, h.clientInfo(r))
 	if err != nil {
+		if lockedErr, ok := err.(*LoginLockedError); ok {
+			errors.WriteHTTPError(w, errors.NewTooManyRequestsError("Too many failed login attempts, try again later", lockedErr.RetryAfter))
+			return
+		}
+		if pendingErr, ok := err.(*AccountPendingDeletionError); ok {
+			errors.WriteHTTPError(w, newPendingDeletionError(pendingErr))
+			return
+		}
+		if suspendedErr, ok := err.(*AccountSuspendedError); ok {
+			errors.WriteHTTPError(w, newSuspendedError(suspendedErr))
+			return
+		}
 		if err == ErrInvalidCredentials {
-			errors.WriteHTTPError(w, errors.NewUnauthorizedError("Invalid email or password"))
+			errors.WriteHTTPError(w, errors.NewUnauthorizedError("Invalid username, email or password"))
 			return
 		}
 		errors.WriteHTTPError(w, errors.NewInternalServerError("Login failed", err))
@@ -125,3 +267,553 @@ func (h *AuthHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
+
+// RestoreAccountHandler cancels a scheduled account deletion. It takes the
+// same body as a login and signs the account in. Accounts without a password
+// use /api/auth/oidc/{provider}/start?restore=true instead.
+func (h *AuthHandler) RestoreAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	var request LoginRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+		return
+	}
+
+	if request.Identifier == "" {
+		request.Identifier = request.Email
+	}
+	if request.Identifier == "" || request.Password == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Email or username and password are required"))
+		return
+	}
+
+	response, err := h.service.restoreAccount(request, h.clientInfo(r))
+	if err != nil {
+		if lockedErr, ok := err.(*LoginLockedError); ok {
+			errors.WriteHTTPError(w, errors.NewTooManyRequestsError("Too many failed login attempts, try again later", lockedErr.RetryAfter))
+			return
+		}
+		if err == ErrInvalidCredentials {
+			errors.WriteHTTPError(w, errors.NewUnauthorizedError("Invalid username, email or password"))
+			return
+		}
+		if suspendedErr, ok := err.(*AccountSuspendedError); ok {
+			errors.WriteHTTPError(w, newSuspendedError(suspendedErr))
+			return
+		}
+		errors.WriteHTTPError(w, errors.NewInternalServerError("Account restore failed", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func newPendingDeletionError(err *AccountPendingDeletionError) *errors.HTTPError {
+	return errors.NewForbiddenError(fmt.Sprintf(
+		"Account is scheduled for deletion on %s; restore it to sign in",
+		err.DeleteAfter.UTC().Format("2006-01-02"),
+	))
+}
+
+func newSuspendedError(err *AccountSuspendedError) *errors.HTTPError {
+	return errors.NewForbiddenError(fmt.Sprintf(
+		"Account is suspended until %s",
+		err.SuspendedUntil.UTC().Format("2006-01-02 15:04 MST"),
+	))
+}
+
+func (h *AuthHandler) UpdateUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) != 6 || pathParts[4] == "" || pathParts[5] != "role" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/admin/users/{id}/role"))
+		return
+	}
+	targetUserID := pathParts[4]
+
+	var request UpdateRoleRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+		return
+	}
+
+	if !IsValidRole(request.Role) {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Role must be one of user, editor, admin"))
+		return
+	}
+
+	if targetUserID == r.Context().Value("user_id").(string) {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("You cannot change your own role"))
+		return
+	}
+
+	user, err := h.service.updateUserRole(targetUserID, request.Role)
+	if err != nil {
+		if err == ErrUserNotFound {
+			errors.WriteHTTPError(w, errors.NewNotFoundError("User not found"))
+			return
+		}
+		errors.WriteHTTPError(w, errors.NewInternalServerError("Failed to update role", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+func (h *AuthHandler) APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	switch r.Method {
+	case http.MethodGet:
+		apiKeys, err := h.service.listAPIKeys(userID)
+		if err != nil {
+			errors.WriteHTTPError(w, errors.NewInternalServerError("Failed to list API keys", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"api_keys": apiKeys,
+		})
+	case http.MethodPost:
+		var request CreateAPIKeyRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" || len(request.Scopes) == 0 {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Name and at least one scope are required"))
+			return
+		}
+
+		response, err := h.service.createAPIKey(userID, request)
+		if err != nil {
+			switch err {
+			case ErrInvalidScope:
+				errors.WriteHTTPError(w, errors.NewBadRequestError("Unknown scope requested"))
+			case ErrAPIKeyExpiryInPast:
+				errors.WriteHTTPError(w, errors.NewBadRequestError("Expiry must be in the future"))
+			case ErrTooManyAPIKeys:
+				errors.WriteHTTPError(w, errors.NewConflictError("API key limit reached, revoke an existing key first"))
+			default:
+				errors.WriteHTTPError(w, errors.NewInternalServerError("Failed to create API key", err))
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(response)
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+	}
+}
+
+func (h *AuthHandler) RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	userID := r.Context().Value("user_id").(string)
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) != 5 || pathParts[4] == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/user/api-keys/{id}"))
+		return
+	}
+
+	err := h.service.revokeAPIKey(userID, pathParts[4])
+	if err != nil {
+		if err == ErrAPIKeyNotFound {
+			errors.WriteHTTPError(w, errors.NewNotFoundError("API key not found"))
+			return
+		}
+		errors.WriteHTTPError(w, errors.NewInternalServerError("Failed to revoke API key", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked"})
+}
+
+func (h *AuthHandler) SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+	sessionID, _ := r.Context().Value("session_id").(string)
+
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := h.service.listSessions(userID, sessionID)
+		if err != nil {
+			errors.WriteHTTPError(w, errors.NewInternalServerError("Failed to list sessions", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sessions": sessions,
+		})
+	case http.MethodDelete:
+		revoked, err := h.service.revokeOtherSessions(userID, sessionID)
+		if err != nil {
+			errors.WriteHTTPError(w, errors.NewInternalServerError("Failed to log out other sessions", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Logged out of all other sessions",
+			"revoked": revoked,
+		})
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+	}
+}
+
+func (h *AuthHandler) RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	userID := r.Context().Value("user_id").(string)
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) != 5 || pathParts[4] == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/user/sessions/{id}"))
+		return
+	}
+
+	err := h.service.revokeSession(userID, pathParts[4])
+	if err != nil {
+		if err == ErrSessionNotFound {
+			errors.WriteHTTPError(w, errors.NewNotFoundError("Session not found"))
+			return
+		}
+		errors.WriteHTTPError(w, errors.NewInternalServerError("Failed to revoke session", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Session logged out"})
+}
+
+func writeOIDCError(w http.ResponseWriter, err error) {
+	if pendingErr, ok := err.(*AccountPendingDeletionError); ok {
+		errors.WriteHTTPError(w, newPendingDeletionError(pendingErr))
+		return
+	}
+	if suspendedErr, ok := err.(*AccountSuspendedError); ok {
+		errors.WriteHTTPError(w, newSuspendedError(suspendedErr))
+		return
+	}
+
+	switch err {
+	case ErrUnknownProvider:
+		errors.WriteHTTPError(w, errors.NewNotFoundError("Unknown identity provider"))
+	case ErrInvalidOIDCState:
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Sign-in request is invalid or has expired, please try again"))
+	case ErrInvalidIDToken:
+		errors.WriteHTTPError(w, errors.NewUnauthorizedError("Identity provider returned an invalid token"))
+	case ErrEmailNotVerified:
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Identity provider did not supply a verified email"))
+	case ErrEmailNotLinked:
+		errors.WriteHTTPError(w, errors.NewConflictError("An account with this email already exists. Sign in to it and link this provider from your account settings"))
+	case ErrIdentityLinked:
+		errors.WriteHTTPError(w, errors.NewConflictError("This identity is already linked to another account"))
+	case ErrProviderAlreadyUsed:
+		errors.WriteHTTPError(w, errors.NewConflictError("A different identity from this provider is already linked"))
+	case ErrUserExists:
+		errors.WriteHTTPError(w, errors.NewConflictError("User already exists"))
+	default:
+		errors.WriteHTTPError(w, errors.NewInternalServerError("Identity provider sign-in failed", err))
+	}
+}
+
+// oidcBindingCookie ties a sign-in or link flow to the browser that started
+// it. It is only sent back to the callback endpoint.
+const oidcBindingCookie = "oidc_binding"
+
+// setOIDCBindingCookie stores binding for the callback, or clears the cookie
+// when maxAge is zero.
+func setOIDCBindingCookie(w http.ResponseWriter, binding string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     oidcBindingCookie,
+		Value:    binding,
+		Path:     "/api/auth/oidc/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge <= 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// OIDCHandler serves /api/auth/oidc/providers, /api/auth/oidc/{provider}/start
+// and /api/auth/oidc/{provider}/callback. The redirect URL registered with the
+// provider points at the frontend, which posts the code and state back here
+// with credentials, so that the binding cookie set by start is included.
+func (h *AuthHandler) OIDCHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+
+	if len(pathParts) == 5 && pathParts[4] == "providers" {
+		if r.Method != http.MethodGet {
+			errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"providers": h.service.providerNames(),
+		})
+		return
+	}
+
+	if len(pathParts) != 6 || pathParts[4] == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/auth/oidc/{provider}/start or /api/auth/oidc/{provider}/callback"))
+		return
+	}
+	provider := pathParts[4]
+
+	switch pathParts[5] {
+	case "start":
+		if r.Method != http.MethodGet {
+			errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+			return
+		}
+
+		restore := r.URL.Query().Get("restore") == "true"
+		authorizationURL, binding, err := h.service.startOIDC(provider, "", restore)
+		if err != nil {
+			writeOIDCError(w, err)
+			return
+		}
+
+		setOIDCBindingCookie(w, binding, oidcStateLifetime)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"authorization_url": authorizationURL,
+		})
+	case "callback":
+		if r.Method != http.MethodPost {
+			errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+			return
+		}
+
+		var request OIDCCallbackRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+
+		if request.Code == "" || request.State == "" {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Code and state are required"))
+			return
+		}
+
+		binding := ""
+		if cookie, err := r.Cookie(oidcBindingCookie); err == nil {
+			binding = cookie.Value
+		}
+		setOIDCBindingCookie(w, "", 0)
+
+		response, err := h.service.completeOIDC(provider, request.Code, request.State, binding, h.clientInfo(r))
+		if err != nil {
+			writeOIDCError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+	default:
+		errors.WriteHTTPError(w, errors.NewNotFoundError("Not found"))
+	}
+}
+
+func (h *AuthHandler) IdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	userID := r.Context().Value("user_id").(string)
+
+	identities, err := h.service.listIdentities(userID)
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewInternalServerError("Failed to list linked identities", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"identities": identities,
+	})
+}
+
+// IdentityHandler starts linking a provider to the caller's account with POST
+// and unlinks it with DELETE on /api/user/identities/{provider}.
+func (h *AuthHandler) IdentityHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) != 5 || pathParts[4] == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/user/identities/{provider}"))
+		return
+	}
+	provider := pathParts[4]
+
+	switch r.Method {
+	case http.MethodPost:
+		authorizationURL, binding, err := h.service.startOIDC(provider, userID, false)
+		if err != nil {
+			writeOIDCError(w, err)
+			return
+		}
+
+		setOIDCBindingCookie(w, binding, oidcStateLifetime)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"authorization_url": authorizationURL,
+		})
+	case http.MethodDelete:
+		err := h.service.unlinkIdentity(userID, provider)
+		if err != nil {
+			switch err {
+			case ErrIdentityNotFound:
+				errors.WriteHTTPError(w, errors.NewNotFoundError("Provider is not linked to this account"))
+			case ErrLastSignInMethod:
+				errors.WriteHTTPError(w, errors.NewConflictError("Cannot unlink the only way to sign in to this account"))
+			case ErrUserNotFound:
+				errors.WriteHTTPError(w, errors.NewNotFoundError("User not found"))
+			default:
+				errors.WriteHTTPError(w, errors.NewInternalServerError("Failed to unlink identity", err))
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Identity unlinked"})
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+	}
+}
+
+// NewIdentityFieldError describes a username or email rejected by
+// NormalizeUsername or NormalizeEmail.
+func NewIdentityFieldError(field string, err error) errors.FieldError {
+	if err == ErrInvalidUsername {
+		return errors.FieldError{
+			Field:   field,
+			Code:    "invalid_username",
+			Message: fmt.Sprintf("Username must be %d-%d characters of letters, digits, '.', '_' or '-', starting with a letter or digit", minUsernameLength, maxUsernameLength),
+		}
+	}
+	return errors.FieldError{
+		Field:   field,
+		Code:    "invalid_email",
+		Message: "Email address is not valid",
+	}
+}
+
+func (h *AuthHandler) clientInfo(r *http.Request) ClientInfo {
+	return ClientInfo{
+		IP:        h.clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// clientIP returns the address of the connection unless it comes from a
+// trusted proxy. In that case X-Forwarded-For is walked from the right, past
+// any further trusted proxies, to the first address a proxy of ours saw;
+// entries left of it are supplied by the client and can be spoofed.
+func (h *AuthHandler) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !h.isTrustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !h.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (h *AuthHandler) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, proxy := range h.trustedProxies {
+		if proxy.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies reads a comma-separated list of proxy addresses, each
+// either a single IP or a CIDR range.
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy range %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
@@ -0,0 +1,381 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const oidcStateLifetime = 10 * time.Minute
+
+var (
+	ErrInvalidOIDCState    = errors.New("invalid or expired OIDC state")
+	ErrEmailNotVerified    = errors.New("identity provider did not supply a verified email")
+	ErrEmailNotLinked      = errors.New("an unverified account already uses this email")
+	ErrIdentityLinked      = errors.New("identity is linked to another account")
+	ErrIdentityNotFound    = errors.New("identity not found")
+	ErrLastSignInMethod    = errors.New("cannot remove the only sign-in method")
+	ErrProviderAlreadyUsed = errors.New("provider already linked to this account")
+)
+
+var usernameUnsafeChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// ConfigureOIDCProvider enables "Sign in with <provider>" for one issuer.
+func (s *AuthService) ConfigureOIDCProvider(config OIDCProviderConfig) {
+	if s.providers == nil {
+		s.providers = make(map[string]*oidcProvider)
+	}
+	s.providers[config.Name] = newOIDCProvider(config)
+}
+
+func (s *AuthService) providerNames() []string {
+	names := make([]string, 0, len(s.providers))
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// startOIDC begins an authorization-code flow and returns the URL to send the
+// browser to, together with a binding secret for the browser to hold in a
+// cookie. The flow can only be completed by presenting that secret, so a
+// state started in one browser cannot be finished in another. A non-empty
+// linkUserID links the resulting identity to that account instead of signing
+// in. restore cancels a scheduled deletion of the account signing in, which
+// is how accounts without a password get theirs back.
+func (s *AuthService) startOIDC(providerName, linkUserID string, restore bool) (authorizationURL, binding string, err error) {
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return "", "", ErrUnknownProvider
+	}
+
+	state, err := randomURLString(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomURLString(32)
+	if err != nil {
+		return "", "", err
+	}
+	codeVerifier, err := randomURLString(48)
+	if err != nil {
+		return "", "", err
+	}
+	binding, err = randomURLString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	authorizationURL, err = provider.authorizationURL(state, nonce, codeVerifier)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now().UTC()
+	_, err = s.db.Exec("DELETE FROM oauth_states WHERE created_at < $1", now.Add(-oidcStateLifetime))
+	if err != nil {
+		return "", "", err
+	}
+
+	query := `
+		INSERT INTO oauth_states (state, provider, code_verifier, nonce, link_user_id, binding_hash, restore, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err = s.db.Exec(query, state, providerName, codeVerifier, nonce, linkUserID, hashOIDCBinding(binding), restore, now)
+	if err != nil {
+		return "", "", err
+	}
+
+	return authorizationURL, binding, nil
+}
+
+func hashOIDCBinding(binding string) string {
+	sum := sha256.Sum256([]byte(binding))
+	return hex.EncodeToString(sum[:])
+}
+
+// completeOIDC redeems the code returned to the redirect URL, resolves the
+// external identity to a local account and signs that account in. binding is
+// the secret startOIDC handed to the browser that began the flow.
+func (s *AuthService) completeOIDC(providerName, code, state, binding string, client ClientInfo) (*AuthResponse, error) {
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	var storedProvider, codeVerifier, nonce, linkUserID, bindingHash string
+	var restore bool
+	var createdAt time.Time
+	err := s.db.QueryRow(
+		"SELECT provider, code_verifier, nonce, link_user_id, binding_hash, restore, created_at FROM oauth_states WHERE state = $1",
+		state,
+	).Scan(&storedProvider, &codeVerifier, &nonce, &linkUserID, &bindingHash, &restore, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidOIDCState
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// States are single use, whether or not the exchange succeeds.
+	if _, err := s.db.Exec("DELETE FROM oauth_states WHERE state = $1", state); err != nil {
+		return nil, err
+	}
+	if storedProvider != providerName || time.Since(createdAt) > oidcStateLifetime {
+		return nil, ErrInvalidOIDCState
+	}
+	if binding == "" || subtle.ConstantTimeCompare([]byte(hashOIDCBinding(binding)), []byte(bindingHash)) != 1 {
+		return nil, ErrInvalidOIDCState
+	}
+
+	claims, err := provider.exchangeCode(code, codeVerifier, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	var user *User
+	if linkUserID != "" {
+		user, err = s.linkIdentity(linkUserID, providerName, claims)
+	} else {
+		user, err = s.resolveIdentity(providerName, claims)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if restore && linkUserID == "" {
+		if err := s.cancelDeletion(user); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.issueToken(user, client)
+}
+
+func (s *AuthService) identityOwner(providerName, subject string) (string, error) {
+	var userID string
+	err := s.db.QueryRow(
+		"SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2",
+		providerName, subject,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return userID, err
+}
+
+func (s *AuthService) insertIdentity(userID, providerName string, claims *oidcIDTokenClaims) error {
+	var exists bool
+	err := s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM user_identities WHERE user_id = $1 AND provider = $2)",
+		userID, providerName,
+	).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrProviderAlreadyUsed
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO user_identities (provider, subject, user_id, email, created_at) VALUES ($1, $2, $3, $4, $5)",
+		providerName, claims.Subject, userID, claims.Email, time.Now().UTC(),
+	)
+	return err
+}
+
+func (s *AuthService) linkIdentity(userID, providerName string, claims *oidcIDTokenClaims) (*User, error) {
+	ownerID, err := s.identityOwner(providerName, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if ownerID != "" && ownerID != userID {
+		return nil, ErrIdentityLinked
+	}
+	if ownerID == "" {
+		if err := s.insertIdentity(userID, providerName, claims); err != nil {
+			return nil, err
+		}
+	}
+
+	// A provider vouching for the account's own address verifies it, which
+	// lets later sign-ins with other providers link automatically.
+	if email, err := NormalizeEmail(claims.verifiedEmail()); err == nil {
+		_, err := s.db.Exec(
+			"UPDATE users SET email_verified_at = $1 WHERE id = $2 AND email = $3 AND email_verified_at IS NULL",
+			time.Now().UTC(), userID, email,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s.getUserByID(userID)
+}
+
+// resolveIdentity finds the account for an external identity: an existing
+// link first, then an account with the same verified email, and finally a
+// brand new account. Both sides of the email must be verified to link
+// automatically; otherwise anyone could register a victim's address locally
+// and wait for them to sign in with a provider. Unverified accounts have to
+// link the provider explicitly while signed in.
+func (s *AuthService) resolveIdentity(providerName string, claims *oidcIDTokenClaims) (*User, error) {
+	ownerID, err := s.identityOwner(providerName, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if ownerID != "" {
+		return s.getUserByID(ownerID)
+	}
+
+	if claims.verifiedEmail() == "" {
+		return nil, ErrEmailNotVerified
+	}
+	email, err := NormalizeEmail(claims.verifiedEmail())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.getUserByEmail(email)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == sql.ErrNoRows {
+		user, err = s.createOIDCUser(email)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var emailVerifiedAt sql.NullTime
+		err := s.db.QueryRow("SELECT email_verified_at FROM users WHERE id = $1", user.ID).Scan(&emailVerifiedAt)
+		if err != nil {
+			return nil, err
+		}
+		if !emailVerifiedAt.Valid {
+			return nil, ErrEmailNotLinked
+		}
+	}
+
+	if err := s.insertIdentity(user.ID, providerName, claims); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// createOIDCUser creates a password-less account for a provider-verified
+// email. Its username is derived from the email's local part, with a random
+// suffix if that is taken.
+func (s *AuthService) createOIDCUser(email string) (*User, error) {
+	base := strings.ToLower(strings.SplitN(email, "@", 2)[0])
+	base = strings.TrimLeft(usernameUnsafeChars.ReplaceAllString(base, ""), "._-")
+	if len(base) < minUsernameLength {
+		base = "user" + base
+	}
+	// Leave room for the random suffix within the username length limit.
+	if len(base) > maxUsernameLength-7 {
+		base = base[:maxUsernameLength-7]
+	}
+
+	username := base
+	for attempt := 0; attempt < 5; attempt++ {
+		exists, err := s.userExists(email, username)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			query := "INSERT INTO users (id, username, email, password_hash, role, created_at, updated_at, email_verified_at) VALUES ($1, $2, $3, '', $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP);"
+			if _, err := s.db.Exec(query, uuid.New().String(), username, email, RoleUser); err != nil {
+				return nil, err
+			}
+			return s.getUserByEmail(email)
+		}
+
+		username = fmt.Sprintf("%s_%s", base, uuid.New().String()[:6])
+	}
+
+	return nil, ErrUserExists
+}
+
+func (s *AuthService) listIdentities(userID string) ([]Identity, error) {
+	rows, err := s.db.Query(
+		"SELECT provider, email, created_at FROM user_identities WHERE user_id = $1 ORDER BY provider",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var identity Identity
+		if err := rows.Scan(&identity.Provider, &identity.Email, &identity.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+// unlinkIdentity removes a linked provider, refusing when it is the account's
+// only way to sign in.
+func (s *AuthService) unlinkIdentity(userID, providerName string) error {
+	var passwordHash string
+	err := s.db.QueryRow("SELECT password_hash FROM users WHERE id = $1", userID).Scan(&passwordHash)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var identityCount int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM user_identities WHERE user_id = $1", userID).Scan(&identityCount)
+	if err != nil {
+		return err
+	}
+
+	if passwordHash == "" && identityCount <= 1 {
+		var linked bool
+		err = s.db.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM user_identities WHERE user_id = $1 AND provider = $2)",
+			userID, providerName,
+		).Scan(&linked)
+		if err != nil {
+			return err
+		}
+		if linked {
+			return ErrLastSignInMethod
+		}
+	}
+
+	result, err := s.db.Exec("DELETE FROM user_identities WHERE user_id = $1 AND provider = $2", userID, providerName)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrIdentityNotFound
+	}
+
+	return nil
+}
@@ -2,13 +2,41 @@ package auth
 
 import "time"
 
+const (
+	RoleUser   = "user"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleUser:   1,
+	RoleEditor: 2,
+	RoleAdmin:  3,
+}
+
+func IsValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// HasRole reports whether role grants at least the privileges of required.
+// Admins can do everything editors can, and editors everything users can.
+func HasRole(role, required string) bool {
+	return roleRanks[role] >= roleRanks[required] && roleRanks[required] > 0
+}
+
 type User struct {
 	ID        string    `json:"id" db:"id"`
 	Username  string    `json:"username" db:"username"`
 	Email     string    `json:"email" db:"email"`
 	Password  string    `json:"-" db:"password_hash"`
+	Role      string    `json:"role" db:"role"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	// DeleteAfter is set while the account is scheduled for deletion.
+	DeleteAfter *time.Time `json:"delete_after,omitempty" db:"delete_after"`
+	// SuspendedUntil is set when a moderator has suspended the account.
+	SuspendedUntil *time.Time `json:"suspended_until,omitempty" db:"suspended_until"`
 }
 
 type RegisterRequest struct {
@@ -17,9 +45,12 @@ type RegisterRequest struct {
 	Password string `json:"password"`
 }
 
+// LoginRequest accepts either an email address or a username in Identifier.
+// Email is still read for clients that predate username login.
 type LoginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Identifier string `json:"identifier"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
 }
 
 type AuthResponse struct {
@@ -27,7 +58,56 @@ type AuthResponse struct {
 	Token string `json:"token"`
 }
 
+type UpdateRoleRequest struct {
+	Role string `json:"role"`
+}
+
 type JWTClaims struct {
-	UserID string `json:"user_id"`
-	Exp    int64  `json:"exp"`
+	UserID    string `json:"user_id"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid,omitempty"`
+	Exp       int64  `json:"exp"`
+}
+
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	Role       string     `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OIDCCallbackRequest struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
 }
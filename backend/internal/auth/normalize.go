@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 30
+)
+
+var (
+	ErrInvalidEmail    = errors.New("invalid email address")
+	ErrInvalidUsername = errors.New("invalid username")
+)
+
+// Usernames are limited to ASCII letters, digits, '.', '_' and '-', and must
+// start with a letter or digit, so that look-alike Unicode names cannot
+// impersonate each other.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// NormalizeEmail applies NFKC, trims surrounding space and lowercases the
+// whole address, so that one mailbox maps to exactly one account.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(norm.NFKC.String(email)))
+
+	at := strings.Index(email, "@")
+	if at <= 0 || at != strings.LastIndex(email, "@") || at == len(email)-1 {
+		return "", ErrInvalidEmail
+	}
+	if strings.ContainsAny(email, " \t\r\n") {
+		return "", ErrInvalidEmail
+	}
+
+	return email, nil
+}
+
+// NormalizeUsername applies NFKC and trims surrounding space. The result keeps
+// its case for display; uniqueness is enforced case-insensitively.
+func NormalizeUsername(username string) (string, error) {
+	username = strings.TrimSpace(norm.NFKC.String(username))
+
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return "", ErrInvalidUsername
+	}
+	if !usernamePattern.MatchString(username) {
+		return "", ErrInvalidUsername
+	}
+
+	return username, nil
+}
+
+// NormalizeLoginIdentifier normalizes whatever the user typed into the login
+// form. Anything containing '@' is treated as an email address.
+func NormalizeLoginIdentifier(identifier string) (value string, isEmail bool) {
+	identifier = strings.TrimSpace(norm.NFKC.String(identifier))
+	if strings.Contains(identifier, "@") {
+		return strings.ToLower(identifier), true
+	}
+	return identifier, false
+}
@@ -0,0 +1,399 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockIdentity struct {
+	subject       string
+	email         string
+	emailVerified bool
+}
+
+type mockAuthorization struct {
+	identity      mockIdentity
+	nonce         string
+	codeChallenge string
+}
+
+// mockOIDCIssuer is a minimal OpenID provider: discovery, JWKS and a token
+// endpoint that enforces PKCE. Tests play the browser by calling authorize.
+type mockOIDCIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+func newMockOIDCIssuer(t *testing.T) *mockOIDCIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate signing key: %v", err)
+	}
+
+	issuer := &mockOIDCIssuer{t: t, key: key, codes: make(map[string]mockAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.server.URL,
+			"authorization_endpoint": issuer.server.URL + "/authorize",
+			"token_endpoint":         issuer.server.URL + "/token",
+			"jwks_uri":               issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "test-key",
+				"kty": "RSA",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", issuer.tokenHandler)
+	issuer.server = httptest.NewServer(mux)
+
+	return issuer
+}
+
+func (m *mockOIDCIssuer) authorize(authorizationURL string, identity mockIdentity) (code, state string) {
+	parsed, err := url.Parse(authorizationURL)
+	if err != nil {
+		m.t.Fatalf("Invalid authorization URL: %v", err)
+	}
+	query := parsed.Query()
+
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		m.t.Fatalf("Authorization URL is missing PKCE parameters: %s", authorizationURL)
+	}
+
+	code, _ = randomURLString(16)
+
+	m.mu.Lock()
+	m.codes[code] = mockAuthorization{
+		identity:      identity,
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+	}
+	m.mu.Unlock()
+
+	return code, query.Get("state")
+}
+
+func (m *mockOIDCIssuer) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	m.mu.Lock()
+	authorization, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	verifierHash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != authorization.codeChallenge ||
+		r.PostForm.Get("client_id") != "test-client" || r.PostForm.Get("client_secret") != "test-secret" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "unused",
+		"token_type":   "Bearer",
+		"id_token":     m.signIDToken(authorization),
+	})
+}
+
+func (m *mockOIDCIssuer) signIDToken(authorization mockAuthorization) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":            m.server.URL,
+		"sub":            authorization.identity.subject,
+		"aud":            "test-client",
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          authorization.nonce,
+		"email":          authorization.identity.email,
+		"email_verified": authorization.identity.emailVerified,
+	})
+
+	message := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(message))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		m.t.Fatalf("Failed to sign ID token: %v", err)
+	}
+
+	return message + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func setupOIDCService(t *testing.T) (*AuthService, *mockOIDCIssuer) {
+	db := setupTestDB(t)
+	t.Cleanup(func() { db.Close() })
+
+	issuer := newMockOIDCIssuer(t)
+	t.Cleanup(issuer.server.Close)
+
+	service := NewAuthService(db, "test-secret")
+	service.ConfigureOIDCProvider(OIDCProviderConfig{
+		Name:         "mock",
+		IssuerURL:    issuer.server.URL,
+		ClientID:     "test-client",
+		ClientSecret: "test-secret",
+		RedirectURL:  "http://localhost:3000/login/callback/mock",
+	})
+
+	return service, issuer
+}
+
+func (m *mockOIDCIssuer) signIn(t *testing.T, service *AuthService, linkUserID string, identity mockIdentity) (*AuthResponse, error) {
+	authorizationURL, binding, err := service.startOIDC("mock", linkUserID, false)
+	if err != nil {
+		t.Fatalf("startOIDC() failed: %v", err)
+	}
+
+	code, state := m.authorize(authorizationURL, identity)
+	return service.completeOIDC("mock", code, state, binding, ClientInfo{IP: "127.0.0.1"})
+}
+
+func TestOIDCSignInCreatesAndReusesAccount(t *testing.T) {
+	service, issuer := setupOIDCService(t)
+
+	identity := mockIdentity{subject: "subject-1", email: "new.person@example.com", emailVerified: true}
+
+	first, err := issuer.signIn(t, service, "", identity)
+	if err != nil {
+		t.Fatalf("First OIDC sign-in failed: %v", err)
+	}
+	if first.Token == "" {
+		t.Error("OIDC sign-in returned empty token")
+	}
+	if first.User.Email != "new.person@example.com" || first.User.Username != "new.person" {
+		t.Errorf("Unexpected new user: %+v", first.User)
+	}
+
+	second, err := issuer.signIn(t, service, "", identity)
+	if err != nil {
+		t.Fatalf("Second OIDC sign-in failed: %v", err)
+	}
+	if second.User.ID != first.User.ID {
+		t.Errorf("Second sign-in should reuse account %s, got %s", first.User.ID, second.User.ID)
+	}
+
+	_, err = service.loginUser(LoginRequest{Email: "new.person@example.com", Password: ""}, ClientInfo{IP: "127.0.0.1"})
+	if err != ErrInvalidCredentials {
+		t.Errorf("Password login for a password-less account should fail, got %v", err)
+	}
+}
+
+func TestOIDCLinksByVerifiedEmail(t *testing.T) {
+	service, issuer := setupOIDCService(t)
+
+	registered, err := service.registerUser(RegisterRequest{
+		Username: "existing",
+		Email:    "existing@example.com",
+		Password: "password123",
+	}, ClientInfo{})
+	if err != nil {
+		t.Fatalf("registerUser() failed: %v", err)
+	}
+
+	_, err = issuer.signIn(t, service, "", mockIdentity{subject: "unverified", email: "existing@example.com", emailVerified: false})
+	if err != ErrEmailNotVerified {
+		t.Errorf("Expected ErrEmailNotVerified, got %v", err)
+	}
+
+	// The local address was never verified, so it could belong to anyone.
+	_, err = issuer.signIn(t, service, "", mockIdentity{subject: "verified", email: "existing@example.com", emailVerified: true})
+	if err != ErrEmailNotLinked {
+		t.Errorf("Expected ErrEmailNotLinked for an unverified local email, got %v", err)
+	}
+
+	if _, err := service.db.Exec("UPDATE users SET email_verified_at = CURRENT_TIMESTAMP WHERE id = $1", registered.User.ID); err != nil {
+		t.Fatalf("Failed to verify email: %v", err)
+	}
+
+	response, err := issuer.signIn(t, service, "", mockIdentity{subject: "verified", email: "existing@example.com", emailVerified: true})
+	if err != nil {
+		t.Fatalf("OIDC sign-in failed: %v", err)
+	}
+	if response.User.ID != registered.User.ID {
+		t.Errorf("Verified email should link to existing account %s, got %s", registered.User.ID, response.User.ID)
+	}
+
+	identities, err := service.listIdentities(registered.User.ID)
+	if err != nil {
+		t.Fatalf("listIdentities() failed: %v", err)
+	}
+	if len(identities) != 1 || identities[0].Provider != "mock" {
+		t.Errorf("Expected one linked mock identity, got %+v", identities)
+	}
+
+	err = service.unlinkIdentity(registered.User.ID, "mock")
+	if err != nil {
+		t.Fatalf("unlinkIdentity() failed: %v", err)
+	}
+
+	err = service.unlinkIdentity(registered.User.ID, "mock")
+	if err != ErrIdentityNotFound {
+		t.Errorf("Expected ErrIdentityNotFound, got %v", err)
+	}
+}
+
+func TestOIDCExplicitLinkAndUnlink(t *testing.T) {
+	service, issuer := setupOIDCService(t)
+
+	registered, err := service.registerUser(RegisterRequest{
+		Username: "linker",
+		Email:    "linker@example.com",
+		Password: "password123",
+	}, ClientInfo{})
+	if err != nil {
+		t.Fatalf("registerUser() failed: %v", err)
+	}
+
+	response, err := issuer.signIn(t, service, registered.User.ID, mockIdentity{subject: "other-email", email: "different@example.com", emailVerified: false})
+	if err != nil {
+		t.Fatalf("Linking failed: %v", err)
+	}
+	if response.User.ID != registered.User.ID {
+		t.Errorf("Linking should sign in as %s, got %s", registered.User.ID, response.User.ID)
+	}
+
+	passwordless, err := issuer.signIn(t, service, "", mockIdentity{subject: "solo", email: "solo@example.com", emailVerified: true})
+	if err != nil {
+		t.Fatalf("OIDC sign-in failed: %v", err)
+	}
+
+	_, err = issuer.signIn(t, service, passwordless.User.ID, mockIdentity{subject: "other-email"})
+	if err != ErrIdentityLinked {
+		t.Errorf("Expected ErrIdentityLinked, got %v", err)
+	}
+
+	err = service.unlinkIdentity(passwordless.User.ID, "mock")
+	if err != ErrLastSignInMethod {
+		t.Errorf("Expected ErrLastSignInMethod, got %v", err)
+	}
+
+	err = service.unlinkIdentity(registered.User.ID, "mock")
+	if err != nil {
+		t.Errorf("unlinkIdentity() should succeed for an account with a password: %v", err)
+	}
+}
+
+func TestOIDCRejectsReplayedAndForgedState(t *testing.T) {
+	service, issuer := setupOIDCService(t)
+
+	authorizationURL, binding, err := service.startOIDC("mock", "", false)
+	if err != nil {
+		t.Fatalf("startOIDC() failed: %v", err)
+	}
+	code, state := issuer.authorize(authorizationURL, mockIdentity{subject: "s", email: "s@example.com", emailVerified: true})
+
+	_, err = service.completeOIDC("mock", code, "forged-state", binding, ClientInfo{})
+	if err != ErrInvalidOIDCState {
+		t.Errorf("Expected ErrInvalidOIDCState for forged state, got %v", err)
+	}
+
+	_, err = service.completeOIDC("mock", code, state, binding, ClientInfo{})
+	if err != nil {
+		t.Fatalf("completeOIDC() failed: %v", err)
+	}
+
+	_, err = service.completeOIDC("mock", code, state, binding, ClientInfo{})
+	if err != ErrInvalidOIDCState {
+		t.Errorf("Expected ErrInvalidOIDCState for replayed state, got %v", err)
+	}
+
+	// A state started in another browser cannot be completed without its
+	// binding cookie.
+	for _, other := range []string{"", binding} {
+		authorizationURL, _, err := service.startOIDC("mock", "", false)
+		if err != nil {
+			t.Fatalf("startOIDC() failed: %v", err)
+		}
+		code, state := issuer.authorize(authorizationURL, mockIdentity{subject: "s", email: "s@example.com", emailVerified: true})
+		if _, err := service.completeOIDC("mock", code, state, other, ClientInfo{}); err != ErrInvalidOIDCState {
+			t.Errorf("Expected ErrInvalidOIDCState for binding %q, got %v", other, err)
+		}
+	}
+
+	_, _, err = service.startOIDC("unknown", "", false)
+	if err != ErrUnknownProvider {
+		t.Errorf("Expected ErrUnknownProvider, got %v", err)
+	}
+}
+
+func TestOIDCRejectsTamperedIDToken(t *testing.T) {
+	_, issuer := setupOIDCService(t)
+
+	provider := newOIDCProvider(OIDCProviderConfig{
+		Name:      "mock",
+		IssuerURL: issuer.server.URL,
+		ClientID:  "test-client",
+	})
+
+	token := issuer.signIDToken(mockAuthorization{identity: mockIdentity{subject: "s"}, nonce: "expected"})
+
+	if _, err := provider.verifyIDToken(token, "expected"); err != nil {
+		t.Fatalf("verifyIDToken() failed for a valid token: %v", err)
+	}
+	if _, err := provider.verifyIDToken(token, "other-nonce"); err != ErrInvalidIDToken {
+		t.Errorf("Expected ErrInvalidIDToken for wrong nonce, got %v", err)
+	}
+	if _, err := provider.verifyIDToken(token[:len(token)-4]+"AAAA", "expected"); err != ErrInvalidIDToken {
+		t.Errorf("Expected ErrInvalidIDToken for tampered signature, got %v", err)
+	}
+}
+
+func TestOIDCRestoresAccountWithoutPassword(t *testing.T) {
+	service, issuer := setupOIDCService(t)
+
+	identity := mockIdentity{subject: "subject-restore", email: "restore.me@example.com", emailVerified: true}
+	created, err := issuer.signIn(t, service, "", identity)
+	if err != nil {
+		t.Fatalf("OIDC sign-in failed: %v", err)
+	}
+	service.db.Exec("UPDATE users SET delete_after = $1 WHERE id = $2", time.Now().UTC().Add(24*time.Hour), created.User.ID)
+
+	_, err = issuer.signIn(t, service, "", identity)
+	if _, ok := err.(*AccountPendingDeletionError); !ok {
+		t.Fatalf("Plain sign-in to an account pending deletion: got %v, want AccountPendingDeletionError", err)
+	}
+
+	authorizationURL, binding, err := service.startOIDC("mock", "", true)
+	if err != nil {
+		t.Fatalf("startOIDC() failed: %v", err)
+	}
+	code, state := issuer.authorize(authorizationURL, identity)
+	restored, err := service.completeOIDC("mock", code, state, binding, ClientInfo{IP: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("Restoring through OIDC failed: %v", err)
+	}
+	if restored.User.ID != created.User.ID || restored.User.DeleteAfter != nil {
+		t.Errorf("Restored user = %+v, want %s with no deletion scheduled", restored.User, created.User.ID)
+	}
+
+	var deleteAfter sql.NullTime
+	service.db.QueryRow("SELECT delete_after FROM users WHERE id = $1", created.User.ID).Scan(&deleteAfter)
+	if deleteAfter.Valid {
+		t.Error("Restoring through OIDC should cancel the scheduled deletion")
+	}
+}
@@ -4,32 +4,161 @@ import (
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
 
 	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
 )
 
+var ErrUnsupportedHash = errors.New("unsupported password hash format")
+
+const maxBcryptPasswordLength = 72
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	saltLength  uint32
+	keyLength   uint32
+}
+
+// currentArgon2Params are used for every new hash. Raising them makes
+// existing hashes outdated, and they are upgraded on the user's next login.
+var currentArgon2Params = argon2Params{
+	memory:      64 * 1024,
+	iterations:  3,
+	parallelism: 2,
+	saltLength:  16,
+	keyLength:   32,
+}
+
+// legacyArgon2Params describe hashes stored before the PHC format, as raw
+// base64 of salt followed by key.
+var legacyArgon2Params = argon2Params{
+	memory:      64 * 1024,
+	iterations:  3,
+	parallelism: 2,
+	saltLength:  16,
+	keyLength:   16,
+}
+
 func HashPassword(password string) (string, error) {
-	salt := make([]byte, 16)
+	p := currentArgon2Params
+
+	salt := make([]byte, p.saltLength)
 	if _, err := rand.Read(salt); err != nil {
 		return "", err
 	}
 
-	hash := argon2.IDKey([]byte(password), salt, 3, 64*1024, 2, 16)
-	passwordHash := append(salt, hash...)
+	hash := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
 
-	return base64.StdEncoding.EncodeToString(passwordHash), nil
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.memory, p.iterations, p.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
 }
 
+// VerifyPasswordHash checks a password against a PHC-format Argon2id hash, a
+// legacy raw Argon2 hash, or a bcrypt hash imported from the old system.
 func VerifyPasswordHash(password, encodedHash string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encodedHash, "$argon2id$"):
+		params, salt, hash, err := decodeArgon2PHC(encodedHash)
+		if err != nil {
+			return false, err
+		}
+		return compareArgon2(password, params, salt, hash), nil
+	case isBcryptHash(encodedHash):
+		// bcrypt only reads the first 72 bytes; a longer password is not the
+		// one that was hashed.
+		if len(password) > maxBcryptPasswordLength {
+			return false, nil
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
 	decodedHash, err := base64.StdEncoding.DecodeString(encodedHash)
 	if err != nil {
 		return false, err
 	}
 
-	salt := decodedHash[:16]
-	correctHash := decodedHash[16:]
+	// Accounts created through an identity provider have no password.
+	if len(decodedHash) <= 16 {
+		return false, nil
+	}
+
+	salt := decodedHash[:legacyArgon2Params.saltLength]
+	correctHash := decodedHash[legacyArgon2Params.saltLength:]
+
+	return compareArgon2(password, legacyArgon2Params, salt, correctHash), nil
+}
 
-	hash := argon2.IDKey([]byte(password), salt, 3, 64*1024, 2, 16)
+// NeedsRehash reports whether a stored hash should be replaced with one made
+// using the current algorithm and parameters.
+func NeedsRehash(encodedHash string) bool {
+	if !strings.HasPrefix(encodedHash, "$argon2id$") {
+		return true
+	}
+
+	params, salt, hash, err := decodeArgon2PHC(encodedHash)
+	if err != nil {
+		return true
+	}
+
+	params.saltLength = uint32(len(salt))
+	params.keyLength = uint32(len(hash))
+	return params != currentArgon2Params
+}
+
+func compareArgon2(password string, p argon2Params, salt, correctHash []byte) bool {
+	hash := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, uint32(len(correctHash)))
+	return subtle.ConstantTimeCompare(correctHash, hash) == 1
+}
+
+func decodeArgon2PHC(encodedHash string) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, ErrUnsupportedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnsupportedHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return p, nil, nil, ErrUnsupportedHash
+	}
+	// argon2 panics when asked for zero passes or zero lanes.
+	if p.memory == 0 || p.iterations == 0 || p.parallelism == 0 {
+		return p, nil, nil, ErrUnsupportedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnsupportedHash
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(hash) == 0 {
+		return p, nil, nil, ErrUnsupportedHash
+	}
+
+	p.saltLength = uint32(len(salt))
+	p.keyLength = uint32(len(hash))
+	return p, salt, hash, nil
+}
 
-	return subtle.ConstantTimeCompare(correctHash, hash) == 1, nil
+func isBcryptHash(encodedHash string) bool {
+	return strings.HasPrefix(encodedHash, "$2a$") ||
+		strings.HasPrefix(encodedHash, "$2b$") ||
+		strings.HasPrefix(encodedHash, "$2y$")
 }
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+const (
+	ClassLower  = "lower"
+	ClassUpper  = "upper"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+var characterClassNames = map[string]string{
+	ClassLower:  "a lowercase letter",
+	ClassUpper:  "an uppercase letter",
+	ClassDigit:  "a digit",
+	ClassSymbol: "a symbol",
+}
+
+// minIdentityFragment keeps very short usernames from rejecting half of all
+// passwords just because they happen to contain them.
+const minIdentityFragment = 3
+
+type PolicyViolation struct {
+	Code    string
+	Message string
+}
+
+// PasswordPolicy is the single set of password rules applied wherever a user
+// chooses a password.
+type PasswordPolicy struct {
+	MinLength       int
+	MaxLength       int
+	RequiredClasses []string
+	ForbidIdentity  bool
+
+	blocklist map[string]struct{}
+}
+
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength:      8,
+		MaxLength:      128,
+		ForbidIdentity: true,
+		blocklist:      make(map[string]struct{}),
+	}
+}
+
+func IsValidCharacterClass(class string) bool {
+	_, ok := characterClassNames[class]
+	return ok
+}
+
+// LoadBlocklist adds every non-empty line of the file at path to the set of
+// rejected passwords. Matching is case-insensitive.
+func (p *PasswordPolicy) LoadBlocklist(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if p.blocklist == nil {
+		p.blocklist = make(map[string]struct{})
+	}
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.blocklist[strings.ToLower(line)] = struct{}{}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+
+	return count, nil
+}
+
+func (p *PasswordPolicy) Validate(password, username, email string) []PolicyViolation {
+	var violations []PolicyViolation
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violations = append(violations, PolicyViolation{
+			Code:    "too_short",
+			Message: fmt.Sprintf("Password must be at least %d characters", p.MinLength),
+		})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, PolicyViolation{
+			Code:    "too_long",
+			Message: fmt.Sprintf("Password must be at most %d characters", p.MaxLength),
+		})
+	}
+
+	present := make(map[string]bool)
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			present[ClassLower] = true
+		case unicode.IsUpper(r):
+			present[ClassUpper] = true
+		case unicode.IsDigit(r):
+			present[ClassDigit] = true
+		default:
+			present[ClassSymbol] = true
+		}
+	}
+	for _, class := range p.RequiredClasses {
+		if !present[class] {
+			violations = append(violations, PolicyViolation{
+				Code:    "missing_" + class,
+				Message: "Password must contain " + characterClassNames[class],
+			})
+		}
+	}
+
+	if p.ForbidIdentity && containsIdentity(password, username, email) {
+		violations = append(violations, PolicyViolation{
+			Code:    "contains_identity",
+			Message: "Password must not contain your username or email",
+		})
+	}
+
+	if _, blocked := p.blocklist[strings.ToLower(password)]; blocked {
+		violations = append(violations, PolicyViolation{
+			Code:    "too_common",
+			Message: "Password is too common or has appeared in a data breach",
+		})
+	}
+
+	return violations
+}
+
+func containsIdentity(password, username, email string) bool {
+	lowered := strings.ToLower(password)
+
+	fragments := []string{strings.ToLower(username)}
+	if email != "" {
+		email = strings.ToLower(email)
+		fragments = append(fragments, email, strings.SplitN(email, "@", 2)[0])
+	}
+
+	for _, fragment := range fragments {
+		if utf8.RuneCountInString(fragment) >= minIdentityFragment && strings.Contains(lowered, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewPolicyViolationError reports every violation against the request field
+// that carried the password.
+func NewPolicyViolationError(field string, violations []PolicyViolation) *errors.HTTPError {
+	fields := make([]errors.FieldError, 0, len(violations))
+	for _, violation := range violations {
+		fields = append(fields, errors.FieldError{
+			Field:   field,
+			Code:    violation.Code,
+			Message: violation.Message,
+		})
+	}
+
+	return errors.NewValidationError("Password does not meet the password policy", fields)
+}
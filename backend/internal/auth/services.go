@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"log"
 	"strings"
 	"time"
 
@@ -19,20 +20,91 @@ var (
 	ErrUserNotFound       = errors.New("user not found")
 )
 
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return "too many failed login attempts"
+}
+
+// AccountPendingDeletionError is returned instead of signing in to an account
+// that is scheduled for deletion. The account can still be restored.
+type AccountPendingDeletionError struct {
+	DeleteAfter time.Time
+}
+
+func (e *AccountPendingDeletionError) Error() string {
+	return "account is scheduled for deletion"
+}
+
+// AccountSuspendedError is returned instead of signing in to an account a
+// moderator has suspended.
+type AccountSuspendedError struct {
+	SuspendedUntil time.Time
+}
+
+func (e *AccountSuspendedError) Error() string {
+	return "account is suspended"
+}
+
 type AuthService struct {
 	db        *sql.DB
 	jwtSecret string
+	throttle  *LoginThrottle
+	providers map[string]*oidcProvider
+	policy    *PasswordPolicy
 }
 
 func NewAuthService(db *sql.DB, jwtSecret string) *AuthService {
 	return &AuthService{
 		db:        db,
 		jwtSecret: jwtSecret,
+		throttle:  NewLoginThrottle(db),
+		policy:    DefaultPasswordPolicy(),
 	}
 }
 
-func (s *AuthService) registerUser(registerRequest RegisterRequest) (*AuthResponse, error) {
-	exists, err := s.userExists(registerRequest.Email, registerRequest.Username)
+func (s *AuthService) SetPasswordPolicy(policy *PasswordPolicy) {
+	s.policy = policy
+}
+
+// BootstrapAdmin grants the admin role to the existing account registered
+// with email. Accounts registered later are not promoted: registration does
+// not prove ownership of the address, so anyone could claim it first.
+func (s *AuthService) BootstrapAdmin(email string) (bool, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := s.db.Exec(
+		"UPDATE users SET role = $1, updated_at = CURRENT_TIMESTAMP WHERE email = $2 AND role != $1",
+		RoleAdmin, email,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+func (s *AuthService) registerUser(registerRequest RegisterRequest, client ClientInfo) (*AuthResponse, error) {
+	username, err := NormalizeUsername(registerRequest.Username)
+	if err != nil {
+		return nil, err
+	}
+	email, err := NormalizeEmail(registerRequest.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := s.userExists(email, username)
 	if err != nil {
 		return nil, err
 	}
@@ -47,81 +119,184 @@ func (s *AuthService) registerUser(registerRequest RegisterRequest) (*AuthRespon
 		return nil, err
 	}
 
-	query := "INSERT INTO users (id, username, email, password_hash, created_at, updated_at) VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP);"
-	_, err = s.db.Exec(query, uuid, registerRequest.Username, registerRequest.Email, encodedPasswordHash)
-	if err != nil {
-		return nil, err
-	}
-
-	user, err := s.getUserByEmail(registerRequest.Email)
+	query := "INSERT INTO users (id, username, email, password_hash, role, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP);"
+	_, err = s.db.Exec(query, uuid, username, email, encodedPasswordHash, RoleUser)
 	if err != nil {
 		return nil, err
 	}
 
-	token, err := s.generateJWT(user)
+	user, err := s.getUserByEmail(email)
 	if err != nil {
 		return nil, err
 	}
 
-	return &AuthResponse{
-		User:  *user,
-		Token: token,
-	}, nil
+	return s.issueToken(user, client)
 }
 
+// userExists expects normalized values. Usernames are compared
+// case-insensitively so "Alice" and "alice" cannot both be registered.
 func (s *AuthService) userExists(email, username string) (bool, error) {
 	var count int
-	query := `SELECT COUNT(*) FROM users WHERE email = $1 OR username = $2`
+	query := `SELECT COUNT(*) FROM users WHERE LOWER(email) = $1 OR LOWER(username) = LOWER($2)`
 	err := s.db.QueryRow(query, email, username).Scan(&count)
 	return count > 0, err
 }
 
-func (s *AuthService) loginUser(loginRequest LoginRequest) (*AuthResponse, error) {
-	verified, err := s.verifyPassword(loginRequest.Email, loginRequest.Password)
+func (s *AuthService) loginUser(loginRequest LoginRequest, client ClientInfo) (*AuthResponse, error) {
+	user, err := s.authenticate(loginRequest, client)
 	if err != nil {
 		return nil, err
 	}
 
-	if !verified {
-		return nil, ErrInvalidCredentials
+	return s.issueToken(user, client)
+}
+
+// restoreAccount cancels a scheduled deletion and signs the account in. It
+// takes the same credentials as a login, since logging in is blocked.
+// Accounts without a password restore through an OIDC sign-in instead.
+func (s *AuthService) restoreAccount(loginRequest LoginRequest, client ClientInfo) (*AuthResponse, error) {
+	user, err := s.authenticate(loginRequest, client)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.cancelDeletion(user); err != nil {
+		return nil, err
 	}
 
-	user, err := s.getUserByEmail(loginRequest.Email)
+	return s.issueToken(user, client)
+}
+
+func (s *AuthService) cancelDeletion(user *User) error {
+	if user.DeleteAfter == nil {
+		return nil
+	}
+	_, err := s.db.Exec("UPDATE users SET delete_after = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = $1", user.ID)
 	if err != nil {
+		return err
+	}
+	user.DeleteAfter = nil
+	return nil
+}
+
+// authenticate checks a login's credentials, subject to throttling, and
+// returns the account they belong to.
+func (s *AuthService) authenticate(loginRequest LoginRequest, client ClientInfo) (*User, error) {
+	identifier := loginRequest.Identifier
+	if identifier == "" {
+		identifier = loginRequest.Email
+	}
+	identifier, isEmail := NormalizeLoginIdentifier(identifier)
+
+	userID, email, storedEncodedPasswordHash, err := s.findLoginAccount(identifier, isEmail)
+	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
 
-	token, err := s.generateJWT(user)
+	// Failures count against the account whichever identifier was typed, so
+	// switching between username and email does not reset the delay.
+	accountKey := accountThrottleKey(identifier)
+	if userID != "" {
+		accountKey = accountThrottleKey(email)
+	}
+	ipKey := ipThrottleKey(client.IP)
+
+	// The attempt is counted before the password is checked; a successful
+	// login hands it back below.
+	retryAfter, err := s.throttle.reserveAttempt(accountKey, accountThrottleRule)
 	if err != nil {
 		return nil, err
 	}
+	if retryAfter > 0 {
+		return nil, &LoginLockedError{RetryAfter: retryAfter}
+	}
+	retryAfter, err = s.throttle.reserveAttempt(ipKey, ipThrottleRule)
+	if err != nil {
+		return nil, err
+	}
+	if retryAfter > 0 {
+		if err := s.throttle.refund(accountKey, accountThrottleRule); err != nil {
+			return nil, err
+		}
+		return nil, &LoginLockedError{RetryAfter: retryAfter}
+	}
 
-	return &AuthResponse{
-		User:  *user,
-		Token: token,
-	}, nil
+	verified, err := s.verifyPassword(userID, storedEncodedPasswordHash, loginRequest.Password)
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := s.throttle.reset(accountKey); err != nil {
+		return nil, err
+	}
+	if err := s.throttle.refund(ipKey, ipThrottleRule); err != nil {
+		return nil, err
+	}
+
+	return s.getUserByID(userID)
 }
 
-func (s *AuthService) verifyPassword(email string, password string) (bool, error) {
-	storedEncodedPasswordHash := ""
-	query := "SELECT password_hash FROM users WHERE email = $1;"
-	err := s.db.QueryRow(query, email).Scan(&storedEncodedPasswordHash)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, nil
+// findLoginAccount looks an account up by email or, case-insensitively, by
+// username. It returns sql.ErrNoRows when neither matches.
+func (s *AuthService) findLoginAccount(identifier string, isEmail bool) (userID, email, passwordHash string, err error) {
+	query := "SELECT id, email, password_hash FROM users WHERE LOWER(username) = LOWER($1);"
+	if isEmail {
+		query = "SELECT id, email, password_hash FROM users WHERE LOWER(email) = $1;"
+	}
+
+	err = s.db.QueryRow(query, identifier).Scan(&userID, &email, &passwordHash)
+	return userID, email, passwordHash, err
+}
+
+// verifyPassword checks password against the account's stored hash. An empty
+// userID means no account matched; a dummy hash is still verified so that the
+// response time does not reveal which accounts exist.
+func (s *AuthService) verifyPassword(userID, storedEncodedPasswordHash, password string) (bool, error) {
+	if userID == "" {
+		VerifyPasswordHash(password, dummyPasswordHash())
+		return false, nil
+	}
+
+	verified, err := VerifyPasswordHash(password, storedEncodedPasswordHash)
+	if err != nil || !verified {
+		return verified, err
+	}
+
+	if NeedsRehash(storedEncodedPasswordHash) {
+		if err := s.rehashPassword(userID, password, storedEncodedPasswordHash); err != nil {
+			log.Printf("Warning: failed to upgrade password hash: %v", err)
 		}
-		return false, err
 	}
 
-	return VerifyPasswordHash(password, storedEncodedPasswordHash)
+	return true, nil
+}
+
+// rehashPassword replaces an outdated hash after a successful login, when the
+// plaintext is briefly available. The stored hash is compared so a password
+// changed concurrently is never overwritten.
+func (s *AuthService) rehashPassword(userID, password, oldEncodedHash string) error {
+	newEncodedHash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"UPDATE users SET password_hash = $1 WHERE id = $2 AND password_hash = $3",
+		newEncodedHash, userID, oldEncodedHash,
+	)
+	return err
 }
 
 func (s *AuthService) getUserByEmail(email string) (*User, error) {
 	var user User
-	query := `SELECT id, username, email, created_at, updated_at FROM users WHERE email = $1`
+	var deleteAfter, suspendedUntil sql.NullTime
+	query := `SELECT id, username, email, role, created_at, updated_at, delete_after, suspended_until FROM users WHERE LOWER(email) = $1`
 
 	err := s.db.QueryRow(query, email).Scan(
-		&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt,
+		&user.ID, &user.Username, &user.Email, &user.Role, &user.CreatedAt, &user.UpdatedAt, &deleteAfter, &suspendedUntil,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -129,11 +304,87 @@ func (s *AuthService) getUserByEmail(email string) (*User, error) {
 		}
 		return nil, err
 	}
+	if deleteAfter.Valid {
+		user.DeleteAfter = &deleteAfter.Time
+	}
+	if suspendedUntil.Valid {
+		user.SuspendedUntil = &suspendedUntil.Time
+	}
+
+	return &user, nil
+}
+
+func (s *AuthService) getUserByID(userID string) (*User, error) {
+	var user User
+	var deleteAfter, suspendedUntil sql.NullTime
+	query := `SELECT id, username, email, role, created_at, updated_at, delete_after, suspended_until FROM users WHERE id = $1`
+
+	err := s.db.QueryRow(query, userID).Scan(
+		&user.ID, &user.Username, &user.Email, &user.Role, &user.CreatedAt, &user.UpdatedAt, &deleteAfter, &suspendedUntil,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	if deleteAfter.Valid {
+		user.DeleteAfter = &deleteAfter.Time
+	}
+	if suspendedUntil.Valid {
+		user.SuspendedUntil = &suspendedUntil.Time
+	}
 
 	return &user, nil
 }
 
-func (s *AuthService) generateJWT(user *User) (string, error) {
+// currentRole reads the user's role from the database. Tokens carry the role
+// they were issued with, which may since have changed.
+func (s *AuthService) currentRole(userID string) (string, error) {
+	var role string
+	err := s.db.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return role, err
+}
+
+// updateUserRole changes a user's role. A demotion also ends the user's
+// sessions, so that no token still claims the old role.
+func (s *AuthService) updateUserRole(userID, role string) (*User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var oldRole string
+	err = tx.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&oldRole)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET role = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", role, userID); err != nil {
+		return nil, err
+	}
+
+	if roleRanks[role] < roleRanks[oldRole] {
+		if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = $1", userID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.getUserByID(userID)
+}
+
+func (s *AuthService) generateJWT(user *User, sessionID string) (string, error) {
 	header := map[string]string{
 		"alg": "HS256",
 		"typ": "JWT",
@@ -145,8 +396,10 @@ func (s *AuthService) generateJWT(user *User) (string, error) {
 	encodedHeader := base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(headerJSON)
 
 	claims := JWTClaims{
-		UserID: user.ID,
-		Exp:    time.Now().Add(24 * time.Hour).Unix(),
+		UserID:    user.ID,
+		Role:      user.Role,
+		SessionID: sessionID,
+		Exp:       time.Now().Add(tokenLifetime).Unix(),
 	}
 	claimsJSON, err := json.Marshal(claims)
 	if err != nil {
@@ -214,5 +467,9 @@ func (s *AuthService) validateJWT(tokenString string) (*JWTClaims, error) {
 		return nil, errors.New("Token expired")
 	}
 
+	if claims.Role == "" {
+		claims.Role = RoleUser
+	}
+
 	return &claims, nil
 }
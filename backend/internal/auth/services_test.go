@@ -2,9 +2,18 @@ package auth
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func setupTestDB(t *testing.T) *sql.DB {
@@ -19,14 +28,87 @@ func setupTestDB(t *testing.T) *sql.DB {
 			username TEXT UNIQUE NOT NULL,
 			email TEXT UNIQUE NOT NULL,
 			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'user',
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			delete_after DATETIME,
+			suspended_until DATETIME,
+			email_verified_at DATETIME
 		);
 	`)
 	if err != nil {
 		t.Fatalf("Failed to create users table: %v", err)
 	}
 
+	_, err = db.Exec(`
+		CREATE TABLE login_failures (
+			key TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL DEFAULT 0,
+			last_failure_at DATETIME NOT NULL,
+			locked_until DATETIME
+		);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create login_failures table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE api_keys (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			key_hash TEXT UNIQUE NOT NULL,
+			scopes TEXT NOT NULL,
+			expires_at DATETIME,
+			last_used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create api_keys table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			ip_address TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_seen_at DATETIME NOT NULL
+		);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create sessions table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE user_identities (
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			email TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (provider, subject),
+			UNIQUE (user_id, provider)
+		);
+
+		CREATE TABLE oauth_states (
+			state TEXT PRIMARY KEY,
+			provider TEXT NOT NULL,
+			code_verifier TEXT NOT NULL,
+			nonce TEXT NOT NULL,
+			link_user_id TEXT NOT NULL,
+			binding_hash TEXT NOT NULL DEFAULT '',
+			restore BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at DATETIME NOT NULL
+		);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create identity tables: %v", err)
+	}
+
 	return db
 }
 
@@ -68,7 +150,7 @@ func TestRegistrationAndLogin(t *testing.T) {
 		Password: "password123",
 	}
 
-	response, err := service.registerUser(registerReq)
+	response, err := service.registerUser(registerReq, ClientInfo{})
 	if err != nil {
 		t.Fatalf("registerUser() failed: %v", err)
 	}
@@ -90,7 +172,7 @@ func TestRegistrationAndLogin(t *testing.T) {
 		Password: "password123",
 	}
 
-	loginResp, err := service.loginUser(loginReq)
+	loginResp, err := service.loginUser(loginReq, ClientInfo{IP: "127.0.0.1"})
 	if err != nil {
 		t.Fatalf("loginUser() with correct password failed: %v", err)
 	}
@@ -104,7 +186,7 @@ func TestRegistrationAndLogin(t *testing.T) {
 		Password: "wrongpassword",
 	}
 
-	_, err = service.loginUser(wrongLoginReq)
+	_, err = service.loginUser(wrongLoginReq, ClientInfo{IP: "127.0.0.1"})
 	if err == nil {
 		t.Error("loginUser() should fail with wrong password")
 	}
@@ -123,7 +205,7 @@ func TestJWTGeneration(t *testing.T) {
 		Email:    "test@example.com",
 	}
 
-	token, err := service.generateJWT(testUser)
+	token, err := service.generateJWT(testUser, "")
 	if err != nil {
 		t.Fatalf("generateJWT() failed: %v", err)
 	}
@@ -174,7 +256,7 @@ func TestDuplicateUserRegistration(t *testing.T) {
 		Password: "password123",
 	}
 
-	_, err := service.registerUser(registerReq)
+	_, err := service.registerUser(registerReq, ClientInfo{})
 	if err != nil {
 		t.Fatalf("First registration failed: %v", err)
 	}
@@ -185,7 +267,7 @@ func TestDuplicateUserRegistration(t *testing.T) {
 		Password: "password123",
 	}
 
-	_, err = service.registerUser(duplicateReq)
+	_, err = service.registerUser(duplicateReq, ClientInfo{})
 	if err != ErrUserExists {
 		t.Errorf("Expected ErrUserExists, got %v", err)
 	}
@@ -196,8 +278,872 @@ func TestDuplicateUserRegistration(t *testing.T) {
 		Password: "password123",
 	}
 
-	_, err = service.registerUser(duplicateReq2)
+	_, err = service.registerUser(duplicateReq2, ClientInfo{})
 	if err != ErrUserExists {
 		t.Errorf("Expected ErrUserExists, got %v", err)
 	}
 }
+
+func TestIdentityNormalization(t *testing.T) {
+	emails := []struct {
+		input string
+		want  string
+		valid bool
+	}{
+		{"Test@Example.com", "test@example.com", true},
+		{"  padded@example.com ", "padded@example.com", true},
+		{"ｆｕｌｌ@example.com", "full@example.com", true},
+		{"no-at-sign", "", false},
+		{"two@@example.com", "", false},
+		{"@example.com", "", false},
+		{"trailing@", "", false},
+		{"has space@example.com", "", false},
+	}
+	for _, tc := range emails {
+		got, err := NormalizeEmail(tc.input)
+		if (err == nil) != tc.valid || got != tc.want {
+			t.Errorf("NormalizeEmail(%q) = %q, %v; want %q, valid %v", tc.input, got, err, tc.want, tc.valid)
+		}
+	}
+
+	usernames := []struct {
+		input string
+		want  string
+		valid bool
+	}{
+		{"ChefBob", "ChefBob", true},
+		{"chef.bob_99-x", "chef.bob_99-x", true},
+		{" padded ", "padded", true},
+		{"ｃｈｅｆ", "chef", true},
+		{"ab", "", false},
+		{strings.Repeat("a", maxUsernameLength+1), "", false},
+		{"_leading", "", false},
+		{"has space", "", false},
+		{"émile", "", false},
+	}
+	for _, tc := range usernames {
+		got, err := NormalizeUsername(tc.input)
+		if (err == nil) != tc.valid || got != tc.want {
+			t.Errorf("NormalizeUsername(%q) = %q, %v; want %q, valid %v", tc.input, got, err, tc.want, tc.valid)
+		}
+	}
+}
+
+func TestCaseInsensitiveIdentities(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewAuthService(db, "test-secret")
+
+	response, err := service.registerUser(RegisterRequest{
+		Username: "ChefBob",
+		Email:    "Bob@Example.com",
+		Password: "password123",
+	}, ClientInfo{})
+	if err != nil {
+		t.Fatalf("registerUser() failed: %v", err)
+	}
+	if response.User.Email != "bob@example.com" {
+		t.Errorf("Email = %v, want bob@example.com", response.User.Email)
+	}
+	if response.User.Username != "ChefBob" {
+		t.Errorf("Username = %v, want ChefBob", response.User.Username)
+	}
+
+	_, err = service.registerUser(RegisterRequest{Username: "chefbob", Email: "other@example.com", Password: "password123"}, ClientInfo{})
+	if err != ErrUserExists {
+		t.Errorf("Registering a username differing only in case: got %v, want ErrUserExists", err)
+	}
+	_, err = service.registerUser(RegisterRequest{Username: "someoneelse", Email: "BOB@example.com", Password: "password123"}, ClientInfo{})
+	if err != ErrUserExists {
+		t.Errorf("Registering an email differing only in case: got %v, want ErrUserExists", err)
+	}
+
+	identifiers := []string{"bob@example.com", "BOB@EXAMPLE.COM", "ChefBob", "chefbob", " CHEFBOB "}
+	for _, identifier := range identifiers {
+		login, err := service.loginUser(LoginRequest{Identifier: identifier, Password: "password123"}, ClientInfo{IP: "127.0.0.1"})
+		if err != nil {
+			t.Errorf("loginUser(%q) failed: %v", identifier, err)
+			continue
+		}
+		if login.User.ID != response.User.ID {
+			t.Errorf("loginUser(%q) signed in %v, want %v", identifier, login.User.ID, response.User.ID)
+		}
+	}
+
+	// Clients that still send only "email" keep working
+	_, err = service.loginUser(LoginRequest{Email: "Bob@Example.com", Password: "password123"}, ClientInfo{IP: "127.0.0.1"})
+	if err != nil {
+		t.Errorf("loginUser() with legacy email field failed: %v", err)
+	}
+
+	// Failures by username and by email count against the same account
+	service.loginUser(LoginRequest{Identifier: "chefbob", Password: "wrong"}, ClientInfo{IP: "127.0.0.1"})
+	service.loginUser(LoginRequest{Identifier: "bob@example.com", Password: "wrong"}, ClientInfo{IP: "127.0.0.1"})
+	var failures int
+	db.QueryRow("SELECT failures FROM login_failures WHERE key = $1", accountThrottleKey("bob@example.com")).Scan(&failures)
+	if failures != 2 {
+		t.Errorf("Account failures = %d, want 2", failures)
+	}
+}
+
+func TestLoginThrottling(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewAuthService(db, "test-secret")
+
+	now := time.Now()
+	service.throttle.now = func() time.Time { return now }
+
+	_, err := service.registerUser(RegisterRequest{
+		Username: "testuser",
+		Email:    "test@example.com",
+		Password: "password123",
+	}, ClientInfo{})
+	if err != nil {
+		t.Fatalf("registerUser() failed: %v", err)
+	}
+
+	wrongLoginReq := LoginRequest{Email: "test@example.com", Password: "wrongpassword"}
+	for i := 0; i < accountThrottleRule.freeAttempts; i++ {
+		_, err = service.loginUser(wrongLoginReq, ClientInfo{IP: "10.0.0.1"})
+		if err != ErrInvalidCredentials {
+			t.Fatalf("Attempt %d: expected ErrInvalidCredentials, got %v", i+1, err)
+		}
+	}
+
+	_, err = service.loginUser(wrongLoginReq, ClientInfo{IP: "10.0.0.1"})
+	if err != ErrInvalidCredentials {
+		t.Fatalf("Expected ErrInvalidCredentials on first delayed attempt, got %v", err)
+	}
+
+	_, err = service.loginUser(LoginRequest{Email: "test@example.com", Password: "password123"}, ClientInfo{IP: "10.0.0.2"})
+	lockedErr, ok := err.(*LoginLockedError)
+	if !ok {
+		t.Fatalf("Expected LoginLockedError, got %v", err)
+	}
+	if lockedErr.RetryAfter != accountThrottleRule.baseDelay {
+		t.Errorf("RetryAfter = %v, want %v", lockedErr.RetryAfter, accountThrottleRule.baseDelay)
+	}
+
+	now = now.Add(accountThrottleRule.baseDelay)
+	_, err = service.loginUser(LoginRequest{Email: "test@example.com", Password: "password123"}, ClientInfo{IP: "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("loginUser() should succeed once the delay has passed: %v", err)
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM login_failures WHERE key = $1", accountThrottleKey("test@example.com")).Scan(&count)
+	if count != 0 {
+		t.Error("Successful login should reset the account failure counter")
+	}
+
+	var ipFailures int
+	db.QueryRow("SELECT failures FROM login_failures WHERE key = $1", ipThrottleKey("10.0.0.2")).Scan(&ipFailures)
+	if ipFailures != 0 {
+		t.Errorf("IP failures after successful logins = %d, want 0", ipFailures)
+	}
+
+	// Attempts count as soon as they start, so guesses sent in parallel
+	// cannot all pass the check before any of them has failed.
+	for i := 0; i <= accountThrottleRule.freeAttempts; i++ {
+		retryAfter, err := service.throttle.reserveAttempt(accountThrottleKey("test@example.com"), accountThrottleRule)
+		if err != nil || retryAfter != 0 {
+			t.Fatalf("reserveAttempt() #%d = %v, %v; want 0, nil", i+1, retryAfter, err)
+		}
+	}
+	_, err = service.loginUser(wrongLoginReq, ClientInfo{IP: "10.0.0.4"})
+	if _, ok := err.(*LoginLockedError); !ok {
+		t.Fatalf("Expected LoginLockedError while earlier attempts are in flight, got %v", err)
+	}
+
+	for i := accountThrottleRule.freeAttempts + 1; i < accountThrottleRule.lockoutThreshold; i++ {
+		now = now.Add(accountThrottleRule.maxDelay)
+		if _, err := service.throttle.reserveAttempt(accountThrottleKey("test@example.com"), accountThrottleRule); err != nil {
+			t.Fatalf("reserveAttempt() failed: %v", err)
+		}
+	}
+	_, err = service.loginUser(LoginRequest{Email: "test@example.com", Password: "password123"}, ClientInfo{IP: "10.0.0.2"})
+	lockedErr, ok = err.(*LoginLockedError)
+	if !ok {
+		t.Fatalf("Expected LoginLockedError after reaching the lockout threshold, got %v", err)
+	}
+	if lockedErr.RetryAfter != accountThrottleRule.lockoutDuration {
+		t.Errorf("RetryAfter = %v, want %v", lockedErr.RetryAfter, accountThrottleRule.lockoutDuration)
+	}
+
+	_, err = service.loginUser(LoginRequest{Email: "unknown@example.com", Password: "whatever"}, ClientInfo{IP: "10.0.0.3"})
+	if err != ErrInvalidCredentials {
+		t.Errorf("Expected ErrInvalidCredentials for unknown email, got %v", err)
+	}
+}
+
+func TestRolesAndAdminBootstrap(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewAuthService(db, "test-secret")
+
+	existing, err := service.registerUser(RegisterRequest{
+		Username: "existing",
+		Email:    "existing@example.com",
+		Password: "password123",
+	}, ClientInfo{})
+	if err != nil {
+		t.Fatalf("registerUser() failed: %v", err)
+	}
+	if existing.User.Role != RoleUser {
+		t.Errorf("Role = %v, want %v", existing.User.Role, RoleUser)
+	}
+
+	promoted, err := service.BootstrapAdmin("existing@example.com")
+	if err != nil {
+		t.Fatalf("BootstrapAdmin() failed: %v", err)
+	}
+	if !promoted {
+		t.Error("BootstrapAdmin() should promote an existing account")
+	}
+
+	promoted, err = service.BootstrapAdmin("later@example.com")
+	if err != nil {
+		t.Fatalf("BootstrapAdmin() failed: %v", err)
+	}
+	if promoted {
+		t.Error("BootstrapAdmin() should not report a promotion for a missing account")
+	}
+
+	later, err := service.registerUser(RegisterRequest{
+		Username: "later",
+		Email:    "later@example.com",
+		Password: "password123",
+	}, ClientInfo{})
+	if err != nil {
+		t.Fatalf("registerUser() failed: %v", err)
+	}
+	if later.User.Role != RoleUser {
+		t.Errorf("Role of an account registered after bootstrap = %v, want %v", later.User.Role, RoleUser)
+	}
+
+	admin, err := service.loginUser(LoginRequest{Email: "existing@example.com", Password: "password123"}, ClientInfo{})
+	if err != nil {
+		t.Fatalf("loginUser() failed: %v", err)
+	}
+	claims, err := service.validateJWT(admin.Token)
+	if err != nil {
+		t.Fatalf("validateJWT() failed: %v", err)
+	}
+	if claims.Role != RoleAdmin {
+		t.Errorf("Claims role = %v, want %v", claims.Role, RoleAdmin)
+	}
+
+	user, err := service.updateUserRole(existing.User.ID, RoleEditor)
+	if err != nil {
+		t.Fatalf("updateUserRole() failed: %v", err)
+	}
+	if user.Role != RoleEditor {
+		t.Errorf("Role = %v, want %v", user.Role, RoleEditor)
+	}
+
+	_, err = service.updateUserRole("non-existent", RoleEditor)
+	if err != ErrUserNotFound {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewAuthService(db, "test-secret-key")
+	handler := NewAuthHandler(service)
+
+	protected := handler.RequireRole(RoleEditor, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		role string
+		want int
+	}{
+		{RoleUser, http.StatusForbidden},
+		{RoleEditor, http.StatusOK},
+		{RoleAdmin, http.StatusOK},
+	}
+
+	tokens := make(map[string]string)
+	for _, tt := range tests {
+		response, err := service.registerUser(RegisterRequest{
+			Username: "user-" + tt.role,
+			Email:    tt.role + "@example.com",
+			Password: "password123",
+		}, ClientInfo{})
+		if err != nil {
+			t.Fatalf("registerUser() failed: %v", err)
+		}
+		db.Exec("UPDATE users SET role = $1 WHERE id = $2", tt.role, response.User.ID)
+
+		// Sign in again so the token claims the new role.
+		login, err := service.loginUser(LoginRequest{Email: tt.role + "@example.com", Password: "password123"}, ClientInfo{})
+		if err != nil {
+			t.Fatalf("loginUser() failed: %v", err)
+		}
+		tokens[tt.role] = login.Token
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+login.Token)
+		rec := httptest.NewRecorder()
+		protected(rec, req)
+
+		if rec.Code != tt.want {
+			t.Errorf("Role %s: status = %d, want %d", tt.role, rec.Code, tt.want)
+		}
+	}
+
+	// A token still claiming editor is refused once the role is gone.
+	db.Exec("UPDATE users SET role = $1 WHERE username = $2", RoleUser, "user-"+RoleEditor)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens[RoleEditor])
+	rec := httptest.NewRecorder()
+	protected(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Demoted editor: status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	// Demoting through updateUserRole also logs the account out.
+	admin, _ := service.getUserByEmail(RoleAdmin + "@example.com")
+	if _, err := service.updateUserRole(admin.ID, RoleEditor); err != nil {
+		t.Fatalf("updateUserRole() failed: %v", err)
+	}
+	claims, _ := service.validateJWT(tokens[RoleAdmin])
+	if err := service.checkSession(claims); err != ErrSessionRevoked {
+		t.Errorf("checkSession() after demotion = %v, want ErrSessionRevoked", err)
+	}
+
+	rec = httptest.NewRecorder()
+	protected(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Missing token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewAuthService(db, "test-secret")
+	handler := NewAuthHandler(service)
+
+	registered, err := service.registerUser(RegisterRequest{
+		Username: "testuser",
+		Email:    "test@example.com",
+		Password: "password123",
+	}, ClientInfo{})
+	if err != nil {
+		t.Fatalf("registerUser() failed: %v", err)
+	}
+	userID := registered.User.ID
+
+	_, err = service.createAPIKey(userID, CreateAPIKeyRequest{Name: "bad", Scopes: []string{"everything"}})
+	if err != ErrInvalidScope {
+		t.Errorf("Expected ErrInvalidScope, got %v", err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	_, err = service.createAPIKey(userID, CreateAPIKeyRequest{Name: "old", Scopes: []string{ScopeLikesRead}, ExpiresAt: &past})
+	if err != ErrAPIKeyExpiryInPast {
+		t.Errorf("Expected ErrAPIKeyExpiryInPast, got %v", err)
+	}
+
+	created, err := service.createAPIKey(userID, CreateAPIKeyRequest{
+		Name:   "script",
+		Scopes: []string{ScopeLikesRead, ScopeLikesRead, ScopeRecipesRead},
+	})
+	if err != nil {
+		t.Fatalf("createAPIKey() failed: %v", err)
+	}
+	if created.Key == "" {
+		t.Fatal("createAPIKey() returned empty key")
+	}
+	if len(created.Scopes) != 2 {
+		t.Errorf("Expected duplicate scopes to collapse to 2, got %v", created.Scopes)
+	}
+
+	var storedHash string
+	db.QueryRow("SELECT key_hash FROM api_keys WHERE id = $1", created.ID).Scan(&storedHash)
+	if storedHash == created.Key {
+		t.Error("API key must not be stored in plaintext")
+	}
+
+	apiKey, err := service.validateAPIKey(created.Key)
+	if err != nil {
+		t.Fatalf("validateAPIKey() failed: %v", err)
+	}
+	if apiKey.UserID != userID {
+		t.Errorf("UserID = %v, want %v", apiKey.UserID, userID)
+	}
+
+	keys, err := service.listAPIKeys(userID)
+	if err != nil {
+		t.Fatalf("listAPIKeys() failed: %v", err)
+	}
+	if len(keys) != 1 || keys[0].LastUsedAt == nil {
+		t.Errorf("Expected one key with last_used_at recorded, got %+v", keys)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value("user_id") != userID {
+			t.Errorf("user_id in context = %v, want %v", r.Context().Value("user_id"), userID)
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		scopes []string
+		want   int
+	}{
+		{"granted scope", created.Key, []string{ScopeLikesRead}, http.StatusOK},
+		{"missing scope", created.Key, []string{ScopeLikesWrite}, http.StatusForbidden},
+		{"endpoint without scopes", created.Key, nil, http.StatusForbidden},
+		{"unknown key", "rk_unknown", []string{ScopeLikesRead}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-API-Key", tt.key)
+		rec := httptest.NewRecorder()
+		handler.AuthMiddleware(ok, tt.scopes...)(rec, req)
+
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	soon := time.Now().Add(time.Hour)
+	expiring, err := service.createAPIKey(userID, CreateAPIKeyRequest{Name: "temp", Scopes: []string{ScopeLikesRead}, ExpiresAt: &soon})
+	if err != nil {
+		t.Fatalf("createAPIKey() failed: %v", err)
+	}
+	db.Exec("UPDATE api_keys SET expires_at = $1 WHERE id = $2", time.Now().UTC().Add(-time.Minute), expiring.ID)
+	_, err = service.validateAPIKey(expiring.Key)
+	if err != ErrInvalidAPIKey {
+		t.Errorf("Expected ErrInvalidAPIKey for expired key, got %v", err)
+	}
+
+	err = service.revokeAPIKey("someone-else", created.ID)
+	if err != ErrAPIKeyNotFound {
+		t.Errorf("Expected ErrAPIKeyNotFound when revoking another user's key, got %v", err)
+	}
+
+	err = service.revokeAPIKey(userID, created.ID)
+	if err != nil {
+		t.Fatalf("revokeAPIKey() failed: %v", err)
+	}
+
+	_, err = service.validateAPIKey(created.Key)
+	if err != ErrInvalidAPIKey {
+		t.Errorf("Expected ErrInvalidAPIKey after revocation, got %v", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewAuthService(db, "test-secret")
+	handler := NewAuthHandler(service)
+
+	first, err := service.registerUser(RegisterRequest{
+		Username: "testuser",
+		Email:    "test@example.com",
+		Password: "password123",
+	}, ClientInfo{IP: "10.0.0.1", UserAgent: "laptop"})
+	if err != nil {
+		t.Fatalf("registerUser() failed: %v", err)
+	}
+
+	second, err := service.loginUser(LoginRequest{Email: "test@example.com", Password: "password123"}, ClientInfo{IP: "10.0.0.2", UserAgent: "phone"})
+	if err != nil {
+		t.Fatalf("loginUser() failed: %v", err)
+	}
+
+	firstClaims, _ := service.validateJWT(first.Token)
+	secondClaims, _ := service.validateJWT(second.Token)
+	if firstClaims.SessionID == "" || firstClaims.SessionID == secondClaims.SessionID {
+		t.Fatal("Each login should get its own session")
+	}
+
+	sessions, err := service.listSessions(first.User.ID, secondClaims.SessionID)
+	if err != nil {
+		t.Fatalf("listSessions() failed: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+	for _, session := range sessions {
+		if session.Current != (session.ID == secondClaims.SessionID) {
+			t.Errorf("Session %s current = %v", session.ID, session.Current)
+		}
+		if session.ID == firstClaims.SessionID && (session.UserAgent != "laptop" || session.IPAddress != "10.0.0.1") {
+			t.Errorf("Session metadata not recorded: %+v", session)
+		}
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	status := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.AuthMiddleware(ok)(rec, req)
+		return rec.Code
+	}
+
+	if code := status(first.Token); code != http.StatusOK {
+		t.Errorf("Active session: status = %d, want %d", code, http.StatusOK)
+	}
+
+	// A token without a session could never be logged out.
+	legacy, err := service.generateJWT(&first.User, "")
+	if err != nil {
+		t.Fatalf("generateJWT() failed: %v", err)
+	}
+	if code := status(legacy); code != http.StatusUnauthorized {
+		t.Errorf("Token without a session: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	revoked, err := service.revokeOtherSessions(first.User.ID, secondClaims.SessionID)
+	if err != nil {
+		t.Fatalf("revokeOtherSessions() failed: %v", err)
+	}
+	if revoked != 1 {
+		t.Errorf("Expected 1 revoked session, got %d", revoked)
+	}
+
+	if code := status(first.Token); code != http.StatusUnauthorized {
+		t.Errorf("Revoked session: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := status(second.Token); code != http.StatusOK {
+		t.Errorf("Kept session: status = %d, want %d", code, http.StatusOK)
+	}
+
+	err = service.revokeSession("someone-else", secondClaims.SessionID)
+	if err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound, got %v", err)
+	}
+
+	err = service.revokeSession(first.User.ID, secondClaims.SessionID)
+	if err != nil {
+		t.Fatalf("revokeSession() failed: %v", err)
+	}
+	if code := status(second.Token); code != http.StatusUnauthorized {
+		t.Errorf("Revoked session: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	blocklistPath := filepath.Join(t.TempDir(), "blocklist.txt")
+	err := os.WriteFile(blocklistPath, []byte("# comment\nPassword123\n\nletmein\n"), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write blocklist: %v", err)
+	}
+
+	policy := DefaultPasswordPolicy()
+	policy.RequiredClasses = []string{ClassLower, ClassDigit}
+
+	count, err := policy.LoadBlocklist(blocklistPath)
+	if err != nil {
+		t.Fatalf("LoadBlocklist() failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("LoadBlocklist() loaded %d entries, want 2", count)
+	}
+
+	tests := []struct {
+		name      string
+		password  string
+		wantCodes []string
+	}{
+		{"valid", "correct horse 42", nil},
+		{"too short", "ab1", []string{"too_short"}},
+		{"missing digit", "correct horse battery", []string{"missing_digit"}},
+		{"contains username", "chefbob-2024", []string{"contains_identity"}},
+		{"contains email local part", "xx bob.smith 99", []string{"contains_identity"}},
+		{"blocklisted any case", "PASSWORD123", []string{"missing_lower", "too_common"}},
+		{"several violations", "BOB", []string{"too_short", "missing_lower", "missing_digit"}},
+	}
+
+	for _, tt := range tests {
+		violations := policy.Validate(tt.password, "chefbob", "bob.smith@example.com")
+
+		var codes []string
+		for _, violation := range violations {
+			codes = append(codes, violation.Code)
+		}
+
+		if len(codes) != len(tt.wantCodes) {
+			t.Errorf("%s: violations = %v, want %v", tt.name, codes, tt.wantCodes)
+			continue
+		}
+		for i := range codes {
+			if codes[i] != tt.wantCodes[i] {
+				t.Errorf("%s: violations = %v, want %v", tt.name, codes, tt.wantCodes)
+				break
+			}
+		}
+	}
+
+	httpErr := NewPolicyViolationError("new_password", policy.Validate("ab1", "", ""))
+	if httpErr.StatusCode != http.StatusBadRequest || len(httpErr.Fields) != 1 || httpErr.Fields[0].Field != "new_password" {
+		t.Errorf("Unexpected policy error: %+v", httpErr)
+	}
+}
+
+func TestPasswordHashFormats(t *testing.T) {
+	hash, err := HashPassword("SecurePass123")
+	if err != nil {
+		t.Fatalf("HashPassword() failed: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=2$") {
+		t.Errorf("HashPassword() = %s, want PHC argon2id format", hash)
+	}
+	if NeedsRehash(hash) {
+		t.Error("A freshly made hash should not need rehashing")
+	}
+
+	salt := []byte("0123456789abcdef")
+	legacy := base64.StdEncoding.EncodeToString(append(salt, argon2.IDKey([]byte("SecurePass123"), salt, 3, 64*1024, 2, 16)...))
+
+	weaker := strings.Replace(hash, "t=3", "t=1", 1)
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("SecurePass123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword() failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		hash        string
+		wantVerify  bool
+		needsRehash bool
+	}{
+		{"phc argon2id", hash, true, false},
+		{"legacy raw argon2", legacy, true, true},
+		{"bcrypt", string(bcryptHash), true, true},
+		{"bcrypt 2y", "$2y$" + strings.TrimPrefix(string(bcryptHash), "$2a$"), true, true},
+		{"outdated parameters", weaker, false, true},
+	}
+
+	for _, tt := range tests {
+		verified, err := VerifyPasswordHash("SecurePass123", tt.hash)
+		if err != nil {
+			t.Errorf("%s: VerifyPasswordHash() error: %v", tt.name, err)
+		}
+		if verified != tt.wantVerify {
+			t.Errorf("%s: VerifyPasswordHash() = %v, want %v", tt.name, verified, tt.wantVerify)
+		}
+		if NeedsRehash(tt.hash) != tt.needsRehash {
+			t.Errorf("%s: NeedsRehash() = %v, want %v", tt.name, !tt.needsRehash, tt.needsRehash)
+		}
+
+		verified, _ = VerifyPasswordHash("WrongPass", tt.hash)
+		if verified {
+			t.Errorf("%s: VerifyPasswordHash() accepted a wrong password", tt.name)
+		}
+	}
+
+	if _, err := VerifyPasswordHash("x", "$argon2id$v=19$garbage"); err == nil {
+		t.Error("VerifyPasswordHash() should reject a malformed PHC string")
+	}
+	for _, params := range []string{"t=0", "p=0", "m=0"} {
+		field := strings.SplitN(params, "=", 2)[0] + "="
+		start := strings.Index(hash, field)
+		end := start + strings.IndexAny(hash[start:], ",$")
+		broken := hash[:start] + params + hash[end:]
+		if _, err := VerifyPasswordHash("SecurePass123", broken); err == nil {
+			t.Errorf("VerifyPasswordHash() should reject a hash with %s", params)
+		}
+	}
+
+	// bcrypt ignores everything past 72 bytes; longer passwords never match
+	long := strings.Repeat("a", 72)
+	longHash, _ := bcrypt.GenerateFromPassword([]byte(long), bcrypt.MinCost)
+	verified, err := VerifyPasswordHash(long+"extra", string(longHash))
+	if err != nil || verified {
+		t.Errorf("VerifyPasswordHash() with a password over 72 bytes = %v, %v; want false, nil", verified, err)
+	}
+}
+
+func TestLoginUpgradesOutdatedHash(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewAuthService(db, "test-secret")
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("imported-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword() failed: %v", err)
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO users (id, username, email, password_hash) VALUES (?, ?, ?, ?)",
+		"imported-1", "imported", "imported@example.com", string(bcryptHash),
+	)
+	if err != nil {
+		t.Fatalf("Failed to seed imported user: %v", err)
+	}
+
+	_, err = service.loginUser(LoginRequest{Email: "imported@example.com", Password: "imported-pass"}, ClientInfo{IP: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("loginUser() with imported bcrypt hash failed: %v", err)
+	}
+
+	var stored string
+	db.QueryRow("SELECT password_hash FROM users WHERE id = $1", "imported-1").Scan(&stored)
+	if !strings.HasPrefix(stored, "$argon2id$") {
+		t.Errorf("Stored hash was not upgraded after login: %s", stored)
+	}
+
+	_, err = service.loginUser(LoginRequest{Email: "imported@example.com", Password: "imported-pass"}, ClientInfo{IP: "127.0.0.1"})
+	if err != nil {
+		t.Errorf("loginUser() should keep working after the upgrade: %v", err)
+	}
+}
+
+func TestAccountPendingDeletion(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewAuthService(db, "test-secret")
+
+	registered, err := service.registerUser(RegisterRequest{
+		Username: "leaving",
+		Email:    "leaving@example.com",
+		Password: "password123",
+	}, ClientInfo{})
+	if err != nil {
+		t.Fatalf("registerUser() failed: %v", err)
+	}
+	apiKey, err := service.createAPIKey(registered.User.ID, CreateAPIKeyRequest{Name: "cli", Scopes: []string{ScopeLikesRead}})
+	if err != nil {
+		t.Fatalf("createAPIKey() failed: %v", err)
+	}
+
+	deleteAfter := time.Now().UTC().Add(30 * 24 * time.Hour)
+	db.Exec("UPDATE users SET delete_after = $1 WHERE id = $2", deleteAfter, registered.User.ID)
+
+	credentials := LoginRequest{Identifier: "leaving", Password: "password123"}
+	_, err = service.loginUser(credentials, ClientInfo{IP: "127.0.0.1"})
+	if _, ok := err.(*AccountPendingDeletionError); !ok {
+		t.Errorf("loginUser() = %v, want AccountPendingDeletionError", err)
+	}
+
+	if _, err := service.validateAPIKey(apiKey.Key); err != ErrInvalidAPIKey {
+		t.Errorf("validateAPIKey() = %v, want ErrInvalidAPIKey while deletion is pending", err)
+	}
+
+	_, err = service.restoreAccount(LoginRequest{Identifier: "leaving", Password: "wrong"}, ClientInfo{IP: "127.0.0.1"})
+	if err != ErrInvalidCredentials {
+		t.Errorf("restoreAccount() with wrong password = %v, want ErrInvalidCredentials", err)
+	}
+
+	restored, err := service.restoreAccount(credentials, ClientInfo{IP: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("restoreAccount() failed: %v", err)
+	}
+	if restored.Token == "" || restored.User.DeleteAfter != nil {
+		t.Errorf("restoreAccount() = %+v, want a token and no scheduled deletion", restored.User)
+	}
+
+	if _, err := service.loginUser(credentials, ClientInfo{IP: "127.0.0.1"}); err != nil {
+		t.Errorf("loginUser() after restore failed: %v", err)
+	}
+	if _, err := service.validateAPIKey(apiKey.Key); err != nil {
+		t.Errorf("validateAPIKey() after restore failed: %v", err)
+	}
+}
+
+func TestSuspendedAccount(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewAuthService(db, "test-secret")
+
+	registered, err := service.registerUser(RegisterRequest{
+		Username: "suspended",
+		Email:    "suspended@example.com",
+		Password: "password123",
+	}, ClientInfo{})
+	if err != nil {
+		t.Fatalf("registerUser() failed: %v", err)
+	}
+	apiKey, err := service.createAPIKey(registered.User.ID, CreateAPIKeyRequest{Name: "cli", Scopes: []string{ScopeLikesRead}})
+	if err != nil {
+		t.Fatalf("createAPIKey() failed: %v", err)
+	}
+
+	db.Exec("UPDATE users SET suspended_until = $1 WHERE id = $2", time.Now().UTC().Add(24*time.Hour), registered.User.ID)
+
+	credentials := LoginRequest{Identifier: "suspended", Password: "password123"}
+	_, err = service.loginUser(credentials, ClientInfo{IP: "127.0.0.1"})
+	if _, ok := err.(*AccountSuspendedError); !ok {
+		t.Errorf("loginUser() = %v, want AccountSuspendedError", err)
+	}
+	if _, err := service.validateAPIKey(apiKey.Key); err != ErrInvalidAPIKey {
+		t.Errorf("validateAPIKey() = %v, want ErrInvalidAPIKey while suspended", err)
+	}
+
+	db.Exec("UPDATE users SET suspended_until = $1 WHERE id = $2", time.Now().UTC().Add(-time.Minute), registered.User.ID)
+
+	if _, err := service.loginUser(credentials, ClientInfo{IP: "127.0.0.1"}); err != nil {
+		t.Errorf("loginUser() after suspension ended failed: %v", err)
+	}
+	if _, err := service.validateAPIKey(apiKey.Key); err != nil {
+		t.Errorf("validateAPIKey() after suspension ended failed: %v", err)
+	}
+}
+
+func TestClientIPHonorsOnlyTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies() failed: %v", err)
+	}
+	if _, err := ParseTrustedProxies("10.0.0.0/8,not-an-ip"); err == nil {
+		t.Error("ParseTrustedProxies() should reject invalid entries")
+	}
+
+	untrusting := NewAuthHandler(nil)
+	trusting := NewAuthHandler(nil)
+	trusting.SetTrustedProxies(proxies)
+
+	tests := []struct {
+		name       string
+		handler    *AuthHandler
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"no proxies configured", untrusting, "203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"untrusted peer", trusting, "203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"trusted proxy", trusting, "10.1.2.3:1234", "1.1.1.1, 198.51.100.7", "198.51.100.7"},
+		{"chain of trusted proxies", trusting, "10.1.2.3:1234", "198.51.100.7, 192.168.1.1, 10.9.9.9", "198.51.100.7"},
+		{"trusted proxy without header", trusting, "10.1.2.3:1234", "", "10.1.2.3"},
+		{"garbage in header", trusting, "10.1.2.3:1234", "198.51.100.7, bogus", "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := tt.handler.clientIP(req); got != tt.want {
+				t.Errorf("clientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
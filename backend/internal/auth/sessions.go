@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	tokenLifetime = 24 * time.Hour
+	// lastSeenResolution limits how often an active session's last_seen_at is
+	// written, so authenticated requests do not each cost an UPDATE.
+	lastSeenResolution = time.Minute
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionRevoked  = errors.New("session revoked")
+)
+
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+// issueToken records a new session for the user and returns a JWT bound to it.
+// Accounts scheduled for deletion or suspended get no new sessions, however
+// they sign in.
+func (s *AuthService) issueToken(user *User, client ClientInfo) (*AuthResponse, error) {
+	if user.DeleteAfter != nil {
+		return nil, &AccountPendingDeletionError{DeleteAfter: *user.DeleteAfter}
+	}
+
+	now := time.Now().UTC()
+	if user.SuspendedUntil != nil && user.SuspendedUntil.After(now) {
+		return nil, &AccountSuspendedError{SuspendedUntil: *user.SuspendedUntil}
+	}
+
+	_, err := s.db.Exec("DELETE FROM sessions WHERE user_id = $1 AND created_at < $2", user.ID, now.Add(-tokenLifetime))
+	if err != nil {
+		return nil, err
+	}
+
+	sessionID := uuid.New().String()
+	query := `
+		INSERT INTO sessions (id, user_id, user_agent, ip_address, created_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $5)
+	`
+	_, err = s.db.Exec(query, sessionID, user.ID, client.UserAgent, client.IP, now)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.generateJWT(user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthResponse{
+		User:  *user,
+		Token: token,
+	}, nil
+}
+
+// checkSession rejects tokens whose session has been logged out. Every token
+// issued since sessions were tracked names one; older tokens without it could
+// never be logged out, so they are refused too.
+func (s *AuthService) checkSession(claims *JWTClaims) error {
+	if claims.SessionID == "" {
+		return ErrSessionRevoked
+	}
+	return s.touchSession(claims.SessionID, claims.UserID)
+}
+
+// touchSession confirms the session behind a token is still active and
+// refreshes its last-seen time.
+func (s *AuthService) touchSession(sessionID, userID string) error {
+	var lastSeenAt time.Time
+	err := s.db.QueryRow("SELECT last_seen_at FROM sessions WHERE id = $1 AND user_id = $2", sessionID, userID).Scan(&lastSeenAt)
+	if err == sql.ErrNoRows {
+		return ErrSessionRevoked
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(lastSeenAt) < lastSeenResolution {
+		return nil
+	}
+
+	_, err = s.db.Exec("UPDATE sessions SET last_seen_at = $1 WHERE id = $2", now, sessionID)
+	return err
+}
+
+func (s *AuthService) listSessions(userID, currentSessionID string) ([]Session, error) {
+	query := `
+		SELECT id, user_agent, ip_address, created_at, last_seen_at
+		FROM sessions
+		WHERE user_id = $1 AND created_at >= $2
+		ORDER BY last_seen_at DESC
+	`
+	rows, err := s.db.Query(query, userID, time.Now().UTC().Add(-tokenLifetime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.ID, &session.UserAgent, &session.IPAddress, &session.CreatedAt, &session.LastSeenAt)
+		if err != nil {
+			return nil, err
+		}
+		session.Current = session.ID == currentSessionID
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (s *AuthService) revokeSession(userID, sessionID string) error {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE id = $1 AND user_id = $2", sessionID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// revokeOtherSessions ends every session of the user except the one given,
+// and returns how many were ended.
+func (s *AuthService) revokeOtherSessions(userID, keepSessionID string) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE user_id = $1 AND id != $2", userID, keepSessionID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleRule describes how failed logins against a single key (an account
+// or a client IP) slow down further attempts. The first freeAttempts failures
+// are free; after that every failure forces a wait that doubles from
+// baseDelay up to maxDelay, and reaching lockoutThreshold locks the key for
+// lockoutDuration.
+type throttleRule struct {
+	freeAttempts     int
+	baseDelay        time.Duration
+	maxDelay         time.Duration
+	lockoutThreshold int
+	lockoutDuration  time.Duration
+}
+
+func (r throttleRule) delayFor(failures int) time.Duration {
+	if failures >= r.lockoutThreshold {
+		return r.lockoutDuration
+	}
+	if failures <= r.freeAttempts {
+		return 0
+	}
+
+	exponent := float64(failures - r.freeAttempts - 1)
+	delay := time.Duration(float64(r.baseDelay) * math.Pow(2, exponent))
+	if delay > r.maxDelay || delay <= 0 {
+		return r.maxDelay
+	}
+	return delay
+}
+
+var (
+	accountThrottleRule = throttleRule{
+		freeAttempts:     3,
+		baseDelay:        time.Second,
+		maxDelay:         time.Minute,
+		lockoutThreshold: 10,
+		lockoutDuration:  15 * time.Minute,
+	}
+	// Many users can share one address behind a NAT, so the per-IP rule is
+	// deliberately more forgiving than the per-account one.
+	ipThrottleRule = throttleRule{
+		freeAttempts:     20,
+		baseDelay:        time.Second,
+		maxDelay:         time.Minute,
+		lockoutThreshold: 100,
+		lockoutDuration:  time.Hour,
+	}
+)
+
+// failureWindow is how long a key must stay quiet before its failure count
+// starts over.
+const failureWindow = time.Hour
+
+// LoginThrottle records failed login attempts in the login_failures table so
+// that the limits hold across every backend replica.
+type LoginThrottle struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+func NewLoginThrottle(db *sql.DB) *LoginThrottle {
+	return &LoginThrottle{
+		db:  db,
+		now: time.Now,
+	}
+}
+
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// maxThrottleRetries bounds how often reserveAttempt and refund retry after
+// losing a race with a concurrent login against the same key.
+const maxThrottleRetries = 5
+
+// reserveAttempt counts a login attempt against key before the password is
+// checked, so parallel guesses cannot all slip through a single pre-check.
+// It returns how long the caller has to wait when the key is locked; the
+// attempt is not counted in that case. A successful login gives the
+// reservation back through reset or refund.
+func (t *LoginThrottle) reserveAttempt(key string, rule throttleRule) (time.Duration, error) {
+	for attempt := 0; attempt < maxThrottleRetries; attempt++ {
+		now := t.now().UTC()
+
+		var failures int
+		var lastFailureAt time.Time
+		var lockedUntil sql.NullTime
+		err := t.db.QueryRow(
+			"SELECT failures, last_failure_at, locked_until FROM login_failures WHERE key = $1", key,
+		).Scan(&failures, &lastFailureAt, &lockedUntil)
+		if err == sql.ErrNoRows {
+			result, err := t.db.Exec(
+				"INSERT INTO login_failures (key, failures, last_failure_at, locked_until) VALUES ($1, 1, $2, $3) ON CONFLICT (key) DO NOTHING",
+				key, now, lockFor(rule, 1, now),
+			)
+			if err != nil {
+				return 0, err
+			}
+			if inserted, _ := result.RowsAffected(); inserted == 1 {
+				return 0, nil
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if lockedUntil.Valid && lockedUntil.Time.After(now) {
+			return lockedUntil.Time.Sub(now), nil
+		}
+
+		next := failures + 1
+		if now.Sub(lastFailureAt) > failureWindow {
+			next = 1
+		}
+		result, err := t.db.Exec(
+			"UPDATE login_failures SET failures = $1, last_failure_at = $2, locked_until = $3 WHERE key = $4 AND failures = $5 AND last_failure_at = $6",
+			next, now, lockFor(rule, next, now), key, failures, lastFailureAt,
+		)
+		if err != nil {
+			return 0, err
+		}
+		if updated, _ := result.RowsAffected(); updated == 1 {
+			return 0, nil
+		}
+	}
+
+	// Contention this heavy on one key is an attack in itself.
+	return rule.baseDelay, nil
+}
+
+// refund gives back an attempt reserved against key, recomputing the lock
+// from the remaining count. It is used for keys that should only count
+// failures, such as the client IP after a successful login.
+func (t *LoginThrottle) refund(key string, rule throttleRule) error {
+	for attempt := 0; attempt < maxThrottleRetries; attempt++ {
+		var failures int
+		var lastFailureAt time.Time
+		err := t.db.QueryRow(
+			"SELECT failures, last_failure_at FROM login_failures WHERE key = $1", key,
+		).Scan(&failures, &lastFailureAt)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if failures <= 0 {
+			return nil
+		}
+
+		result, err := t.db.Exec(
+			"UPDATE login_failures SET failures = $1, locked_until = $2 WHERE key = $3 AND failures = $4 AND last_failure_at = $5",
+			failures-1, lockFor(rule, failures-1, lastFailureAt), key, failures, lastFailureAt,
+		)
+		if err != nil {
+			return err
+		}
+		if updated, _ := result.RowsAffected(); updated == 1 {
+			return nil
+		}
+	}
+	return nil
+}
+
+func lockFor(rule throttleRule, failures int, from time.Time) sql.NullTime {
+	if delay := rule.delayFor(failures); delay > 0 {
+		return sql.NullTime{Time: from.Add(delay), Valid: true}
+	}
+	return sql.NullTime{}
+}
+
+func (t *LoginThrottle) reset(key string) error {
+	_, err := t.db.Exec("DELETE FROM login_failures WHERE key = $1", key)
+	return err
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash is verified against when the requested account does not
+// exist, so that unknown emails cost the same Argon2 work as known ones.
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		hash, err := HashPassword("dummy-password-for-timing")
+		if err == nil {
+			dummyHash = hash
+		}
+	})
+	return dummyHash
+}
@@ -60,6 +60,14 @@ func InitDB(config Config) error {
 		return fmt.Errorf("failed to create tables: %w", err)
 	}
 
+	if err := migrateTables(); err != nil {
+		return fmt.Errorf("failed to migrate tables: %w", err)
+	}
+
+	if err := normalizeUserIdentities(); err != nil {
+		return fmt.Errorf("failed to normalize user identities: %w", err)
+	}
+
 	if err := createIndexes(); err != nil {
 		return fmt.Errorf("failed to create indexes: %w", err)
 	}
@@ -92,7 +100,15 @@ func createTables() error {
 			servings INTEGER NOT NULL,
 			difficulty TEXT NOT NULL,
 			instructions TEXT NOT NULL,
-			description TEXT
+			description TEXT,
+			rating_count INTEGER NOT NULL DEFAULT 0,
+			rating_sum INTEGER NOT NULL DEFAULT 0,
+			like_count INTEGER NOT NULL DEFAULT 0,
+			trending_score REAL NOT NULL DEFAULT 0,
+			author_id TEXT,
+			forked_from INTEGER REFERENCES recipes (id) ON DELETE SET NULL,
+			hidden_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`,
 		`CREATE TABLE IF NOT EXISTS recipe_ingredients (
 			recipe_id INTEGER NOT NULL,
@@ -109,8 +125,12 @@ func createTables() error {
 			username TEXT UNIQUE NOT NULL,
 			email TEXT UNIQUE NOT NULL,
 			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'user',
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			delete_after TIMESTAMP,
+			suspended_until TIMESTAMP,
+			email_verified_at TIMESTAMP
 		)`,
 		`CREATE TABLE IF NOT EXISTS user_liked_recipes (
 			user_id TEXT NOT NULL,
@@ -120,6 +140,231 @@ func createTables() error {
 			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
 			FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE
 		)`,
+		`CREATE TABLE IF NOT EXISTS recipe_like_buckets (
+			recipe_id INTEGER NOT NULL,
+			bucket_start TIMESTAMP NOT NULL,
+			likes INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (recipe_id, bucket_start),
+			FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS recipe_similarities (
+			recipe_id INTEGER NOT NULL,
+			similar_recipe_id INTEGER NOT NULL,
+			score REAL NOT NULL,
+			PRIMARY KEY (recipe_id, similar_recipe_id),
+			FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE,
+			FOREIGN KEY (similar_recipe_id) REFERENCES recipes(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS recipe_reviews (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			recipe_id INTEGER NOT NULL,
+			rating INTEGER NOT NULL CHECK (rating BETWEEN 1 AND 5),
+			review TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			hidden_at TIMESTAMP,
+			UNIQUE (user_id, recipe_id),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS recipe_comments (
+			id TEXT PRIMARY KEY,
+			recipe_id INTEGER NOT NULL,
+			user_id TEXT,
+			parent_id TEXT,
+			root_id TEXT NOT NULL,
+			body TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			edited_at TIMESTAMP,
+			deleted_at TIMESTAMP,
+			hidden_at TIMESTAMP,
+			FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+			FOREIGN KEY (parent_id) REFERENCES recipe_comments(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS collections (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			is_public BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS collection_recipes (
+			collection_id TEXT NOT NULL,
+			recipe_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			added_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (collection_id, recipe_id),
+			FOREIGN KEY (collection_id) REFERENCES collections(id) ON DELETE CASCADE,
+			FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS follows (
+			follower_id TEXT NOT NULL,
+			followee_id TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (follower_id, followee_id),
+			FOREIGN KEY (follower_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (followee_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS profile_settings (
+			user_id TEXT PRIMARY KEY,
+			display_name TEXT NOT NULL DEFAULT '',
+			show_join_date BOOLEAN NOT NULL DEFAULT TRUE,
+			show_recipes BOOLEAN NOT NULL DEFAULT TRUE,
+			show_collections BOOLEAN NOT NULL DEFAULT TRUE,
+			show_stats BOOLEAN NOT NULL DEFAULT TRUE,
+			show_follows BOOLEAN NOT NULL DEFAULT TRUE,
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			key_hash TEXT UNIQUE NOT NULL,
+			scopes TEXT NOT NULL,
+			expires_at TIMESTAMP,
+			last_used_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			ip_address TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			last_seen_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_identities (
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			email TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (provider, subject),
+			UNIQUE (user_id, provider),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS oauth_states (
+			state TEXT PRIMARY KEY,
+			provider TEXT NOT NULL,
+			code_verifier TEXT NOT NULL,
+			nonce TEXT NOT NULL,
+			link_user_id TEXT NOT NULL,
+			binding_hash TEXT NOT NULL DEFAULT '',
+			restore BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS email_changes (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			old_email TEXT NOT NULL,
+			new_email TEXT NOT NULL,
+			confirm_token_hash TEXT UNIQUE NOT NULL,
+			revert_token_hash TEXT UNIQUE,
+			created_at TIMESTAMP NOT NULL,
+			confirmed_at TIMESTAMP,
+			reverted_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS data_exports (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			format TEXT NOT NULL,
+			status TEXT NOT NULL,
+			error TEXT,
+			archive BYTEA,
+			download_token_hash TEXT UNIQUE,
+			link_expires_at TIMESTAMP,
+			created_at TIMESTAMP NOT NULL,
+			completed_at TIMESTAMP,
+			expires_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS recipe_notes (
+			user_id TEXT NOT NULL,
+			recipe_id INTEGER NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (user_id, recipe_id),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS recipe_ingredient_tweaks (
+			user_id TEXT NOT NULL,
+			recipe_id INTEGER NOT NULL,
+			ingredient_id INTEGER NOT NULL,
+			quantity REAL,
+			unit TEXT,
+			substitute_ingredient_id INTEGER,
+			PRIMARY KEY (user_id, recipe_id, ingredient_id),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE,
+			FOREIGN KEY (ingredient_id) REFERENCES ingredients(id),
+			FOREIGN KEY (substitute_ingredient_id) REFERENCES ingredients(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS pantry_items (
+			user_id TEXT NOT NULL,
+			ingredient_id INTEGER NOT NULL,
+			quantity REAL NOT NULL,
+			unit TEXT NOT NULL,
+			expires_at TIMESTAMP,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (user_id, ingredient_id),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (ingredient_id) REFERENCES ingredients(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS recipe_revisions (
+			id TEXT PRIMARY KEY,
+			recipe_id INTEGER NOT NULL,
+			revision INTEGER NOT NULL,
+			author_id TEXT,
+			summary TEXT NOT NULL DEFAULT '',
+			snapshot TEXT NOT NULL,
+			reverted_from INTEGER,
+			created_at TIMESTAMP NOT NULL,
+			UNIQUE (recipe_id, revision),
+			FOREIGN KEY (recipe_id) REFERENCES recipes(id) ON DELETE CASCADE,
+			FOREIGN KEY (author_id) REFERENCES users(id) ON DELETE SET NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS content_reports (
+			id TEXT PRIMARY KEY,
+			reporter_id TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			content_id TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			details TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT 'open',
+			created_at TIMESTAMP NOT NULL,
+			resolved_at TIMESTAMP,
+			FOREIGN KEY (reporter_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS moderation_actions (
+			id TEXT PRIMARY KEY,
+			moderator_id TEXT,
+			user_id TEXT,
+			action TEXT NOT NULL,
+			content_type TEXT NOT NULL DEFAULT '',
+			content_id TEXT NOT NULL DEFAULT '',
+			reason TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (moderator_id) REFERENCES users(id) ON DELETE SET NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS login_failures (
+			key TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL DEFAULT 0,
+			last_failure_at TIMESTAMP NOT NULL,
+			locked_until TIMESTAMP
+		)`,
 	}
 
 	for _, table := range tables {
@@ -132,6 +377,53 @@ func createTables() error {
 	return nil
 }
 
+// migrateTables brings tables created by older versions up to date. Every
+// statement must be safe to run on each startup.
+func migrateTables() error {
+	migrations := []string{
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user'",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS delete_after TIMESTAMP",
+		"ALTER TABLE recipes ADD COLUMN IF NOT EXISTS rating_count INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE recipes ADD COLUMN IF NOT EXISTS rating_sum INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE recipes ADD COLUMN IF NOT EXISTS author_id TEXT",
+		"ALTER TABLE recipes ADD COLUMN IF NOT EXISTS forked_from INTEGER REFERENCES recipes (id) ON DELETE SET NULL",
+		"ALTER TABLE recipes ADD COLUMN IF NOT EXISTS created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP",
+		"ALTER TABLE recipes ADD COLUMN IF NOT EXISTS like_count INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE recipes ADD COLUMN IF NOT EXISTS trending_score REAL NOT NULL DEFAULT 0",
+		"ALTER TABLE recipes ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMP",
+		"ALTER TABLE recipe_reviews ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMP",
+		"ALTER TABLE recipe_comments ADD COLUMN IF NOT EXISTS hidden_at TIMESTAMP",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended_until TIMESTAMP",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP",
+		"ALTER TABLE oauth_states ADD COLUMN IF NOT EXISTS binding_hash TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE oauth_states ADD COLUMN IF NOT EXISTS restore BOOLEAN NOT NULL DEFAULT FALSE",
+		// Moderation history outlives the accounts it concerns
+		"ALTER TABLE moderation_actions DROP CONSTRAINT IF EXISTS moderation_actions_user_id_fkey",
+		"ALTER TABLE moderation_actions ADD CONSTRAINT moderation_actions_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL",
+		// Likes given before like_count existed
+		"UPDATE recipes SET like_count = (SELECT COUNT(*) FROM user_liked_recipes WHERE recipe_id = recipes.id) WHERE like_count = 0",
+		// Like buckets for likes given before buckets existed, covering the
+		// seven days the trending windows look back. It only runs while no
+		// bucket has been recorded, so later restarts leave the counts alone.
+		`INSERT INTO recipe_like_buckets (recipe_id, bucket_start, likes)
+		SELECT recipe_id, date_trunc('hour', created_at), COUNT(*)
+		FROM user_liked_recipes
+		WHERE created_at > (NOW() AT TIME ZONE 'UTC') - INTERVAL '7 days'
+			AND NOT EXISTS (SELECT 1 FROM recipe_like_buckets)
+		GROUP BY recipe_id, date_trunc('hour', created_at)
+		ON CONFLICT (recipe_id, bucket_start) DO NOTHING`,
+	}
+
+	for _, migration := range migrations {
+		if _, err := DB.Exec(migration); err != nil {
+			return fmt.Errorf("failed to run migration: %w", err)
+		}
+	}
+
+	log.Println("All migrations applied successfully")
+	return nil
+}
+
 func createIndexes() error {
 	indexes := []string{
 		"CREATE INDEX IF NOT EXISTS idx_ingredients_category ON ingredients(category)",
@@ -141,8 +433,33 @@ func createIndexes() error {
 		"CREATE INDEX IF NOT EXISTS idx_recipes_category_difficulty ON recipes(category, difficulty)",
 		"CREATE INDEX IF NOT EXISTS idx_recipe_ingredients_recipe_id ON recipe_ingredients(recipe_id)",
 		"CREATE INDEX IF NOT EXISTS idx_recipe_ingredients_ingredient_id ON recipe_ingredients(ingredient_id)",
+		"CREATE INDEX IF NOT EXISTS idx_recipe_reviews_recipe_id ON recipe_reviews(recipe_id)",
+		"CREATE INDEX IF NOT EXISTS idx_recipe_comments_recipe_id ON recipe_comments(recipe_id, created_at)",
+		"CREATE INDEX IF NOT EXISTS idx_recipe_comments_root_id ON recipe_comments(root_id)",
+		"CREATE INDEX IF NOT EXISTS idx_recipe_comments_user_id ON recipe_comments(user_id)",
+		"CREATE INDEX IF NOT EXISTS idx_collection_recipes_recipe_id ON collection_recipes(recipe_id)",
+		"CREATE INDEX IF NOT EXISTS idx_recipe_like_buckets_bucket_start ON recipe_like_buckets(bucket_start)",
+		"CREATE INDEX IF NOT EXISTS idx_recipes_like_count ON recipes(like_count)",
+		"CREATE INDEX IF NOT EXISTS idx_recipes_trending_score ON recipes(trending_score)",
+		"CREATE INDEX IF NOT EXISTS idx_recipes_author_id_created_at ON recipes(author_id, created_at)",
+		"CREATE INDEX IF NOT EXISTS idx_recipes_forked_from ON recipes(forked_from)",
+		"CREATE INDEX IF NOT EXISTS idx_recipe_reviews_user_id_created_at ON recipe_reviews(user_id, created_at)",
+		"CREATE INDEX IF NOT EXISTS idx_collections_user_id_created_at ON collections(user_id, created_at)",
+		"CREATE INDEX IF NOT EXISTS idx_follows_followee_id ON follows(followee_id)",
+		"CREATE INDEX IF NOT EXISTS idx_recipe_revisions_author_id ON recipe_revisions(author_id)",
+		"CREATE INDEX IF NOT EXISTS idx_content_reports_content ON content_reports(content_type, content_id, status)",
+		"CREATE INDEX IF NOT EXISTS idx_content_reports_status_created_at ON content_reports(status, created_at)",
+		"CREATE INDEX IF NOT EXISTS idx_content_reports_reporter_id ON content_reports(reporter_id)",
+		"CREATE INDEX IF NOT EXISTS idx_moderation_actions_user_id ON moderation_actions(user_id)",
+		"CREATE INDEX IF NOT EXISTS idx_moderation_actions_content ON moderation_actions(content_type, content_id)",
 		"CREATE INDEX IF NOT EXISTS idx_users_email ON users(email)",
 		"CREATE INDEX IF NOT EXISTS idx_users_username ON users(username)",
+		"CREATE INDEX IF NOT EXISTS idx_users_role ON users(role)",
+		"CREATE INDEX IF NOT EXISTS idx_users_delete_after ON users(delete_after)",
+		"CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys(user_id)",
+		"CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)",
+		"CREATE INDEX IF NOT EXISTS idx_email_changes_user_id ON email_changes(user_id)",
+		"CREATE INDEX IF NOT EXISTS idx_data_exports_user_id ON data_exports(user_id)",
 	}
 
 	for _, index := range indexes {
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/ngthecoder/go_web_api/internal/auth"
+	"golang.org/x/text/unicode/norm"
+)
+
+type identityConflict struct {
+	field   string
+	value   string
+	userIDs []string
+}
+
+// normalizeUserIdentities brings accounts created before identities were
+// normalized in line with the current rules: emails are stored NFKC-normalized
+// and lowercased, usernames NFKC-normalized with their case kept, and both are
+// unique regardless of case.
+//
+// Accounts that collide once normalized are left untouched and reported,
+// since merging them needs a human decision. The case-insensitive unique
+// indexes are only created once no conflicts remain. Usernames that the
+// current rules would not accept are reported too, so that an admin can
+// rename them; they keep working until then.
+func normalizeUserIdentities() error {
+	rows, err := DB.Query("SELECT id, username, email FROM users")
+	if err != nil {
+		return err
+	}
+
+	type account struct {
+		id          string
+		email       string
+		newEmail    string
+		username    string
+		newUsername string
+	}
+
+	var accounts []account
+	emailOwners := make(map[string][]string)
+	usernameOwners := make(map[string][]string)
+	for rows.Next() {
+		var id, username, email string
+		if err := rows.Scan(&id, &username, &email); err != nil {
+			rows.Close()
+			return err
+		}
+
+		newEmail := strings.ToLower(strings.TrimSpace(norm.NFKC.String(email)))
+		emailOwners[newEmail] = append(emailOwners[newEmail], id)
+
+		newUsername := strings.TrimSpace(norm.NFKC.String(username))
+		usernameKey := strings.ToLower(newUsername)
+		usernameOwners[usernameKey] = append(usernameOwners[usernameKey], id)
+
+		if _, err := auth.NormalizeUsername(username); err != nil {
+			log.Printf("Warning: account %s has the username %q, which is no longer allowed; rename it", id, username)
+		}
+
+		accounts = append(accounts, account{id: id, email: email, newEmail: newEmail, username: username, newUsername: newUsername})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	emailConflicts := findIdentityConflicts("email", emailOwners)
+	usernameConflicts := findIdentityConflicts("username", usernameOwners)
+	for _, conflict := range append(emailConflicts, usernameConflicts...) {
+		log.Printf("Warning: accounts %s share the %s %q once normalized; resolve them manually",
+			strings.Join(conflict.userIDs, ", "), conflict.field, conflict.value)
+	}
+
+	updated := 0
+	for _, a := range accounts {
+		if a.newEmail == a.email || len(emailOwners[a.newEmail]) > 1 {
+			continue
+		}
+		if _, err := DB.Exec("UPDATE users SET email = $1 WHERE id = $2", a.newEmail, a.id); err != nil {
+			return fmt.Errorf("failed to normalize email for user %s: %w", a.id, err)
+		}
+		updated++
+	}
+	if updated > 0 {
+		log.Printf("Normalized %d stored email addresses", updated)
+	}
+
+	updated = 0
+	for _, a := range accounts {
+		if a.newUsername == a.username || len(usernameOwners[strings.ToLower(a.newUsername)]) > 1 {
+			continue
+		}
+		if _, err := DB.Exec("UPDATE users SET username = $1 WHERE id = $2", a.newUsername, a.id); err != nil {
+			return fmt.Errorf("failed to normalize username for user %s: %w", a.id, err)
+		}
+		updated++
+	}
+	if updated > 0 {
+		log.Printf("Normalized %d stored usernames", updated)
+	}
+
+	if len(emailConflicts) == 0 {
+		if _, err := DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users (LOWER(email))"); err != nil {
+			return fmt.Errorf("failed to create email uniqueness index: %w", err)
+		}
+	} else {
+		log.Printf("Warning: %d email conflicts found; case-insensitive email uniqueness is not enforced", len(emailConflicts))
+	}
+
+	if len(usernameConflicts) == 0 {
+		if _, err := DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username_lower ON users (LOWER(username))"); err != nil {
+			return fmt.Errorf("failed to create username uniqueness index: %w", err)
+		}
+	} else {
+		log.Printf("Warning: %d username conflicts found; case-insensitive username uniqueness is not enforced", len(usernameConflicts))
+	}
+
+	return nil
+}
+
+func findIdentityConflicts(field string, owners map[string][]string) []identityConflict {
+	var conflicts []identityConflict
+	for value, userIDs := range owners {
+		if len(userIDs) > 1 {
+			conflicts = append(conflicts, identityConflict{field: field, value: value, userIDs: userIDs})
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].value < conflicts[j].value
+	})
+	return conflicts
+}
@@ -4,12 +4,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type HTTPError struct {
 	StatusCode int
 	Message    string
 	Err        error
+	RetryAfter time.Duration
+	Fields     []FieldError
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 func (e *HTTPError) Error() string {
@@ -26,6 +36,14 @@ func NewBadRequestError(message string) *HTTPError {
 	}
 }
 
+func NewValidationError(message string, fields []FieldError) *HTTPError {
+	return &HTTPError{
+		StatusCode: http.StatusBadRequest,
+		Message:    message,
+		Fields:     fields,
+	}
+}
+
 func NewNotFoundError(message string) *HTTPError {
 	return &HTTPError{
 		StatusCode: http.StatusNotFound,
@@ -55,6 +73,21 @@ func NewUnauthorizedError(message string) *HTTPError {
 	}
 }
 
+func NewForbiddenError(message string) *HTTPError {
+	return &HTTPError{
+		StatusCode: http.StatusForbidden,
+		Message:    message,
+	}
+}
+
+func NewTooManyRequestsError(message string, retryAfter time.Duration) *HTTPError {
+	return &HTTPError{
+		StatusCode: http.StatusTooManyRequests,
+		Message:    message,
+		RetryAfter: retryAfter,
+	}
+}
+
 func NewMethodNotAllowedError() *HTTPError {
 	return &HTTPError{
 		StatusCode: http.StatusMethodNotAllowed,
@@ -66,7 +99,18 @@ func WriteHTTPError(w http.ResponseWriter, err error) {
 	w.Header().Set("Content-Type", "application/json")
 
 	if httpErr, ok := err.(*HTTPError); ok {
+		if httpErr.RetryAfter > 0 {
+			seconds := int((httpErr.RetryAfter + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		}
 		w.WriteHeader(httpErr.StatusCode)
+		if len(httpErr.Fields) > 0 {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":  httpErr.Message,
+				"fields": httpErr.Fields,
+			})
+			return
+		}
 		json.NewEncoder(w).Encode(map[string]string{
 			"error": httpErr.Message,
 		})
@@ -64,7 +64,7 @@ func (s *IngredientsService) ingredientDetailsWithRecipesRetriever(ingredientID
         LEFT JOIN
             recipe_ingredients AS ri ON i.id = ri.ingredient_id
         LEFT JOIN
-            recipes AS r ON ri.recipe_id = r.id
+            recipes AS r ON ri.recipe_id = r.id AND r.hidden_at IS NULL
         WHERE
             i.id = $1;
     `
@@ -0,0 +1,161 @@
+package moderation
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+type ModerationHandler struct {
+	service *ModerationService
+}
+
+func NewModerationHandler(s *ModerationService) *ModerationHandler {
+	return &ModerationHandler{service: s}
+}
+
+// ReportHandler serves POST /api/reports, which reports a recipe, review or
+// comment to the moderators.
+func (h *ModerationHandler) ReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	var request ReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+		return
+	}
+
+	report, err := h.service.createReport(r.Context().Value("user_id").(string), request)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// QueueHandler serves GET /api/admin/moderation/queue, a page of content
+// waiting for a moderator, optionally of one type.
+func (h *ModerationHandler) QueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	query := r.URL.Query()
+	contentType := query.Get("type")
+	if contentType != "" && !IsValidContentType(contentType) {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Type must be one of recipe, review, comment"))
+		return
+	}
+
+	page := 1
+	if p, err := strconv.Atoi(query.Get("page")); err == nil && p > 0 {
+		page = p
+	}
+	limit := 20
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+
+	items, total, err := h.service.queueRetriever(contentType, limit, (page-1)*limit)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	totalPages := (total + limit - 1) / limit
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"items":       items,
+		"total":       total,
+		"page":        page,
+		"page_size":   limit,
+		"total_pages": totalPages,
+		"has_next":    page < totalPages,
+	})
+}
+
+// ContentHandler serves /api/admin/moderation/content/{type}/{id}. GET shows
+// the content with its reports and past actions; POST hides or restores it or
+// dismisses its reports.
+func (h *ModerationHandler) ContentHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) != 7 || pathParts[6] == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/admin/moderation/content/{type}/{id}"))
+		return
+	}
+	contentType, contentID := pathParts[5], pathParts[6]
+	if !IsValidContentType(contentType) {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Type must be one of recipe, review, comment"))
+		return
+	}
+
+	var moderation ContentModeration
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		moderation, err = h.service.contentModerationRetriever(contentType, contentID)
+	case http.MethodPost:
+		var request ContentActionRequest
+		if decodeErr := json.NewDecoder(r.Body).Decode(&request); decodeErr != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+		moderation, err = h.service.moderateContent(r.Context().Value("user_id").(string), contentType, contentID, request)
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(moderation)
+}
+
+// UserHandler serves /api/admin/moderation/users/{id}. GET shows the user's
+// suspension and moderation history; POST warns, suspends or unsuspends them.
+func (h *ModerationHandler) UserHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) != 6 || pathParts[5] == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/admin/moderation/users/{id}"))
+		return
+	}
+	userID := pathParts[5]
+
+	var moderation UserModeration
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		moderation, err = h.service.userModerationRetriever(userID)
+	case http.MethodPost:
+		var request UserActionRequest
+		if decodeErr := json.NewDecoder(r.Body).Decode(&request); decodeErr != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+		moderation, err = h.service.moderateUser(r.Context().Value("user_id").(string), userID, request)
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(moderation)
+}
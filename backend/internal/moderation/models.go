@@ -0,0 +1,105 @@
+package moderation
+
+import "time"
+
+const (
+	ContentTypeRecipe  = "recipe"
+	ContentTypeReview  = "review"
+	ContentTypeComment = "comment"
+
+	ReasonSpam          = "spam"
+	ReasonOffensive     = "offensive"
+	ReasonInappropriate = "inappropriate"
+	ReasonCopyright     = "copyright"
+	ReasonOther         = "other"
+
+	ReportStatusOpen      = "open"
+	ReportStatusResolved  = "resolved"
+	ReportStatusDismissed = "dismissed"
+
+	ActionHide      = "hide"
+	ActionRestore   = "restore"
+	ActionDismiss   = "dismiss"
+	ActionWarn      = "warn"
+	ActionSuspend   = "suspend"
+	ActionUnsuspend = "unsuspend"
+)
+
+type ReportRequest struct {
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id"`
+	Reason      string `json:"reason"`
+	Details     string `json:"details"`
+}
+
+type Report struct {
+	ID               string     `json:"id"`
+	ReporterUsername string     `json:"reporter_username,omitempty"`
+	ContentType      string     `json:"content_type"`
+	ContentID        string     `json:"content_id"`
+	Reason           string     `json:"reason"`
+	Details          string     `json:"details"`
+	Status           string     `json:"status"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ResolvedAt       *time.Time `json:"resolved_at,omitempty"`
+}
+
+// Content is a reported recipe, review or comment as moderators see it,
+// hidden or not. Text is the recipe name, review text or comment body.
+type Content struct {
+	Type           string     `json:"type"`
+	ID             string     `json:"id"`
+	RecipeID       int        `json:"recipe_id"`
+	Text           string     `json:"text"`
+	AuthorID       string     `json:"author_id,omitempty"`
+	AuthorUsername string     `json:"author_username,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	HiddenAt       *time.Time `json:"hidden_at,omitempty"`
+}
+
+// QueueItem is one piece of content with open reports. Content is nil when
+// it has since been deleted.
+type QueueItem struct {
+	ContentType     string         `json:"content_type"`
+	ContentID       string         `json:"content_id"`
+	Content         *Content       `json:"content"`
+	Reports         int            `json:"reports"`
+	Reasons         map[string]int `json:"reasons"`
+	FirstReportedAt time.Time      `json:"first_reported_at"`
+	LastReportedAt  time.Time      `json:"last_reported_at"`
+}
+
+type Action struct {
+	ID                string    `json:"id"`
+	ModeratorUsername string    `json:"moderator_username,omitempty"`
+	UserID            string    `json:"user_id,omitempty"`
+	Action            string    `json:"action"`
+	ContentType       string    `json:"content_type,omitempty"`
+	ContentID         string    `json:"content_id,omitempty"`
+	Reason            string    `json:"reason"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+type ContentModeration struct {
+	Content *Content `json:"content"`
+	Reports []Report `json:"reports"`
+	Actions []Action `json:"actions"`
+}
+
+type ContentActionRequest struct {
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+type UserActionRequest struct {
+	Action       string `json:"action"`
+	Reason       string `json:"reason"`
+	DurationDays int    `json:"duration_days"`
+}
+
+type UserModeration struct {
+	UserID         string     `json:"user_id"`
+	Username       string     `json:"username"`
+	SuspendedUntil *time.Time `json:"suspended_until,omitempty"`
+	Actions        []Action   `json:"actions"`
+}
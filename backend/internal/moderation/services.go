@@ -0,0 +1,618 @@
+package moderation
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/ngthecoder/go_web_api/internal/auth"
+	"github.com/ngthecoder/go_web_api/internal/errors"
+	"github.com/ngthecoder/go_web_api/internal/mail"
+)
+
+const (
+	maxReportDetailsLength = 1000
+	maxActionReasonLength  = 500
+	maxSuspensionDays      = 365
+)
+
+// contentTables maps each reportable content type to the table holding it.
+var contentTables = map[string]string{
+	ContentTypeRecipe:  "recipes",
+	ContentTypeReview:  "recipe_reviews",
+	ContentTypeComment: "recipe_comments",
+}
+
+var reportReasons = map[string]bool{
+	ReasonSpam:          true,
+	ReasonOffensive:     true,
+	ReasonInappropriate: true,
+	ReasonCopyright:     true,
+	ReasonOther:         true,
+}
+
+func IsValidContentType(contentType string) bool {
+	_, ok := contentTables[contentType]
+	return ok
+}
+
+type ModerationService struct {
+	db     *sql.DB
+	mailer mail.Mailer
+}
+
+func NewModerationService(db *sql.DB) *ModerationService {
+	return &ModerationService{
+		db:     db,
+		mailer: mail.LogMailer{},
+	}
+}
+
+// SetMailer sets how users are told about warnings and suspensions.
+func (s *ModerationService) SetMailer(mailer mail.Mailer) {
+	s.mailer = mailer
+}
+
+type rowQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// contentKey converts a content ID to the value its table is keyed by.
+// Recipes have integer IDs; reviews and comments have UUIDs.
+func contentKey(contentType, contentID string) (interface{}, bool) {
+	if contentType == ContentTypeRecipe {
+		id, err := strconv.Atoi(contentID)
+		return id, err == nil && id > 0
+	}
+	return contentID, contentID != ""
+}
+
+// lookupContent loads a piece of content whether or not it is hidden.
+// Deleted comments count as missing.
+func lookupContent(q rowQueryer, contentType, contentID string) (Content, error) {
+	key, ok := contentKey(contentType, contentID)
+	if !ok || !IsValidContentType(contentType) {
+		return Content{}, errors.NewNotFoundError("Content not found")
+	}
+
+	var query string
+	switch contentType {
+	case ContentTypeRecipe:
+		query = `SELECT r.id, r.name, r.author_id, u.username, r.created_at, r.hidden_at
+			FROM recipes r
+			LEFT JOIN users u ON u.id = r.author_id
+			WHERE r.id = $1`
+	case ContentTypeReview:
+		query = `SELECT rr.recipe_id, rr.review, rr.user_id, u.username, rr.created_at, rr.hidden_at
+			FROM recipe_reviews rr
+			LEFT JOIN users u ON u.id = rr.user_id
+			WHERE rr.id = $1`
+	case ContentTypeComment:
+		query = `SELECT c.recipe_id, c.body, c.user_id, u.username, c.created_at, c.hidden_at
+			FROM recipe_comments c
+			LEFT JOIN users u ON u.id = c.user_id
+			WHERE c.id = $1 AND c.deleted_at IS NULL`
+	}
+
+	content := Content{Type: contentType, ID: contentID}
+	var authorID, authorUsername sql.NullString
+	var hiddenAt sql.NullTime
+	err := q.QueryRow(query, key).Scan(&content.RecipeID, &content.Text, &authorID, &authorUsername, &content.CreatedAt, &hiddenAt)
+	if err == sql.ErrNoRows {
+		return Content{}, errors.NewNotFoundError("Content not found")
+	}
+	if err != nil {
+		return Content{}, errors.NewInternalServerError("Database error", err)
+	}
+	content.AuthorID = authorID.String
+	content.AuthorUsername = authorUsername.String
+	if hiddenAt.Valid {
+		content.HiddenAt = &hiddenAt.Time
+	}
+
+	return content, nil
+}
+
+// optionalContent is lookupContent for callers that can do without the
+// content, such as when it has been deleted since it was reported.
+func optionalContent(q rowQueryer, contentType, contentID string) (*Content, error) {
+	content, err := lookupContent(q, contentType, contentID)
+	if httpErr, ok := err.(*errors.HTTPError); ok && httpErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// createReport files a report against visible content. A reporter can have
+// only one open report per piece of content and cannot report their own.
+func (s *ModerationService) createReport(reporterID string, request ReportRequest) (Report, error) {
+	request.ContentID = strings.TrimSpace(request.ContentID)
+	request.Details = strings.TrimSpace(request.Details)
+
+	var fields []errors.FieldError
+	if !IsValidContentType(request.ContentType) {
+		fields = append(fields, errors.FieldError{Field: "content_type", Code: "invalid", Message: "Content type must be one of recipe, review, comment"})
+	}
+	if request.ContentID == "" {
+		fields = append(fields, errors.FieldError{Field: "content_id", Code: "required", Message: "Content ID is required"})
+	}
+	if !reportReasons[request.Reason] {
+		fields = append(fields, errors.FieldError{Field: "reason", Code: "invalid", Message: "Reason must be one of spam, offensive, inappropriate, copyright, other"})
+	}
+	if utf8.RuneCountInString(request.Details) > maxReportDetailsLength {
+		fields = append(fields, errors.FieldError{Field: "details", Code: "too_long", Message: fmt.Sprintf("Details must be at most %d characters", maxReportDetailsLength)})
+	}
+	if len(fields) > 0 {
+		return Report{}, errors.NewValidationError("Invalid report", fields)
+	}
+
+	content, err := lookupContent(s.db, request.ContentType, request.ContentID)
+	if err != nil {
+		return Report{}, err
+	}
+	if content.HiddenAt != nil {
+		return Report{}, errors.NewNotFoundError("Content not found")
+	}
+	if content.AuthorID == reporterID {
+		return Report{}, errors.NewBadRequestError("You cannot report your own content")
+	}
+
+	var exists bool
+	err = s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM content_reports WHERE reporter_id = $1 AND content_type = $2 AND content_id = $3 AND status = $4)",
+		reporterID, request.ContentType, request.ContentID, ReportStatusOpen,
+	).Scan(&exists)
+	if err != nil {
+		return Report{}, errors.NewInternalServerError("Database error", err)
+	}
+	if exists {
+		return Report{}, errors.NewConflictError("You have already reported this content")
+	}
+
+	report := Report{
+		ID:          uuid.New().String(),
+		ContentType: request.ContentType,
+		ContentID:   request.ContentID,
+		Reason:      request.Reason,
+		Details:     request.Details,
+		Status:      ReportStatusOpen,
+		CreatedAt:   time.Now().UTC(),
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO content_reports (id, reporter_id, content_type, content_id, reason, details, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		report.ID, reporterID, report.ContentType, report.ContentID, report.Reason, report.Details, report.Status, report.CreatedAt,
+	)
+	if err != nil {
+		return Report{}, errors.NewInternalServerError("Failed to save report", err)
+	}
+
+	return report, nil
+}
+
+// queueRetriever lists content with open reports, most reported first and
+// then oldest report first. contentType narrows it to one type when set.
+func (s *ModerationService) queueRetriever(contentType string, limit, offset int) ([]QueueItem, int, error) {
+	condition := "status = $1"
+	args := []interface{}{ReportStatusOpen}
+	if contentType != "" {
+		condition += " AND content_type = $2"
+		args = append(args, contentType)
+	}
+
+	var total int
+	err := s.db.QueryRow(
+		"SELECT COUNT(*) FROM (SELECT 1 FROM content_reports WHERE "+condition+" GROUP BY content_type, content_id) AS reported",
+		args...,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+
+	n := len(args)
+	rows, err := s.db.Query(
+		`SELECT content_type, content_id
+		FROM content_reports
+		WHERE `+condition+`
+		GROUP BY content_type, content_id
+		ORDER BY COUNT(*) DESC, MIN(created_at), content_type, content_id
+		LIMIT $`+strconv.Itoa(n+1)+` OFFSET $`+strconv.Itoa(n+2),
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+	items := []QueueItem{}
+	for rows.Next() {
+		item := QueueItem{Reasons: map[string]int{}}
+		if err := rows.Scan(&item.ContentType, &item.ContentID); err != nil {
+			rows.Close()
+			return nil, 0, errors.NewInternalServerError("Data scanning error", err)
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	for i := range items {
+		if err := s.fillQueueItem(&items[i]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return items, total, nil
+}
+
+// fillQueueItem adds the report summary and the content to a queue item.
+func (s *ModerationService) fillQueueItem(item *QueueItem) error {
+	rows, err := s.db.Query(
+		"SELECT reason, created_at FROM content_reports WHERE content_type = $1 AND content_id = $2 AND status = $3 ORDER BY created_at",
+		item.ContentType, item.ContentID, ReportStatusOpen,
+	)
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var reason string
+		var createdAt time.Time
+		if err := rows.Scan(&reason, &createdAt); err != nil {
+			return errors.NewInternalServerError("Data scanning error", err)
+		}
+		if item.Reports == 0 {
+			item.FirstReportedAt = createdAt
+		}
+		item.LastReportedAt = createdAt
+		item.Reasons[reason]++
+		item.Reports++
+	}
+	if err := rows.Err(); err != nil {
+		return errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	item.Content, err = optionalContent(s.db, item.ContentType, item.ContentID)
+	return err
+}
+
+// contentModerationRetriever returns a piece of content with every report
+// and moderation action on it. Content that has been deleted can still be
+// looked up while reports or actions refer to it.
+func (s *ModerationService) contentModerationRetriever(contentType, contentID string) (ContentModeration, error) {
+	var moderation ContentModeration
+	var err error
+	moderation.Content, err = optionalContent(s.db, contentType, contentID)
+	if err != nil {
+		return ContentModeration{}, err
+	}
+
+	moderation.Reports, err = s.contentReports(contentType, contentID)
+	if err != nil {
+		return ContentModeration{}, err
+	}
+	moderation.Actions, err = s.actions("a.content_type = $1 AND a.content_id = $2", contentType, contentID)
+	if err != nil {
+		return ContentModeration{}, err
+	}
+
+	if moderation.Content == nil && len(moderation.Reports) == 0 && len(moderation.Actions) == 0 {
+		return ContentModeration{}, errors.NewNotFoundError("Content not found")
+	}
+
+	return moderation, nil
+}
+
+func (s *ModerationService) contentReports(contentType, contentID string) ([]Report, error) {
+	rows, err := s.db.Query(`
+		SELECT cr.id, u.username, cr.content_type, cr.content_id, cr.reason, cr.details, cr.status, cr.created_at, cr.resolved_at
+		FROM content_reports cr
+		JOIN users u ON u.id = cr.reporter_id
+		WHERE cr.content_type = $1 AND cr.content_id = $2
+		ORDER BY cr.created_at DESC`,
+		contentType, contentID,
+	)
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		var report Report
+		var resolvedAt sql.NullTime
+		err := rows.Scan(&report.ID, &report.ReporterUsername, &report.ContentType, &report.ContentID, &report.Reason,
+			&report.Details, &report.Status, &report.CreatedAt, &resolvedAt)
+		if err != nil {
+			return nil, errors.NewInternalServerError("Data scanning error", err)
+		}
+		if resolvedAt.Valid {
+			report.ResolvedAt = &resolvedAt.Time
+		}
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return reports, nil
+}
+
+// actions lists moderation actions matching condition, newest first.
+func (s *ModerationService) actions(condition string, args ...interface{}) ([]Action, error) {
+	rows, err := s.db.Query(`
+		SELECT a.id, m.username, a.user_id, a.action, a.content_type, a.content_id, a.reason, a.created_at
+		FROM moderation_actions a
+		LEFT JOIN users m ON m.id = a.moderator_id
+		WHERE `+condition+`
+		ORDER BY a.created_at DESC`,
+		args...,
+	)
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	actions := []Action{}
+	for rows.Next() {
+		var action Action
+		var moderator, userID sql.NullString
+		err := rows.Scan(&action.ID, &moderator, &userID, &action.Action, &action.ContentType, &action.ContentID, &action.Reason, &action.CreatedAt)
+		if err != nil {
+			return nil, errors.NewInternalServerError("Data scanning error", err)
+		}
+		action.ModeratorUsername = moderator.String
+		action.UserID = userID.String
+		actions = append(actions, action)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return actions, nil
+}
+
+func recordAction(tx *sql.Tx, moderatorID, userID, action, contentType, contentID, reason string, now time.Time) error {
+	_, err := tx.Exec(
+		`INSERT INTO moderation_actions (id, moderator_id, user_id, action, content_type, content_id, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		uuid.New().String(), moderatorID, sql.NullString{String: userID, Valid: userID != ""}, action, contentType, contentID, reason, now,
+	)
+	return err
+}
+
+// moderateContent hides, restores or dismisses the reports on a piece of
+// content. Hiding resolves its open reports; dismissing closes them and
+// leaves the content up. Hidden reviews are kept out of the recipe's rating.
+func (s *ModerationService) moderateContent(moderatorID, contentType, contentID string, request ContentActionRequest) (ContentModeration, error) {
+	request.Reason = strings.TrimSpace(request.Reason)
+	if request.Action != ActionHide && request.Action != ActionRestore && request.Action != ActionDismiss {
+		return ContentModeration{}, errors.NewValidationError("Invalid action", []errors.FieldError{
+			{Field: "action", Code: "invalid", Message: "Action must be one of hide, restore, dismiss"},
+		})
+	}
+	if utf8.RuneCountInString(request.Reason) > maxActionReasonLength {
+		return ContentModeration{}, errors.NewValidationError("Invalid action", []errors.FieldError{
+			{Field: "reason", Code: "too_long", Message: fmt.Sprintf("Reason must be at most %d characters", maxActionReasonLength)},
+		})
+	}
+	if !IsValidContentType(contentType) {
+		return ContentModeration{}, errors.NewNotFoundError("Content not found")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ContentModeration{}, errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var authorID string
+	if request.Action == ActionDismiss {
+		// Reports on deleted content can still be dismissed
+		content, err := optionalContent(tx, contentType, contentID)
+		if err != nil {
+			return ContentModeration{}, err
+		}
+		if content != nil {
+			authorID = content.AuthorID
+		}
+
+		result, err := tx.Exec(
+			"UPDATE content_reports SET status = $1, resolved_at = $2 WHERE content_type = $3 AND content_id = $4 AND status = $5",
+			ReportStatusDismissed, now, contentType, contentID, ReportStatusOpen,
+		)
+		if err != nil {
+			return ContentModeration{}, errors.NewInternalServerError("Failed to dismiss reports", err)
+		}
+		if dismissed, _ := result.RowsAffected(); dismissed == 0 {
+			return ContentModeration{}, errors.NewNotFoundError("No open reports for this content")
+		}
+	} else {
+		content, err := lookupContent(tx, contentType, contentID)
+		if err != nil {
+			return ContentModeration{}, err
+		}
+		authorID = content.AuthorID
+
+		hide := request.Action == ActionHide
+		if hide == (content.HiddenAt != nil) {
+			if hide {
+				return ContentModeration{}, errors.NewConflictError("Content is already hidden")
+			}
+			return ContentModeration{}, errors.NewConflictError("Content is not hidden")
+		}
+
+		if err := setHidden(tx, content, hide, now); err != nil {
+			return ContentModeration{}, errors.NewInternalServerError("Failed to update content", err)
+		}
+
+		if hide {
+			_, err = tx.Exec(
+				"UPDATE content_reports SET status = $1, resolved_at = $2 WHERE content_type = $3 AND content_id = $4 AND status = $5",
+				ReportStatusResolved, now, contentType, contentID, ReportStatusOpen,
+			)
+			if err != nil {
+				return ContentModeration{}, errors.NewInternalServerError("Failed to resolve reports", err)
+			}
+		}
+	}
+
+	if err := recordAction(tx, moderatorID, authorID, request.Action, contentType, contentID, request.Reason, now); err != nil {
+		return ContentModeration{}, errors.NewInternalServerError("Failed to record action", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return ContentModeration{}, errors.NewInternalServerError("Failed to update content", err)
+	}
+
+	return s.contentModerationRetriever(contentType, contentID)
+}
+
+// setHidden hides or restores content, moving a review's rating out of or
+// back into its recipe's totals.
+func setHidden(tx *sql.Tx, content Content, hide bool, now time.Time) error {
+	key, _ := contentKey(content.Type, content.ID)
+	hiddenAt := sql.NullTime{Time: now, Valid: hide}
+	_, err := tx.Exec("UPDATE "+contentTables[content.Type]+" SET hidden_at = $1 WHERE id = $2", hiddenAt, key)
+	if err != nil || content.Type != ContentTypeReview {
+		return err
+	}
+
+	var rating int
+	if err := tx.QueryRow("SELECT rating FROM recipe_reviews WHERE id = $1", key).Scan(&rating); err != nil {
+		return err
+	}
+	delta := 1
+	if hide {
+		delta = -1
+	}
+	_, err = tx.Exec(
+		"UPDATE recipes SET rating_count = rating_count + $1, rating_sum = rating_sum + $2 WHERE id = $3",
+		delta, delta*rating, content.RecipeID,
+	)
+	return err
+}
+
+func (s *ModerationService) userModerationRetriever(userID string) (UserModeration, error) {
+	moderation := UserModeration{UserID: userID}
+	var suspendedUntil sql.NullTime
+	err := s.db.QueryRow("SELECT username, suspended_until FROM users WHERE id = $1", userID).Scan(&moderation.Username, &suspendedUntil)
+	if err == sql.ErrNoRows {
+		return UserModeration{}, errors.NewNotFoundError("User not found")
+	}
+	if err != nil {
+		return UserModeration{}, errors.NewInternalServerError("Database error", err)
+	}
+	if suspendedUntil.Valid && suspendedUntil.Time.After(time.Now()) {
+		moderation.SuspendedUntil = &suspendedUntil.Time
+	}
+
+	moderation.Actions, err = s.actions("a.user_id = $1", userID)
+	if err != nil {
+		return UserModeration{}, err
+	}
+
+	return moderation, nil
+}
+
+// moderateUser warns, suspends or lifts the suspension of a user. A suspended
+// user is signed out everywhere and cannot sign in or use API keys until the
+// suspension ends. Admins cannot be moderated.
+func (s *ModerationService) moderateUser(moderatorID, userID string, request UserActionRequest) (UserModeration, error) {
+	request.Reason = strings.TrimSpace(request.Reason)
+
+	var fields []errors.FieldError
+	switch request.Action {
+	case ActionWarn, ActionSuspend:
+		if request.Reason == "" {
+			fields = append(fields, errors.FieldError{Field: "reason", Code: "required", Message: "Reason is required"})
+		}
+	case ActionUnsuspend:
+	default:
+		fields = append(fields, errors.FieldError{Field: "action", Code: "invalid", Message: "Action must be one of warn, suspend, unsuspend"})
+	}
+	if utf8.RuneCountInString(request.Reason) > maxActionReasonLength {
+		fields = append(fields, errors.FieldError{Field: "reason", Code: "too_long", Message: fmt.Sprintf("Reason must be at most %d characters", maxActionReasonLength)})
+	}
+	if request.Action == ActionSuspend && (request.DurationDays < 1 || request.DurationDays > maxSuspensionDays) {
+		fields = append(fields, errors.FieldError{Field: "duration_days", Code: "out_of_range", Message: fmt.Sprintf("Duration must be between 1 and %d days", maxSuspensionDays)})
+	}
+	if len(fields) > 0 {
+		return UserModeration{}, errors.NewValidationError("Invalid action", fields)
+	}
+	if userID == moderatorID {
+		return UserModeration{}, errors.NewBadRequestError("You cannot moderate your own account")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return UserModeration{}, errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	var email, role string
+	var suspendedUntil sql.NullTime
+	err = tx.QueryRow("SELECT email, role, suspended_until FROM users WHERE id = $1", userID).Scan(&email, &role, &suspendedUntil)
+	if err == sql.ErrNoRows {
+		return UserModeration{}, errors.NewNotFoundError("User not found")
+	}
+	if err != nil {
+		return UserModeration{}, errors.NewInternalServerError("Database error", err)
+	}
+	if auth.HasRole(role, auth.RoleAdmin) {
+		return UserModeration{}, errors.NewForbiddenError("Admins cannot be moderated")
+	}
+
+	now := time.Now().UTC()
+	suspended := suspendedUntil.Valid && suspendedUntil.Time.After(now)
+	var subject, body string
+	switch request.Action {
+	case ActionWarn:
+		subject = "A warning about your account"
+		body = fmt.Sprintf("A moderator has warned you about your activity:\n\n%s\n\nFurther problems may lead to your account being suspended.", request.Reason)
+	case ActionSuspend:
+		until := now.Add(time.Duration(request.DurationDays) * 24 * time.Hour)
+		if _, err := tx.Exec("UPDATE users SET suspended_until = $1 WHERE id = $2", until, userID); err != nil {
+			return UserModeration{}, errors.NewInternalServerError("Failed to suspend user", err)
+		}
+		if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = $1", userID); err != nil {
+			return UserModeration{}, errors.NewInternalServerError("Failed to suspend user", err)
+		}
+		subject = "Your account has been suspended"
+		body = fmt.Sprintf("Your account has been suspended until %s:\n\n%s", until.Format(time.RFC1123), request.Reason)
+	case ActionUnsuspend:
+		if !suspended {
+			return UserModeration{}, errors.NewConflictError("User is not suspended")
+		}
+		if _, err := tx.Exec("UPDATE users SET suspended_until = NULL WHERE id = $1", userID); err != nil {
+			return UserModeration{}, errors.NewInternalServerError("Failed to lift suspension", err)
+		}
+	}
+
+	if err := recordAction(tx, moderatorID, userID, request.Action, "", "", request.Reason, now); err != nil {
+		return UserModeration{}, errors.NewInternalServerError("Failed to record action", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return UserModeration{}, errors.NewInternalServerError("Failed to moderate user", err)
+	}
+
+	if subject != "" {
+		if err := s.mailer.Send(email, subject, body); err != nil {
+			log.Printf("Warning: failed to notify %s of moderation action: %v", email, err)
+		}
+	}
+
+	return s.userModerationRetriever(userID)
+}
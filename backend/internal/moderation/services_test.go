@@ -0,0 +1,277 @@
+package moderation
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+func assertStatus(t *testing.T, name string, err error, want int) {
+	t.Helper()
+	httpErr, ok := err.(*errors.HTTPError)
+	if !ok || httpErr.StatusCode != want {
+		t.Errorf("%s error = %v, want status %d", name, err, want)
+	}
+}
+
+func TestReportsAndContentModeration(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewModerationService(db)
+
+	report := ReportRequest{ContentType: ContentTypeRecipe, ContentID: "1", Reason: ReasonSpam}
+	if _, err := service.createReport("reporter-1", report); err != nil {
+		t.Fatalf("createReport() error: %v", err)
+	}
+	_, err := service.createReport("reporter-1", report)
+	assertStatus(t, "duplicate createReport()", err, http.StatusConflict)
+	_, err = service.createReport("author", report)
+	assertStatus(t, "createReport() of own recipe", err, http.StatusBadRequest)
+	_, err = service.createReport("reporter-1", ReportRequest{ContentType: "user", ContentID: "1", Reason: "boring"})
+	assertStatus(t, "invalid createReport()", err, http.StatusBadRequest)
+
+	report.Reason = ReasonOffensive
+	if _, err := service.createReport("reporter-2", report); err != nil {
+		t.Fatalf("createReport() error: %v", err)
+	}
+	if _, err := service.createReport("reporter-1", ReportRequest{ContentType: ContentTypeReview, ContentID: "review-1", Reason: ReasonOther}); err != nil {
+		t.Fatalf("createReport() of review error: %v", err)
+	}
+
+	queue, total, err := service.queueRetriever("", 10, 0)
+	if err != nil {
+		t.Fatalf("queueRetriever() error: %v", err)
+	}
+	if total != 2 || len(queue) != 2 {
+		t.Fatalf("queueRetriever() = %d items of %d, want 2 of 2", len(queue), total)
+	}
+	first := queue[0]
+	if first.ContentID != "1" || first.Reports != 2 || first.Reasons[ReasonSpam] != 1 || first.Reasons[ReasonOffensive] != 1 {
+		t.Errorf("queue[0] = %+v, want recipe 1 with one spam and one offensive report", first)
+	}
+	if first.Content == nil || first.Content.AuthorUsername != "author" {
+		t.Errorf("queue[0].Content = %+v, want author's recipe", first.Content)
+	}
+
+	moderation, err := service.moderateContent("admin", ContentTypeRecipe, "1", ContentActionRequest{Action: ActionHide, Reason: "Spam"})
+	if err != nil {
+		t.Fatalf("moderateContent(hide) error: %v", err)
+	}
+	if moderation.Content == nil || moderation.Content.HiddenAt == nil {
+		t.Errorf("moderateContent(hide) content = %+v, want hidden", moderation.Content)
+	}
+	for _, r := range moderation.Reports {
+		if r.Status != ReportStatusResolved {
+			t.Errorf("report %s status = %v, want %v", r.ID, r.Status, ReportStatusResolved)
+		}
+	}
+	if len(moderation.Actions) != 1 || moderation.Actions[0].UserID != "author" || moderation.Actions[0].ModeratorUsername != "admin" {
+		t.Errorf("moderateContent(hide) actions = %+v, want one action by admin against author", moderation.Actions)
+	}
+
+	_, err = service.moderateContent("admin", ContentTypeRecipe, "1", ContentActionRequest{Action: ActionHide})
+	assertStatus(t, "moderateContent(hide) of hidden recipe", err, http.StatusConflict)
+	_, err = service.createReport("reporter-3", ReportRequest{ContentType: ContentTypeRecipe, ContentID: "1", Reason: ReasonSpam})
+	assertStatus(t, "createReport() of hidden recipe", err, http.StatusNotFound)
+
+	queue, total, err = service.queueRetriever(ContentTypeRecipe, 10, 0)
+	if err != nil {
+		t.Fatalf("queueRetriever() error: %v", err)
+	}
+	if total != 0 || len(queue) != 0 {
+		t.Errorf("queueRetriever(recipe) after hide = %d items, want 0", total)
+	}
+
+	if _, err := service.moderateContent("admin", ContentTypeRecipe, "1", ContentActionRequest{Action: ActionRestore}); err != nil {
+		t.Fatalf("moderateContent(restore) error: %v", err)
+	}
+	var hiddenAt sql.NullTime
+	db.QueryRow("SELECT hidden_at FROM recipes WHERE id = 1").Scan(&hiddenAt)
+	if hiddenAt.Valid {
+		t.Error("recipe 1 still hidden after restore")
+	}
+
+	// Hiding a review takes it out of the recipe's rating
+	if _, err := service.moderateContent("admin", ContentTypeReview, "review-1", ContentActionRequest{Action: ActionHide}); err != nil {
+		t.Fatalf("moderateContent(hide review) error: %v", err)
+	}
+	var count, sum int
+	db.QueryRow("SELECT rating_count, rating_sum FROM recipes WHERE id = 1").Scan(&count, &sum)
+	if count != 1 || sum != 5 {
+		t.Errorf("rating after hiding review = %d/%d, want 1/5", count, sum)
+	}
+	if _, err := service.moderateContent("admin", ContentTypeReview, "review-1", ContentActionRequest{Action: ActionRestore}); err != nil {
+		t.Fatalf("moderateContent(restore review) error: %v", err)
+	}
+	db.QueryRow("SELECT rating_count, rating_sum FROM recipes WHERE id = 1").Scan(&count, &sum)
+	if count != 2 || sum != 7 {
+		t.Errorf("rating after restoring review = %d/%d, want 2/7", count, sum)
+	}
+
+	// Reports on deleted content can still be dismissed
+	if _, err := service.createReport("reporter-1", ReportRequest{ContentType: ContentTypeComment, ContentID: "comment-1", Reason: ReasonSpam}); err != nil {
+		t.Fatalf("createReport() of comment error: %v", err)
+	}
+	db.Exec("DELETE FROM recipe_comments WHERE id = 'comment-1'")
+	moderation, err = service.moderateContent("admin", ContentTypeComment, "comment-1", ContentActionRequest{Action: ActionDismiss})
+	if err != nil {
+		t.Fatalf("moderateContent(dismiss) error: %v", err)
+	}
+	if moderation.Content != nil || len(moderation.Reports) != 1 || moderation.Reports[0].Status != ReportStatusDismissed {
+		t.Errorf("moderateContent(dismiss) = %+v, want no content and one dismissed report", moderation)
+	}
+	_, err = service.moderateContent("admin", ContentTypeComment, "comment-1", ContentActionRequest{Action: ActionDismiss})
+	assertStatus(t, "second moderateContent(dismiss)", err, http.StatusNotFound)
+}
+
+func TestUserModeration(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewModerationService(db)
+
+	db.Exec("INSERT INTO sessions (id, user_id) VALUES ('session-1', 'author')")
+
+	_, err := service.moderateUser("admin", "author", UserActionRequest{Action: ActionSuspend, Reason: "Spam"})
+	assertStatus(t, "moderateUser(suspend) without duration", err, http.StatusBadRequest)
+	_, err = service.moderateUser("admin", "author", UserActionRequest{Action: ActionWarn})
+	assertStatus(t, "moderateUser(warn) without reason", err, http.StatusBadRequest)
+	_, err = service.moderateUser("reporter-1", "admin", UserActionRequest{Action: ActionWarn, Reason: "No"})
+	assertStatus(t, "moderateUser() of admin", err, http.StatusForbidden)
+	_, err = service.moderateUser("admin", "author", UserActionRequest{Action: ActionUnsuspend})
+	assertStatus(t, "moderateUser(unsuspend) of active user", err, http.StatusConflict)
+
+	if _, err := service.moderateUser("admin", "author", UserActionRequest{Action: ActionWarn, Reason: "Keep it civil"}); err != nil {
+		t.Fatalf("moderateUser(warn) error: %v", err)
+	}
+
+	moderation, err := service.moderateUser("admin", "author", UserActionRequest{Action: ActionSuspend, Reason: "Spam", DurationDays: 7})
+	if err != nil {
+		t.Fatalf("moderateUser(suspend) error: %v", err)
+	}
+	if moderation.SuspendedUntil == nil || moderation.SuspendedUntil.Before(time.Now().Add(6*24*time.Hour)) {
+		t.Errorf("SuspendedUntil = %v, want about a week from now", moderation.SuspendedUntil)
+	}
+	if len(moderation.Actions) != 2 || moderation.Actions[0].Action != ActionSuspend {
+		t.Errorf("Actions = %+v, want suspend then warn", moderation.Actions)
+	}
+	var sessions int
+	db.QueryRow("SELECT COUNT(*) FROM sessions WHERE user_id = 'author'").Scan(&sessions)
+	if sessions != 0 {
+		t.Errorf("sessions after suspension = %d, want 0", sessions)
+	}
+
+	moderation, err = service.moderateUser("admin", "author", UserActionRequest{Action: ActionUnsuspend})
+	if err != nil {
+		t.Fatalf("moderateUser(unsuspend) error: %v", err)
+	}
+	if moderation.SuspendedUntil != nil {
+		t.Errorf("SuspendedUntil after unsuspend = %v, want nil", moderation.SuspendedUntil)
+	}
+}
+
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE users (
+			id TEXT PRIMARY KEY,
+			username TEXT UNIQUE NOT NULL,
+			email TEXT UNIQUE NOT NULL,
+			role TEXT NOT NULL DEFAULT 'user',
+			suspended_until DATETIME
+		);
+
+		CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL
+		);
+
+		CREATE TABLE recipes (
+			id INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			rating_count INTEGER NOT NULL DEFAULT 0,
+			rating_sum INTEGER NOT NULL DEFAULT 0,
+			author_id TEXT,
+			hidden_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE recipe_reviews (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			recipe_id INTEGER NOT NULL,
+			rating INTEGER NOT NULL,
+			review TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			hidden_at DATETIME
+		);
+
+		CREATE TABLE recipe_comments (
+			id TEXT PRIMARY KEY,
+			recipe_id INTEGER NOT NULL,
+			user_id TEXT,
+			body TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			deleted_at DATETIME,
+			hidden_at DATETIME
+		);
+
+		CREATE TABLE content_reports (
+			id TEXT PRIMARY KEY,
+			reporter_id TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			content_id TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			details TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT 'open',
+			created_at DATETIME NOT NULL,
+			resolved_at DATETIME
+		);
+
+		CREATE TABLE moderation_actions (
+			id TEXT PRIMARY KEY,
+			moderator_id TEXT,
+			user_id TEXT,
+			action TEXT NOT NULL,
+			content_type TEXT NOT NULL DEFAULT '',
+			content_id TEXT NOT NULL DEFAULT '',
+			reason TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL
+		);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create tables: %v", err)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO users (id, username, email, role) VALUES
+		('admin', 'admin', 'admin@example.com', 'admin'),
+		('author', 'author', 'author@example.com', 'user'),
+		('reporter-1', 'reporter1', 'reporter1@example.com', 'user'),
+		('reporter-2', 'reporter2', 'reporter2@example.com', 'user'),
+		('reporter-3', 'reporter3', 'reporter3@example.com', 'user');
+
+		INSERT INTO recipes (id, name, rating_count, rating_sum, author_id) VALUES (1, 'Spam Salad', 2, 7, 'author');
+
+		INSERT INTO recipe_reviews (id, user_id, recipe_id, rating, review, created_at) VALUES
+		('review-1', 'reporter-2', 1, 2, 'Buy my cookbook', CURRENT_TIMESTAMP),
+		('review-2', 'reporter-3', 1, 5, 'Lovely', CURRENT_TIMESTAMP);
+
+		INSERT INTO recipe_comments (id, recipe_id, user_id, body, created_at) VALUES
+		('comment-1', 1, 'author', 'Follow me', CURRENT_TIMESTAMP);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	return db
+}
@@ -0,0 +1,346 @@
+package recipes
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+const (
+	CommentSortNewest = "newest"
+	CommentSortThread = "thread"
+
+	maxCommentLength = 2000
+	// commentEditWindow is how long after posting a comment its author may
+	// still change it.
+	commentEditWindow = 15 * time.Minute
+)
+
+const commentColumns = `c.id, c.recipe_id, c.parent_id, u.username, c.body, c.created_at, c.edited_at, c.deleted_at, c.hidden_at`
+
+func scanComment(scanner interface{ Scan(...interface{}) error }) (Comment, error) {
+	var comment Comment
+	var parentID, username sql.NullString
+	var editedAt, deletedAt, hiddenAt sql.NullTime
+	err := scanner.Scan(&comment.ID, &comment.RecipeID, &parentID, &username,
+		&comment.Body, &comment.CreatedAt, &editedAt, &deletedAt, &hiddenAt)
+	if err != nil {
+		return Comment{}, err
+	}
+
+	if parentID.Valid {
+		comment.ParentID = &parentID.String
+	}
+	if editedAt.Valid {
+		comment.EditedAt = &editedAt.Time
+	}
+	// Deleted and hidden comments stay in place so replies keep their
+	// parent, but nothing about them is shown.
+	if deletedAt.Valid || hiddenAt.Valid {
+		comment.Deleted = deletedAt.Valid
+		comment.Hidden = hiddenAt.Valid
+		comment.Body = ""
+		comment.EditedAt = nil
+	} else {
+		comment.Username = username.String
+	}
+
+	return comment, nil
+}
+
+func validateCommentBody(body string) error {
+	if body == "" {
+		return errors.NewBadRequestError("Comment cannot be empty")
+	}
+	if utf8.RuneCountInString(body) > maxCommentLength {
+		return errors.NewBadRequestError(fmt.Sprintf("Comment must be at most %d characters", maxCommentLength))
+	}
+	return nil
+}
+
+// createComment posts a comment on a recipe, or a reply when parentID is set.
+// A reply joins the thread of the top-level comment it descends from.
+func (s *RecipesService) createComment(userID string, recipeID int, parentID, body string) (Comment, error) {
+	if err := validateCommentBody(body); err != nil {
+		return Comment{}, err
+	}
+
+	exists, err := s.recipeExists(recipeID)
+	if err != nil {
+		return Comment{}, errors.NewInternalServerError("Database error", err)
+	}
+	if !exists {
+		return Comment{}, errors.NewNotFoundError("Recipe not found")
+	}
+
+	commentID := uuid.New().String()
+	rootID := commentID
+	var parent sql.NullString
+	if parentID != "" {
+		var parentRecipeID int
+		var deletedAt, hiddenAt sql.NullTime
+		err := s.db.QueryRow(
+			"SELECT recipe_id, root_id, deleted_at, hidden_at FROM recipe_comments WHERE id = $1",
+			parentID,
+		).Scan(&parentRecipeID, &rootID, &deletedAt, &hiddenAt)
+		if err == sql.ErrNoRows || (err == nil && parentRecipeID != recipeID) {
+			return Comment{}, errors.NewNotFoundError("Parent comment not found")
+		}
+		if err != nil {
+			return Comment{}, errors.NewInternalServerError("Database error", err)
+		}
+		if deletedAt.Valid || hiddenAt.Valid {
+			return Comment{}, errors.NewBadRequestError("Cannot reply to a deleted comment")
+		}
+		parent = sql.NullString{String: parentID, Valid: true}
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO recipe_comments (id, recipe_id, user_id, parent_id, root_id, body, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		commentID, recipeID, userID, parent, rootID, body, time.Now().UTC(),
+	)
+	if err != nil {
+		return Comment{}, errors.NewInternalServerError("Failed to save comment", err)
+	}
+
+	return s.getComment(recipeID, commentID)
+}
+
+func (s *RecipesService) getComment(recipeID int, commentID string) (Comment, error) {
+	row := s.db.QueryRow(`
+		SELECT `+commentColumns+`
+		FROM recipe_comments c
+		LEFT JOIN users u ON u.id = c.user_id
+		WHERE c.id = $1 AND c.recipe_id = $2`,
+		commentID, recipeID,
+	)
+	comment, err := scanComment(row)
+	if err == sql.ErrNoRows {
+		return Comment{}, errors.NewNotFoundError("Comment not found")
+	}
+	if err != nil {
+		return Comment{}, errors.NewInternalServerError("Database error", err)
+	}
+
+	return comment, nil
+}
+
+// commentOwnedBy loads a live comment for a change by its author. Comments a
+// moderator has hidden can no longer be changed.
+func (s *RecipesService) commentOwnedBy(userID string, recipeID int, commentID string) (time.Time, error) {
+	var authorID sql.NullString
+	var createdAt time.Time
+	var deletedAt, hiddenAt sql.NullTime
+	err := s.db.QueryRow(
+		"SELECT user_id, created_at, deleted_at, hidden_at FROM recipe_comments WHERE id = $1 AND recipe_id = $2",
+		commentID, recipeID,
+	).Scan(&authorID, &createdAt, &deletedAt, &hiddenAt)
+	if err == sql.ErrNoRows || (err == nil && (deletedAt.Valid || hiddenAt.Valid)) {
+		return time.Time{}, errors.NewNotFoundError("Comment not found")
+	}
+	if err != nil {
+		return time.Time{}, errors.NewInternalServerError("Database error", err)
+	}
+	if authorID.String != userID {
+		return time.Time{}, errors.NewForbiddenError("You can only change your own comments")
+	}
+
+	return createdAt, nil
+}
+
+func (s *RecipesService) editComment(userID string, recipeID int, commentID, body string) (Comment, error) {
+	if err := validateCommentBody(body); err != nil {
+		return Comment{}, err
+	}
+
+	createdAt, err := s.commentOwnedBy(userID, recipeID, commentID)
+	if err != nil {
+		return Comment{}, err
+	}
+	if time.Since(createdAt) > commentEditWindow {
+		return Comment{}, errors.NewForbiddenError(fmt.Sprintf("Comments can only be edited within %d minutes of posting", int(commentEditWindow.Minutes())))
+	}
+
+	_, err = s.db.Exec(
+		"UPDATE recipe_comments SET body = $1, edited_at = $2 WHERE id = $3",
+		body, time.Now().UTC(), commentID,
+	)
+	if err != nil {
+		return Comment{}, errors.NewInternalServerError("Failed to update comment", err)
+	}
+
+	return s.getComment(recipeID, commentID)
+}
+
+// deleteComment blanks a comment but keeps its row, so that the replies to
+// it stay attached to the thread.
+func (s *RecipesService) deleteComment(userID string, recipeID int, commentID string) error {
+	if _, err := s.commentOwnedBy(userID, recipeID, commentID); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(
+		"UPDATE recipe_comments SET body = '', deleted_at = $1 WHERE id = $2",
+		time.Now().UTC(), commentID,
+	)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to delete comment", err)
+	}
+
+	return nil
+}
+
+// commentsRetriever pages through a recipe's comments. Sorted by newest it
+// returns a flat list; sorted by thread it pages through top-level comments,
+// newest first, each with its replies nested in the order they were posted.
+// Both leave out hidden comments and whole threads whose top-level comment
+// was hidden or deleted. total counts the items being paged.
+func (s *RecipesService) commentsRetriever(recipeID int, sort string, limit, offset int) ([]Comment, int, error) {
+	exists, err := s.recipeExists(recipeID)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+	if !exists {
+		return nil, 0, errors.NewNotFoundError("Recipe not found")
+	}
+
+	if sort == CommentSortNewest {
+		return s.newestComments(recipeID, limit, offset)
+	}
+	return s.commentThreads(recipeID, limit, offset)
+}
+
+// visibleThread limits comments c, joined with their top-level comment as
+// root, to threads that are still shown.
+const visibleThread = "root.hidden_at IS NULL AND root.deleted_at IS NULL"
+
+func (s *RecipesService) newestComments(recipeID, limit, offset int) ([]Comment, int, error) {
+	var total int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM recipe_comments c
+		JOIN recipe_comments root ON root.id = c.root_id
+		WHERE c.recipe_id = $1 AND c.hidden_at IS NULL AND `+visibleThread,
+		recipeID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+
+	comments, err := s.queryComments(`
+		SELECT `+commentColumns+`
+		FROM recipe_comments c
+		JOIN recipe_comments root ON root.id = c.root_id
+		LEFT JOIN users u ON u.id = c.user_id
+		WHERE c.recipe_id = $1 AND c.hidden_at IS NULL AND `+visibleThread+`
+		ORDER BY c.created_at DESC, c.id
+		LIMIT $2 OFFSET $3`,
+		recipeID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return comments, total, nil
+}
+
+func (s *RecipesService) commentThreads(recipeID, limit, offset int) ([]Comment, int, error) {
+	var total int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM recipe_comments root
+		WHERE root.recipe_id = $1 AND root.parent_id IS NULL AND `+visibleThread,
+		recipeID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+
+	roots, err := s.queryComments(`
+		SELECT `+commentColumns+`
+		FROM recipe_comments c
+		JOIN recipe_comments root ON root.id = c.id
+		LEFT JOIN users u ON u.id = c.user_id
+		WHERE c.recipe_id = $1 AND c.parent_id IS NULL AND `+visibleThread+`
+		ORDER BY c.created_at DESC, c.id
+		LIMIT $2 OFFSET $3`,
+		recipeID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(roots) == 0 {
+		return roots, total, nil
+	}
+
+	placeholders := make([]string, len(roots))
+	args := make([]interface{}, len(roots))
+	for i, root := range roots {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = root.ID
+	}
+	// Hidden replies are fetched only to place their own replies, which
+	// attachReplies moves up to the hidden reply's parent.
+	replies, err := s.queryComments(`
+		SELECT `+commentColumns+`
+		FROM recipe_comments c
+		LEFT JOIN users u ON u.id = c.user_id
+		WHERE c.root_id IN (`+strings.Join(placeholders, ", ")+`) AND c.parent_id IS NOT NULL
+		ORDER BY c.created_at, c.id`,
+		args...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	children := make(map[string][]Comment)
+	for _, reply := range replies {
+		children[*reply.ParentID] = append(children[*reply.ParentID], reply)
+	}
+	for i := range roots {
+		roots[i].Replies = attachReplies(roots[i].ID, children)
+	}
+
+	return roots, total, nil
+}
+
+func attachReplies(parentID string, children map[string][]Comment) []Comment {
+	var replies []Comment
+	for _, reply := range children[parentID] {
+		if reply.Hidden {
+			replies = append(replies, attachReplies(reply.ID, children)...)
+			continue
+		}
+		reply.Replies = attachReplies(reply.ID, children)
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+func (s *RecipesService) queryComments(query string, args ...interface{}) ([]Comment, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	comments := []Comment{}
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, errors.NewInternalServerError("Data scanning error", err)
+		}
+		comments = append(comments, comment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return comments, nil
+}
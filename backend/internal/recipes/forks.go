@@ -0,0 +1,126 @@
+package recipes
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+const maxRecipeNameLength = 200
+
+// forkRecipe copies a visible recipe and its ingredients into a new recipe
+// owned by userID that links back to the original. The copy starts with no
+// ratings, likes or comments of its own.
+func (s *RecipesService) forkRecipe(userID string, recipeID int, request ForkRecipeRequest) (Recipe, []IngredientWithQuantity, error) {
+	name := strings.TrimSpace(request.Name)
+	if utf8.RuneCountInString(name) > maxRecipeNameLength {
+		return Recipe{}, nil, errors.NewValidationError("Invalid fork", []errors.FieldError{
+			{Field: "name", Code: "too_long", Message: fmt.Sprintf("Name must be at most %d characters", maxRecipeNameLength)},
+		})
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Recipe{}, nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	var forkID int
+	err = tx.QueryRow(`
+		INSERT INTO recipes (name, category, prep_time_minutes, cook_time_minutes, servings, difficulty, instructions, description, author_id, forked_from, created_at)
+		SELECT CASE WHEN $1 = '' THEN name ELSE $1 END, category, prep_time_minutes, cook_time_minutes, servings, difficulty, instructions, description, $2, id, $3
+		FROM recipes
+		WHERE id = $4 AND hidden_at IS NULL
+		RETURNING id`,
+		name, userID, time.Now().UTC(), recipeID,
+	).Scan(&forkID)
+	if err == sql.ErrNoRows {
+		return Recipe{}, nil, errors.NewNotFoundError("Recipe not found")
+	}
+	if err != nil {
+		return Recipe{}, nil, errors.NewInternalServerError("Failed to fork recipe", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO recipe_ingredients (recipe_id, ingredient_id, quantity, unit, notes)
+		SELECT $1, ingredient_id, quantity, unit, notes FROM recipe_ingredients WHERE recipe_id = $2`,
+		forkID, recipeID,
+	)
+	if err != nil {
+		return Recipe{}, nil, errors.NewInternalServerError("Failed to copy ingredients", err)
+	}
+
+	if _, err := recordRevision(tx, forkID, userID, fmt.Sprintf("Forked from recipe %d", recipeID), 0, time.Now().UTC()); err != nil {
+		return Recipe{}, nil, errors.NewInternalServerError("Failed to record revision", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Recipe{}, nil, errors.NewInternalServerError("Failed to fork recipe", err)
+	}
+
+	return s.recipeDetailsWithIngredientsRetriever(forkID, userID)
+}
+
+// forksRetriever lists the visible direct forks of a recipe, newest first.
+func (s *RecipesService) forksRetriever(recipeID, limit, offset int, userID string) ([]RecipeFork, int, error) {
+	exists, err := s.recipeExists(recipeID)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+	if !exists {
+		return nil, 0, errors.NewNotFoundError("Recipe not found")
+	}
+
+	var total int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM recipes WHERE forked_from = $1 AND hidden_at IS NULL", recipeID).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT r.id, r.name, r.category, r.prep_time_minutes, r.cook_time_minutes,
+			r.servings, r.difficulty, r.instructions, r.description,
+			CASE WHEN r.rating_count > 0 THEN r.rating_sum * 1.0 / r.rating_count ELSE 0 END as average_rating, r.rating_count,
+			CASE WHEN ulr.user_id IS NOT NULL THEN 1 ELSE 0 END as is_liked,
+			r.forked_from, u.username, r.created_at
+		FROM recipes r
+		LEFT JOIN user_liked_recipes ulr ON r.id = ulr.recipe_id AND ulr.user_id = $1
+		LEFT JOIN users u ON u.id = r.author_id
+		WHERE r.forked_from = $2 AND r.hidden_at IS NULL
+		ORDER BY r.created_at DESC, r.id DESC
+		LIMIT $3 OFFSET $4`,
+		userID, recipeID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	forks := []RecipeFork{}
+	for rows.Next() {
+		var fork RecipeFork
+		var forkedFrom sql.NullInt64
+		var author sql.NullString
+		err := rows.Scan(&fork.ID, &fork.Name, &fork.Category, &fork.PrepTimeMinutes, &fork.CookTimeMinutes,
+			&fork.Servings, &fork.Difficulty, &fork.Instructions, &fork.Description,
+			&fork.AverageRating, &fork.RatingCount, &fork.IsLiked, &forkedFrom, &author, &fork.CreatedAt)
+		if err != nil {
+			return nil, 0, errors.NewInternalServerError("Data scanning error", err)
+		}
+		if forkedFrom.Valid {
+			id := int(forkedFrom.Int64)
+			fork.ForkedFrom = &id
+		}
+		fork.Author = author.String
+		forks = append(forks, fork)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return forks, total, nil
+}
@@ -3,9 +3,11 @@ package recipes
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/ngthecoder/go_web_api/internal/auth"
 	"github.com/ngthecoder/go_web_api/internal/errors"
 )
 
@@ -40,6 +42,7 @@ func (h *RecipesHandler) AllRecipesHandler(w http.ResponseWriter, r *http.Reques
 	validSorts := map[string]bool{
 		"name": true, "prep_time": true, "cook_time": true,
 		"total_time": true, "servings": true, "difficulty": true,
+		"rating": true, "popular": true, "trending": true,
 	}
 	if sort == "" || !validSorts[sort] {
 		sort = "name"
@@ -47,6 +50,9 @@ func (h *RecipesHandler) AllRecipesHandler(w http.ResponseWriter, r *http.Reques
 
 	if order != "asc" && order != "desc" {
 		order = "asc"
+		if sort == "rating" || sort == "popular" || sort == "trending" {
+			order = "desc"
+		}
 	}
 
 	page := 1
@@ -98,6 +104,45 @@ func (h *RecipesHandler) AllRecipesHandler(w http.ResponseWriter, r *http.Reques
 }
 
 func (h *RecipesHandler) RecipeDetailHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) == 5 && pathParts[4] == "reviews" {
+		h.ReviewsHandler(w, r)
+		return
+	}
+	if len(pathParts) >= 5 && pathParts[4] == "comments" {
+		h.CommentsHandler(w, r)
+		return
+	}
+	if len(pathParts) == 5 && pathParts[4] == "similar" {
+		h.SimilarRecipesHandler(w, r)
+		return
+	}
+	if len(pathParts) == 5 && pathParts[4] == "fork" {
+		h.ForkRecipeHandler(w, r)
+		return
+	}
+	if len(pathParts) == 5 && pathParts[4] == "forks" {
+		h.ForksHandler(w, r)
+		return
+	}
+	if len(pathParts) == 5 && pathParts[4] == "notes" {
+		h.NotesHandler(w, r)
+		return
+	}
+	if len(pathParts) >= 5 && pathParts[4] == "revisions" {
+		h.RevisionsHandler(w, r)
+		return
+	}
+	if len(pathParts) == 4 && r.Method == http.MethodPut {
+		h.UpdateRecipeHandler(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
 	idStr := r.URL.Path[len("/api/recipes/"):]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
@@ -116,18 +161,46 @@ func (h *RecipesHandler) RecipeDetailHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	// Personal notes are private, so API keys never see them.
 	resp := RecipeWithIngredients{Recipe: recipe, Ingredients: ingredients}
+	if sessionUserID := auth.SessionUserID(r); sessionUserID != "" {
+		notes, found, err := h.recipesService.personalNotesRetriever(sessionUserID, id)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+		if found {
+			applyTweaks(resp.Ingredients, notes.Tweaks)
+			resp.PersonalNotes = &notes
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+// FindRecipesByIngredientsHandler matches recipes against the given
+// ingredients. With pantry=true the caller's unexpired pantry items are
+// matched as well, and ingredients may be left out. The pantry is private, so
+// pantry=true needs a signed-in session rather than an API key.
 func (h *RecipesHandler) FindRecipesByIngredientsHandler(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 	ingredientsParams := query.Get("ingredients")
 	matchType := query.Get("match_type")
 	limitParams := query.Get("limit")
+	usePantry := query.Get("pantry") == "true"
+
+	userID := ""
+	if userIDValue := r.Context().Value("user_id"); userIDValue != nil {
+		userID = userIDValue.(string)
+	}
 
-	if ingredientsParams == "" {
+	if usePantry && auth.SessionUserID(r) == "" {
+		errors.WriteHTTPError(w, errors.NewUnauthorizedError("Authentication required"))
+		return
+	}
+
+	if ingredientsParams == "" && !usePantry {
 		errors.WriteHTTPError(w, errors.NewBadRequestError("Missing required parameters: ingredients"))
 		return
 	}
@@ -145,21 +218,39 @@ func (h *RecipesHandler) FindRecipesByIngredientsHandler(w http.ResponseWriter,
 
 	ingredientIDStrings := strings.Split(ingredientsParams, ",")
 	ingredientIDs := make([]int, 0, len(ingredientIDStrings))
+	seen := make(map[int]struct{}, len(ingredientIDStrings))
 
-	for _, idStr := range ingredientIDStrings {
-		if id, err := strconv.Atoi(strings.TrimSpace(idStr)); err == nil {
-			ingredientIDs = append(ingredientIDs, id)
+	if ingredientsParams != "" {
+		for _, idStr := range ingredientIDStrings {
+			if id, err := strconv.Atoi(strings.TrimSpace(idStr)); err == nil {
+				ingredientIDs = append(ingredientIDs, id)
+				seen[id] = struct{}{}
+			}
 		}
-	}
 
-	if len(ingredientIDs) == 0 {
-		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid ingredient IDs"))
-		return
+		if len(ingredientIDs) == 0 {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid ingredient IDs"))
+			return
+		}
 	}
 
-	userID := ""
-	if userIDValue := r.Context().Value("user_id"); userIDValue != nil {
-		userID = userIDValue.(string)
+	if usePantry {
+		pantry, err := h.recipesService.pantryRetriever(userID)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+		for id := range pantry {
+			if _, ok := seen[id]; !ok {
+				ingredientIDs = append(ingredientIDs, id)
+			}
+		}
+		sort.Ints(ingredientIDs)
+
+		if len(ingredientIDs) == 0 {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Your pantry is empty"))
+			return
+		}
 	}
 
 	matchedRecipes, err := h.recipesService.matchedRecipesRetriever(matchType, ingredientIDs, limit, userID)
@@ -172,6 +263,10 @@ func (h *RecipesHandler) FindRecipesByIngredientsHandler(w http.ResponseWriter,
 	json.NewEncoder(w).Encode(matchedRecipes)
 }
 
+// ShoppingListHandler lists what to buy for a recipe. Ingredients named in
+// have_ingredients are left out entirely; with pantry=true the quantities in
+// the caller's pantry are taken off instead, which needs a signed-in session.
+// The two cannot be combined.
 func (h *RecipesHandler) ShoppingListHandler(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
 	if len(pathParts) < 5 || pathParts[4] == "" {
@@ -185,7 +280,18 @@ func (h *RecipesHandler) ShoppingListHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	usePantry := r.URL.Query().Get("pantry") == "true"
+	userID := auth.SessionUserID(r)
+	if usePantry && userID == "" {
+		errors.WriteHTTPError(w, errors.NewUnauthorizedError("Authentication required"))
+		return
+	}
+
 	haveIngredientsStr := r.URL.Query().Get("have_ingredients")
+	if usePantry && haveIngredientsStr != "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("have_ingredients cannot be combined with pantry=true"))
+		return
+	}
 	haveIngredientIDs := make(map[int]struct{})
 	if haveIngredientsStr != "" {
 		ids := strings.Split(haveIngredientsStr, ",")
@@ -203,9 +309,620 @@ func (h *RecipesHandler) ShoppingListHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	if usePantry {
+		pantry, err := h.recipesService.pantryRetriever(userID)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+		shoppingList = subtractPantry(shoppingList, pantry)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"recipe_id":     recipeID,
 		"shopping_list": shoppingList,
 	})
 }
+
+// ReviewsHandler serves /api/recipes/{id}/reviews: GET lists reviews, PUT
+// creates or replaces the caller's review and DELETE removes it.
+func (h *RecipesHandler) ReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	recipeID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid recipe ID"))
+		return
+	}
+
+	userID := ""
+	if userIDValue := r.Context().Value("user_id"); userIDValue != nil {
+		userID = userIDValue.(string)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+
+		page := 1
+		limit := 10
+		if p, err := strconv.Atoi(query.Get("page")); err == nil && p > 0 {
+			page = p
+		}
+		if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+
+		reviews, total, err := h.recipesService.reviewsRetriever(recipeID, query.Get("sort"), limit, (page-1)*limit)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		totalPages := (total + limit - 1) / limit
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"reviews":     reviews,
+			"total":       total,
+			"page":        page,
+			"page_size":   limit,
+			"total_pages": totalPages,
+			"has_next":    page < totalPages,
+		})
+
+	case http.MethodPut:
+		if userID == "" {
+			errors.WriteHTTPError(w, errors.NewUnauthorizedError("Authentication required"))
+			return
+		}
+
+		var request ReviewRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+
+		review, created, err := h.recipesService.upsertReview(userID, recipeID, request.Rating, strings.TrimSpace(request.Review))
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		json.NewEncoder(w).Encode(review)
+
+	case http.MethodDelete:
+		if userID == "" {
+			errors.WriteHTTPError(w, errors.NewUnauthorizedError("Authentication required"))
+			return
+		}
+
+		if err := h.recipesService.deleteReview(userID, recipeID); err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Review deleted"})
+
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+	}
+}
+
+// CommentsHandler serves /api/recipes/{id}/comments, where GET lists comments
+// and POST adds one, and /api/recipes/{id}/comments/{commentID}, where PUT
+// edits the caller's comment and DELETE removes it.
+func (h *RecipesHandler) CommentsHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	recipeID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid recipe ID"))
+		return
+	}
+
+	commentID := ""
+	if len(pathParts) == 6 {
+		commentID = pathParts[5]
+	}
+	if len(pathParts) > 6 || (len(pathParts) == 6 && commentID == "") {
+		errors.WriteHTTPError(w, errors.NewNotFoundError("Not found"))
+		return
+	}
+
+	userID := ""
+	if userIDValue := r.Context().Value("user_id"); userIDValue != nil {
+		userID = userIDValue.(string)
+	}
+	if r.Method != http.MethodGet && userID == "" {
+		errors.WriteHTTPError(w, errors.NewUnauthorizedError("Authentication required"))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && commentID == "":
+		query := r.URL.Query()
+
+		page := 1
+		limit := 20
+		if p, err := strconv.Atoi(query.Get("page")); err == nil && p > 0 {
+			page = p
+		}
+		if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+
+		sort := query.Get("sort")
+		if sort != CommentSortNewest {
+			sort = CommentSortThread
+		}
+
+		comments, total, err := h.recipesService.commentsRetriever(recipeID, sort, limit, (page-1)*limit)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		totalPages := (total + limit - 1) / limit
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"comments":    comments,
+			"sort":        sort,
+			"total":       total,
+			"page":        page,
+			"page_size":   limit,
+			"total_pages": totalPages,
+			"has_next":    page < totalPages,
+		})
+
+	case r.Method == http.MethodPost && commentID == "":
+		var request CommentRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+
+		comment, err := h.recipesService.createComment(userID, recipeID, request.ParentID, strings.TrimSpace(request.Body))
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(comment)
+
+	case r.Method == http.MethodPut && commentID != "":
+		var request CommentRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+
+		comment, err := h.recipesService.editComment(userID, recipeID, commentID, strings.TrimSpace(request.Body))
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(comment)
+
+	case r.Method == http.MethodDelete && commentID != "":
+		if err := h.recipesService.deleteComment(userID, recipeID, commentID); err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Comment deleted"})
+
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+	}
+}
+
+// RecommendationsHandler serves GET /api/user/recommendations, recipes the
+// caller has not liked yet but probably would.
+func (h *RecipesHandler) RecommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	userID := r.Context().Value("user_id").(string)
+
+	limit := 10
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 50 {
+		limit = l
+	}
+
+	recommendations, err := h.recipesService.recommendationsRetriever(userID, limit)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recommendations": recommendations,
+	})
+}
+
+// SimilarRecipesHandler serves GET /api/recipes/{id}/similar, the recipes
+// most like this one with the ingredients they share.
+func (h *RecipesHandler) SimilarRecipesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	recipeID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid recipe ID"))
+		return
+	}
+
+	limit := 5
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 20 {
+		limit = l
+	}
+
+	userID := ""
+	if userIDValue := r.Context().Value("user_id"); userIDValue != nil {
+		userID = userIDValue.(string)
+	}
+
+	similar, err := h.recipesService.similarRecipesRetriever(recipeID, limit, userID)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recipe_id": recipeID,
+		"similar":   similar,
+	})
+}
+
+// ForkRecipeHandler serves POST /api/recipes/{id}/fork, which copies a recipe
+// into a new one owned by the caller.
+func (h *RecipesHandler) ForkRecipeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	recipeID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid recipe ID"))
+		return
+	}
+
+	var request ForkRecipeRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+	}
+
+	recipe, ingredients, err := h.recipesService.forkRecipe(r.Context().Value("user_id").(string), recipeID, request)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(RecipeWithIngredients{Recipe: recipe, Ingredients: ingredients})
+}
+
+// ForksHandler serves GET /api/recipes/{id}/forks, a page of the recipes
+// forked from this one.
+func (h *RecipesHandler) ForksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	recipeID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid recipe ID"))
+		return
+	}
+
+	query := r.URL.Query()
+	page := 1
+	if p, err := strconv.Atoi(query.Get("page")); err == nil && p > 0 {
+		page = p
+	}
+	limit := 10
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 50 {
+		limit = l
+	}
+
+	userID := ""
+	if userIDValue := r.Context().Value("user_id"); userIDValue != nil {
+		userID = userIDValue.(string)
+	}
+
+	forks, total, err := h.recipesService.forksRetriever(recipeID, limit, (page-1)*limit, userID)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	totalPages := (total + limit - 1) / limit
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recipe_id":   recipeID,
+		"forks":       forks,
+		"total":       total,
+		"page":        page,
+		"page_size":   limit,
+		"total_pages": totalPages,
+		"has_next":    page < totalPages,
+	})
+}
+
+// NotesHandler serves /api/recipes/{id}/notes, the caller's private note and
+// ingredient tweaks for a recipe. GET returns them, PUT replaces them and
+// DELETE removes them.
+func (h *RecipesHandler) NotesHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	recipeID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid recipe ID"))
+		return
+	}
+
+	userID := auth.SessionUserID(r)
+	if userID == "" {
+		errors.WriteHTTPError(w, errors.NewUnauthorizedError("Authentication required"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		exists, err := h.recipesService.recipeExists(recipeID)
+		if err != nil {
+			errors.WriteHTTPError(w, errors.NewInternalServerError("Database error", err))
+			return
+		}
+		if !exists {
+			errors.WriteHTTPError(w, errors.NewNotFoundError("Recipe not found"))
+			return
+		}
+
+		notes, _, err := h.recipesService.personalNotesRetriever(userID, recipeID)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notes)
+
+	case http.MethodPut:
+		var request RecipeNotesRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+
+		notes, err := h.recipesService.saveNotes(userID, recipeID, request)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notes)
+
+	case http.MethodDelete:
+		if err := h.recipesService.deleteNotes(userID, recipeID); err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Notes deleted"})
+
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+	}
+}
+
+// UpdateRecipeHandler serves PUT /api/recipes/{id}, which replaces a recipe's
+// content and ingredients. Only the author or an editor may do this.
+func (h *RecipesHandler) UpdateRecipeHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	recipeID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid recipe ID"))
+		return
+	}
+
+	var request UpdateRecipeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+		return
+	}
+
+	role, _ := r.Context().Value("role").(string)
+	recipe, ingredients, err := h.recipesService.updateRecipe(r.Context().Value("user_id").(string), role, recipeID, request)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecipeWithIngredients{Recipe: recipe, Ingredients: ingredients})
+}
+
+// RevisionsHandler serves a recipe's revision history:
+// GET /api/recipes/{id}/revisions lists revisions,
+// GET /api/recipes/{id}/revisions/{revision} shows one,
+// GET /api/recipes/{id}/revisions/diff?from=&to= compares two and
+// POST /api/recipes/{id}/revisions/{revision}/revert restores one.
+func (h *RecipesHandler) RevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	recipeID, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid recipe ID"))
+		return
+	}
+
+	if len(pathParts) == 7 && pathParts[6] == "revert" {
+		if r.Method != http.MethodPost {
+			errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+			return
+		}
+		revision, err := strconv.Atoi(pathParts[5])
+		if err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid revision"))
+			return
+		}
+
+		role, _ := r.Context().Value("role").(string)
+		reverted, err := h.recipesService.revertRecipe(r.Context().Value("user_id").(string), role, recipeID, revision)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(reverted)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	switch {
+	case len(pathParts) == 5:
+		query := r.URL.Query()
+		page := 1
+		if p, err := strconv.Atoi(query.Get("page")); err == nil && p > 0 {
+			page = p
+		}
+		limit := 20
+		if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+
+		revisions, total, err := h.recipesService.revisionsRetriever(recipeID, limit, (page-1)*limit)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		totalPages := (total + limit - 1) / limit
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"recipe_id":   recipeID,
+			"revisions":   revisions,
+			"total":       total,
+			"page":        page,
+			"page_size":   limit,
+			"total_pages": totalPages,
+			"has_next":    page < totalPages,
+		})
+
+	case len(pathParts) == 6 && pathParts[5] == "diff":
+		from, fromErr := strconv.Atoi(r.URL.Query().Get("from"))
+		to, toErr := strconv.Atoi(r.URL.Query().Get("to"))
+		if fromErr != nil || toErr != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("from and to must be revision numbers"))
+			return
+		}
+
+		diff, err := h.recipesService.revisionDiffRetriever(recipeID, from, to)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diff)
+
+	case len(pathParts) == 6:
+		revisionNumber, err := strconv.Atoi(pathParts[5])
+		if err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid revision"))
+			return
+		}
+
+		revision, err := h.recipesService.revisionRetriever(recipeID, revisionNumber)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(revision)
+
+	default:
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/recipes/{id}/revisions"))
+	}
+}
+
+// TrendingRecipesHandler serves GET /api/recipes/trending, the most liked
+// recipes over the last day, week or all time.
+func (h *RecipesHandler) TrendingRecipesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	query := r.URL.Query()
+	window := query.Get("window")
+	if window == "" {
+		window = TrendingWindowWeek
+	}
+	if !IsValidTrendingWindow(window) {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid window, must be 24h, 7d or all"))
+		return
+	}
+
+	limit := 10
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 50 {
+		limit = l
+	}
+
+	userID := ""
+	if userIDValue := r.Context().Value("user_id"); userIDValue != nil {
+		userID = userIDValue.(string)
+	}
+
+	trending, err := h.recipesService.trendingRecipesRetriever(window, limit, userID)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"window":   window,
+		"trending": trending,
+	})
+}
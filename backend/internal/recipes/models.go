@@ -1,16 +1,21 @@
 package recipes
 
+import "time"
+
 type Recipe struct {
-	ID              int    `json:"id"`
-	Name            string `json:"name"`
-	Category        string `json:"category"`
-	PrepTimeMinutes int    `json:"prep_time_minutes"`
-	CookTimeMinutes int    `json:"cook_time_minutes"`
-	Servings        int    `json:"servings"`
-	Difficulty      string `json:"difficulty"`
-	Instructions    string `json:"instructions"`
-	Description     string `json:"description"`
-	IsLiked         bool   `json:"is_liked"`
+	ID              int     `json:"id"`
+	Name            string  `json:"name"`
+	Category        string  `json:"category"`
+	PrepTimeMinutes int     `json:"prep_time_minutes"`
+	CookTimeMinutes int     `json:"cook_time_minutes"`
+	Servings        int     `json:"servings"`
+	Difficulty      string  `json:"difficulty"`
+	Instructions    string  `json:"instructions"`
+	Description     string  `json:"description"`
+	AverageRating   float64 `json:"average_rating"`
+	RatingCount     int     `json:"rating_count"`
+	IsLiked         bool    `json:"is_liked"`
+	ForkedFrom      *int    `json:"forked_from,omitempty"`
 }
 
 type IngredientWithQuantity struct {
@@ -19,11 +24,52 @@ type IngredientWithQuantity struct {
 	Quantity     float64 `json:"quantity"`
 	Unit         string  `json:"unit"`
 	Notes        string  `json:"notes"`
+	// Effective is what the ingredient becomes under the caller's tweaks.
+	Effective *EffectiveIngredient `json:"effective,omitempty"`
+	// InPantry is how much of the ingredient the caller has on hand, set on
+	// shopping lists built from their pantry.
+	InPantry *PantryStock `json:"in_pantry,omitempty"`
+}
+
+type EffectiveIngredient struct {
+	IngredientID int     `json:"ingredient_id"`
+	Name         string  `json:"name"`
+	Quantity     float64 `json:"quantity"`
+	Unit         string  `json:"unit"`
+}
+
+type PantryStock struct {
+	Quantity float64 `json:"quantity"`
+	Unit     string  `json:"unit"`
 }
 
 type RecipeWithIngredients struct {
-	Recipe      Recipe                   `json:"recipe"`
-	Ingredients []IngredientWithQuantity `json:"ingredients"`
+	Recipe        Recipe                   `json:"recipe"`
+	Ingredients   []IngredientWithQuantity `json:"ingredients"`
+	PersonalNotes *RecipeNotes             `json:"personal_notes,omitempty"`
+}
+
+// IngredientTweak changes one of a recipe's ingredients for a single user:
+// its quantity, its unit, or the ingredient itself.
+type IngredientTweak struct {
+	IngredientID           int      `json:"ingredient_id"`
+	Quantity               *float64 `json:"quantity,omitempty"`
+	Unit                   string   `json:"unit,omitempty"`
+	SubstituteIngredientID *int     `json:"substitute_ingredient_id,omitempty"`
+	SubstituteName         string   `json:"substitute_name,omitempty"`
+}
+
+// RecipeNotes is a user's private note and ingredient tweaks for a recipe.
+type RecipeNotes struct {
+	RecipeID  int               `json:"recipe_id"`
+	Note      string            `json:"note"`
+	Tweaks    []IngredientTweak `json:"tweaks"`
+	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
+}
+
+type RecipeNotesRequest struct {
+	Note   string            `json:"note"`
+	Tweaks []IngredientTweak `json:"tweaks"`
 }
 
 type MatchedRecipe struct {
@@ -41,3 +87,155 @@ type MatchedRecipe struct {
 	MatchScore              float32 `json:"match_score"`
 	IsLiked                 bool    `json:"is_liked"`
 }
+
+type Review struct {
+	ID        string    `json:"id"`
+	RecipeID  int       `json:"recipe_id"`
+	Username  string    `json:"username"`
+	Rating    int       `json:"rating"`
+	Review    string    `json:"review"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Comment struct {
+	ID        string     `json:"id"`
+	RecipeID  int        `json:"recipe_id"`
+	ParentID  *string    `json:"parent_id"`
+	Username  string     `json:"username,omitempty"`
+	Body      string     `json:"body"`
+	Deleted   bool       `json:"deleted"`
+	Hidden    bool       `json:"hidden,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	Replies   []Comment  `json:"replies,omitempty"`
+}
+
+type CommentRequest struct {
+	ParentID string `json:"parent_id"`
+	Body     string `json:"body"`
+}
+
+type ForkRecipeRequest struct {
+	Name string `json:"name"`
+}
+
+// RecipeFork is a recipe forked from another, with who forked it and when.
+type RecipeFork struct {
+	Recipe
+	Author    string    `json:"author,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UpdateRecipeRequest replaces a recipe's content and ingredients. Summary
+// describes the change in the revision history.
+type UpdateRecipeRequest struct {
+	Name            string                  `json:"name"`
+	Category        string                  `json:"category"`
+	PrepTimeMinutes int                     `json:"prep_time_minutes"`
+	CookTimeMinutes int                     `json:"cook_time_minutes"`
+	Servings        int                     `json:"servings"`
+	Difficulty      string                  `json:"difficulty"`
+	Instructions    string                  `json:"instructions"`
+	Description     string                  `json:"description"`
+	Ingredients     []RecipeIngredientInput `json:"ingredients"`
+	Summary         string                  `json:"summary"`
+}
+
+type RecipeIngredientInput struct {
+	IngredientID int     `json:"ingredient_id"`
+	Quantity     float64 `json:"quantity"`
+	Unit         string  `json:"unit"`
+	Notes        string  `json:"notes"`
+}
+
+// RecipeSnapshot is a recipe's content as stored in a revision.
+type RecipeSnapshot struct {
+	Name            string               `json:"name"`
+	Category        string               `json:"category"`
+	PrepTimeMinutes int                  `json:"prep_time_minutes"`
+	CookTimeMinutes int                  `json:"cook_time_minutes"`
+	Servings        int                  `json:"servings"`
+	Difficulty      string               `json:"difficulty"`
+	Instructions    string               `json:"instructions"`
+	Description     string               `json:"description"`
+	Ingredients     []SnapshotIngredient `json:"ingredients"`
+}
+
+type SnapshotIngredient struct {
+	IngredientID int     `json:"ingredient_id"`
+	Name         string  `json:"name"`
+	Quantity     float64 `json:"quantity"`
+	Unit         string  `json:"unit"`
+	Notes        string  `json:"notes"`
+}
+
+// RecipeRevision is one saved version of a recipe. Snapshot is only filled
+// in when a single revision is requested.
+type RecipeRevision struct {
+	RecipeID     int             `json:"recipe_id"`
+	Revision     int             `json:"revision"`
+	Author       string          `json:"author,omitempty"`
+	Summary      string          `json:"summary"`
+	RevertedFrom *int            `json:"reverted_from,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+	Snapshot     *RecipeSnapshot `json:"snapshot,omitempty"`
+}
+
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+type IngredientChange struct {
+	IngredientID int                `json:"ingredient_id"`
+	Name         string             `json:"name"`
+	From         SnapshotIngredient `json:"from"`
+	To           SnapshotIngredient `json:"to"`
+}
+
+type RevisionDiff struct {
+	RecipeID           int                  `json:"recipe_id"`
+	From               int                  `json:"from"`
+	To                 int                  `json:"to"`
+	Fields             []FieldChange        `json:"fields"`
+	IngredientsAdded   []SnapshotIngredient `json:"ingredients_added"`
+	IngredientsRemoved []SnapshotIngredient `json:"ingredients_removed"`
+	IngredientsChanged []IngredientChange   `json:"ingredients_changed"`
+}
+
+type ReviewRequest struct {
+	Rating int    `json:"rating"`
+	Review string `json:"review"`
+}
+
+type Recommendation struct {
+	Recipe Recipe  `json:"recipe"`
+	Score  float64 `json:"score"`
+	Reason string  `json:"reason"`
+}
+
+type SharedIngredient struct {
+	IngredientID int    `json:"ingredient_id"`
+	Name         string `json:"name"`
+}
+
+type SimilarRecipe struct {
+	Recipe            Recipe             `json:"recipe"`
+	Score             float64            `json:"score"`
+	SharedIngredients []SharedIngredient `json:"shared_ingredients"`
+}
+
+// LikeCounts are a recipe's likes over each trending window.
+type LikeCounts struct {
+	Day     int `json:"24h"`
+	Week    int `json:"7d"`
+	AllTime int `json:"all"`
+}
+
+type TrendingRecipe struct {
+	Recipe        Recipe     `json:"recipe"`
+	Likes         LikeCounts `json:"likes"`
+	TrendingScore float64    `json:"trending_score"`
+}
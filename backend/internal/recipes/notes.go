@@ -0,0 +1,259 @@
+package recipes
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+const maxRecipeNoteLength = 2000
+
+// personalNotesRetriever returns the caller's note and ingredient tweaks for
+// a recipe, and whether they have any. Tweaks to ingredients the recipe no
+// longer uses are left out.
+func (s *RecipesService) personalNotesRetriever(userID string, recipeID int) (RecipeNotes, bool, error) {
+	notes := RecipeNotes{RecipeID: recipeID, Tweaks: []IngredientTweak{}}
+	var updatedAt time.Time
+	err := s.db.QueryRow(
+		"SELECT note, updated_at FROM recipe_notes WHERE user_id = $1 AND recipe_id = $2",
+		userID, recipeID,
+	).Scan(&notes.Note, &updatedAt)
+	if err == sql.ErrNoRows {
+		return notes, false, nil
+	}
+	if err != nil {
+		return RecipeNotes{}, false, errors.NewInternalServerError("Database error", err)
+	}
+	notes.UpdatedAt = &updatedAt
+
+	rows, err := s.db.Query(`
+		SELECT t.ingredient_id, t.quantity, t.unit, t.substitute_ingredient_id, sub.name
+		FROM recipe_ingredient_tweaks t
+		JOIN recipe_ingredients ri ON ri.recipe_id = t.recipe_id AND ri.ingredient_id = t.ingredient_id
+		LEFT JOIN ingredients sub ON sub.id = t.substitute_ingredient_id
+		WHERE t.user_id = $1 AND t.recipe_id = $2
+		ORDER BY t.ingredient_id`,
+		userID, recipeID,
+	)
+	if err != nil {
+		return RecipeNotes{}, false, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tweak IngredientTweak
+		var quantity sql.NullFloat64
+		var unit, substituteName sql.NullString
+		var substituteID sql.NullInt64
+		if err := rows.Scan(&tweak.IngredientID, &quantity, &unit, &substituteID, &substituteName); err != nil {
+			return RecipeNotes{}, false, errors.NewInternalServerError("Data scanning error", err)
+		}
+		if quantity.Valid {
+			tweak.Quantity = &quantity.Float64
+		}
+		tweak.Unit = unit.String
+		if substituteID.Valid {
+			id := int(substituteID.Int64)
+			tweak.SubstituteIngredientID = &id
+			tweak.SubstituteName = substituteName.String
+		}
+		notes.Tweaks = append(notes.Tweaks, tweak)
+	}
+	if err := rows.Err(); err != nil {
+		return RecipeNotes{}, false, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return notes, true, nil
+}
+
+// saveNotes replaces the caller's note and tweaks for a recipe. Saving an
+// empty note with no tweaks removes them.
+func (s *RecipesService) saveNotes(userID string, recipeID int, request RecipeNotesRequest) (RecipeNotes, error) {
+	note := strings.TrimSpace(request.Note)
+	if utf8.RuneCountInString(note) > maxRecipeNoteLength {
+		return RecipeNotes{}, errors.NewValidationError("Invalid notes", []errors.FieldError{
+			{Field: "note", Code: "too_long", Message: fmt.Sprintf("Note must be at most %d characters", maxRecipeNoteLength)},
+		})
+	}
+
+	exists, err := s.recipeExists(recipeID)
+	if err != nil {
+		return RecipeNotes{}, errors.NewInternalServerError("Database error", err)
+	}
+	if !exists {
+		return RecipeNotes{}, errors.NewNotFoundError("Recipe not found")
+	}
+
+	if err := s.validateTweaks(recipeID, request.Tweaks); err != nil {
+		return RecipeNotes{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return RecipeNotes{}, errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recipe_ingredient_tweaks WHERE user_id = $1 AND recipe_id = $2", userID, recipeID); err != nil {
+		return RecipeNotes{}, errors.NewInternalServerError("Failed to save notes", err)
+	}
+
+	if note == "" && len(request.Tweaks) == 0 {
+		if _, err := tx.Exec("DELETE FROM recipe_notes WHERE user_id = $1 AND recipe_id = $2", userID, recipeID); err != nil {
+			return RecipeNotes{}, errors.NewInternalServerError("Failed to save notes", err)
+		}
+	} else {
+		_, err = tx.Exec(
+			`INSERT INTO recipe_notes (user_id, recipe_id, note, updated_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, recipe_id) DO UPDATE SET note = EXCLUDED.note, updated_at = EXCLUDED.updated_at`,
+			userID, recipeID, note, time.Now().UTC(),
+		)
+		if err != nil {
+			return RecipeNotes{}, errors.NewInternalServerError("Failed to save notes", err)
+		}
+
+		for _, tweak := range request.Tweaks {
+			var quantity sql.NullFloat64
+			if tweak.Quantity != nil {
+				quantity = sql.NullFloat64{Float64: *tweak.Quantity, Valid: true}
+			}
+			var substituteID sql.NullInt64
+			if tweak.SubstituteIngredientID != nil {
+				substituteID = sql.NullInt64{Int64: int64(*tweak.SubstituteIngredientID), Valid: true}
+			}
+			unit := strings.TrimSpace(tweak.Unit)
+			_, err := tx.Exec(
+				`INSERT INTO recipe_ingredient_tweaks (user_id, recipe_id, ingredient_id, quantity, unit, substitute_ingredient_id)
+				VALUES ($1, $2, $3, $4, $5, $6)`,
+				userID, recipeID, tweak.IngredientID, quantity, sql.NullString{String: unit, Valid: unit != ""}, substituteID,
+			)
+			if err != nil {
+				return RecipeNotes{}, errors.NewInternalServerError("Failed to save notes", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return RecipeNotes{}, errors.NewInternalServerError("Failed to save notes", err)
+	}
+
+	notes, _, err := s.personalNotesRetriever(userID, recipeID)
+	return notes, err
+}
+
+// validateTweaks checks that each tweak changes an ingredient of the recipe,
+// at most once, and that substitutes are real ingredients.
+func (s *RecipesService) validateTweaks(recipeID int, tweaks []IngredientTweak) error {
+	used := make(map[int]bool)
+	rows, err := s.db.Query("SELECT ingredient_id FROM recipe_ingredients WHERE recipe_id = $1", recipeID)
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return errors.NewInternalServerError("Data scanning error", err)
+		}
+		used[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	var fields []errors.FieldError
+	seen := make(map[int]bool, len(tweaks))
+	for i, tweak := range tweaks {
+		field := fmt.Sprintf("tweaks[%d]", i)
+		switch {
+		case !used[tweak.IngredientID]:
+			fields = append(fields, errors.FieldError{Field: field, Code: "not_in_recipe", Message: fmt.Sprintf("Ingredient %d is not in this recipe", tweak.IngredientID)})
+		case seen[tweak.IngredientID]:
+			fields = append(fields, errors.FieldError{Field: field, Code: "duplicate", Message: fmt.Sprintf("Ingredient %d is tweaked more than once", tweak.IngredientID)})
+		case tweak.Quantity == nil && strings.TrimSpace(tweak.Unit) == "" && tweak.SubstituteIngredientID == nil:
+			fields = append(fields, errors.FieldError{Field: field, Code: "empty", Message: "A tweak must change the quantity, unit or ingredient"})
+		case tweak.Quantity != nil && *tweak.Quantity <= 0:
+			fields = append(fields, errors.FieldError{Field: field, Code: "out_of_range", Message: "Quantity must be positive"})
+		case tweak.SubstituteIngredientID != nil && *tweak.SubstituteIngredientID == tweak.IngredientID:
+			fields = append(fields, errors.FieldError{Field: field, Code: "invalid", Message: "An ingredient cannot be swapped for itself"})
+		case tweak.SubstituteIngredientID != nil:
+			var exists bool
+			err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM ingredients WHERE id = $1)", *tweak.SubstituteIngredientID).Scan(&exists)
+			if err != nil {
+				return errors.NewInternalServerError("Database error", err)
+			}
+			if !exists {
+				fields = append(fields, errors.FieldError{Field: field, Code: "not_found", Message: fmt.Sprintf("Ingredient %d does not exist", *tweak.SubstituteIngredientID)})
+			}
+		}
+		seen[tweak.IngredientID] = true
+	}
+	if len(fields) > 0 {
+		return errors.NewValidationError("Invalid tweaks", fields)
+	}
+
+	return nil
+}
+
+func (s *RecipesService) deleteNotes(userID string, recipeID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM recipe_notes WHERE user_id = $1 AND recipe_id = $2", userID, recipeID)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to delete notes", err)
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return errors.NewNotFoundError("No notes for this recipe")
+	}
+	if _, err := tx.Exec("DELETE FROM recipe_ingredient_tweaks WHERE user_id = $1 AND recipe_id = $2", userID, recipeID); err != nil {
+		return errors.NewInternalServerError("Failed to delete notes", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.NewInternalServerError("Failed to delete notes", err)
+	}
+
+	return nil
+}
+
+// applyTweaks fills in what each ingredient becomes under the user's tweaks,
+// leaving the original quantities as they are.
+func applyTweaks(ingredients []IngredientWithQuantity, tweaks []IngredientTweak) {
+	byIngredient := make(map[int]IngredientTweak, len(tweaks))
+	for _, tweak := range tweaks {
+		byIngredient[tweak.IngredientID] = tweak
+	}
+
+	for i, ingredient := range ingredients {
+		tweak, ok := byIngredient[ingredient.IngredientID]
+		if !ok {
+			continue
+		}
+		effective := EffectiveIngredient{
+			IngredientID: ingredient.IngredientID,
+			Name:         ingredient.Name,
+			Quantity:     ingredient.Quantity,
+			Unit:         ingredient.Unit,
+		}
+		if tweak.Quantity != nil {
+			effective.Quantity = *tweak.Quantity
+		}
+		if tweak.Unit != "" {
+			effective.Unit = tweak.Unit
+		}
+		if tweak.SubstituteIngredientID != nil {
+			effective.IngredientID = *tweak.SubstituteIngredientID
+			effective.Name = tweak.SubstituteName
+		}
+		ingredients[i].Effective = &effective
+	}
+}
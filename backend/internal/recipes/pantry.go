@@ -0,0 +1,61 @@
+package recipes
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+// pantryRetriever returns what the user has on hand, by ingredient. Expired
+// items are left out.
+func (s *RecipesService) pantryRetriever(userID string) (map[int]PantryStock, error) {
+	rows, err := s.db.Query(
+		"SELECT ingredient_id, quantity, unit FROM pantry_items WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > $2)",
+		userID, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	pantry := make(map[int]PantryStock)
+	for rows.Next() {
+		var ingredientID int
+		var stock PantryStock
+		if err := rows.Scan(&ingredientID, &stock.Quantity, &stock.Unit); err != nil {
+			return nil, errors.NewInternalServerError("Data scanning error", err)
+		}
+		pantry[ingredientID] = stock
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return pantry, nil
+}
+
+// subtractPantry takes what the user already has off a shopping list. An
+// ingredient is dropped once the pantry covers it and otherwise reduced to
+// the amount still needed. Quantities in different units are not converted,
+// so such items are kept whole with the pantry amount shown alongside.
+func subtractPantry(shoppingList []IngredientWithQuantity, pantry map[int]PantryStock) []IngredientWithQuantity {
+	remaining := shoppingList[:0]
+	for _, ingredient := range shoppingList {
+		stock, ok := pantry[ingredient.IngredientID]
+		if !ok {
+			remaining = append(remaining, ingredient)
+			continue
+		}
+
+		if strings.EqualFold(strings.TrimSpace(stock.Unit), strings.TrimSpace(ingredient.Unit)) {
+			if stock.Quantity >= ingredient.Quantity {
+				continue
+			}
+			ingredient.Quantity -= stock.Quantity
+		}
+		ingredient.InPantry = &PantryStock{Quantity: stock.Quantity, Unit: stock.Unit}
+		remaining = append(remaining, ingredient)
+	}
+	return remaining
+}
@@ -0,0 +1,279 @@
+package recipes
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+const (
+	RecommendationReasonSimilarUsers = "liked_by_similar_users"
+	RecommendationReasonIngredients  = "similar_ingredients"
+	RecommendationReasonPopular      = "popular"
+
+	// similarityMinCoLikes is how many users must like both recipes before
+	// the pair counts as similar, so a single user's taste is not taken as
+	// a pattern.
+	similarityMinCoLikes = 2
+	// similarityNeighbours is how many of the most similar recipes are kept
+	// for each recipe.
+	similarityNeighbours = 50
+)
+
+type recipeSimilarity struct {
+	recipeID        int
+	similarRecipeID int
+	score           float64
+}
+
+// RebuildRecipeSimilarities recomputes the item-to-item similarity table
+// used for recommendations from everyone's likes. Two recipes are similar
+// when the same people like them, scored by the cosine of their like
+// vectors. It returns the number of pairs stored.
+func (s *RecipesService) RebuildRecipeSimilarities() (int, error) {
+	likeCounts := make(map[int]int)
+	rows, err := s.db.Query("SELECT recipe_id, COUNT(*) FROM user_liked_recipes GROUP BY recipe_id")
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var recipeID, count int
+		if err := rows.Scan(&recipeID, &count); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		likeCounts[recipeID] = count
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rows, err = s.db.Query(`
+		SELECT a.recipe_id, b.recipe_id, COUNT(*)
+		FROM user_liked_recipes a
+		JOIN user_liked_recipes b ON a.user_id = b.user_id AND a.recipe_id < b.recipe_id
+		GROUP BY a.recipe_id, b.recipe_id
+		HAVING COUNT(*) >= $1`, similarityMinCoLikes,
+	)
+	if err != nil {
+		return 0, err
+	}
+	neighbours := make(map[int][]recipeSimilarity)
+	for rows.Next() {
+		var a, b, coLikes int
+		if err := rows.Scan(&a, &b, &coLikes); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		score := float64(coLikes) / math.Sqrt(float64(likeCounts[a])*float64(likeCounts[b]))
+		neighbours[a] = append(neighbours[a], recipeSimilarity{a, b, score})
+		neighbours[b] = append(neighbours[b], recipeSimilarity{b, a, score})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recipe_similarities"); err != nil {
+		return 0, err
+	}
+
+	stored := 0
+	for _, similar := range neighbours {
+		sort.Slice(similar, func(i, j int) bool {
+			if similar[i].score != similar[j].score {
+				return similar[i].score > similar[j].score
+			}
+			return similar[i].similarRecipeID < similar[j].similarRecipeID
+		})
+		if len(similar) > similarityNeighbours {
+			similar = similar[:similarityNeighbours]
+		}
+		for _, pair := range similar {
+			_, err := tx.Exec(
+				"INSERT INTO recipe_similarities (recipe_id, similar_recipe_id, score) VALUES ($1, $2, $3)",
+				pair.recipeID, pair.similarRecipeID, pair.score,
+			)
+			if err != nil {
+				return 0, err
+			}
+			stored++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return stored, nil
+}
+
+// recommendationSources are tried in order until enough recipes are found.
+// Each query takes the user ID and a limit, leaves out recipes the user
+// already likes, and selects a recipe ID and a score, best first.
+var recommendationSources = []struct {
+	reason string
+	query  string
+}{
+	{
+		// Recipes similar to the ones the user likes, by who else likes them
+		reason: RecommendationReasonSimilarUsers,
+		query: `
+			SELECT rs.similar_recipe_id, SUM(rs.score) AS score
+			FROM user_liked_recipes ulr
+			JOIN recipe_similarities rs ON rs.recipe_id = ulr.recipe_id
+			JOIN recipes r ON r.id = rs.similar_recipe_id
+			WHERE ulr.user_id = $1 AND r.hidden_at IS NULL
+				AND rs.similar_recipe_id NOT IN (SELECT recipe_id FROM user_liked_recipes WHERE user_id = $1)
+			GROUP BY rs.similar_recipe_id
+			ORDER BY score DESC, rs.similar_recipe_id
+			LIMIT $2`,
+	},
+	{
+		// Users with too few likes to have neighbours get recipes sharing
+		// ingredients and categories with what they like
+		reason: RecommendationReasonIngredients,
+		query: `
+			SELECT candidate.id, candidate.score FROM (
+				SELECT r.id,
+					(SELECT COUNT(DISTINCT ri.ingredient_id) FROM recipe_ingredients ri
+						WHERE ri.recipe_id = r.id AND ri.ingredient_id IN (
+							SELECT liked_ri.ingredient_id FROM recipe_ingredients liked_ri
+							JOIN user_liked_recipes ulr ON ulr.recipe_id = liked_ri.recipe_id
+							WHERE ulr.user_id = $1))
+					+ CASE WHEN r.category IN (
+							SELECT liked.category FROM recipes liked
+							JOIN user_liked_recipes ulr ON ulr.recipe_id = liked.id
+							WHERE ulr.user_id = $1) THEN 1 ELSE 0 END AS score
+				FROM recipes r
+				WHERE r.id NOT IN (SELECT recipe_id FROM user_liked_recipes WHERE user_id = $1)
+					AND r.hidden_at IS NULL
+			) AS candidate
+			WHERE candidate.score > 0
+			ORDER BY candidate.score DESC, candidate.id
+			LIMIT $2`,
+	},
+	{
+		// With no likes at all there is nothing to go on but popularity
+		reason: RecommendationReasonPopular,
+		query: `
+			SELECT r.id, COUNT(all_likes.user_id) AS score
+			FROM recipes r
+			LEFT JOIN user_liked_recipes all_likes ON all_likes.recipe_id = r.id
+			WHERE r.id NOT IN (SELECT recipe_id FROM user_liked_recipes WHERE user_id = $1)
+				AND r.hidden_at IS NULL
+			GROUP BY r.id
+			ORDER BY score DESC, r.id
+			LIMIT $2`,
+	},
+}
+
+// recommendationsRetriever suggests recipes the user has not liked yet,
+// preferring those liked by people with similar taste and filling up with
+// content-based and popular picks.
+func (s *RecipesService) recommendationsRetriever(userID string, limit int) ([]Recommendation, error) {
+	var picks []Recommendation
+	picked := make(map[int]bool)
+
+	for _, source := range recommendationSources {
+		if len(picks) >= limit {
+			break
+		}
+
+		// Ask for enough to make up for recipes an earlier source already
+		// picked.
+		rows, err := s.db.Query(source.query, userID, limit+len(picks))
+		if err != nil {
+			return nil, errors.NewInternalServerError("Database error", err)
+		}
+		for rows.Next() && len(picks) < limit {
+			var recipeID int
+			var score float64
+			if err := rows.Scan(&recipeID, &score); err != nil {
+				rows.Close()
+				return nil, errors.NewInternalServerError("Data scanning error", err)
+			}
+			if picked[recipeID] {
+				continue
+			}
+			picked[recipeID] = true
+			picks = append(picks, Recommendation{Recipe: Recipe{ID: recipeID}, Score: score, Reason: source.reason})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, errors.NewInternalServerError("Data scanning error", err)
+		}
+	}
+
+	ids := make([]int, len(picks))
+	for i, pick := range picks {
+		ids[i] = pick.Recipe.ID
+	}
+	recipes, err := s.recipesByIDs(ids, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range picks {
+		picks[i].Recipe = recipes[picks[i].Recipe.ID]
+	}
+
+	if picks == nil {
+		picks = []Recommendation{}
+	}
+	return picks, nil
+}
+
+// recipesByIDs loads the listed recipes as seen by userID, keyed by ID.
+// Hidden recipes are left out.
+func (s *RecipesService) recipesByIDs(ids []int, userID string) (map[int]Recipe, error) {
+	recipes := make(map[int]Recipe, len(ids))
+	if len(ids) == 0 {
+		return recipes, nil
+	}
+
+	args := []interface{}{userID}
+	placeholders := make([]string, len(ids))
+	for i, id := range ids {
+		placeholders[i] = fmt.Sprintf("$%d", i+2)
+		args = append(args, id)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT r.id, r.name, r.category, r.prep_time_minutes, r.cook_time_minutes,
+			r.servings, r.difficulty, r.instructions, r.description,
+			CASE WHEN r.rating_count > 0 THEN r.rating_sum * 1.0 / r.rating_count ELSE 0 END as average_rating, r.rating_count,
+			CASE WHEN ulr.user_id IS NOT NULL THEN 1 ELSE 0 END as is_liked
+		FROM recipes r
+		LEFT JOIN user_liked_recipes ulr ON r.id = ulr.recipe_id AND ulr.user_id = $1
+		WHERE r.id IN (`+strings.Join(placeholders, ", ")+`) AND r.hidden_at IS NULL`, args...)
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var recipe Recipe
+		err := rows.Scan(&recipe.ID, &recipe.Name, &recipe.Category, &recipe.PrepTimeMinutes, &recipe.CookTimeMinutes,
+			&recipe.Servings, &recipe.Difficulty, &recipe.Instructions, &recipe.Description,
+			&recipe.AverageRating, &recipe.RatingCount, &recipe.IsLiked)
+		if err != nil {
+			return nil, errors.NewInternalServerError("Data scanning error", err)
+		}
+		recipes[recipe.ID] = recipe
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return recipes, nil
+}
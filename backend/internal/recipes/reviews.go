@@ -0,0 +1,232 @@
+package recipes
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+const (
+	minRating       = 1
+	maxRating       = 5
+	maxReviewLength = 5000
+
+	// ratingPriorWeight is how many votes of the site-wide average rating
+	// every recipe starts with when sorting by rating, so that a single
+	// 5-star vote does not put a recipe above ones with many good reviews.
+	ratingPriorWeight = 5
+	// defaultPriorRating is used as the site-wide average before any review
+	// has been written.
+	defaultPriorRating = 3.0
+)
+
+// bayesianRatingSQL ranks recipes by their rating pulled towards the
+// site-wide average, weighted by ratingPriorWeight.
+var bayesianRatingSQL = fmt.Sprintf(
+	"((%d * (SELECT COALESCE(AVG(rating), %.1f) FROM recipe_reviews WHERE hidden_at IS NULL)) + r.rating_sum) / (%d.0 + r.rating_count)",
+	ratingPriorWeight, defaultPriorRating, ratingPriorWeight,
+)
+
+func (s *RecipesService) recipeExists(recipeID int) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = $1 AND hidden_at IS NULL)", recipeID).Scan(&exists)
+	return exists, err
+}
+
+// upsertReview creates or replaces the user's review of a recipe and keeps
+// the recipe's rating totals in step. It reports whether the review is new.
+// A review hidden by a moderator stays hidden, and out of the totals, when it
+// is edited.
+func (s *RecipesService) upsertReview(userID string, recipeID, rating int, text string) (Review, bool, error) {
+	if rating < minRating || rating > maxRating {
+		return Review{}, false, errors.NewBadRequestError(fmt.Sprintf("Rating must be between %d and %d", minRating, maxRating))
+	}
+	if utf8.RuneCountInString(text) > maxReviewLength {
+		return Review{}, false, errors.NewBadRequestError(fmt.Sprintf("Review must be at most %d characters", maxReviewLength))
+	}
+
+	exists, err := s.recipeExists(recipeID)
+	if err != nil {
+		return Review{}, false, errors.NewInternalServerError("Database error", err)
+	}
+	if !exists {
+		return Review{}, false, errors.NewNotFoundError("Recipe not found")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Review{}, false, errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var reviewID string
+	var oldRating int
+	var hiddenAt sql.NullTime
+	err = tx.QueryRow(
+		"SELECT id, rating, hidden_at FROM recipe_reviews WHERE user_id = $1 AND recipe_id = $2",
+		userID, recipeID,
+	).Scan(&reviewID, &oldRating, &hiddenAt)
+	created := err == sql.ErrNoRows
+	if err != nil && !created {
+		return Review{}, false, errors.NewInternalServerError("Database error", err)
+	}
+
+	if created {
+		reviewID = uuid.New().String()
+		_, err = tx.Exec(
+			`INSERT INTO recipe_reviews (id, user_id, recipe_id, rating, review, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $6)`,
+			reviewID, userID, recipeID, rating, text, now,
+		)
+		if err != nil {
+			return Review{}, false, errors.NewInternalServerError("Failed to save review", err)
+		}
+		_, err = tx.Exec(
+			"UPDATE recipes SET rating_count = rating_count + 1, rating_sum = rating_sum + $1 WHERE id = $2",
+			rating, recipeID,
+		)
+	} else {
+		_, err = tx.Exec(
+			"UPDATE recipe_reviews SET rating = $1, review = $2, updated_at = $3 WHERE id = $4",
+			rating, text, now, reviewID,
+		)
+		if err != nil {
+			return Review{}, false, errors.NewInternalServerError("Failed to save review", err)
+		}
+		if !hiddenAt.Valid {
+			_, err = tx.Exec(
+				"UPDATE recipes SET rating_sum = rating_sum + $1 WHERE id = $2",
+				rating-oldRating, recipeID,
+			)
+		}
+	}
+	if err != nil {
+		return Review{}, false, errors.NewInternalServerError("Failed to update recipe rating", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Review{}, false, errors.NewInternalServerError("Failed to save review", err)
+	}
+
+	review, err := s.getReview(reviewID)
+	return review, created, err
+}
+
+func (s *RecipesService) getReview(reviewID string) (Review, error) {
+	var review Review
+	err := s.db.QueryRow(`
+		SELECT rr.id, rr.recipe_id, u.username, rr.rating, rr.review, rr.created_at, rr.updated_at
+		FROM recipe_reviews rr
+		JOIN users u ON u.id = rr.user_id
+		WHERE rr.id = $1`, reviewID,
+	).Scan(&review.ID, &review.RecipeID, &review.Username, &review.Rating, &review.Review, &review.CreatedAt, &review.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return Review{}, errors.NewNotFoundError("Review not found")
+	}
+	if err != nil {
+		return Review{}, errors.NewInternalServerError("Database error", err)
+	}
+
+	return review, nil
+}
+
+func (s *RecipesService) deleteReview(userID string, recipeID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	var rating int
+	var hiddenAt sql.NullTime
+	err = tx.QueryRow(
+		"SELECT rating, hidden_at FROM recipe_reviews WHERE user_id = $1 AND recipe_id = $2",
+		userID, recipeID,
+	).Scan(&rating, &hiddenAt)
+	if err == sql.ErrNoRows {
+		return errors.NewNotFoundError("Review not found")
+	}
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM recipe_reviews WHERE user_id = $1 AND recipe_id = $2", userID, recipeID)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to delete review", err)
+	}
+
+	// Hidden reviews were already taken out of the totals
+	if !hiddenAt.Valid {
+		_, err = tx.Exec(
+			"UPDATE recipes SET rating_count = rating_count - 1, rating_sum = rating_sum - $1 WHERE id = $2",
+			rating, recipeID,
+		)
+		if err != nil {
+			return errors.NewInternalServerError("Failed to update recipe rating", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.NewInternalServerError("Failed to delete review", err)
+	}
+
+	return nil
+}
+
+func (s *RecipesService) reviewsRetriever(recipeID int, sort string, limit, offset int) ([]Review, int, error) {
+	exists, err := s.recipeExists(recipeID)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+	if !exists {
+		return nil, 0, errors.NewNotFoundError("Recipe not found")
+	}
+
+	var total int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM recipe_reviews WHERE recipe_id = $1 AND hidden_at IS NULL", recipeID).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+
+	orderByClause := "rr.created_at DESC"
+	switch sort {
+	case "highest":
+		orderByClause = "rr.rating DESC, rr.created_at DESC"
+	case "lowest":
+		orderByClause = "rr.rating ASC, rr.created_at DESC"
+	}
+
+	rows, err := s.db.Query(`
+		SELECT rr.id, rr.recipe_id, u.username, rr.rating, rr.review, rr.created_at, rr.updated_at
+		FROM recipe_reviews rr
+		JOIN users u ON u.id = rr.user_id
+		WHERE rr.recipe_id = $1 AND rr.hidden_at IS NULL
+		ORDER BY `+orderByClause+`
+		LIMIT $2 OFFSET $3`,
+		recipeID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	reviews := []Review{}
+	for rows.Next() {
+		var review Review
+		err := rows.Scan(&review.ID, &review.RecipeID, &review.Username, &review.Rating, &review.Review, &review.CreatedAt, &review.UpdatedAt)
+		if err != nil {
+			return nil, 0, errors.NewInternalServerError("Data scanning error", err)
+		}
+		reviews = append(reviews, review)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return reviews, total, nil
+}
@@ -0,0 +1,534 @@
+package recipes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/ngthecoder/go_web_api/internal/auth"
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+const (
+	maxRevisionSummaryLength = 200
+	maxRecipeIngredients     = 50
+)
+
+var recipeDifficulties = map[string]bool{"easy": true, "medium": true, "hard": true}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// loadSnapshot reads a recipe's current content, hidden or not, in the form
+// revisions store it.
+func loadSnapshot(q queryer, recipeID int) (RecipeSnapshot, error) {
+	var snapshot RecipeSnapshot
+	var description sql.NullString
+	err := q.QueryRow(`
+		SELECT name, category, prep_time_minutes, cook_time_minutes, servings, difficulty, instructions, description
+		FROM recipes WHERE id = $1`, recipeID,
+	).Scan(&snapshot.Name, &snapshot.Category, &snapshot.PrepTimeMinutes, &snapshot.CookTimeMinutes,
+		&snapshot.Servings, &snapshot.Difficulty, &snapshot.Instructions, &description)
+	if err != nil {
+		return RecipeSnapshot{}, err
+	}
+	snapshot.Description = description.String
+
+	rows, err := q.Query(`
+		SELECT ri.ingredient_id, i.name, ri.quantity, ri.unit, ri.notes
+		FROM recipe_ingredients ri
+		JOIN ingredients i ON i.id = ri.ingredient_id
+		WHERE ri.recipe_id = $1
+		ORDER BY ri.ingredient_id`, recipeID,
+	)
+	if err != nil {
+		return RecipeSnapshot{}, err
+	}
+	defer rows.Close()
+
+	snapshot.Ingredients = []SnapshotIngredient{}
+	for rows.Next() {
+		var ingredient SnapshotIngredient
+		var notes sql.NullString
+		if err := rows.Scan(&ingredient.IngredientID, &ingredient.Name, &ingredient.Quantity, &ingredient.Unit, &notes); err != nil {
+			return RecipeSnapshot{}, err
+		}
+		ingredient.Notes = notes.String
+		snapshot.Ingredients = append(snapshot.Ingredients, ingredient)
+	}
+
+	return snapshot, rows.Err()
+}
+
+// recordRevision stores the recipe's current content as its next revision.
+func recordRevision(tx *sql.Tx, recipeID int, authorID, summary string, revertedFrom int, now time.Time) (int, error) {
+	snapshot, err := loadSnapshot(tx, recipeID)
+	if err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return 0, err
+	}
+
+	var revision int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(revision), 0) + 1 FROM recipe_revisions WHERE recipe_id = $1", recipeID).Scan(&revision); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO recipe_revisions (id, recipe_id, revision, author_id, summary, snapshot, reverted_from, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		uuid.New().String(), recipeID, revision, sql.NullString{String: authorID, Valid: authorID != ""}, summary, string(data),
+		sql.NullInt64{Int64: int64(revertedFrom), Valid: revertedFrom > 0}, now,
+	)
+	return revision, err
+}
+
+// ensureBaselineRevision records a recipe's content as revision 1 if it has
+// no revisions yet, so that recipes from before revisions were kept can be
+// reverted to how they started.
+func ensureBaselineRevision(tx *sql.Tx, recipeID int, authorID string, now time.Time) error {
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM recipe_revisions WHERE recipe_id = $1)", recipeID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	_, err := recordRevision(tx, recipeID, authorID, "Initial version", 0, now)
+	return err
+}
+
+// applySnapshot replaces a recipe's content and ingredients with snapshot.
+func applySnapshot(tx *sql.Tx, recipeID int, snapshot RecipeSnapshot) error {
+	_, err := tx.Exec(
+		`UPDATE recipes SET name = $1, category = $2, prep_time_minutes = $3, cook_time_minutes = $4,
+			servings = $5, difficulty = $6, instructions = $7, description = $8
+		WHERE id = $9`,
+		snapshot.Name, snapshot.Category, snapshot.PrepTimeMinutes, snapshot.CookTimeMinutes,
+		snapshot.Servings, snapshot.Difficulty, snapshot.Instructions, snapshot.Description, recipeID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM recipe_ingredients WHERE recipe_id = $1", recipeID); err != nil {
+		return err
+	}
+	for _, ingredient := range snapshot.Ingredients {
+		_, err := tx.Exec(
+			"INSERT INTO recipe_ingredients (recipe_id, ingredient_id, quantity, unit, notes) VALUES ($1, $2, $3, $4, $5)",
+			recipeID, ingredient.IngredientID, ingredient.Quantity, ingredient.Unit, ingredient.Notes,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sameContent reports whether two snapshots describe the same recipe,
+// ignoring ingredient names, which are not part of the recipe.
+func sameContent(a, b RecipeSnapshot) bool {
+	if len(a.Ingredients) != len(b.Ingredients) {
+		return false
+	}
+	for i := range a.Ingredients {
+		x, y := a.Ingredients[i], b.Ingredients[i]
+		if x.IngredientID != y.IngredientID || x.Quantity != y.Quantity || x.Unit != y.Unit || x.Notes != y.Notes {
+			return false
+		}
+	}
+	return a.Name == b.Name && a.Category == b.Category &&
+		a.PrepTimeMinutes == b.PrepTimeMinutes && a.CookTimeMinutes == b.CookTimeMinutes &&
+		a.Servings == b.Servings && a.Difficulty == b.Difficulty &&
+		a.Instructions == b.Instructions && a.Description == b.Description
+}
+
+// validateRecipeUpdate checks an edit and turns it into the snapshot it
+// would produce, with ingredients in the order snapshots keep them.
+func (s *RecipesService) validateRecipeUpdate(request UpdateRecipeRequest) (RecipeSnapshot, error) {
+	snapshot := RecipeSnapshot{
+		Name:            strings.TrimSpace(request.Name),
+		Category:        strings.TrimSpace(request.Category),
+		PrepTimeMinutes: request.PrepTimeMinutes,
+		CookTimeMinutes: request.CookTimeMinutes,
+		Servings:        request.Servings,
+		Difficulty:      request.Difficulty,
+		Instructions:    strings.TrimSpace(request.Instructions),
+		Description:     strings.TrimSpace(request.Description),
+		Ingredients:     []SnapshotIngredient{},
+	}
+
+	var fields []errors.FieldError
+	if snapshot.Name == "" || utf8.RuneCountInString(snapshot.Name) > maxRecipeNameLength {
+		fields = append(fields, errors.FieldError{Field: "name", Code: "invalid", Message: fmt.Sprintf("Name must be 1 to %d characters", maxRecipeNameLength)})
+	}
+	if snapshot.Category == "" {
+		fields = append(fields, errors.FieldError{Field: "category", Code: "required", Message: "Category is required"})
+	}
+	if snapshot.PrepTimeMinutes < 0 || snapshot.CookTimeMinutes < 0 {
+		fields = append(fields, errors.FieldError{Field: "prep_time_minutes", Code: "out_of_range", Message: "Times cannot be negative"})
+	}
+	if snapshot.Servings < 1 {
+		fields = append(fields, errors.FieldError{Field: "servings", Code: "out_of_range", Message: "Servings must be at least 1"})
+	}
+	if !recipeDifficulties[snapshot.Difficulty] {
+		fields = append(fields, errors.FieldError{Field: "difficulty", Code: "invalid", Message: "Difficulty must be one of easy, medium, hard"})
+	}
+	if snapshot.Instructions == "" {
+		fields = append(fields, errors.FieldError{Field: "instructions", Code: "required", Message: "Instructions are required"})
+	}
+	if utf8.RuneCountInString(strings.TrimSpace(request.Summary)) > maxRevisionSummaryLength {
+		fields = append(fields, errors.FieldError{Field: "summary", Code: "too_long", Message: fmt.Sprintf("Summary must be at most %d characters", maxRevisionSummaryLength)})
+	}
+
+	if len(request.Ingredients) == 0 || len(request.Ingredients) > maxRecipeIngredients {
+		fields = append(fields, errors.FieldError{Field: "ingredients", Code: "out_of_range", Message: fmt.Sprintf("A recipe needs 1 to %d ingredients", maxRecipeIngredients)})
+	}
+	seen := make(map[int]bool, len(request.Ingredients))
+	for _, ingredient := range request.Ingredients {
+		ingredient.Unit = strings.TrimSpace(ingredient.Unit)
+		ingredient.Notes = strings.TrimSpace(ingredient.Notes)
+		if seen[ingredient.IngredientID] {
+			fields = append(fields, errors.FieldError{Field: "ingredients", Code: "duplicate", Message: fmt.Sprintf("Ingredient %d is listed more than once", ingredient.IngredientID)})
+			continue
+		}
+		seen[ingredient.IngredientID] = true
+		if ingredient.Quantity <= 0 || ingredient.Unit == "" {
+			fields = append(fields, errors.FieldError{Field: "ingredients", Code: "invalid", Message: fmt.Sprintf("Ingredient %d needs a positive quantity and a unit", ingredient.IngredientID)})
+			continue
+		}
+
+		var name string
+		err := s.db.QueryRow("SELECT name FROM ingredients WHERE id = $1", ingredient.IngredientID).Scan(&name)
+		if err == sql.ErrNoRows {
+			fields = append(fields, errors.FieldError{Field: "ingredients", Code: "not_found", Message: fmt.Sprintf("Ingredient %d does not exist", ingredient.IngredientID)})
+			continue
+		}
+		if err != nil {
+			return RecipeSnapshot{}, errors.NewInternalServerError("Database error", err)
+		}
+		snapshot.Ingredients = append(snapshot.Ingredients, SnapshotIngredient{
+			IngredientID: ingredient.IngredientID,
+			Name:         name,
+			Quantity:     ingredient.Quantity,
+			Unit:         ingredient.Unit,
+			Notes:        ingredient.Notes,
+		})
+	}
+	if len(fields) > 0 {
+		return RecipeSnapshot{}, errors.NewValidationError("Invalid recipe", fields)
+	}
+
+	sort.Slice(snapshot.Ingredients, func(i, j int) bool {
+		return snapshot.Ingredients[i].IngredientID < snapshot.Ingredients[j].IngredientID
+	})
+	return snapshot, nil
+}
+
+// canEditRecipe reports whether a user may change a recipe: its author, or
+// anyone with the editor role.
+func canEditRecipe(userID, role string, authorID sql.NullString) bool {
+	return auth.HasRole(role, auth.RoleEditor) || (authorID.Valid && authorID.String == userID)
+}
+
+// checkEditableRecipe checks that a visible recipe exists and that the user
+// may edit it. It also locks the recipe's row for the rest of tx, so that
+// concurrent edits are applied one after the other and cannot both claim the
+// same revision number. The lock is taken with a no-op UPDATE rather than
+// SELECT ... FOR UPDATE, which SQLite does not support.
+func checkEditableRecipe(tx *sql.Tx, recipeID int, userID, role string) error {
+	result, err := tx.Exec("UPDATE recipes SET id = id WHERE id = $1 AND hidden_at IS NULL", recipeID)
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	if locked, _ := result.RowsAffected(); locked == 0 {
+		return errors.NewNotFoundError("Recipe not found")
+	}
+
+	var authorID sql.NullString
+	err = tx.QueryRow("SELECT author_id FROM recipes WHERE id = $1", recipeID).Scan(&authorID)
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	if !canEditRecipe(userID, role, authorID) {
+		return errors.NewForbiddenError("You cannot edit this recipe")
+	}
+	return nil
+}
+
+// updateRecipe replaces a recipe's content and ingredients and records the
+// result as a new revision. An edit that changes nothing records nothing.
+func (s *RecipesService) updateRecipe(userID, role string, recipeID int, request UpdateRecipeRequest) (Recipe, []IngredientWithQuantity, error) {
+	snapshot, err := s.validateRecipeUpdate(request)
+	if err != nil {
+		return Recipe{}, nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Recipe{}, nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkEditableRecipe(tx, recipeID, userID, role); err != nil {
+		return Recipe{}, nil, err
+	}
+
+	current, err := loadSnapshot(tx, recipeID)
+	if err != nil {
+		return Recipe{}, nil, errors.NewInternalServerError("Database error", err)
+	}
+	if !sameContent(current, snapshot) {
+		now := time.Now().UTC()
+		if err := ensureBaselineRevision(tx, recipeID, "", now); err != nil {
+			return Recipe{}, nil, errors.NewInternalServerError("Failed to record revision", err)
+		}
+		if err := applySnapshot(tx, recipeID, snapshot); err != nil {
+			return Recipe{}, nil, errors.NewInternalServerError("Failed to update recipe", err)
+		}
+		if _, err := recordRevision(tx, recipeID, userID, strings.TrimSpace(request.Summary), 0, now); err != nil {
+			return Recipe{}, nil, errors.NewInternalServerError("Failed to record revision", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Recipe{}, nil, errors.NewInternalServerError("Failed to update recipe", err)
+	}
+
+	return s.recipeDetailsWithIngredientsRetriever(recipeID, userID)
+}
+
+// revertRecipe restores a recipe to an earlier revision. The history is kept:
+// the restored content becomes a new revision that points at the old one.
+func (s *RecipesService) revertRecipe(userID, role string, recipeID, revision int) (RecipeRevision, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return RecipeRevision{}, errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkEditableRecipe(tx, recipeID, userID, role); err != nil {
+		return RecipeRevision{}, err
+	}
+
+	target, err := s.revision(tx, recipeID, revision)
+	if err != nil {
+		return RecipeRevision{}, err
+	}
+	current, err := loadSnapshot(tx, recipeID)
+	if err != nil {
+		return RecipeRevision{}, errors.NewInternalServerError("Database error", err)
+	}
+	if sameContent(current, *target.Snapshot) {
+		return RecipeRevision{}, errors.NewConflictError(fmt.Sprintf("Recipe already matches revision %d", revision))
+	}
+
+	if err := applySnapshot(tx, recipeID, *target.Snapshot); err != nil {
+		return RecipeRevision{}, errors.NewInternalServerError("Failed to revert recipe", err)
+	}
+	created, err := recordRevision(tx, recipeID, userID, fmt.Sprintf("Reverted to revision %d", revision), revision, time.Now().UTC())
+	if err != nil {
+		return RecipeRevision{}, errors.NewInternalServerError("Failed to record revision", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return RecipeRevision{}, errors.NewInternalServerError("Failed to revert recipe", err)
+	}
+
+	return s.revision(s.db, recipeID, created)
+}
+
+// revision loads one revision of a recipe with its snapshot.
+func (s *RecipesService) revision(q queryer, recipeID, revision int) (RecipeRevision, error) {
+	var result RecipeRevision
+	var author sql.NullString
+	var revertedFrom sql.NullInt64
+	var data string
+	err := q.QueryRow(`
+		SELECT rv.revision, u.username, rv.summary, rv.reverted_from, rv.created_at, rv.snapshot
+		FROM recipe_revisions rv
+		LEFT JOIN users u ON u.id = rv.author_id
+		WHERE rv.recipe_id = $1 AND rv.revision = $2`,
+		recipeID, revision,
+	).Scan(&result.Revision, &author, &result.Summary, &revertedFrom, &result.CreatedAt, &data)
+	if err == sql.ErrNoRows {
+		return RecipeRevision{}, errors.NewNotFoundError("Revision not found")
+	}
+	if err != nil {
+		return RecipeRevision{}, errors.NewInternalServerError("Database error", err)
+	}
+
+	var snapshot RecipeSnapshot
+	if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+		return RecipeRevision{}, errors.NewInternalServerError("Corrupt revision", err)
+	}
+	result.RecipeID = recipeID
+	result.Author = author.String
+	if revertedFrom.Valid {
+		from := int(revertedFrom.Int64)
+		result.RevertedFrom = &from
+	}
+	result.Snapshot = &snapshot
+
+	return result, nil
+}
+
+func (s *RecipesService) revisionRetriever(recipeID, revision int) (RecipeRevision, error) {
+	exists, err := s.recipeExists(recipeID)
+	if err != nil {
+		return RecipeRevision{}, errors.NewInternalServerError("Database error", err)
+	}
+	if !exists {
+		return RecipeRevision{}, errors.NewNotFoundError("Recipe not found")
+	}
+
+	return s.revision(s.db, recipeID, revision)
+}
+
+// revisionsRetriever lists a recipe's revisions, newest first, without their
+// snapshots. Recipes never edited have none.
+func (s *RecipesService) revisionsRetriever(recipeID, limit, offset int) ([]RecipeRevision, int, error) {
+	exists, err := s.recipeExists(recipeID)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+	if !exists {
+		return nil, 0, errors.NewNotFoundError("Recipe not found")
+	}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM recipe_revisions WHERE recipe_id = $1", recipeID).Scan(&total); err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT rv.revision, u.username, rv.summary, rv.reverted_from, rv.created_at
+		FROM recipe_revisions rv
+		LEFT JOIN users u ON u.id = rv.author_id
+		WHERE rv.recipe_id = $1
+		ORDER BY rv.revision DESC
+		LIMIT $2 OFFSET $3`,
+		recipeID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	revisions := []RecipeRevision{}
+	for rows.Next() {
+		revision := RecipeRevision{RecipeID: recipeID}
+		var author sql.NullString
+		var revertedFrom sql.NullInt64
+		if err := rows.Scan(&revision.Revision, &author, &revision.Summary, &revertedFrom, &revision.CreatedAt); err != nil {
+			return nil, 0, errors.NewInternalServerError("Data scanning error", err)
+		}
+		revision.Author = author.String
+		if revertedFrom.Valid {
+			from := int(revertedFrom.Int64)
+			revision.RevertedFrom = &from
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return revisions, total, nil
+}
+
+// revisionDiffRetriever compares two revisions of a recipe.
+func (s *RecipesService) revisionDiffRetriever(recipeID, from, to int) (RevisionDiff, error) {
+	exists, err := s.recipeExists(recipeID)
+	if err != nil {
+		return RevisionDiff{}, errors.NewInternalServerError("Database error", err)
+	}
+	if !exists {
+		return RevisionDiff{}, errors.NewNotFoundError("Recipe not found")
+	}
+
+	fromRevision, err := s.revision(s.db, recipeID, from)
+	if err != nil {
+		return RevisionDiff{}, err
+	}
+	toRevision, err := s.revision(s.db, recipeID, to)
+	if err != nil {
+		return RevisionDiff{}, err
+	}
+
+	diff := diffSnapshots(*fromRevision.Snapshot, *toRevision.Snapshot)
+	diff.RecipeID = recipeID
+	diff.From = from
+	diff.To = to
+	return diff, nil
+}
+
+// diffSnapshots lists the fields and ingredients that differ between two
+// snapshots. Ingredients are matched by ingredient ID.
+func diffSnapshots(from, to RecipeSnapshot) RevisionDiff {
+	diff := RevisionDiff{
+		Fields:             []FieldChange{},
+		IngredientsAdded:   []SnapshotIngredient{},
+		IngredientsRemoved: []SnapshotIngredient{},
+		IngredientsChanged: []IngredientChange{},
+	}
+
+	fields := []struct {
+		name     string
+		from, to interface{}
+	}{
+		{"name", from.Name, to.Name},
+		{"category", from.Category, to.Category},
+		{"prep_time_minutes", from.PrepTimeMinutes, to.PrepTimeMinutes},
+		{"cook_time_minutes", from.CookTimeMinutes, to.CookTimeMinutes},
+		{"servings", from.Servings, to.Servings},
+		{"difficulty", from.Difficulty, to.Difficulty},
+		{"instructions", from.Instructions, to.Instructions},
+		{"description", from.Description, to.Description},
+	}
+	for _, field := range fields {
+		if field.from != field.to {
+			diff.Fields = append(diff.Fields, FieldChange{Field: field.name, From: field.from, To: field.to})
+		}
+	}
+
+	before := make(map[int]SnapshotIngredient, len(from.Ingredients))
+	for _, ingredient := range from.Ingredients {
+		before[ingredient.IngredientID] = ingredient
+	}
+	after := make(map[int]bool, len(to.Ingredients))
+	for _, ingredient := range to.Ingredients {
+		after[ingredient.IngredientID] = true
+		old, ok := before[ingredient.IngredientID]
+		if !ok {
+			diff.IngredientsAdded = append(diff.IngredientsAdded, ingredient)
+			continue
+		}
+		if old.Quantity != ingredient.Quantity || old.Unit != ingredient.Unit || old.Notes != ingredient.Notes {
+			diff.IngredientsChanged = append(diff.IngredientsChanged, IngredientChange{
+				IngredientID: ingredient.IngredientID,
+				Name:         ingredient.Name,
+				From:         old,
+				To:           ingredient,
+			})
+		}
+	}
+	for _, ingredient := range from.Ingredients {
+		if !after[ingredient.IngredientID] {
+			diff.IngredientsRemoved = append(diff.IngredientsRemoved, ingredient)
+		}
+	}
+
+	return diff
+}
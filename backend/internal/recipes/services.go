@@ -54,6 +54,8 @@ func (s *RecipesService) recipesRetriever(search, category, difficulty, sort, or
 			&recipe.Difficulty,
 			&recipe.Instructions,
 			&recipe.Description,
+			&recipe.AverageRating,
+			&recipe.RatingCount,
 			&recipe.IsLiked,
 		)
 		if err != nil {
@@ -73,22 +75,29 @@ func (s *RecipesService) recipeDetailsWithIngredientsRetriever(id int, userID st
 		SELECT 
 			r.id, r.name, r.category, r.prep_time_minutes, r.cook_time_minutes, 
 			r.servings, r.difficulty, r.instructions, r.description,
-			CASE WHEN ulr.user_id IS NOT NULL THEN 1 ELSE 0 END as is_liked
+			CASE WHEN r.rating_count > 0 THEN r.rating_sum * 1.0 / r.rating_count ELSE 0 END as average_rating, r.rating_count,
+			CASE WHEN ulr.user_id IS NOT NULL THEN 1 ELSE 0 END as is_liked,
+			r.forked_from
 		FROM recipes r
 		LEFT JOIN user_liked_recipes ulr ON r.id = ulr.recipe_id AND ulr.user_id = $1
-		WHERE r.id = $2
+		WHERE r.id = $2 AND r.hidden_at IS NULL
 	`
 
+	var forkedFrom sql.NullInt64
 	err := s.db.QueryRow(query, userID, id).
 		Scan(&recipe.ID, &recipe.Name, &recipe.Category, &recipe.PrepTimeMinutes, &recipe.CookTimeMinutes,
 			&recipe.Servings, &recipe.Difficulty, &recipe.Instructions, &recipe.Description,
-			&recipe.IsLiked)
+			&recipe.AverageRating, &recipe.RatingCount, &recipe.IsLiked, &forkedFrom)
 
 	if err == sql.ErrNoRows {
 		return Recipe{}, nil, errors.NewNotFoundError("Recipe not found")
 	} else if err != nil {
 		return Recipe{}, nil, errors.NewInternalServerError("Database error", err)
 	}
+	if forkedFrom.Valid {
+		forkedFromID := int(forkedFrom.Int64)
+		recipe.ForkedFrom = &forkedFromID
+	}
 
 	rows, err := s.db.Query(`
 		SELECT i.id, i.name, ri.quantity, ri.unit, ri.notes
@@ -118,7 +127,7 @@ func (s *RecipesService) recipeDetailsWithIngredientsRetriever(id int, userID st
 
 func (s *RecipesService) matchedRecipesRetriever(matchType string, ingredientIDs []int, limit int, userID string) ([]MatchedRecipe, error) {
 	sqlQuery := ""
-	args := []interface{}{}
+	args := []interface{}{userID}
 
 	placeholderNum := 2
 
@@ -129,7 +138,6 @@ func (s *RecipesService) matchedRecipesRetriever(matchType string, ingredientIDs
 		placeholderNum++
 	}
 
-	args = append(args, userID)
 	args = append(args, limit)
 
 	if matchType == "partial" {
@@ -144,7 +152,7 @@ func (s *RecipesService) matchedRecipesRetriever(matchType string, ingredientIDs
 			FROM recipes r
 			JOIN recipe_ingredients ri on r.id = ri.recipe_id
 			LEFT JOIN user_liked_recipes ulr ON r.id = ulr.recipe_id AND ulr.user_id = $1
-			WHERE ri.ingredient_id in (%s)
+			WHERE ri.ingredient_id in (%s) AND r.hidden_at IS NULL
 			GROUP BY r.id, r.name, r.category, r.prep_time_minutes, r.cook_time_minutes, r.servings, r.difficulty, r.instructions, r.description, ulr.user_id
 			ORDER BY match_ingredients_count DESC, total_ingredients_count ASC
 			LIMIT $%d
@@ -163,7 +171,7 @@ func (s *RecipesService) matchedRecipesRetriever(matchType string, ingredientIDs
 			FROM recipes r
 			JOIN recipe_ingredients ri on r.id = ri.recipe_id
 			LEFT JOIN user_liked_recipes ulr ON r.id = ulr.recipe_id AND ulr.user_id = $1
-			WHERE ri.ingredient_id in (%s)
+			WHERE ri.ingredient_id in (%s) AND r.hidden_at IS NULL
 			GROUP BY r.id, r.name, r.category, r.prep_time_minutes, r.cook_time_minutes, r.servings, r.difficulty, r.instructions, r.description, ulr.user_id
 			HAVING COUNT(ri.ingredient_id) = (SELECT COUNT(*) FROM recipe_ingredients WHERE recipe_id = r.id)
 			ORDER BY match_ingredients_count DESC, total_ingredients_count ASC
@@ -219,8 +227,10 @@ func (s *RecipesService) shoppingListRetriever(recipeID int, haveIngredientIDs m
 			recipe_ingredients AS ri
 		JOIN
 			ingredients AS i ON ri.ingredient_id = i.id
+		JOIN
+			recipes AS r ON ri.recipe_id = r.id
 		WHERE
-			ri.recipe_id = $1;
+			ri.recipe_id = $1 AND r.hidden_at IS NULL;
 	`
 
 	rows, err := s.db.Query(query, recipeID)
@@ -259,7 +269,7 @@ func (s *RecipesService) shoppingListRetriever(recipeID int, haveIngredientIDs m
 
 func (s *RecipesService) buildRecipeCountQuery(search, category, difficulty string, maxTime int) (string, []interface{}) {
 	query := "SELECT COUNT(*) FROM recipes"
-	conditions := []string{}
+	conditions := []string{"hidden_at IS NULL"}
 	args := []interface{}{}
 
 	placeholderNum := 1
@@ -299,10 +309,10 @@ func (s *RecipesService) buildRecipeCountQuery(search, category, difficulty stri
 func (s *RecipesService) buildRecipeQuery(search, category, difficulty, sort, order string, maxTime, limit, offset int, userID string) (string, []interface{}) {
 	placeholderNum := 1
 
-	query := fmt.Sprintf("SELECT r.id, r.name, r.category, r.prep_time_minutes, r.cook_time_minutes, r.servings, r.difficulty, r.instructions, r.description, CASE WHEN ulr.user_id IS NOT NULL THEN 1 ELSE 0 END as is_liked FROM recipes r LEFT JOIN user_liked_recipes ulr ON r.id = ulr.recipe_id AND ulr.user_id = $%d", placeholderNum)
+	query := fmt.Sprintf("SELECT r.id, r.name, r.category, r.prep_time_minutes, r.cook_time_minutes, r.servings, r.difficulty, r.instructions, r.description, CASE WHEN r.rating_count > 0 THEN r.rating_sum * 1.0 / r.rating_count ELSE 0 END as average_rating, r.rating_count, CASE WHEN ulr.user_id IS NOT NULL THEN 1 ELSE 0 END as is_liked FROM recipes r LEFT JOIN user_liked_recipes ulr ON r.id = ulr.recipe_id AND ulr.user_id = $%d", placeholderNum)
 	placeholderNum++
 
-	conditions := []string{}
+	conditions := []string{"r.hidden_at IS NULL"}
 	args := []interface{}{userID}
 
 	if search != "" {
@@ -346,11 +356,17 @@ func (s *RecipesService) buildRecipeQuery(search, category, difficulty, sort, or
 		orderByClause = "r.servings"
 	case "difficulty":
 		orderByClause = "r.difficulty"
+	case "rating":
+		orderByClause = bayesianRatingSQL
+	case "popular":
+		orderByClause = "r.like_count"
+	case "trending":
+		orderByClause = "r.trending_score"
 	default:
 		orderByClause = "r.name"
 	}
 
-	query += " ORDER BY " + orderByClause + " " + strings.ToUpper(order)
+	query += " ORDER BY " + orderByClause + " " + strings.ToUpper(order) + ", r.id"
 	query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", placeholderNum, placeholderNum+1)
 	args = append(args, limit, offset)
 
@@ -1,10 +1,18 @@
 package recipes
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/ngthecoder/go_web_api/internal/errors"
 )
 
 func TestRecipeServiceBasics(t *testing.T) {
@@ -57,6 +65,802 @@ func TestRecipeDetailsWithIngredientsRetriever(t *testing.T) {
 	t.Logf("Recipe details test passed!")
 }
 
+func TestHiddenRecipesExcluded(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewRecipesService(db)
+
+	if _, err := db.Exec("UPDATE recipes SET hidden_at = $1 WHERE id = 2", time.Now().UTC()); err != nil {
+		t.Fatalf("Failed to hide recipe: %v", err)
+	}
+
+	total, err := service.recipesCounter("Rice", "", "", 0)
+	if err != nil {
+		t.Fatalf("recipesCounter() error: %v", err)
+	}
+	if total != 1 {
+		t.Errorf("recipesCounter() = %d, want 1", total)
+	}
+
+	recipes, err := service.recipesRetriever("Rice", "", "", "name", "asc", 0, 10, 0, "")
+	if err != nil {
+		t.Fatalf("recipesRetriever() error: %v", err)
+	}
+	if len(recipes) != 1 || recipes[0].ID != 1 {
+		t.Errorf("recipesRetriever() = %+v, want only recipe 1", recipes)
+	}
+
+	if _, _, err := service.recipeDetailsWithIngredientsRetriever(2, ""); err == nil {
+		t.Error("recipeDetailsWithIngredientsRetriever() of hidden recipe succeeded, want not found")
+	}
+
+	matched, err := service.matchedRecipesRetriever("partial", []int{3}, 10, "")
+	if err != nil {
+		t.Fatalf("matchedRecipesRetriever() error: %v", err)
+	}
+	for _, m := range matched {
+		if m.ID == 2 {
+			t.Error("matchedRecipesRetriever() returned hidden recipe 2")
+		}
+	}
+}
+
+func TestReviewsAndRatings(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewRecipesService(db)
+
+	for i, name := range []string{"alice", "bob", "carol"} {
+		_, err := db.Exec("INSERT INTO users (id, username, email, password_hash) VALUES ($1, $2, $3, 'x')",
+			fmt.Sprintf("user-%d", i+1), name, name+"@example.com")
+		if err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+	}
+
+	if _, _, err := service.upsertReview("user-1", 1, 6, ""); err == nil {
+		t.Error("upsertReview() should reject a rating above 5")
+	}
+	if _, _, err := service.upsertReview("user-1", 99, 4, ""); err == nil {
+		t.Error("upsertReview() should fail for a missing recipe")
+	}
+
+	review, created, err := service.upsertReview("user-1", 1, 5, "Great")
+	if err != nil {
+		t.Fatalf("upsertReview() error: %v", err)
+	}
+	if !created || review.Username != "alice" || review.Rating != 5 {
+		t.Errorf("upsertReview() = %+v, created %v; want a new 5-star review by alice", review, created)
+	}
+
+	// Editing replaces the rating rather than adding another one
+	if _, created, err := service.upsertReview("user-1", 1, 3, "Good"); err != nil || created {
+		t.Errorf("Second upsertReview() created = %v, err = %v; want an update", created, err)
+	}
+
+	recipe, _, err := service.recipeDetailsWithIngredientsRetriever(1, "")
+	if err != nil {
+		t.Fatalf("recipeDetailsWithIngredientsRetriever() error: %v", err)
+	}
+	if recipe.RatingCount != 1 || recipe.AverageRating != 3 {
+		t.Errorf("Rating = %v from %d reviews, want 3 from 1", recipe.AverageRating, recipe.RatingCount)
+	}
+
+	// Recipe 2 has more reviews; a single review on recipe 1 is pulled
+	// towards the site average, so recipe 2 ranks first.
+	service.upsertReview("user-1", 2, 4, "")
+	service.upsertReview("user-2", 2, 4, "")
+	service.upsertReview("user-3", 2, 5, "")
+	service.upsertReview("user-2", 1, 5, "")
+
+	recipes, err := service.recipesRetriever("", "", "", "rating", "desc", 0, 10, 0, "")
+	if err != nil {
+		t.Fatalf("recipesRetriever() error: %v", err)
+	}
+	if len(recipes) != 2 || recipes[0].ID != 2 {
+		t.Errorf("Sorting by rating put recipe %d first, want 2", recipes[0].ID)
+	}
+
+	reviews, total, err := service.reviewsRetriever(2, "lowest", 2, 0)
+	if err != nil {
+		t.Fatalf("reviewsRetriever() error: %v", err)
+	}
+	if total != 3 || len(reviews) != 2 || reviews[0].Rating != 4 {
+		t.Errorf("reviewsRetriever() = %d of %d, first rating %d; want 2 of 3 starting at 4", len(reviews), total, reviews[0].Rating)
+	}
+
+	if err := service.deleteReview("user-3", 1); err == nil {
+		t.Error("deleteReview() should fail when the user has no review")
+	}
+	if err := service.deleteReview("user-3", 2); err != nil {
+		t.Fatalf("deleteReview() error: %v", err)
+	}
+
+	recipe, _, _ = service.recipeDetailsWithIngredientsRetriever(2, "")
+	if recipe.RatingCount != 2 || recipe.AverageRating != 4 {
+		t.Errorf("Rating after delete = %v from %d reviews, want 4 from 2", recipe.AverageRating, recipe.RatingCount)
+	}
+}
+
+func TestComments(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewRecipesService(db)
+
+	for i, name := range []string{"alice", "bob"} {
+		_, err := db.Exec("INSERT INTO users (id, username, email, password_hash) VALUES ($1, $2, $3, 'x')",
+			fmt.Sprintf("user-%d", i+1), name, name+"@example.com")
+		if err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+	}
+
+	if _, err := service.createComment("user-1", 1, "", ""); err == nil {
+		t.Error("createComment() should reject an empty comment")
+	}
+
+	first, err := service.createComment("user-1", 1, "", "Added garlic")
+	if err != nil {
+		t.Fatalf("createComment() error: %v", err)
+	}
+	reply, err := service.createComment("user-2", 1, first.ID, "How much?")
+	if err != nil {
+		t.Fatalf("createComment() reply error: %v", err)
+	}
+	nested, err := service.createComment("user-1", 1, reply.ID, "Two cloves")
+	if err != nil {
+		t.Fatalf("createComment() nested reply error: %v", err)
+	}
+	if _, err := service.createComment("user-1", 2, first.ID, "Wrong recipe"); err == nil {
+		t.Error("createComment() should reject a parent from another recipe")
+	}
+	// Make the second thread clearly newer than the first
+	db.Exec("UPDATE recipe_comments SET created_at = $1", time.Now().UTC().Add(-time.Minute))
+	second, _ := service.createComment("user-2", 1, "", "Lovely")
+
+	if _, err := service.editComment("user-2", 1, first.ID, "Hijacked"); err == nil {
+		t.Error("editComment() should not let another user edit")
+	}
+	edited, err := service.editComment("user-1", 1, first.ID, "Added lots of garlic")
+	if err != nil {
+		t.Fatalf("editComment() error: %v", err)
+	}
+	if edited.Body != "Added lots of garlic" || edited.EditedAt == nil {
+		t.Errorf("editComment() = %+v, want edited body and time", edited)
+	}
+
+	// The edit window closes after a while
+	db.Exec("UPDATE recipe_comments SET created_at = $1 WHERE id = $2", time.Now().UTC().Add(-time.Hour), nested.ID)
+	if _, err := service.editComment("user-1", 1, nested.ID, "Three cloves"); err == nil {
+		t.Error("editComment() should fail once the edit window has passed")
+	}
+
+	if err := service.deleteComment("user-2", 1, reply.ID); err != nil {
+		t.Fatalf("deleteComment() error: %v", err)
+	}
+	if _, err := service.createComment("user-1", 1, reply.ID, "Still there?"); err == nil {
+		t.Error("createComment() should not reply to a deleted comment")
+	}
+
+	threads, total, err := service.commentsRetriever(1, CommentSortThread, 10, 0)
+	if err != nil {
+		t.Fatalf("commentsRetriever() error: %v", err)
+	}
+	if total != 2 || len(threads) != 2 || threads[0].ID != second.ID {
+		t.Fatalf("Threads = %d of %d, first %s; want 2 of 2 starting with the newest", len(threads), total, threads[0].ID)
+	}
+
+	// The deleted reply keeps its place and its own reply
+	thread := threads[1]
+	if len(thread.Replies) != 1 || !thread.Replies[0].Deleted || thread.Replies[0].Body != "" || thread.Replies[0].Username != "" {
+		t.Fatalf("Thread replies = %+v, want one blanked deleted reply", thread.Replies)
+	}
+	if len(thread.Replies[0].Replies) != 1 || thread.Replies[0].Replies[0].Body != "Two cloves" {
+		t.Errorf("Nested replies = %+v, want the reply to the deleted comment", thread.Replies[0].Replies)
+	}
+
+	newest, total, err := service.commentsRetriever(1, CommentSortNewest, 2, 0)
+	if err != nil {
+		t.Fatalf("commentsRetriever() error: %v", err)
+	}
+	if total != 4 || len(newest) != 2 || newest[0].ID != second.ID {
+		t.Errorf("Newest = %d of %d, want 2 of 4 starting with the latest comment", len(newest), total)
+	}
+
+	// Both views leave out hidden comments and threads whose top-level
+	// comment is hidden or deleted
+	hiddenReply, _ := service.createComment("user-1", 1, second.ID, "Spam")
+	afterHidden, _ := service.createComment("user-2", 1, hiddenReply.ID, "Reply to spam")
+	db.Exec("UPDATE recipe_comments SET hidden_at = CURRENT_TIMESTAMP WHERE id = $1", hiddenReply.ID)
+	if err := service.deleteComment("user-1", 1, first.ID); err != nil {
+		t.Fatalf("deleteComment() error: %v", err)
+	}
+
+	threads, total, err = service.commentsRetriever(1, CommentSortThread, 10, 0)
+	if err != nil {
+		t.Fatalf("commentsRetriever() error: %v", err)
+	}
+	if total != 1 || len(threads) != 1 || threads[0].ID != second.ID {
+		t.Fatalf("Threads = %+v (total %d), want only the remaining thread", threads, total)
+	}
+	if len(threads[0].Replies) != 1 || threads[0].Replies[0].ID != afterHidden.ID {
+		t.Errorf("Thread replies = %+v, want the reply to the hidden comment in its place", threads[0].Replies)
+	}
+
+	newest, total, err = service.commentsRetriever(1, CommentSortNewest, 10, 0)
+	if err != nil {
+		t.Fatalf("commentsRetriever() error: %v", err)
+	}
+	if total != 2 || len(newest) != 2 || newest[0].ID != afterHidden.ID || newest[1].ID != second.ID {
+		t.Errorf("Newest = %+v (total %d), want the same two comments as the thread view", newest, total)
+	}
+}
+
+func TestRecommendations(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewRecipesService(db)
+
+	_, err := db.Exec(`
+		INSERT INTO recipes (id, name, category, prep_time_minutes, cook_time_minutes, servings, difficulty, instructions, description) VALUES
+		(3, 'Tomato Soup', 'lunch', 10, 20, 2, 'easy', 'Simmer tomatoes', 'Warming'),
+		(4, 'Fruit Salad', 'dessert', 10, 0, 2, 'easy', 'Chop fruit', 'Fresh');
+
+		INSERT INTO recipe_ingredients (recipe_id, ingredient_id, quantity, unit, notes) VALUES
+		(3, 1, 4, 'pieces', 'chopped');
+
+		INSERT INTO user_liked_recipes (user_id, recipe_id) VALUES
+		('user-a', 1), ('user-a', 2),
+		('user-b', 1), ('user-b', 2),
+		('user-c', 1);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	pairs, err := service.RebuildRecipeSimilarities()
+	if err != nil {
+		t.Fatalf("RebuildRecipeSimilarities() error: %v", err)
+	}
+	if pairs != 2 {
+		t.Errorf("RebuildRecipeSimilarities() stored %d pairs, want 2", pairs)
+	}
+
+	// Liked by people who like the same things, then by shared ingredients,
+	// then by popularity
+	recommendations, err := service.recommendationsRetriever("user-c", 3)
+	if err != nil {
+		t.Fatalf("recommendationsRetriever() error: %v", err)
+	}
+	want := []struct {
+		id     int
+		reason string
+	}{
+		{2, RecommendationReasonSimilarUsers},
+		{3, RecommendationReasonIngredients},
+		{4, RecommendationReasonPopular},
+	}
+	if len(recommendations) != len(want) {
+		t.Fatalf("Got %d recommendations, want %d", len(recommendations), len(want))
+	}
+	for i, w := range want {
+		if recommendations[i].Recipe.ID != w.id || recommendations[i].Reason != w.reason {
+			t.Errorf("Recommendation %d = recipe %d (%s), want recipe %d (%s)",
+				i, recommendations[i].Recipe.ID, recommendations[i].Reason, w.id, w.reason)
+		}
+	}
+	if recommendations[0].Recipe.Name != "Chicken Rice" {
+		t.Errorf("Recommended recipe name = %q, want Chicken Rice", recommendations[0].Recipe.Name)
+	}
+
+	// Liked recipes are never recommended
+	recommendations, _ = service.recommendationsRetriever("user-a", 10)
+	for _, recommendation := range recommendations {
+		if recommendation.Recipe.ID == 1 || recommendation.Recipe.ID == 2 {
+			t.Errorf("Recommended already liked recipe %d", recommendation.Recipe.ID)
+		}
+	}
+
+	// Users without likes get the most popular recipes
+	recommendations, _ = service.recommendationsRetriever("user-new", 1)
+	if len(recommendations) != 1 || recommendations[0].Recipe.ID != 1 || recommendations[0].Reason != RecommendationReasonPopular {
+		t.Errorf("Cold start recommendations = %+v, want the most liked recipe", recommendations)
+	}
+}
+
+func TestSimilarRecipes(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewRecipesService(db)
+
+	_, err := db.Exec(`
+		INSERT INTO recipes (id, name, category, prep_time_minutes, cook_time_minutes, servings, difficulty, instructions, description) VALUES
+		(3, 'Onion Rice', 'lunch', 10, 25, 2, 'easy', 'Fry onions, add rice', 'Simple'),
+		(4, 'Lunch Salad', 'lunch', 10, 0, 2, 'easy', 'Toss', 'Light'),
+		(5, 'Roast Chicken', 'dinner', 15, 60, 4, 'hard', 'Roast', 'Sunday');
+
+		INSERT INTO recipe_ingredients (recipe_id, ingredient_id, quantity, unit, notes) VALUES
+		(3, 2, 1, 'piece', 'sliced'),
+		(3, 3, 1, 'cup', ''),
+		(5, 4, 1, 'piece', 'whole');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to insert test data: %v", err)
+	}
+
+	if score := similarityScore(3, 3, 3, true, 30, 30); math.Abs(score-1) > 1e-9 {
+		t.Errorf("similarityScore() of identical recipes = %v, want 1", score)
+	}
+
+	similar, err := service.similarRecipesRetriever(1, 10, "")
+	if err != nil {
+		t.Fatalf("similarRecipesRetriever() error: %v", err)
+	}
+
+	// Onion Rice shares two of Tomato Rice's three ingredients and its
+	// category; Chicken Rice shares rice; Lunch Salad only the category;
+	// Roast Chicken nothing.
+	var order []int
+	for _, result := range similar {
+		order = append(order, result.Recipe.ID)
+	}
+	if fmt.Sprint(order) != "[3 2 4]" {
+		t.Fatalf("Similar recipes = %v, want [3 2 4]", order)
+	}
+	if similar[0].Recipe.Name != "Onion Rice" || similar[0].Score <= similar[1].Score {
+		t.Errorf("Top result = %+v, want Onion Rice with the highest score", similar[0])
+	}
+	var shared []string
+	for _, ingredient := range similar[0].SharedIngredients {
+		shared = append(shared, ingredient.Name)
+	}
+	if fmt.Sprint(shared) != "[Onion Rice]" {
+		t.Errorf("Shared ingredients = %v, want [Onion Rice]", shared)
+	}
+	if len(similar[2].SharedIngredients) != 0 {
+		t.Errorf("Lunch Salad shared ingredients = %v, want none", similar[2].SharedIngredients)
+	}
+
+	if _, err := service.similarRecipesRetriever(99, 10, ""); err == nil {
+		t.Error("similarRecipesRetriever() should fail for a missing recipe")
+	}
+}
+
+func TestTrendingRecipes(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewRecipesService(db)
+	now := time.Now().UTC()
+
+	recordLikes := func(recipeID, count int, likedAt time.Time) {
+		t.Helper()
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("Begin() error: %v", err)
+		}
+		for i := 0; i < count; i++ {
+			if err := RecordLike(tx, recipeID, likedAt); err != nil {
+				t.Fatalf("RecordLike() error: %v", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error: %v", err)
+		}
+	}
+
+	// Recipe 1 is liked twice today; recipe 2 three times three days ago and
+	// once more before the week window.
+	recordLikes(1, 2, now)
+	recordLikes(2, 3, now.Add(-3*24*time.Hour))
+	recordLikes(2, 1, now.Add(-8*24*time.Hour))
+
+	for _, tt := range []struct {
+		window string
+		want   string
+	}{
+		{TrendingWindowDay, "[1 2]"},
+		{TrendingWindowWeek, "[2 1]"},
+		{TrendingWindowAll, "[2 1]"},
+	} {
+		trending, err := service.trendingRecipesRetriever(tt.window, 10, "")
+		if err != nil {
+			t.Fatalf("trendingRecipesRetriever(%q) error: %v", tt.window, err)
+		}
+		var order []int
+		for _, item := range trending {
+			order = append(order, item.Recipe.ID)
+		}
+		if fmt.Sprint(order) != tt.want {
+			t.Errorf("Trending for %s = %v, want %s", tt.window, order, tt.want)
+		}
+		if tt.window == TrendingWindowAll && trending[0].Likes != (LikeCounts{Day: 0, Week: 3, AllTime: 4}) {
+			t.Errorf("Likes of recipe 2 = %+v, want {Day:0 Week:3 AllTime:4}", trending[0].Likes)
+		}
+	}
+
+	refreshed, err := service.RefreshTrendingScores()
+	if err != nil {
+		t.Fatalf("RefreshTrendingScores() error: %v", err)
+	}
+	if refreshed != 2 {
+		t.Errorf("RefreshTrendingScores() = %v, want 2", refreshed)
+	}
+	var oldBuckets int
+	db.QueryRow("SELECT COUNT(*) FROM recipe_like_buckets WHERE bucket_start < $1", now.Add(-likeBucketRetention)).Scan(&oldBuckets)
+	if oldBuckets != 0 {
+		t.Errorf("Buckets past retention = %v, want 0", oldBuckets)
+	}
+
+	// Fresh likes outweigh more but older ones in the trending score, while
+	// popularity counts every like.
+	byTrending, err := service.recipesRetriever("", "", "", "trending", "desc", 0, 10, 0, "")
+	if err != nil {
+		t.Fatalf("recipesRetriever() error: %v", err)
+	}
+	if byTrending[0].ID != 1 {
+		t.Errorf("First recipe by trending = %v, want 1", byTrending[0].ID)
+	}
+	byPopular, err := service.recipesRetriever("", "", "", "popular", "desc", 0, 10, 0, "")
+	if err != nil {
+		t.Fatalf("recipesRetriever() error: %v", err)
+	}
+	if byPopular[0].ID != 2 {
+		t.Errorf("First recipe by popular = %v, want 2", byPopular[0].ID)
+	}
+
+	tx, _ := db.Begin()
+	if err := RecordUnlike(tx, 2, now.Add(-3*24*time.Hour)); err != nil {
+		t.Fatalf("RecordUnlike() error: %v", err)
+	}
+	tx.Commit()
+
+	trending, err := service.trendingRecipesRetriever(TrendingWindowWeek, 10, "")
+	if err != nil {
+		t.Fatalf("trendingRecipesRetriever() error: %v", err)
+	}
+	// Now tied on the week, recipe 1 wins on its fresher likes
+	if len(trending) != 2 || trending[1].Recipe.ID != 2 {
+		t.Fatalf("Trending after unlike = %+v, want recipe 2 second", trending)
+	}
+	if trending[1].Likes != (LikeCounts{Day: 0, Week: 2, AllTime: 3}) {
+		t.Errorf("Likes of recipe 2 after unlike = %+v, want {Day:0 Week:2 AllTime:3}", trending[1].Likes)
+	}
+}
+
+func TestForkRecipe(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewRecipesService(db)
+
+	db.Exec("INSERT INTO users (id, username, email, password_hash) VALUES ('user-1', 'alice', 'alice@example.com', 'x')")
+	db.Exec("UPDATE recipes SET rating_count = 1, rating_sum = 5, like_count = 3 WHERE id = 1")
+
+	fork, ingredients, err := service.forkRecipe("user-1", 1, ForkRecipeRequest{Name: "  Spicy Tomato Rice "})
+	if err != nil {
+		t.Fatalf("forkRecipe() error: %v", err)
+	}
+	if fork.ID == 1 || fork.Name != "Spicy Tomato Rice" || fork.ForkedFrom == nil || *fork.ForkedFrom != 1 {
+		t.Errorf("forkRecipe() = %+v, want a new recipe named Spicy Tomato Rice forked from 1", fork)
+	}
+	if fork.RatingCount != 0 || len(ingredients) != 3 {
+		t.Errorf("fork has %d ratings and %d ingredients, want 0 and 3", fork.RatingCount, len(ingredients))
+	}
+	var authorID string
+	db.QueryRow("SELECT author_id FROM recipes WHERE id = $1", fork.ID).Scan(&authorID)
+	if authorID != "user-1" {
+		t.Errorf("fork author_id = %v, want user-1", authorID)
+	}
+
+	second, _, err := service.forkRecipe("user-1", 1, ForkRecipeRequest{})
+	if err != nil {
+		t.Fatalf("forkRecipe() without name error: %v", err)
+	}
+	if second.Name != "Tomato Rice" {
+		t.Errorf("forkRecipe() without name = %v, want original name", second.Name)
+	}
+
+	forks, total, err := service.forksRetriever(1, 10, 0, "")
+	if err != nil {
+		t.Fatalf("forksRetriever() error: %v", err)
+	}
+	if total != 2 || len(forks) != 2 || forks[0].Author != "alice" {
+		t.Errorf("forksRetriever() = %+v (total %d), want 2 forks by alice", forks, total)
+	}
+
+	db.Exec("UPDATE recipes SET hidden_at = $1 WHERE id = $2", time.Now().UTC(), second.ID)
+	if _, total, _ := service.forksRetriever(1, 10, 0, ""); total != 1 {
+		t.Errorf("forksRetriever() total with a hidden fork = %d, want 1", total)
+	}
+
+	db.Exec("UPDATE recipes SET hidden_at = $1 WHERE id = 2", time.Now().UTC())
+	if _, _, err := service.forkRecipe("user-1", 2, ForkRecipeRequest{}); err == nil {
+		t.Error("forkRecipe() of hidden recipe succeeded, want not found")
+	}
+}
+
+func TestRecipeRevisions(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewRecipesService(db)
+
+	db.Exec("UPDATE recipes SET author_id = 'user-1' WHERE id = 1")
+
+	update := UpdateRecipeRequest{
+		Name:            "Tomato Rice",
+		Category:        "lunch",
+		PrepTimeMinutes: 10,
+		CookTimeMinutes: 25,
+		Servings:        4,
+		Difficulty:      "easy",
+		Instructions:    "Cook rice with tomatoes",
+		Description:     "Delicious",
+		Ingredients: []RecipeIngredientInput{
+			{IngredientID: 1, Quantity: 3, Unit: "pieces", Notes: "diced"},
+			{IngredientID: 3, Quantity: 2, Unit: "cups", Notes: "uncooked"},
+			{IngredientID: 4, Quantity: 1, Unit: "piece"},
+		},
+		Summary: "More tomato, add chicken",
+	}
+
+	if _, _, err := service.updateRecipe("user-2", "user", 1, update); err == nil {
+		t.Error("updateRecipe() by another user succeeded, want forbidden")
+	}
+
+	recipe, ingredients, err := service.updateRecipe("user-1", "user", 1, update)
+	if err != nil {
+		t.Fatalf("updateRecipe() error: %v", err)
+	}
+	if recipe.CookTimeMinutes != 25 || len(ingredients) != 3 {
+		t.Errorf("updateRecipe() = cook time %d with %d ingredients, want 25 with 3", recipe.CookTimeMinutes, len(ingredients))
+	}
+
+	// Saving the same content again records no revision
+	if _, _, err := service.updateRecipe("user-1", "user", 1, update); err != nil {
+		t.Fatalf("repeated updateRecipe() error: %v", err)
+	}
+	revisions, total, err := service.revisionsRetriever(1, 10, 0)
+	if err != nil {
+		t.Fatalf("revisionsRetriever() error: %v", err)
+	}
+	if total != 2 || revisions[0].Revision != 2 || revisions[0].Summary != "More tomato, add chicken" || revisions[1].Summary != "Initial version" {
+		t.Errorf("revisionsRetriever() = %+v, want the edit over the initial version", revisions)
+	}
+
+	diff, err := service.revisionDiffRetriever(1, 1, 2)
+	if err != nil {
+		t.Fatalf("revisionDiffRetriever() error: %v", err)
+	}
+	if len(diff.Fields) != 1 || diff.Fields[0].Field != "cook_time_minutes" {
+		t.Errorf("diff.Fields = %+v, want only cook_time_minutes", diff.Fields)
+	}
+	if len(diff.IngredientsAdded) != 1 || diff.IngredientsAdded[0].Name != "Chicken" {
+		t.Errorf("diff.IngredientsAdded = %+v, want Chicken", diff.IngredientsAdded)
+	}
+	if len(diff.IngredientsRemoved) != 1 || diff.IngredientsRemoved[0].Name != "Onion" {
+		t.Errorf("diff.IngredientsRemoved = %+v, want Onion", diff.IngredientsRemoved)
+	}
+	if len(diff.IngredientsChanged) != 1 || diff.IngredientsChanged[0].To.Quantity != 3 {
+		t.Errorf("diff.IngredientsChanged = %+v, want Tomato going to 3", diff.IngredientsChanged)
+	}
+
+	// Editors may revert recipes they did not write
+	reverted, err := service.revertRecipe("editor-1", "editor", 1, 1)
+	if err != nil {
+		t.Fatalf("revertRecipe() error: %v", err)
+	}
+	if reverted.Revision != 3 || reverted.RevertedFrom == nil || *reverted.RevertedFrom != 1 {
+		t.Errorf("revertRecipe() = %+v, want revision 3 reverted from 1", reverted)
+	}
+	recipe, ingredients, _ = service.recipeDetailsWithIngredientsRetriever(1, "")
+	if recipe.CookTimeMinutes != 20 || len(ingredients) != 3 {
+		t.Errorf("recipe after revert = cook time %d, %d ingredients, want 20 and 3", recipe.CookTimeMinutes, len(ingredients))
+	}
+	if _, err := service.revertRecipe("user-1", "user", 1, 3); err == nil {
+		t.Error("revertRecipe() to the current content succeeded, want conflict")
+	}
+
+	diff, err = service.revisionDiffRetriever(1, 1, 3)
+	if err != nil {
+		t.Fatalf("revisionDiffRetriever() error: %v", err)
+	}
+	if len(diff.Fields)+len(diff.IngredientsAdded)+len(diff.IngredientsRemoved)+len(diff.IngredientsChanged) != 0 {
+		t.Errorf("diff between revision 1 and its revert = %+v, want no changes", diff)
+	}
+
+	update.Difficulty = "extreme"
+	update.Ingredients = append(update.Ingredients, RecipeIngredientInput{IngredientID: 99, Quantity: 1, Unit: "g"})
+	if _, _, err := service.updateRecipe("user-1", "user", 1, update); err == nil {
+		t.Error("updateRecipe() with an invalid difficulty and ingredient succeeded")
+	}
+}
+
+func TestPersonalNotesAndTweaks(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewRecipesService(db)
+
+	half, substitute := 1.0, 4
+	request := RecipeNotesRequest{
+		Note: " Use half the tomatoes ",
+		Tweaks: []IngredientTweak{
+			{IngredientID: 1, Quantity: &half},
+			{IngredientID: 2, SubstituteIngredientID: &substitute, Unit: "breast"},
+		},
+	}
+	notes, err := service.saveNotes("user-1", 1, request)
+	if err != nil {
+		t.Fatalf("saveNotes() error: %v", err)
+	}
+	if notes.Note != "Use half the tomatoes" || len(notes.Tweaks) != 2 || notes.Tweaks[1].SubstituteName != "Chicken" {
+		t.Errorf("saveNotes() = %+v, want the trimmed note and two tweaks", notes)
+	}
+
+	_, ingredients, _ := service.recipeDetailsWithIngredientsRetriever(1, "user-1")
+	applyTweaks(ingredients, notes.Tweaks)
+	for _, ingredient := range ingredients {
+		switch ingredient.IngredientID {
+		case 1:
+			if ingredient.Quantity != 2 || ingredient.Effective == nil || ingredient.Effective.Quantity != 1 || ingredient.Effective.Unit != "pieces" {
+				t.Errorf("Tomato = %+v / %+v, want 2 pieces becoming 1 piece", ingredient, ingredient.Effective)
+			}
+		case 2:
+			if ingredient.Effective == nil || ingredient.Effective.Name != "Chicken" || ingredient.Effective.Unit != "breast" || ingredient.Effective.Quantity != 1 {
+				t.Errorf("Onion effective = %+v, want 1 Chicken breast", ingredient.Effective)
+			}
+		case 3:
+			if ingredient.Effective != nil {
+				t.Errorf("Rice effective = %+v, want untouched", ingredient.Effective)
+			}
+		}
+	}
+
+	if _, found, _ := service.personalNotesRetriever("user-2", 1); found {
+		t.Error("personalNotesRetriever() found another user's notes")
+	}
+
+	// An API key acts for its owner but is not trusted with private notes.
+	handler := NewRecipesHandler(service)
+	keyContext := context.WithValue(context.WithValue(context.Background(), "user_id", "user-1"), "api_key_id", "key-1")
+	rec := httptest.NewRecorder()
+	handler.NotesHandler(rec, httptest.NewRequest(http.MethodGet, "/api/recipes/1/notes", nil).WithContext(keyContext))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Notes via API key status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec = httptest.NewRecorder()
+	handler.RecipeDetailHandler(rec, httptest.NewRequest(http.MethodGet, "/api/recipes/1", nil).WithContext(keyContext))
+	var detail RecipeWithIngredients
+	if err := json.NewDecoder(rec.Body).Decode(&detail); err != nil || detail.PersonalNotes != nil {
+		t.Errorf("Recipe detail via API key = %+v, %v; want no personal notes", detail.PersonalNotes, err)
+	}
+
+	zero := 0.0
+	invalid := []IngredientTweak{
+		{IngredientID: 4, Quantity: &half},
+		{IngredientID: 1, Quantity: &zero},
+		{IngredientID: 3},
+	}
+	_, err = service.saveNotes("user-1", 1, RecipeNotesRequest{Tweaks: invalid})
+	if httpErr, ok := err.(*errors.HTTPError); !ok || len(httpErr.Fields) != 3 {
+		t.Errorf("saveNotes() with invalid tweaks = %v, want three field errors", err)
+	}
+
+	if err := service.deleteNotes("user-1", 1); err != nil {
+		t.Fatalf("deleteNotes() error: %v", err)
+	}
+	if _, found, _ := service.personalNotesRetriever("user-1", 1); found {
+		t.Error("personalNotesRetriever() found notes after delete")
+	}
+	var tweaks int
+	db.QueryRow("SELECT COUNT(*) FROM recipe_ingredient_tweaks").Scan(&tweaks)
+	if tweaks != 0 {
+		t.Errorf("%d tweaks left after delete, want 0", tweaks)
+	}
+}
+
+func TestPantryMatchingAndShoppingList(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	handler := NewRecipesHandler(NewRecipesService(db))
+
+	now := time.Now().UTC()
+	_, err := db.Exec(`
+		INSERT INTO pantry_items (user_id, ingredient_id, quantity, unit, expires_at, created_at, updated_at) VALUES
+		('user-1', 1, 5, 'pieces', NULL, $1, $1),
+		('user-1', 3, 1, 'CUPS', NULL, $1, $1),
+		('user-1', 2, 200, 'g', NULL, $1, $1),
+		('user-1', 4, 1, 'piece', $2, $1, $1)`,
+		now, now.Add(-time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("Failed to stock pantry: %v", err)
+	}
+
+	serve := func(h http.HandlerFunc, target, userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if userID != "" {
+			req = req.WithContext(context.WithValue(req.Context(), "user_id", userID))
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	if rec := serve(handler.FindRecipesByIngredientsHandler, "/api/recipes/find-by-ingredients?pantry=true", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Anonymous pantry match status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	// The expired chicken does not count towards Chicken Rice
+	rec := serve(handler.FindRecipesByIngredientsHandler, "/api/recipes/find-by-ingredients?pantry=true", "user-1")
+	var matched []MatchedRecipe
+	if err := json.NewDecoder(rec.Body).Decode(&matched); err != nil {
+		t.Fatalf("Failed to decode matches (status %d): %v", rec.Code, err)
+	}
+	counts := make(map[int]int)
+	for _, recipe := range matched {
+		counts[recipe.ID] = recipe.MatchedIngredientsCount
+	}
+	if counts[1] != 3 || counts[2] != 1 {
+		t.Errorf("Matched ingredient counts = %v, want recipe 1: 3, recipe 2: 1", counts)
+	}
+
+	rec = serve(handler.ShoppingListHandler, "/api/recipes/shopping-list/1?pantry=true", "user-1")
+	var response struct {
+		ShoppingList []IngredientWithQuantity `json:"shopping_list"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode shopping list (status %d): %v", rec.Code, err)
+	}
+	if len(response.ShoppingList) != 2 {
+		t.Fatalf("Shopping list = %+v, want onion and rice", response.ShoppingList)
+	}
+	for _, item := range response.ShoppingList {
+		switch item.IngredientID {
+		case 2:
+			if item.Quantity != 1 || item.InPantry == nil || item.InPantry.Unit != "g" {
+				t.Errorf("Onion = %+v, want the full piece with 200 g shown in the pantry", item)
+			}
+		case 3:
+			if item.Quantity != 1 || item.Unit != "cups" {
+				t.Errorf("Rice = %+v, want 1 cups still to buy", item)
+			}
+		default:
+			t.Errorf("Unexpected shopping list item %+v", item)
+		}
+	}
+
+	if rec := serve(handler.ShoppingListHandler, "/api/recipes/shopping-list/1?pantry=true&have_ingredients=3", "user-1"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Pantry shopping list with have_ingredients status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	if rec := serve(handler.ShoppingListHandler, "/api/recipes/shopping-list/1?pantry=true", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Anonymous pantry shopping list status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	// A recipes:read API key does not grant access to the owner's pantry.
+	keyContext := context.WithValue(context.WithValue(context.Background(), "user_id", "user-1"), "api_key_id", "key-1")
+	keyRequests := map[string]http.HandlerFunc{
+		"/api/recipes/find-by-ingredients?pantry=true": handler.FindRecipesByIngredientsHandler,
+		"/api/recipes/shopping-list/1?pantry=true":     handler.ShoppingListHandler,
+	}
+	for target, h := range keyRequests {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, target, nil).WithContext(keyContext))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s via API key status = %d, want %d", target, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
 func TestDatabaseSetup(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
@@ -108,7 +912,15 @@ func setupTestDB(t *testing.T) *sql.DB {
 			servings INTEGER NOT NULL,
 			difficulty TEXT NOT NULL,
 			instructions TEXT NOT NULL,
-			description TEXT
+			description TEXT,
+			rating_count INTEGER NOT NULL DEFAULT 0,
+			rating_sum INTEGER NOT NULL DEFAULT 0,
+			like_count INTEGER NOT NULL DEFAULT 0,
+			trending_score REAL NOT NULL DEFAULT 0,
+			author_id TEXT,
+			forked_from INTEGER,
+			hidden_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		);
 
 		CREATE TABLE ingredients (
@@ -133,6 +945,7 @@ func setupTestDB(t *testing.T) *sql.DB {
 			username TEXT UNIQUE NOT NULL,
 			email TEXT UNIQUE NOT NULL,
 			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'user',
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		);
@@ -143,6 +956,86 @@ func setupTestDB(t *testing.T) *sql.DB {
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			PRIMARY KEY (user_id, recipe_id)
 		);
+
+		CREATE TABLE recipe_reviews (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			recipe_id INTEGER NOT NULL,
+			rating INTEGER NOT NULL CHECK (rating BETWEEN 1 AND 5),
+			review TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			hidden_at DATETIME,
+			UNIQUE (user_id, recipe_id)
+		);
+
+		CREATE TABLE recipe_like_buckets (
+			recipe_id INTEGER NOT NULL,
+			bucket_start DATETIME NOT NULL,
+			likes INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (recipe_id, bucket_start)
+		);
+
+		CREATE TABLE recipe_similarities (
+			recipe_id INTEGER NOT NULL,
+			similar_recipe_id INTEGER NOT NULL,
+			score REAL NOT NULL,
+			PRIMARY KEY (recipe_id, similar_recipe_id)
+		);
+
+		CREATE TABLE recipe_notes (
+			user_id TEXT NOT NULL,
+			recipe_id INTEGER NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			updated_at DATETIME NOT NULL,
+			PRIMARY KEY (user_id, recipe_id)
+		);
+
+		CREATE TABLE recipe_ingredient_tweaks (
+			user_id TEXT NOT NULL,
+			recipe_id INTEGER NOT NULL,
+			ingredient_id INTEGER NOT NULL,
+			quantity REAL,
+			unit TEXT,
+			substitute_ingredient_id INTEGER,
+			PRIMARY KEY (user_id, recipe_id, ingredient_id)
+		);
+
+		CREATE TABLE pantry_items (
+			user_id TEXT NOT NULL,
+			ingredient_id INTEGER NOT NULL,
+			quantity REAL NOT NULL,
+			unit TEXT NOT NULL,
+			expires_at DATETIME,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			PRIMARY KEY (user_id, ingredient_id)
+		);
+
+		CREATE TABLE recipe_revisions (
+			id TEXT PRIMARY KEY,
+			recipe_id INTEGER NOT NULL,
+			revision INTEGER NOT NULL,
+			author_id TEXT,
+			summary TEXT NOT NULL DEFAULT '',
+			snapshot TEXT NOT NULL,
+			reverted_from INTEGER,
+			created_at DATETIME NOT NULL,
+			UNIQUE (recipe_id, revision)
+		);
+
+		CREATE TABLE recipe_comments (
+			id TEXT PRIMARY KEY,
+			recipe_id INTEGER NOT NULL,
+			user_id TEXT,
+			parent_id TEXT,
+			root_id TEXT NOT NULL,
+			body TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			edited_at DATETIME,
+			deleted_at DATETIME,
+			hidden_at DATETIME
+		);
 	`)
 	if err != nil {
 		t.Fatalf("Failed to create tables: %v", err)
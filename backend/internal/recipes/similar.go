@@ -0,0 +1,162 @@
+package recipes
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+// Weights of the parts of a similar-recipe score, which add up to 1.
+const (
+	similarIngredientWeight = 0.7
+	similarCategoryWeight   = 0.2
+	similarTimeWeight       = 0.1
+)
+
+// similarityScore rates how alike two recipes are from 0 to 1: mostly by the
+// Jaccard index of their ingredient sets, then by sharing a category and by
+// how close their total times are.
+func similarityScore(shared, ingredientsA, ingredientsB int, sameCategory bool, timeA, timeB int) float64 {
+	score := 0.0
+	if union := ingredientsA + ingredientsB - shared; union > 0 {
+		score += similarIngredientWeight * float64(shared) / float64(union)
+	}
+	if sameCategory {
+		score += similarCategoryWeight
+	}
+	if longest := math.Max(float64(timeA), float64(timeB)); longest > 0 {
+		score += similarTimeWeight * (1 - math.Abs(float64(timeA-timeB))/longest)
+	} else {
+		score += similarTimeWeight
+	}
+	return score
+}
+
+// similarRecipesRetriever ranks the recipes most like the given one. Only
+// recipes sharing an ingredient or the category are considered.
+func (s *RecipesService) similarRecipesRetriever(recipeID, limit int, userID string) ([]SimilarRecipe, error) {
+	var category string
+	var totalTime, ingredientCount int
+	err := s.db.QueryRow(`
+		SELECT r.category, r.prep_time_minutes + r.cook_time_minutes,
+			(SELECT COUNT(*) FROM recipe_ingredients WHERE recipe_id = r.id)
+		FROM recipes r WHERE r.id = $1 AND r.hidden_at IS NULL`, recipeID,
+	).Scan(&category, &totalTime, &ingredientCount)
+	if err == sql.ErrNoRows {
+		return nil, errors.NewNotFoundError("Recipe not found")
+	}
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT candidate.id, candidate.category, candidate.total_time, candidate.ingredient_count, candidate.shared
+		FROM (
+			SELECT r.id, r.category, r.prep_time_minutes + r.cook_time_minutes AS total_time,
+				(SELECT COUNT(*) FROM recipe_ingredients WHERE recipe_id = r.id) AS ingredient_count,
+				(SELECT COUNT(*) FROM recipe_ingredients ri
+					WHERE ri.recipe_id = r.id
+						AND ri.ingredient_id IN (SELECT ingredient_id FROM recipe_ingredients WHERE recipe_id = $1)) AS shared
+			FROM recipes r
+			WHERE r.id != $1 AND r.hidden_at IS NULL
+		) AS candidate
+		WHERE candidate.shared > 0 OR candidate.category = $2`,
+		recipeID, category,
+	)
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	var similar []SimilarRecipe
+	for rows.Next() {
+		var candidateID, candidateTime, candidateIngredients, shared int
+		var candidateCategory string
+		if err := rows.Scan(&candidateID, &candidateCategory, &candidateTime, &candidateIngredients, &shared); err != nil {
+			return nil, errors.NewInternalServerError("Data scanning error", err)
+		}
+		score := similarityScore(shared, ingredientCount, candidateIngredients, candidateCategory == category, totalTime, candidateTime)
+		similar = append(similar, SimilarRecipe{Recipe: Recipe{ID: candidateID}, Score: math.Round(score*1000) / 1000})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].Score != similar[j].Score {
+			return similar[i].Score > similar[j].Score
+		}
+		return similar[i].Recipe.ID < similar[j].Recipe.ID
+	})
+	if len(similar) > limit {
+		similar = similar[:limit]
+	}
+	if len(similar) == 0 {
+		return []SimilarRecipe{}, nil
+	}
+
+	ids := make([]int, len(similar))
+	for i, result := range similar {
+		ids[i] = result.Recipe.ID
+	}
+	recipes, err := s.recipesByIDs(ids, userID)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := s.sharedIngredients(recipeID, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range similar {
+		id := similar[i].Recipe.ID
+		similar[i].Recipe = recipes[id]
+		similar[i].SharedIngredients = shared[id]
+		if similar[i].SharedIngredients == nil {
+			similar[i].SharedIngredients = []SharedIngredient{}
+		}
+	}
+
+	return similar, nil
+}
+
+// sharedIngredients lists, for each of the other recipes, the ingredients it
+// has in common with recipeID.
+func (s *RecipesService) sharedIngredients(recipeID int, otherIDs []int) (map[int][]SharedIngredient, error) {
+	args := []interface{}{recipeID}
+	placeholders := make([]string, len(otherIDs))
+	for i, id := range otherIDs {
+		placeholders[i] = fmt.Sprintf("$%d", i+2)
+		args = append(args, id)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT ri.recipe_id, i.id, i.name
+		FROM recipe_ingredients ri
+		JOIN ingredients i ON i.id = ri.ingredient_id
+		WHERE ri.ingredient_id IN (SELECT ingredient_id FROM recipe_ingredients WHERE recipe_id = $1)
+			AND ri.recipe_id IN (`+strings.Join(placeholders, ", ")+`)
+		ORDER BY i.name`, args...)
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	shared := make(map[int][]SharedIngredient)
+	for rows.Next() {
+		var otherID int
+		var ingredient SharedIngredient
+		if err := rows.Scan(&otherID, &ingredient.IngredientID, &ingredient.Name); err != nil {
+			return nil, errors.NewInternalServerError("Data scanning error", err)
+		}
+		shared[otherID] = append(shared[otherID], ingredient)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return shared, nil
+}
@@ -0,0 +1,210 @@
+package recipes
+
+import (
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+const (
+	TrendingWindowDay  = "24h"
+	TrendingWindowWeek = "7d"
+	TrendingWindowAll  = "all"
+
+	// likeBucketSize is the resolution of recent like counts; windows are
+	// measured in whole buckets.
+	likeBucketSize = time.Hour
+	// likeBucketRetention is how long like buckets are kept. It covers the
+	// longest window and is where the trending score stops counting likes.
+	likeBucketRetention = 7 * 24 * time.Hour
+	// trendingHalfLife is how long it takes a like to lose half its weight
+	// in the trending score.
+	trendingHalfLife = 24 * time.Hour
+)
+
+var trendingWindows = map[string]time.Duration{
+	TrendingWindowDay:  24 * time.Hour,
+	TrendingWindowWeek: 7 * 24 * time.Hour,
+	TrendingWindowAll:  0,
+}
+
+func IsValidTrendingWindow(window string) bool {
+	_, ok := trendingWindows[window]
+	return ok
+}
+
+// likeWeight is what a like given at likedAt adds to the trending score at
+// now.
+func likeWeight(likedAt, now time.Time) float64 {
+	age := now.Sub(likedAt)
+	if age < 0 {
+		age = 0
+	}
+	if age > likeBucketRetention {
+		return 0
+	}
+	return math.Pow(0.5, age.Hours()/trendingHalfLife.Hours())
+}
+
+// RecordLike updates a recipe's like counters for a new like. It must run in
+// the transaction that adds the like.
+func RecordLike(tx *sql.Tx, recipeID int, likedAt time.Time) error {
+	_, err := tx.Exec(
+		"UPDATE recipes SET like_count = like_count + 1, trending_score = trending_score + 1 WHERE id = $1",
+		recipeID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO recipe_like_buckets (recipe_id, bucket_start, likes) VALUES ($1, $2, 1)
+		ON CONFLICT (recipe_id, bucket_start) DO UPDATE SET likes = recipe_like_buckets.likes + 1`,
+		recipeID, likedAt.UTC().Truncate(likeBucketSize),
+	)
+	return err
+}
+
+// RecordUnlike takes a removed like, given at likedAt, back out of the
+// recipe's like counters. It must run in the transaction that removes it.
+func RecordUnlike(tx *sql.Tx, recipeID int, likedAt time.Time) error {
+	now := time.Now().UTC()
+	_, err := tx.Exec(
+		`UPDATE recipes SET
+			like_count = CASE WHEN like_count > 0 THEN like_count - 1 ELSE 0 END,
+			trending_score = CASE WHEN trending_score > $1 THEN trending_score - $1 ELSE 0 END
+		WHERE id = $2`,
+		likeWeight(likedAt, now), recipeID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE recipe_like_buckets SET likes = likes - 1 WHERE recipe_id = $1 AND bucket_start = $2 AND likes > 0",
+		recipeID, likedAt.UTC().Truncate(likeBucketSize),
+	)
+	return err
+}
+
+// RefreshTrendingScores recomputes every recipe's trending score from the
+// like buckets, so that scores decay between likes, and drops buckets that
+// have aged out. It returns the number of recipes with a score.
+func (s *RecipesService) RefreshTrendingScores() (int, error) {
+	now := time.Now().UTC()
+
+	rows, err := s.db.Query(
+		"SELECT recipe_id, bucket_start, likes FROM recipe_like_buckets WHERE bucket_start > $1 AND likes > 0",
+		now.Add(-likeBucketRetention),
+	)
+	if err != nil {
+		return 0, err
+	}
+	scores := make(map[int]float64)
+	for rows.Next() {
+		var recipeID, likes int
+		var bucketStart time.Time
+		if err := rows.Scan(&recipeID, &bucketStart, &likes); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		// A bucket's likes are counted from its middle
+		scores[recipeID] += float64(likes) * likeWeight(bucketStart.Add(likeBucketSize/2), now)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE recipes SET trending_score = 0 WHERE trending_score != 0"); err != nil {
+		return 0, err
+	}
+	for recipeID, score := range scores {
+		if _, err := tx.Exec("UPDATE recipes SET trending_score = $1 WHERE id = $2", score, recipeID); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM recipe_like_buckets WHERE bucket_start <= $1 OR likes <= 0", now.Add(-likeBucketRetention)); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(scores), nil
+}
+
+// trendingRecipesRetriever ranks recipes by how many likes they got within
+// the window, breaking ties by trending score. The all-time window uses the
+// running total.
+func (s *RecipesService) trendingRecipesRetriever(window string, limit int, userID string) ([]TrendingRecipe, error) {
+	now := time.Now().UTC()
+	dayStart := now.Add(-trendingWindows[TrendingWindowDay]).Truncate(likeBucketSize)
+	weekStart := now.Add(-trendingWindows[TrendingWindowWeek]).Truncate(likeBucketSize)
+
+	orderBy := "likes_all DESC"
+	switch window {
+	case TrendingWindowDay:
+		orderBy = "likes_day DESC"
+	case TrendingWindowWeek:
+		orderBy = "likes_week DESC"
+	}
+
+	rows, err := s.db.Query(`
+		SELECT ranked.id, ranked.likes_day, ranked.likes_week, ranked.likes_all, ranked.trending_score FROM (
+			SELECT r.id,
+				COALESCE((SELECT SUM(b.likes) FROM recipe_like_buckets b WHERE b.recipe_id = r.id AND b.bucket_start >= $1), 0) AS likes_day,
+				COALESCE((SELECT SUM(b.likes) FROM recipe_like_buckets b WHERE b.recipe_id = r.id AND b.bucket_start >= $2), 0) AS likes_week,
+				r.like_count AS likes_all,
+				r.trending_score
+			FROM recipes r
+			WHERE r.hidden_at IS NULL
+		) AS ranked
+		WHERE ranked.likes_all > 0
+		ORDER BY `+orderBy+`, ranked.trending_score DESC, ranked.id
+		LIMIT $3`,
+		dayStart, weekStart, limit,
+	)
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	trending := []TrendingRecipe{}
+	for rows.Next() {
+		var item TrendingRecipe
+		err := rows.Scan(&item.Recipe.ID, &item.Likes.Day, &item.Likes.Week, &item.Likes.AllTime, &item.TrendingScore)
+		if err != nil {
+			return nil, errors.NewInternalServerError("Data scanning error", err)
+		}
+		item.TrendingScore = math.Round(item.TrendingScore*1000) / 1000
+		trending = append(trending, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.NewInternalServerError("Data scanning error", err)
+	}
+	rows.Close()
+
+	ids := make([]int, len(trending))
+	for i, item := range trending {
+		ids[i] = item.Recipe.ID
+	}
+	recipes, err := s.recipesByIDs(ids, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range trending {
+		trending[i].Recipe = recipes[trending[i].Recipe.ID]
+	}
+
+	return trending, nil
+}
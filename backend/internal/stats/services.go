@@ -41,6 +41,7 @@ func (s *StatsService) GetCategoryCounts() (*CategoryCountsResponse, error) {
 	recRows, err := s.db.Query(`
 		SELECT category, COUNT(*)
 		FROM recipes
+		WHERE hidden_at IS NULL
 		GROUP BY category
 		ORDER BY category
 	`)
@@ -78,17 +79,17 @@ func (s *StatsService) GetStats() (*Stats, error) {
 		return nil, fmt.Errorf("failed to get total ingredients: %w", err)
 	}
 
-	err = s.db.QueryRow(`SELECT COUNT(*) FROM recipes`).Scan(&stats.TotalRecipes)
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM recipes WHERE hidden_at IS NULL`).Scan(&stats.TotalRecipes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get total recipes: %w", err)
 	}
 
-	err = s.db.QueryRow(`SELECT AVG(prep_time_minutes) FROM recipes`).Scan(&stats.AvgPrepTime)
+	err = s.db.QueryRow(`SELECT AVG(prep_time_minutes) FROM recipes WHERE hidden_at IS NULL`).Scan(&stats.AvgPrepTime)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get average prep time: %w", err)
 	}
 
-	err = s.db.QueryRow(`SELECT AVG(cook_time_minutes) FROM recipes`).Scan(&stats.AvgCookTime)
+	err = s.db.QueryRow(`SELECT AVG(cook_time_minutes) FROM recipes WHERE hidden_at IS NULL`).Scan(&stats.AvgCookTime)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get average cook time: %w", err)
 	}
@@ -96,6 +97,7 @@ func (s *StatsService) GetStats() (*Stats, error) {
 	rows, err := s.db.Query(`
 		SELECT difficulty, COUNT(*)
 		FROM recipes
+		WHERE hidden_at IS NULL
 		GROUP BY difficulty
 	`)
 	if err != nil {
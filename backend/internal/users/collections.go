@@ -0,0 +1,398 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/ngthecoder/go_web_api/internal/errors"
+	"github.com/ngthecoder/go_web_api/internal/recipes"
+)
+
+const (
+	maxCollectionNameLength        = 100
+	maxCollectionDescriptionLength = 1000
+)
+
+func validateCollection(name, description string) error {
+	var fields []errors.FieldError
+	if name == "" {
+		fields = append(fields, errors.FieldError{Field: "name", Code: "required", Message: "Name is required"})
+	} else if utf8.RuneCountInString(name) > maxCollectionNameLength {
+		fields = append(fields, errors.FieldError{Field: "name", Code: "too_long", Message: fmt.Sprintf("Name must be at most %d characters", maxCollectionNameLength)})
+	}
+	if utf8.RuneCountInString(description) > maxCollectionDescriptionLength {
+		fields = append(fields, errors.FieldError{Field: "description", Code: "too_long", Message: fmt.Sprintf("Description must be at most %d characters", maxCollectionDescriptionLength)})
+	}
+	if len(fields) > 0 {
+		return errors.NewValidationError("Invalid collection", fields)
+	}
+	return nil
+}
+
+func (s *UserService) collectionNameTaken(userID, name, exceptID string) (bool, error) {
+	var taken bool
+	err := s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM collections WHERE user_id = $1 AND LOWER(name) = LOWER($2) AND id != $3)",
+		userID, name, exceptID,
+	).Scan(&taken)
+	return taken, err
+}
+
+func (s *UserService) createCollection(userID, name, description string, isPublic bool) (Collection, error) {
+	if err := validateCollection(name, description); err != nil {
+		return Collection{}, err
+	}
+
+	taken, err := s.collectionNameTaken(userID, name, "")
+	if err != nil {
+		return Collection{}, errors.NewInternalServerError("Database error", err)
+	}
+	if taken {
+		return Collection{}, errors.NewConflictError("You already have a collection with that name")
+	}
+
+	now := time.Now().UTC()
+	collectionID := uuid.New().String()
+	_, err = s.db.Exec(
+		`INSERT INTO collections (id, user_id, name, description, is_public, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)`,
+		collectionID, userID, name, description, isPublic, now,
+	)
+	if err != nil {
+		return Collection{}, errors.NewInternalServerError("Failed to create collection", err)
+	}
+
+	return s.getCollection(userID, collectionID)
+}
+
+const collectionColumns = `c.id, c.user_id, u.username, c.name, c.description, c.is_public, c.created_at, c.updated_at,
+	(SELECT COUNT(*) FROM collection_recipes cr JOIN recipes r ON r.id = cr.recipe_id WHERE cr.collection_id = c.id AND r.hidden_at IS NULL)`
+
+func (s *UserService) scanCollection(scanner interface{ Scan(...interface{}) error }) (Collection, string, error) {
+	var collection Collection
+	var ownerID string
+	err := scanner.Scan(&collection.ID, &ownerID, &collection.Owner, &collection.Name, &collection.Description,
+		&collection.IsPublic, &collection.CreatedAt, &collection.UpdatedAt, &collection.RecipeCount)
+	if err != nil {
+		return Collection{}, "", err
+	}
+	if collection.IsPublic {
+		collection.ShareURL = s.linkBaseURL + "/collections/" + collection.ID
+	}
+	return collection, ownerID, nil
+}
+
+// getCollection returns a collection with its recipes in order. Private
+// collections are only visible to their owner; viewerID may be empty for
+// anonymous visitors following a share link.
+func (s *UserService) getCollection(viewerID, collectionID string) (Collection, error) {
+	row := s.db.QueryRow(`
+		SELECT `+collectionColumns+`
+		FROM collections c
+		JOIN users u ON u.id = c.user_id
+		WHERE c.id = $1`, collectionID,
+	)
+	collection, ownerID, err := s.scanCollection(row)
+	if err == sql.ErrNoRows || (err == nil && !collection.IsPublic && ownerID != viewerID) {
+		return Collection{}, errors.NewNotFoundError("Collection not found")
+	}
+	if err != nil {
+		return Collection{}, errors.NewInternalServerError("Database error", err)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT r.id, r.name, r.category, r.prep_time_minutes, r.cook_time_minutes, r.servings, r.difficulty, r.instructions, r.description,
+			CASE WHEN r.rating_count > 0 THEN r.rating_sum * 1.0 / r.rating_count ELSE 0 END as average_rating, r.rating_count
+		FROM collection_recipes cr
+		JOIN recipes r ON r.id = cr.recipe_id
+		WHERE cr.collection_id = $1 AND r.hidden_at IS NULL
+		ORDER BY cr.position, cr.added_at`, collectionID,
+	)
+	if err != nil {
+		return Collection{}, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	collection.Recipes = []recipes.Recipe{}
+	for rows.Next() {
+		var recipe recipes.Recipe
+		err := rows.Scan(&recipe.ID, &recipe.Name, &recipe.Category,
+			&recipe.PrepTimeMinutes, &recipe.CookTimeMinutes,
+			&recipe.Servings, &recipe.Difficulty,
+			&recipe.Instructions, &recipe.Description,
+			&recipe.AverageRating, &recipe.RatingCount)
+		if err != nil {
+			return Collection{}, errors.NewInternalServerError("Data scanning error", err)
+		}
+		collection.Recipes = append(collection.Recipes, recipe)
+	}
+	if err := rows.Err(); err != nil {
+		return Collection{}, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return collection, nil
+}
+
+// getCollections lists the user's collections without their recipes.
+func (s *UserService) getCollections(userID string) ([]Collection, error) {
+	rows, err := s.db.Query(`
+		SELECT `+collectionColumns+`
+		FROM collections c
+		JOIN users u ON u.id = c.user_id
+		WHERE c.user_id = $1
+		ORDER BY c.created_at, c.id`, userID,
+	)
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	collections := []Collection{}
+	for rows.Next() {
+		collection, _, err := s.scanCollection(rows)
+		if err != nil {
+			return nil, errors.NewInternalServerError("Data scanning error", err)
+		}
+		collections = append(collections, collection)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return collections, nil
+}
+
+// ownCollection checks that a collection exists and belongs to the user.
+func (s *UserService) ownCollection(userID, collectionID string) error {
+	var exists bool
+	err := s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM collections WHERE id = $1 AND user_id = $2)",
+		collectionID, userID,
+	).Scan(&exists)
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	if !exists {
+		return errors.NewNotFoundError("Collection not found")
+	}
+	return nil
+}
+
+// updateCollection changes the fields set in the request and leaves the
+// others as they are.
+func (s *UserService) updateCollection(userID, collectionID string, request UpdateCollectionRequest) (Collection, error) {
+	if err := s.ownCollection(userID, collectionID); err != nil {
+		return Collection{}, err
+	}
+	current, err := s.getCollection(userID, collectionID)
+	if err != nil {
+		return Collection{}, err
+	}
+
+	name, description, isPublic := current.Name, current.Description, current.IsPublic
+	if request.Name != nil {
+		name = strings.TrimSpace(*request.Name)
+	}
+	if request.Description != nil {
+		description = strings.TrimSpace(*request.Description)
+	}
+	if request.IsPublic != nil {
+		isPublic = *request.IsPublic
+	}
+
+	if err := validateCollection(name, description); err != nil {
+		return Collection{}, err
+	}
+	taken, err := s.collectionNameTaken(userID, name, collectionID)
+	if err != nil {
+		return Collection{}, errors.NewInternalServerError("Database error", err)
+	}
+	if taken {
+		return Collection{}, errors.NewConflictError("You already have a collection with that name")
+	}
+
+	_, err = s.db.Exec(
+		"UPDATE collections SET name = $1, description = $2, is_public = $3, updated_at = $4 WHERE id = $5",
+		name, description, isPublic, time.Now().UTC(), collectionID,
+	)
+	if err != nil {
+		return Collection{}, errors.NewInternalServerError("Failed to update collection", err)
+	}
+
+	return s.getCollection(userID, collectionID)
+}
+
+func (s *UserService) deleteCollection(userID, collectionID string) error {
+	if err := s.ownCollection(userID, collectionID); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM collection_recipes WHERE collection_id = $1", collectionID); err != nil {
+		return errors.NewInternalServerError("Failed to delete collection", err)
+	}
+	if _, err := tx.Exec("DELETE FROM collections WHERE id = $1", collectionID); err != nil {
+		return errors.NewInternalServerError("Failed to delete collection", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.NewInternalServerError("Failed to delete collection", err)
+	}
+
+	return nil
+}
+
+// addCollectionRecipe appends a recipe to the end of a collection.
+func (s *UserService) addCollectionRecipe(userID, collectionID string, recipeID int) error {
+	if err := s.ownCollection(userID, collectionID); err != nil {
+		return err
+	}
+
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = $1 AND hidden_at IS NULL)", recipeID).Scan(&exists)
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	if !exists {
+		return errors.NewNotFoundError("Recipe not found")
+	}
+
+	err = s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM collection_recipes WHERE collection_id = $1 AND recipe_id = $2)",
+		collectionID, recipeID,
+	).Scan(&exists)
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	if exists {
+		return errors.NewConflictError("Recipe already in collection")
+	}
+
+	now := time.Now().UTC()
+	_, err = s.db.Exec(
+		`INSERT INTO collection_recipes (collection_id, recipe_id, position, added_at)
+		VALUES ($1, $2, (SELECT COALESCE(MAX(position), -1) + 1 FROM collection_recipes WHERE collection_id = $1), $3)`,
+		collectionID, recipeID, now,
+	)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to add recipe to collection", err)
+	}
+
+	_, err = s.db.Exec("UPDATE collections SET updated_at = $1 WHERE id = $2", now, collectionID)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to add recipe to collection", err)
+	}
+
+	return nil
+}
+
+func (s *UserService) removeCollectionRecipe(userID, collectionID string, recipeID int) error {
+	if err := s.ownCollection(userID, collectionID); err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec(
+		"DELETE FROM collection_recipes WHERE collection_id = $1 AND recipe_id = $2",
+		collectionID, recipeID,
+	)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to remove recipe from collection", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	if rowsAffected == 0 {
+		return errors.NewNotFoundError("Recipe not in collection")
+	}
+
+	_, err = s.db.Exec("UPDATE collections SET updated_at = $1 WHERE id = $2", time.Now().UTC(), collectionID)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to remove recipe from collection", err)
+	}
+
+	return nil
+}
+
+// reorderCollection puts a collection's recipes in the given order. The list
+// must name every recipe in the collection exactly once. Recipes hidden by a
+// moderator are not listed and move to the end.
+func (s *UserService) reorderCollection(userID, collectionID string, recipeIDs []int) error {
+	if err := s.ownCollection(userID, collectionID); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM collection_recipes cr
+		JOIN recipes r ON r.id = cr.recipe_id
+		WHERE cr.collection_id = $1 AND r.hidden_at IS NULL`, collectionID,
+	).Scan(&count)
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+
+	seen := make(map[int]bool, len(recipeIDs))
+	for _, recipeID := range recipeIDs {
+		if seen[recipeID] {
+			return errors.NewBadRequestError(fmt.Sprintf("Recipe %d is listed more than once", recipeID))
+		}
+		seen[recipeID] = true
+	}
+	if len(recipeIDs) != count {
+		return errors.NewBadRequestError("The new order must list every recipe in the collection exactly once")
+	}
+
+	for position, recipeID := range recipeIDs {
+		result, err := tx.Exec(
+			`UPDATE collection_recipes SET position = $1
+			WHERE collection_id = $2 AND recipe_id = $3 AND recipe_id IN (SELECT id FROM recipes WHERE hidden_at IS NULL)`,
+			position, collectionID, recipeID,
+		)
+		if err != nil {
+			return errors.NewInternalServerError("Failed to reorder collection", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return errors.NewInternalServerError("Database error", err)
+		}
+		if rowsAffected == 0 {
+			return errors.NewBadRequestError(fmt.Sprintf("Recipe %d is not in the collection", recipeID))
+		}
+	}
+
+	_, err = tx.Exec(
+		`UPDATE collection_recipes SET position = position + $1
+		WHERE collection_id = $2 AND recipe_id IN (SELECT id FROM recipes WHERE hidden_at IS NOT NULL)`,
+		len(recipeIDs), collectionID,
+	)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to reorder collection", err)
+	}
+
+	_, err = tx.Exec("UPDATE collections SET updated_at = $1 WHERE id = $2", time.Now().UTC(), collectionID)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to reorder collection", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.NewInternalServerError("Failed to reorder collection", err)
+	}
+
+	return nil
+}
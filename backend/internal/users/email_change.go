@@ -0,0 +1,236 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+const (
+	emailChangeConfirmLifetime = 24 * time.Hour
+	emailChangeRevertLifetime  = 7 * 24 * time.Hour
+)
+
+// newLinkToken returns a random token for a link sent to the user, and the
+// hash under which it is stored.
+func newLinkToken() (token, tokenHash string, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashLinkToken(token), nil
+}
+
+func hashLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *UserService) pendingEmail(userID string) (string, error) {
+	var newEmail string
+	err := s.db.QueryRow(
+		"SELECT new_email FROM email_changes WHERE user_id = $1 AND confirmed_at IS NULL AND created_at > $2",
+		userID, time.Now().UTC().Add(-emailChangeConfirmLifetime),
+	).Scan(&newEmail)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return newEmail, err
+}
+
+func (s *UserService) cancelPendingEmailChange(userID string) error {
+	_, err := s.db.Exec("DELETE FROM email_changes WHERE user_id = $1 AND confirmed_at IS NULL", userID)
+	return err
+}
+
+// requestEmailChange records newEmail as pending and mails a confirmation
+// link to it. The account keeps its current email until the link is used.
+func (s *UserService) requestEmailChange(userID, oldEmail, newEmail string) error {
+	if err := s.cancelPendingEmailChange(userID); err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+
+	token, tokenHash, err := newLinkToken()
+	if err != nil {
+		return errors.NewInternalServerError("Failed to create confirmation link", err)
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO email_changes (id, user_id, old_email, new_email, confirm_token_hash, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		uuid.New().String(), userID, oldEmail, newEmail, tokenHash, time.Now().UTC(),
+	)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to record email change", err)
+	}
+
+	body := fmt.Sprintf(
+		"Confirm that you want to use this address for your account by opening the link below. It expires in %d hours.\n\n%s/confirm-email?token=%s\n\nIf you did not ask for this, you can ignore this message.",
+		int(emailChangeConfirmLifetime.Hours()), s.linkBaseURL, token,
+	)
+	if err := s.mailer.Send(newEmail, "Confirm your new email address", body); err != nil {
+		return errors.NewInternalServerError("Failed to send confirmation email", err)
+	}
+
+	return nil
+}
+
+// confirmEmailChange applies a pending change and tells the old address how
+// to undo it, in case the change was made by someone else.
+func (s *UserService) confirmEmailChange(token string) (UserProfile, error) {
+	var changeID, userID, oldEmail, newEmail string
+	var createdAt time.Time
+	err := s.db.QueryRow(
+		"SELECT id, user_id, old_email, new_email, created_at FROM email_changes WHERE confirm_token_hash = $1 AND confirmed_at IS NULL",
+		hashLinkToken(token),
+	).Scan(&changeID, &userID, &oldEmail, &newEmail, &createdAt)
+	if err == sql.ErrNoRows || (err == nil && time.Since(createdAt) > emailChangeConfirmLifetime) {
+		return UserProfile{}, errors.NewBadRequestError("Invalid or expired confirmation link")
+	}
+	if err != nil {
+		return UserProfile{}, errors.NewInternalServerError("Database error", err)
+	}
+
+	var taken bool
+	err = s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = $1 AND id != $2)",
+		newEmail, userID,
+	).Scan(&taken)
+	if err != nil {
+		return UserProfile{}, errors.NewInternalServerError("Database error", err)
+	}
+	if taken {
+		return UserProfile{}, errors.NewConflictError("Email already taken")
+	}
+
+	revertToken, revertTokenHash, err := newLinkToken()
+	if err != nil {
+		return UserProfile{}, errors.NewInternalServerError("Failed to create revert link", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return UserProfile{}, errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	// The change only applies if the email has not been changed some other
+	// way since it was requested.
+	result, err := tx.Exec(
+		"UPDATE users SET email = $1, email_verified_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id = $2 AND email = $3",
+		newEmail, userID, oldEmail,
+	)
+	if err != nil {
+		return UserProfile{}, errors.NewInternalServerError("Failed to update email", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return UserProfile{}, errors.NewInternalServerError("Database error", err)
+	}
+	if rowsAffected == 0 {
+		return UserProfile{}, errors.NewBadRequestError("Invalid or expired confirmation link")
+	}
+
+	_, err = tx.Exec(
+		"UPDATE email_changes SET confirmed_at = $1, revert_token_hash = $2 WHERE id = $3",
+		time.Now().UTC(), revertTokenHash, changeID,
+	)
+	if err != nil {
+		return UserProfile{}, errors.NewInternalServerError("Failed to update email", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return UserProfile{}, errors.NewInternalServerError("Failed to update email", err)
+	}
+
+	body := fmt.Sprintf(
+		"The email address for your account was changed to %s.\n\nIf you did not make this change, open the link below within %d days to restore this address and sign out every device.\n\n%s/revert-email?token=%s",
+		newEmail, int(emailChangeRevertLifetime.Hours()/24), s.linkBaseURL, revertToken,
+	)
+	if err := s.mailer.Send(oldEmail, "Your email address was changed", body); err != nil {
+		log.Printf("Warning: failed to notify %s of email change: %v", oldEmail, err)
+	}
+
+	return s.getUserProfile(userID)
+}
+
+// revertEmailChange restores the address a confirmed change replaced. As the
+// change may have been made by someone with access to the account, every
+// session is ended too.
+func (s *UserService) revertEmailChange(token string) error {
+	var changeID, userID, oldEmail string
+	var confirmedAt time.Time
+	err := s.db.QueryRow(
+		"SELECT id, user_id, old_email, confirmed_at FROM email_changes WHERE revert_token_hash = $1 AND reverted_at IS NULL",
+		hashLinkToken(token),
+	).Scan(&changeID, &userID, &oldEmail, &confirmedAt)
+	if err == sql.ErrNoRows || (err == nil && time.Since(confirmedAt) > emailChangeRevertLifetime) {
+		return errors.NewBadRequestError("Invalid or expired revert link")
+	}
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+
+	var taken bool
+	err = s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = $1 AND id != $2)",
+		oldEmail, userID,
+	).Scan(&taken)
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	if taken {
+		return errors.NewConflictError("Email already taken by another account")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	// The revert link went to the old address, so following it proves the
+	// owner still controls that address.
+	_, err = tx.Exec("UPDATE users SET email = $1, email_verified_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id = $2", oldEmail, userID)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to restore email", err)
+	}
+
+	_, err = tx.Exec("UPDATE email_changes SET reverted_at = $1 WHERE id = $2", time.Now().UTC(), changeID)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to restore email", err)
+	}
+
+	// Later changes were made from the same compromised state; their revert
+	// links, sent to addresses the owner may not control, must not undo this.
+	_, err = tx.Exec(
+		"UPDATE email_changes SET revert_token_hash = NULL WHERE user_id = $1 AND id != $2 AND confirmed_at >= $3",
+		userID, changeID, confirmedAt,
+	)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to restore email", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM email_changes WHERE user_id = $1 AND confirmed_at IS NULL", userID); err != nil {
+		return errors.NewInternalServerError("Failed to restore email", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = $1", userID); err != nil {
+		return errors.NewInternalServerError("Failed to end sessions", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.NewInternalServerError("Failed to restore email", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,426 @@
+package users
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+const (
+	ExportFormatJSON = "json"
+	ExportFormatCSV  = "csv"
+
+	ExportStatusPending = "pending"
+	ExportStatusReady   = "ready"
+	ExportStatusFailed  = "failed"
+
+	// exportBuildTimeout is how long an export may stay pending before it is
+	// presumed lost, for example to a restart, and a new one may be requested.
+	exportBuildTimeout = 15 * time.Minute
+	// exportRetention is how long a finished archive is kept for download.
+	exportRetention = 7 * 24 * time.Hour
+	// exportLinkLifetime limits each download link; the status endpoint
+	// hands out a fresh one on every call.
+	exportLinkLifetime = 15 * time.Minute
+)
+
+// exportSection is one kind of data included in an export. Every query takes
+// the user ID as its only parameter and selects the listed columns.
+type exportSection struct {
+	name    string
+	columns []string
+	query   string
+}
+
+var exportSections = []exportSection{
+	{
+		name:    "profile",
+		columns: []string{"id", "username", "email", "role", "created_at", "updated_at"},
+		query:   "SELECT id, username, email, role, created_at, updated_at FROM users WHERE id = $1",
+	},
+	{
+		name:    "profile_settings",
+		columns: []string{"display_name", "show_join_date", "show_recipes", "show_collections", "show_stats", "show_follows", "updated_at"},
+		query:   "SELECT display_name, show_join_date, show_recipes, show_collections, show_stats, show_follows, updated_at FROM profile_settings WHERE user_id = $1",
+	},
+	{
+		name:    "liked_recipes",
+		columns: []string{"recipe_id", "recipe_name", "category", "liked_at"},
+		query: `SELECT r.id, r.name, r.category, ulr.created_at
+			FROM user_liked_recipes ulr
+			JOIN recipes r ON r.id = ulr.recipe_id
+			WHERE ulr.user_id = $1
+			ORDER BY ulr.created_at`,
+	},
+	{
+		name:    "recipes",
+		columns: []string{"id", "name", "category", "prep_time_minutes", "cook_time_minutes", "servings", "difficulty", "instructions", "description", "forked_from", "created_at", "hidden_at"},
+		query: `SELECT id, name, category, prep_time_minutes, cook_time_minutes, servings, difficulty, instructions, description, forked_from, created_at, hidden_at
+			FROM recipes
+			WHERE author_id = $1
+			ORDER BY created_at`,
+	},
+	{
+		name:    "recipe_notes",
+		columns: []string{"recipe_id", "recipe_name", "note", "updated_at"},
+		query: `SELECT r.id, r.name, n.note, n.updated_at
+			FROM recipe_notes n
+			JOIN recipes r ON r.id = n.recipe_id
+			WHERE n.user_id = $1
+			ORDER BY n.updated_at`,
+	},
+	{
+		name:    "ingredient_tweaks",
+		columns: []string{"recipe_id", "ingredient_id", "quantity", "unit", "substitute_ingredient_id"},
+		query: `SELECT recipe_id, ingredient_id, quantity, unit, substitute_ingredient_id
+			FROM recipe_ingredient_tweaks
+			WHERE user_id = $1
+			ORDER BY recipe_id, ingredient_id`,
+	},
+	{
+		name:    "pantry",
+		columns: []string{"ingredient_id", "quantity", "unit", "expires_at", "created_at", "updated_at"},
+		query: `SELECT ingredient_id, quantity, unit, expires_at, created_at, updated_at
+			FROM pantry_items
+			WHERE user_id = $1
+			ORDER BY ingredient_id`,
+	},
+	{
+		name:    "recipe_revisions",
+		columns: []string{"recipe_id", "revision", "summary", "reverted_from", "created_at"},
+		query: `SELECT recipe_id, revision, summary, reverted_from, created_at
+			FROM recipe_revisions
+			WHERE author_id = $1
+			ORDER BY created_at`,
+	},
+	{
+		name:    "reviews",
+		columns: []string{"recipe_id", "recipe_name", "rating", "review", "created_at", "updated_at", "hidden_at"},
+		query: `SELECT r.id, r.name, rr.rating, rr.review, rr.created_at, rr.updated_at, rr.hidden_at
+			FROM recipe_reviews rr
+			JOIN recipes r ON r.id = rr.recipe_id
+			WHERE rr.user_id = $1
+			ORDER BY rr.created_at`,
+	},
+	{
+		name:    "comments",
+		columns: []string{"id", "recipe_id", "recipe_name", "parent_id", "body", "created_at", "edited_at", "deleted_at", "hidden_at"},
+		query: `SELECT c.id, r.id, r.name, c.parent_id, c.body, c.created_at, c.edited_at, c.deleted_at, c.hidden_at
+			FROM recipe_comments c
+			JOIN recipes r ON r.id = c.recipe_id
+			WHERE c.user_id = $1
+			ORDER BY c.created_at`,
+	},
+	{
+		name:    "collections",
+		columns: []string{"id", "name", "description", "is_public", "created_at", "updated_at"},
+		query:   "SELECT id, name, description, is_public, created_at, updated_at FROM collections WHERE user_id = $1 ORDER BY created_at",
+	},
+	{
+		name:    "collection_recipes",
+		columns: []string{"collection_id", "collection_name", "position", "recipe_id", "recipe_name", "added_at"},
+		query: `SELECT c.id, c.name, cr.position, r.id, r.name, cr.added_at
+			FROM collection_recipes cr
+			JOIN collections c ON c.id = cr.collection_id
+			JOIN recipes r ON r.id = cr.recipe_id
+			WHERE c.user_id = $1
+			ORDER BY c.created_at, cr.position`,
+	},
+	{
+		name:    "following",
+		columns: []string{"username", "followed_at"},
+		query: `SELECT u.username, f.created_at
+			FROM follows f
+			JOIN users u ON u.id = f.followee_id
+			WHERE f.follower_id = $1
+			ORDER BY f.created_at`,
+	},
+	{
+		name:    "reports",
+		columns: []string{"content_type", "content_id", "reason", "details", "status", "created_at", "resolved_at"},
+		query: `SELECT content_type, content_id, reason, details, status, created_at, resolved_at
+			FROM content_reports
+			WHERE reporter_id = $1
+			ORDER BY created_at`,
+	},
+	{
+		name:    "moderation_actions",
+		columns: []string{"action", "content_type", "content_id", "reason", "created_at"},
+		query: `SELECT action, content_type, content_id, reason, created_at
+			FROM moderation_actions
+			WHERE user_id = $1
+			ORDER BY created_at`,
+	},
+	{
+		name:    "identities",
+		columns: []string{"provider", "email", "linked_at"},
+		query:   "SELECT provider, email, created_at FROM user_identities WHERE user_id = $1 ORDER BY provider",
+	},
+	{
+		name:    "api_keys",
+		columns: []string{"name", "prefix", "scopes", "created_at", "last_used_at", "expires_at"},
+		query:   "SELECT name, prefix, scopes, created_at, last_used_at, expires_at FROM api_keys WHERE user_id = $1 ORDER BY created_at",
+	},
+	{
+		name:    "sessions",
+		columns: []string{"user_agent", "ip_address", "created_at", "last_seen_at"},
+		query:   "SELECT user_agent, ip_address, created_at, last_seen_at FROM sessions WHERE user_id = $1 ORDER BY created_at",
+	},
+	{
+		name:    "email_changes",
+		columns: []string{"old_email", "new_email", "requested_at", "confirmed_at", "reverted_at"},
+		query:   "SELECT old_email, new_email, created_at, confirmed_at, reverted_at FROM email_changes WHERE user_id = $1 ORDER BY created_at",
+	},
+}
+
+func IsValidExportFormat(format string) bool {
+	return format == ExportFormatJSON || format == ExportFormatCSV
+}
+
+// requestExport records a new export and starts building it in the
+// background. Only one export per user may be in progress.
+func (s *UserService) requestExport(userID, format string) (DataExport, error) {
+	var inProgress bool
+	err := s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM data_exports WHERE user_id = $1 AND status = $2 AND created_at > $3)",
+		userID, ExportStatusPending, time.Now().UTC().Add(-exportBuildTimeout),
+	).Scan(&inProgress)
+	if err != nil {
+		return DataExport{}, errors.NewInternalServerError("Database error", err)
+	}
+	if inProgress {
+		return DataExport{}, errors.NewConflictError("An export is already being prepared")
+	}
+
+	export := DataExport{
+		ID:        uuid.New().String(),
+		Format:    format,
+		Status:    ExportStatusPending,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err = s.db.Exec(
+		"INSERT INTO data_exports (id, user_id, format, status, created_at) VALUES ($1, $2, $3, $4, $5)",
+		export.ID, userID, export.Format, export.Status, export.CreatedAt,
+	)
+	if err != nil {
+		return DataExport{}, errors.NewInternalServerError("Failed to start export", err)
+	}
+
+	go func() {
+		if err := s.buildExport(export.ID, userID, format); err != nil {
+			log.Printf("Warning: export %s failed: %v", export.ID, err)
+		}
+	}()
+
+	return export, nil
+}
+
+// buildExport collects the user's data into a zip archive and stores it on
+// the export row. Failures are recorded on the row as well.
+func (s *UserService) buildExport(exportID, userID, format string) error {
+	archive, err := s.exportArchive(userID, format)
+	if err != nil {
+		_, dbErr := s.db.Exec(
+			"UPDATE data_exports SET status = $1, error = $2, completed_at = $3 WHERE id = $4",
+			ExportStatusFailed, "Export could not be created", time.Now().UTC(), exportID,
+		)
+		if dbErr != nil {
+			log.Printf("Warning: failed to record export failure: %v", dbErr)
+		}
+		return err
+	}
+
+	now := time.Now().UTC()
+	_, err = s.db.Exec(
+		"UPDATE data_exports SET status = $1, archive = $2, completed_at = $3, expires_at = $4 WHERE id = $5",
+		ExportStatusReady, archive, now, now.Add(exportRetention), exportID,
+	)
+	return err
+}
+
+func (s *UserService) exportArchive(userID, format string) ([]byte, error) {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+
+	data := make(map[string][]map[string]interface{})
+	for _, section := range exportSections {
+		rows, err := s.exportRows(section, userID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", section.name, err)
+		}
+
+		if format == ExportFormatCSV {
+			file, err := archive.Create(section.name + ".csv")
+			if err != nil {
+				return nil, err
+			}
+			writer := csv.NewWriter(file)
+			writer.Write(section.columns)
+			for _, row := range rows {
+				record := make([]string, len(row))
+				for i, value := range row {
+					if value != nil {
+						record[i] = fmt.Sprint(value)
+					}
+				}
+				writer.Write(record)
+			}
+			writer.Flush()
+			if err := writer.Error(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		objects := make([]map[string]interface{}, 0, len(rows))
+		for _, row := range rows {
+			object := make(map[string]interface{}, len(section.columns))
+			for i, column := range section.columns {
+				object[column] = row[i]
+			}
+			objects = append(objects, object)
+		}
+		data[section.name] = objects
+	}
+
+	if format == ExportFormatJSON {
+		file, err := archive.Create("data.json")
+		if err != nil {
+			return nil, err
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// exportRows returns a section's rows with values converted to plain strings,
+// numbers and RFC 3339 times, whichever database driver produced them.
+func (s *UserService) exportRows(section exportSection, userID string) ([][]interface{}, error) {
+	rows, err := s.db.Query(section.query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result [][]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(section.columns))
+		pointers := make([]interface{}, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		for i, value := range values {
+			switch v := value.(type) {
+			case []byte:
+				values[i] = string(v)
+			case time.Time:
+				values[i] = v.UTC().Format(time.RFC3339)
+			}
+		}
+		result = append(result, values)
+	}
+
+	return result, rows.Err()
+}
+
+// getExport returns the status of one of the user's exports. When the archive
+// is ready a new short-lived download link is issued.
+func (s *UserService) getExport(userID, exportID string) (DataExport, error) {
+	var export DataExport
+	var exportError sql.NullString
+	var completedAt, expiresAt sql.NullTime
+	err := s.db.QueryRow(
+		"SELECT id, format, status, error, created_at, completed_at, expires_at FROM data_exports WHERE id = $1 AND user_id = $2",
+		exportID, userID,
+	).Scan(&export.ID, &export.Format, &export.Status, &exportError, &export.CreatedAt, &completedAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return DataExport{}, errors.NewNotFoundError("Export not found")
+	}
+	if err != nil {
+		return DataExport{}, errors.NewInternalServerError("Database error", err)
+	}
+
+	export.Error = exportError.String
+	if completedAt.Valid {
+		export.CompletedAt = &completedAt.Time
+	}
+	if expiresAt.Valid {
+		export.ExpiresAt = &expiresAt.Time
+	}
+
+	if export.Status == ExportStatusPending && time.Since(export.CreatedAt) > exportBuildTimeout {
+		export.Status = ExportStatusFailed
+		export.Error = "Export did not finish in time"
+	}
+
+	if export.Status != ExportStatusReady || export.ExpiresAt == nil || !export.ExpiresAt.After(time.Now()) {
+		return export, nil
+	}
+
+	token, tokenHash, err := newLinkToken()
+	if err != nil {
+		return DataExport{}, errors.NewInternalServerError("Failed to create download link", err)
+	}
+	_, err = s.db.Exec(
+		"UPDATE data_exports SET download_token_hash = $1, link_expires_at = $2 WHERE id = $3",
+		tokenHash, time.Now().UTC().Add(exportLinkLifetime), export.ID,
+	)
+	if err != nil {
+		return DataExport{}, errors.NewInternalServerError("Failed to create download link", err)
+	}
+	export.DownloadURL = "/api/user/export/download?token=" + token
+
+	return export, nil
+}
+
+// downloadExport returns the archive behind a download link.
+func (s *UserService) downloadExport(token string) ([]byte, time.Time, error) {
+	var archive []byte
+	var createdAt time.Time
+	now := time.Now().UTC()
+	err := s.db.QueryRow(
+		`SELECT archive, created_at FROM data_exports
+		WHERE download_token_hash = $1 AND status = $2 AND link_expires_at > $3 AND expires_at > $3`,
+		hashLinkToken(token), ExportStatusReady, now,
+	).Scan(&archive, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, errors.NewNotFoundError("Download link is invalid or has expired")
+	}
+	if err != nil {
+		return nil, time.Time{}, errors.NewInternalServerError("Database error", err)
+	}
+
+	return archive, createdAt, nil
+}
+
+// PurgeExpiredExports deletes archives that are past their retention period.
+func (s *UserService) PurgeExpiredExports() (int64, error) {
+	result, err := s.db.Exec(
+		"DELETE FROM data_exports WHERE expires_at <= $1 OR (status != $2 AND created_at <= $3)",
+		time.Now().UTC(), ExportStatusReady, time.Now().UTC().Add(-exportRetention),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
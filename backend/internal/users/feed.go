@@ -0,0 +1,181 @@
+package users
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+const (
+	FeedItemRecipe     = "recipe"
+	FeedItemReview     = "review"
+	FeedItemCollection = "collection"
+)
+
+// feedSource is one kind of activity shown in the feed. Every query selects
+// the same columns so that the sources can be merged: item type, a key unique
+// across all sources that breaks ties between items created at the same time,
+// the item ID, the acting user, when it happened, the recipe it concerns, a
+// title, a rating and some text. %s in the query is replaced with the
+// condition limiting it to followed users and to items after the cursor,
+// built from the actor, createdAt and key expressions. setting names the
+// profile_settings column that hides the source from the actor's public
+// profile; the feed hides it too.
+type feedSource struct {
+	query     string
+	actor     string
+	createdAt string
+	key       string
+	setting   string
+}
+
+var feedSources = []feedSource{
+	{
+		query: `SELECT 'recipe' AS item_type, 'recipe:' || CAST(r.id AS TEXT) AS feed_key, CAST(r.id AS TEXT) AS item_id,
+			r.author_id AS actor_id, r.created_at AS created_at, r.id AS recipe_id, r.name AS title,
+			CAST(NULL AS INTEGER) AS rating, COALESCE(r.description, '') AS body
+		FROM recipes r
+		WHERE r.hidden_at IS NULL AND %s`,
+		actor:     "r.author_id",
+		createdAt: "r.created_at",
+		key:       "'recipe:' || CAST(r.id AS TEXT)",
+		setting:   "show_recipes",
+	},
+	{
+		query: `SELECT 'review', 'review:' || rr.id, rr.id,
+			rr.user_id, rr.created_at, r.id, r.name,
+			rr.rating, rr.review
+		FROM recipe_reviews rr
+		JOIN recipes r ON r.id = rr.recipe_id
+		WHERE rr.hidden_at IS NULL AND r.hidden_at IS NULL AND %s`,
+		actor:     "rr.user_id",
+		createdAt: "rr.created_at",
+		key:       "'review:' || rr.id",
+	},
+	{
+		query: `SELECT 'collection', 'collection:' || c.id, c.id,
+			c.user_id, c.created_at, CAST(NULL AS INTEGER), c.name,
+			CAST(NULL AS INTEGER), c.description
+		FROM collections c
+		WHERE c.is_public AND %s`,
+		actor:     "c.user_id",
+		createdAt: "c.created_at",
+		key:       "'collection:' || c.id",
+		setting:   "show_collections",
+	},
+}
+
+// feedCursor marks the last item of a feed page; the next page starts with
+// the items that sort after it.
+type feedCursor struct {
+	createdAt time.Time
+	key       string
+}
+
+func encodeFeedCursor(cursor feedCursor) string {
+	raw := cursor.createdAt.UTC().Format(time.RFC3339Nano) + "|" + cursor.key
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeFeedCursor(encoded string) (feedCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return feedCursor{}, err
+	}
+	createdAt, key, found := strings.Cut(string(raw), "|")
+	if !found || key == "" {
+		return feedCursor{}, fmt.Errorf("malformed cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return feedCursor{}, err
+	}
+	return feedCursor{createdAt: t.UTC(), key: key}, nil
+}
+
+// getFeed returns recent activity from the users the given user follows,
+// newest first, and the cursor for the next page if there is one.
+//
+// The feed is assembled when read rather than stored per follower. Each
+// source is limited to the followed users and to one page before the results
+// are merged, so every part of the query can use the (user, created_at)
+// indexes however many accounts are followed.
+func (s *UserService) getFeed(userID, cursor string, limit int) ([]FeedItem, string, error) {
+	args := []interface{}{userID}
+	cursorCondition := ""
+	if cursor != "" {
+		after, err := decodeFeedCursor(cursor)
+		if err != nil {
+			return nil, "", errors.NewBadRequestError("Invalid cursor")
+		}
+		args = append(args, after.createdAt, after.key)
+		cursorCondition = " AND (%[2]s < $2 OR (%[2]s = $2 AND %[3]s < $3))"
+	}
+	args = append(args, limit+1)
+	limitParam := len(args)
+
+	parts := make([]string, len(feedSources))
+	for i, source := range feedSources {
+		condition := fmt.Sprintf("%[1]s IN (SELECT followee_id FROM follows WHERE follower_id = $1)"+cursorCondition,
+			source.actor, source.createdAt, source.key)
+		if source.setting != "" {
+			condition += fmt.Sprintf(" AND NOT EXISTS (SELECT 1 FROM profile_settings ps WHERE ps.user_id = %s AND NOT ps.%s)",
+				source.actor, source.setting)
+		}
+		parts[i] = fmt.Sprintf("SELECT * FROM (%s ORDER BY %s DESC, %s DESC LIMIT $%d) AS source_%d",
+			fmt.Sprintf(source.query, condition), source.createdAt, source.key, limitParam, i)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT feed.item_type, feed.feed_key, feed.item_id, u.username, feed.created_at,
+			feed.recipe_id, feed.title, feed.rating, feed.body
+		FROM (%s) AS feed
+		JOIN users u ON u.id = feed.actor_id
+		WHERE u.delete_after IS NULL
+		ORDER BY feed.created_at DESC, feed.feed_key DESC
+		LIMIT $%d`, strings.Join(parts, " UNION ALL "), limitParam)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, "", errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	items := []FeedItem{}
+	var keys []string
+	for rows.Next() {
+		var item FeedItem
+		var key string
+		var recipeID, rating sql.NullInt64
+		err := rows.Scan(&item.Type, &key, &item.ID, &item.Username, &item.CreatedAt,
+			&recipeID, &item.Title, &rating, &item.Text)
+		if err != nil {
+			return nil, "", errors.NewInternalServerError("Data scanning error", err)
+		}
+		if recipeID.Valid {
+			id := int(recipeID.Int64)
+			item.RecipeID = &id
+		}
+		if rating.Valid {
+			value := int(rating.Int64)
+			item.Rating = &value
+		}
+		items = append(items, item)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	nextCursor := ""
+	if len(items) > limit {
+		items = items[:limit]
+		nextCursor = encodeFeedCursor(feedCursor{createdAt: items[limit-1].CreatedAt, key: keys[limit-1]})
+	}
+
+	return items, nextCursor, nil
+}
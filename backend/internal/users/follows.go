@@ -0,0 +1,130 @@
+package users
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+// userIDByUsername looks up an active account by username, ignoring case.
+// Accounts scheduled for deletion are treated as gone.
+func (s *UserService) userIDByUsername(username string) (string, error) {
+	var userID string
+	err := s.db.QueryRow(
+		"SELECT id FROM users WHERE LOWER(username) = LOWER($1) AND delete_after IS NULL",
+		username,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", errors.NewNotFoundError("User not found")
+	}
+	if err != nil {
+		return "", errors.NewInternalServerError("Database error", err)
+	}
+	return userID, nil
+}
+
+func (s *UserService) follow(followerID, username string) error {
+	followeeID, err := s.userIDByUsername(username)
+	if err != nil {
+		return err
+	}
+	if followeeID == followerID {
+		return errors.NewBadRequestError("You cannot follow yourself")
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO follows (follower_id, followee_id, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (follower_id, followee_id) DO NOTHING`,
+		followerID, followeeID, time.Now().UTC(),
+	)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to follow user", err)
+	}
+
+	return nil
+}
+
+func (s *UserService) unfollow(followerID, username string) error {
+	followeeID, err := s.userIDByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec(
+		"DELETE FROM follows WHERE follower_id = $1 AND followee_id = $2",
+		followerID, followeeID,
+	)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to unfollow user", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	if rowsAffected == 0 {
+		return errors.NewNotFoundError("You are not following this user")
+	}
+
+	return nil
+}
+
+// followList pages through the accounts following a user (followers) or the
+// accounts the user follows, most recent first. Users can hide these lists
+// from everyone but themselves.
+func (s *UserService) followList(viewerID, username string, followers bool, limit, offset int) ([]FollowEntry, int, error) {
+	userID, err := s.userIDByUsername(username)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	settings, err := s.getProfileSettings(userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !settings.ShowFollows && viewerID != userID {
+		return nil, 0, errors.NewForbiddenError("This user keeps their follows private")
+	}
+
+	matchColumn, otherColumn := "followee_id", "follower_id"
+	if !followers {
+		matchColumn, otherColumn = "follower_id", "followee_id"
+	}
+
+	var total int
+	err = s.db.QueryRow(`
+		SELECT COUNT(*) FROM follows f
+		JOIN users u ON u.id = f.`+otherColumn+`
+		WHERE f.`+matchColumn+` = $1 AND u.delete_after IS NULL`, userID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT u.username, f.created_at FROM follows f
+		JOIN users u ON u.id = f.`+otherColumn+`
+		WHERE f.`+matchColumn+` = $1 AND u.delete_after IS NULL
+		ORDER BY f.created_at DESC, u.username
+		LIMIT $2 OFFSET $3`,
+		userID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	entries := []FollowEntry{}
+	for rows.Next() {
+		var entry FollowEntry
+		if err := rows.Scan(&entry.Username, &entry.FollowedAt); err != nil {
+			return nil, 0, errors.NewInternalServerError("Data scanning error", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return entries, total, nil
+}
@@ -2,20 +2,24 @@ package users
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/ngthecoder/go_web_api/internal/auth"
 	"github.com/ngthecoder/go_web_api/internal/errors"
 )
 
 type UserHandler struct {
-	userService *UserService
+	userService    *UserService
+	passwordPolicy *auth.PasswordPolicy
 }
 
-func NewUserHandler(s *UserService) *UserHandler {
+func NewUserHandler(s *UserService, passwordPolicy *auth.PasswordPolicy) *UserHandler {
 	return &UserHandler{
-		userService: s,
+		userService:    s,
+		passwordPolicy: passwordPolicy,
 	}
 }
 
@@ -32,17 +36,96 @@ func (h *UserHandler) GetProfile(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(userProfile)
 }
 
+// GetLikedRecipes serves GET /api/user/liked-recipes, a page of the caller's
+// liked recipes with the same filters as the recipe list.
 func (h *UserHandler) GetLikedRecipes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
 	userID := r.Context().Value("user_id").(string)
 
-	recipesList, err := h.userService.getLikedRecipes(userID)
+	query := r.URL.Query()
+	search := strings.TrimSpace(query.Get("search"))
+	category := strings.TrimSpace(query.Get("category"))
+	difficulty := strings.TrimSpace(query.Get("difficulty"))
+	sort := query.Get("sort")
+	order := query.Get("order")
+
+	var maxTime int
+	if m, err := strconv.Atoi(query.Get("max_time")); err == nil && m > 0 {
+		maxTime = m
+	}
+
+	validSorts := map[string]bool{
+		"liked_at": true, "name": true, "prep_time": true, "cook_time": true, "total_time": true,
+	}
+	if sort == "" || !validSorts[sort] {
+		sort = "liked_at"
+	}
+
+	if order != "asc" && order != "desc" {
+		order = "asc"
+		if sort == "liked_at" {
+			order = "desc"
+		}
+	}
+
+	page := 1
+	if p, err := strconv.Atoi(query.Get("page")); err == nil && p > 0 {
+		page = p
+	}
+	limit := 10
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+
+	recipesList, total, err := h.userService.getLikedRecipes(userID, search, category, difficulty, sort, order, maxTime, limit, (page-1)*limit)
 	if err != nil {
 		errors.WriteHTTPError(w, err)
 		return
 	}
 
+	totalPages := (total + limit - 1) / limit
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(recipesList)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recipes":     recipesList,
+		"total":       total,
+		"page":        page,
+		"page_size":   limit,
+		"total_pages": totalPages,
+		"has_next":    page < totalPages,
+	})
+}
+
+// BulkLikedRecipes serves POST /api/user/liked-recipes/bulk, adding and
+// removing many likes at once with a result for each recipe.
+func (h *UserHandler) BulkLikedRecipes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	userID := r.Context().Value("user_id").(string)
+
+	var request BulkLikedRecipesRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+		return
+	}
+
+	results, err := h.userService.bulkUpdateLikedRecipes(userID, request)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": results,
+	})
 }
 
 func (h *UserHandler) AddLikedRecipe(w http.ResponseWriter, r *http.Request) {
@@ -153,12 +236,20 @@ func (h *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(request.NewPassword) < 6 {
-		errors.WriteHTTPError(w, errors.NewBadRequestError("New password must be at least 6 characters"))
+	profile, err := h.userService.getUserProfile(userID)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	if violations := h.passwordPolicy.Validate(request.NewPassword, profile.Username, profile.Email); len(violations) > 0 {
+		errors.WriteHTTPError(w, auth.NewPolicyViolationError("new_password", violations))
 		return
 	}
 
-	err = h.userService.changePassword(userID, request.CurrentPassword, request.NewPassword)
+	sessionID, _ := r.Context().Value("session_id").(string)
+
+	err = h.userService.changePassword(userID, request.CurrentPassword, request.NewPassword, sessionID)
 	if err != nil {
 		errors.WriteHTTPError(w, err)
 		return
@@ -176,6 +267,7 @@ func (h *UserHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID := r.Context().Value("user_id").(string)
+	sessionID, _ := r.Context().Value("session_id").(string)
 
 	var request DeleteAccountRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
@@ -184,12 +276,335 @@ func (h *UserHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if request.Password == "" {
-		errors.WriteHTTPError(w, errors.NewBadRequestError("Password is required"))
+	deleteAfter, err := h.userService.deleteAccount(userID, sessionID, request.Password)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "Account scheduled for deletion; sign in through account restore before then to keep it",
+		"delete_after": deleteAfter,
+	})
+}
+
+func (h *UserHandler) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	var request EmailChangeTokenRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+		return
+	}
+
+	if request.Token == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Token is required"))
+		return
+	}
+
+	profile, err := h.userService.confirmEmailChange(request.Token)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
+}
+
+func (h *UserHandler) RevertEmailChange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	var request EmailChangeTokenRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+		return
+	}
+
+	if request.Token == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Token is required"))
+		return
+	}
+
+	err = h.userService.revertEmailChange(request.Token)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email address restored and all devices signed out. Change your password if you did not make this change."})
+}
+
+// RequestExport starts building an archive of the user's data. The body may
+// choose the "json" (default) or "csv" format.
+func (h *UserHandler) RequestExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	userID := r.Context().Value("user_id").(string)
+
+	var request ExportRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+	}
+
+	if request.Format == "" {
+		request.Format = ExportFormatJSON
+	}
+	if !IsValidExportFormat(request.Format) {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Format must be json or csv"))
+		return
+	}
+
+	export, err := h.userService.requestExport(userID, request.Format)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(export)
+}
+
+// ExportStatus serves GET /api/user/export/{id}.
+func (h *UserHandler) ExportStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	userID := r.Context().Value("user_id").(string)
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) != 5 || pathParts[4] == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/user/export/{id}"))
+		return
+	}
+
+	export, err := h.userService.getExport(userID, pathParts[4])
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(export)
+}
+
+// DownloadExport serves the archive behind a download link. The token in the
+// link is the only credential, so it can be opened directly by a browser.
+func (h *UserHandler) DownloadExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Token is required"))
+		return
+	}
+
+	archive, createdAt, err := h.userService.downloadExport(token)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="recipe-data-export-%s.zip"`, createdAt.UTC().Format("2006-01-02")))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(archive)
+}
+
+// CollectionsHandler lists the user's collections on GET and creates one on
+// POST.
+func (h *UserHandler) CollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	switch r.Method {
+	case http.MethodGet:
+		collections, err := h.userService.getCollections(userID)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"collections": collections,
+		})
+
+	case http.MethodPost:
+		var request CreateCollectionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+
+		collection, err := h.userService.createCollection(userID, strings.TrimSpace(request.Name), strings.TrimSpace(request.Description), request.IsPublic)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(collection)
+
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+	}
+}
+
+// CollectionHandler manages one of the user's collections:
+//
+//	GET, PUT, DELETE /api/user/collections/{id}
+//	POST             /api/user/collections/{id}/recipes
+//	DELETE           /api/user/collections/{id}/recipes/{recipeID}
+//	PUT              /api/user/collections/{id}/order
+func (h *UserHandler) CollectionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 5 || pathParts[4] == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/user/collections/{id}"))
+		return
+	}
+	collectionID := pathParts[4]
+
+	switch {
+	case len(pathParts) == 5:
+		h.collection(w, r, userID, collectionID)
+
+	case len(pathParts) == 6 && pathParts[5] == "recipes":
+		if r.Method != http.MethodPost {
+			errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+			return
+		}
+
+		var request LikedRecipeRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+
+		if err := h.userService.addCollectionRecipe(userID, collectionID, request.RecipeID); err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Recipe added to collection"})
+
+	case len(pathParts) == 7 && pathParts[5] == "recipes":
+		if r.Method != http.MethodDelete {
+			errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+			return
+		}
+
+		recipeID, err := strconv.Atoi(pathParts[6])
+		if err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid recipe ID"))
+			return
+		}
+
+		if err := h.userService.removeCollectionRecipe(userID, collectionID, recipeID); err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Recipe removed from collection"})
+
+	case len(pathParts) == 6 && pathParts[5] == "order":
+		if r.Method != http.MethodPut {
+			errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+			return
+		}
+
+		var request ReorderCollectionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+
+		if err := h.userService.reorderCollection(userID, collectionID, request.RecipeIDs); err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		collection, err := h.userService.getCollection(userID, collectionID)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(collection)
+
+	default:
+		errors.WriteHTTPError(w, errors.NewNotFoundError("Not found"))
+	}
+}
+
+func (h *UserHandler) collection(w http.ResponseWriter, r *http.Request, userID, collectionID string) {
+	var collection Collection
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		collection, err = h.userService.getCollection(userID, collectionID)
+
+	case http.MethodPut:
+		var request UpdateCollectionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+		collection, err = h.userService.updateCollection(userID, collectionID, request)
+
+	case http.MethodDelete:
+		if err := h.userService.deleteCollection(userID, collectionID); err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Collection deleted"})
+		return
+
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
 		return
 	}
 
-	err = h.userService.deleteAccount(userID, request.Password)
 	if err != nil {
 		errors.WriteHTTPError(w, err)
 		return
@@ -197,5 +612,295 @@ func (h *UserHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Account deleted successfully"})
+	json.NewEncoder(w).Encode(collection)
+}
+
+// SharedCollectionHandler serves GET /api/collections/{id}, the target of a
+// collection's share URL. Public collections need no login.
+func (h *UserHandler) SharedCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) != 4 || pathParts[3] == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/collections/{id}"))
+		return
+	}
+
+	// API keys only read what anyone could, so a private collection stays
+	// hidden from its owner's keys too.
+	collection, err := h.userService.getCollection(auth.SessionUserID(r), pathParts[3])
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(collection)
+}
+
+// FeedHandler serves GET /api/user/feed, recent activity from the users the
+// caller follows. Pass the returned next_cursor as cursor to get older items.
+func (h *UserHandler) FeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+
+	userID := r.Context().Value("user_id").(string)
+
+	limit := 20
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+
+	items, nextCursor, err := h.userService.getFeed(userID, r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"items":       items,
+		"next_cursor": nextCursor,
+		"has_next":    nextCursor != "",
+	})
+}
+
+// PublicUserHandler serves paths under /api/users/{username}:
+//
+//	GET         /api/users/{username}
+//	PUT, DELETE /api/users/{username}/follow
+//	GET         /api/users/{username}/followers
+//	GET         /api/users/{username}/following
+func (h *UserHandler) PublicUserHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 4 || pathParts[3] == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/users/{username}"))
+		return
+	}
+	username := pathParts[3]
+
+	// API keys view profiles as an anonymous visitor would, so sections the
+	// owner has hidden stay hidden from the owner's keys.
+	userID := auth.SessionUserID(r)
+
+	if len(pathParts) == 4 {
+		if r.Method != http.MethodGet {
+			errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+			return
+		}
+
+		profile, err := h.userService.getPublicProfile(userID, username)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(profile)
+		return
+	}
+
+	if len(pathParts) != 5 {
+		errors.WriteHTTPError(w, errors.NewNotFoundError("Not found"))
+		return
+	}
+
+	switch pathParts[4] {
+	case "follow":
+		if userID == "" {
+			errors.WriteHTTPError(w, errors.NewUnauthorizedError("Authentication required"))
+			return
+		}
+
+		var err error
+		var message string
+		switch r.Method {
+		case http.MethodPut:
+			err = h.userService.follow(userID, username)
+			message = "Now following " + username
+		case http.MethodDelete:
+			err = h.userService.unfollow(userID, username)
+			message = "Unfollowed " + username
+		default:
+			errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+			return
+		}
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": message})
+
+	case "followers", "following":
+		if r.Method != http.MethodGet {
+			errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+			return
+		}
+
+		page := 1
+		limit := 20
+		if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+			page = p
+		}
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+
+		entries, total, err := h.userService.followList(userID, username, pathParts[4] == "followers", limit, (page-1)*limit)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		totalPages := (total + limit - 1) / limit
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"users":       entries,
+			"total":       total,
+			"page":        page,
+			"page_size":   limit,
+			"total_pages": totalPages,
+			"has_next":    page < totalPages,
+		})
+
+	default:
+		errors.WriteHTTPError(w, errors.NewNotFoundError("Not found"))
+	}
+}
+
+// ProfileSettingsHandler returns the caller's public profile settings on GET
+// and changes them on PUT.
+func (h *UserHandler) ProfileSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	var settings ProfileSettings
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		settings, err = h.userService.getProfileSettings(userID)
+	case http.MethodPut:
+		var request UpdateProfileSettingsRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+		settings, err = h.userService.updateProfileSettings(userID, request)
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+		return
+	}
+	if err != nil {
+		errors.WriteHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(settings)
+}
+
+// PantryHandler lists the user's pantry on GET and adds an ingredient to it
+// on POST.
+func (h *UserHandler) PantryHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	switch r.Method {
+	case http.MethodGet:
+		items, err := h.userService.getPantry(userID)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"items": items,
+		})
+
+	case http.MethodPost:
+		var request PantryItemRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+
+		item, err := h.userService.addPantryItem(userID, request)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(item)
+
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+	}
+}
+
+// PantryItemHandler changes how much of an ingredient the user has on PUT
+// and takes it out of the pantry on DELETE:
+//
+//	PUT, DELETE /api/user/pantry/{ingredientID}
+func (h *UserHandler) PantryItemHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(string)
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) != 5 || pathParts[4] == "" {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid URL format. Use /api/user/pantry/{ingredientID}"))
+		return
+	}
+
+	ingredientID, err := strconv.Atoi(pathParts[4])
+	if err != nil {
+		errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid ingredient ID"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var request PantryItemRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			errors.WriteHTTPError(w, errors.NewBadRequestError("Invalid JSON"))
+			return
+		}
+
+		item, err := h.userService.updatePantryItem(userID, ingredientID, request)
+		if err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(item)
+
+	case http.MethodDelete:
+		if err := h.userService.removePantryItem(userID, ingredientID); err != nil {
+			errors.WriteHTTPError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Ingredient removed from pantry"})
+
+	default:
+		errors.WriteHTTPError(w, errors.NewMethodNotAllowedError())
+	}
 }
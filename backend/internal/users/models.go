@@ -1,19 +1,50 @@
 package users
 
-import "time"
+import (
+	"time"
+
+	"github.com/ngthecoder/go_web_api/internal/recipes"
+)
 
 type UserProfile struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID           string    `json:"id"`
+	Username     string    `json:"username"`
+	Email        string    `json:"email"`
+	PendingEmail string    `json:"pending_email,omitempty"`
+	Role         string    `json:"role"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 type LikedRecipeRequest struct {
 	RecipeID int `json:"recipe_id"`
 }
 
+// LikedRecipe is a liked recipe with when the user liked it.
+type LikedRecipe struct {
+	recipes.Recipe
+	LikedAt time.Time `json:"liked_at"`
+}
+
+const (
+	LikeStatusAdded          = "added"
+	LikeStatusRemoved        = "removed"
+	LikeStatusAlreadyLiked   = "already_liked"
+	LikeStatusNotLiked       = "not_liked"
+	LikeStatusRecipeNotFound = "recipe_not_found"
+)
+
+type BulkLikedRecipesRequest struct {
+	Add    []int `json:"add"`
+	Remove []int `json:"remove"`
+}
+
+type BulkLikeResult struct {
+	RecipeID int    `json:"recipe_id"`
+	Action   string `json:"action"`
+	Status   string `json:"status"`
+}
+
 type LikedRecipeResponse struct {
 	RecipeIDs []int `json:"recipe_ids"`
 }
@@ -28,3 +59,124 @@ type ChangePasswordRequest struct {
 type DeleteAccountRequest struct {
 	Password string `json:"password"`
 }
+type EmailChangeTokenRequest struct {
+	Token string `json:"token"`
+}
+
+type ExportRequest struct {
+	Format string `json:"format"`
+}
+
+type DataExport struct {
+	ID          string     `json:"id"`
+	Format      string     `json:"format"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
+
+type Collection struct {
+	ID          string           `json:"id"`
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	IsPublic    bool             `json:"is_public"`
+	Owner       string           `json:"owner"`
+	RecipeCount int              `json:"recipe_count"`
+	ShareURL    string           `json:"share_url,omitempty"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+	Recipes     []recipes.Recipe `json:"recipes,omitempty"`
+}
+
+type CreateCollectionRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	IsPublic    bool   `json:"is_public"`
+}
+
+type UpdateCollectionRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	IsPublic    *bool   `json:"is_public"`
+}
+
+type ReorderCollectionRequest struct {
+	RecipeIDs []int `json:"recipe_ids"`
+}
+
+// PantryItem is an ingredient the user has on hand. Expired items stay in
+// the pantry but are not used for recipe matching or shopping lists.
+type PantryItem struct {
+	IngredientID int        `json:"ingredient_id"`
+	Name         string     `json:"name"`
+	Category     string     `json:"category"`
+	Quantity     float64    `json:"quantity"`
+	Unit         string     `json:"unit"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	Expired      bool       `json:"expired"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+type PantryItemRequest struct {
+	IngredientID int        `json:"ingredient_id"`
+	Quantity     float64    `json:"quantity"`
+	Unit         string     `json:"unit"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+}
+
+type FollowEntry struct {
+	Username   string    `json:"username"`
+	FollowedAt time.Time `json:"followed_at"`
+}
+
+type FeedItem struct {
+	Type      string    `json:"type"`
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	RecipeID  *int      `json:"recipe_id,omitempty"`
+	Title     string    `json:"title"`
+	Rating    *int      `json:"rating,omitempty"`
+	Text      string    `json:"text"`
+}
+
+type ProfileSettings struct {
+	DisplayName     string `json:"display_name"`
+	ShowJoinDate    bool   `json:"show_join_date"`
+	ShowRecipes     bool   `json:"show_recipes"`
+	ShowCollections bool   `json:"show_collections"`
+	ShowStats       bool   `json:"show_stats"`
+	ShowFollows     bool   `json:"show_follows"`
+}
+
+type UpdateProfileSettingsRequest struct {
+	DisplayName     *string `json:"display_name"`
+	ShowJoinDate    *bool   `json:"show_join_date"`
+	ShowRecipes     *bool   `json:"show_recipes"`
+	ShowCollections *bool   `json:"show_collections"`
+	ShowStats       *bool   `json:"show_stats"`
+	ShowFollows     *bool   `json:"show_follows"`
+}
+
+type ProfileStats struct {
+	LikesReceived   int `json:"likes_received"`
+	ReviewsReceived int `json:"reviews_received"`
+}
+
+// PublicProfile is what others see of a user. Sections the user has chosen
+// to hide are left out.
+type PublicProfile struct {
+	Username       string           `json:"username"`
+	DisplayName    string           `json:"display_name"`
+	JoinedAt       *time.Time       `json:"joined_at,omitempty"`
+	Recipes        []recipes.Recipe `json:"recipes,omitempty"`
+	Collections    []Collection     `json:"collections,omitempty"`
+	Stats          *ProfileStats    `json:"stats,omitempty"`
+	FollowerCount  *int             `json:"follower_count,omitempty"`
+	FollowingCount *int             `json:"following_count,omitempty"`
+	IsFollowing    bool             `json:"is_following"`
+}
@@ -0,0 +1,179 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ngthecoder/go_web_api/internal/errors"
+)
+
+const (
+	maxPantryItems      = 500
+	maxPantryUnitLength = 30
+)
+
+func validatePantryItem(request PantryItemRequest) error {
+	var fields []errors.FieldError
+	if request.Quantity <= 0 {
+		fields = append(fields, errors.FieldError{Field: "quantity", Code: "out_of_range", Message: "Quantity must be positive"})
+	}
+	if request.Unit == "" {
+		fields = append(fields, errors.FieldError{Field: "unit", Code: "required", Message: "Unit is required"})
+	} else if utf8.RuneCountInString(request.Unit) > maxPantryUnitLength {
+		fields = append(fields, errors.FieldError{Field: "unit", Code: "too_long", Message: fmt.Sprintf("Unit must be at most %d characters", maxPantryUnitLength)})
+	}
+	if len(fields) > 0 {
+		return errors.NewValidationError("Invalid pantry item", fields)
+	}
+	return nil
+}
+
+const pantryColumns = "p.ingredient_id, i.name, i.category, p.quantity, p.unit, p.expires_at, p.created_at, p.updated_at"
+
+func scanPantryItem(scanner interface{ Scan(...interface{}) error }, now time.Time) (PantryItem, error) {
+	var item PantryItem
+	var expiresAt sql.NullTime
+	err := scanner.Scan(&item.IngredientID, &item.Name, &item.Category, &item.Quantity, &item.Unit,
+		&expiresAt, &item.CreatedAt, &item.UpdatedAt)
+	if err != nil {
+		return PantryItem{}, err
+	}
+	if expiresAt.Valid {
+		item.ExpiresAt = &expiresAt.Time
+		item.Expired = !expiresAt.Time.After(now)
+	}
+	return item, nil
+}
+
+// getPantry lists the user's pantry, soonest to expire first.
+func (s *UserService) getPantry(userID string) ([]PantryItem, error) {
+	rows, err := s.db.Query(`
+		SELECT `+pantryColumns+`
+		FROM pantry_items p
+		JOIN ingredients i ON i.id = p.ingredient_id
+		WHERE p.user_id = $1
+		ORDER BY CASE WHEN p.expires_at IS NULL THEN 1 ELSE 0 END, p.expires_at, i.name`,
+		userID,
+	)
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	items := []PantryItem{}
+	for rows.Next() {
+		item, err := scanPantryItem(rows, now)
+		if err != nil {
+			return nil, errors.NewInternalServerError("Data scanning error", err)
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return items, nil
+}
+
+func (s *UserService) getPantryItem(userID string, ingredientID int) (PantryItem, error) {
+	row := s.db.QueryRow(`
+		SELECT `+pantryColumns+`
+		FROM pantry_items p
+		JOIN ingredients i ON i.id = p.ingredient_id
+		WHERE p.user_id = $1 AND p.ingredient_id = $2`,
+		userID, ingredientID,
+	)
+	item, err := scanPantryItem(row, time.Now())
+	if err == sql.ErrNoRows {
+		return PantryItem{}, errors.NewNotFoundError("Ingredient is not in your pantry")
+	}
+	if err != nil {
+		return PantryItem{}, errors.NewInternalServerError("Database error", err)
+	}
+	return item, nil
+}
+
+// addPantryItem puts an ingredient in the user's pantry. Each ingredient is
+// kept once; changing how much there is goes through updatePantryItem.
+func (s *UserService) addPantryItem(userID string, request PantryItemRequest) (PantryItem, error) {
+	request.Unit = strings.TrimSpace(request.Unit)
+	if err := validatePantryItem(request); err != nil {
+		return PantryItem{}, err
+	}
+
+	var ingredientExists, inPantry bool
+	var count int
+	err := s.db.QueryRow(`
+		SELECT
+			EXISTS(SELECT 1 FROM ingredients WHERE id = $1),
+			EXISTS(SELECT 1 FROM pantry_items WHERE ingredient_id = $1 AND user_id = $2),
+			(SELECT COUNT(*) FROM pantry_items WHERE user_id = $2)`,
+		request.IngredientID, userID,
+	).Scan(&ingredientExists, &inPantry, &count)
+	if err != nil {
+		return PantryItem{}, errors.NewInternalServerError("Database error", err)
+	}
+	if !ingredientExists {
+		return PantryItem{}, errors.NewNotFoundError("Ingredient not found")
+	}
+	if inPantry {
+		return PantryItem{}, errors.NewConflictError("Ingredient is already in your pantry")
+	}
+	if count >= maxPantryItems {
+		return PantryItem{}, errors.NewBadRequestError(fmt.Sprintf("A pantry can hold at most %d ingredients", maxPantryItems))
+	}
+
+	now := time.Now().UTC()
+	_, err = s.db.Exec(
+		`INSERT INTO pantry_items (user_id, ingredient_id, quantity, unit, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)`,
+		userID, request.IngredientID, request.Quantity, request.Unit, nullTime(request.ExpiresAt), now,
+	)
+	if err != nil {
+		return PantryItem{}, errors.NewInternalServerError("Failed to add pantry item", err)
+	}
+
+	return s.getPantryItem(userID, request.IngredientID)
+}
+
+func (s *UserService) updatePantryItem(userID string, ingredientID int, request PantryItemRequest) (PantryItem, error) {
+	request.Unit = strings.TrimSpace(request.Unit)
+	if err := validatePantryItem(request); err != nil {
+		return PantryItem{}, err
+	}
+
+	result, err := s.db.Exec(
+		"UPDATE pantry_items SET quantity = $1, unit = $2, expires_at = $3, updated_at = $4 WHERE user_id = $5 AND ingredient_id = $6",
+		request.Quantity, request.Unit, nullTime(request.ExpiresAt), time.Now().UTC(), userID, ingredientID,
+	)
+	if err != nil {
+		return PantryItem{}, errors.NewInternalServerError("Failed to update pantry item", err)
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return PantryItem{}, errors.NewNotFoundError("Ingredient is not in your pantry")
+	}
+
+	return s.getPantryItem(userID, ingredientID)
+}
+
+func (s *UserService) removePantryItem(userID string, ingredientID int) error {
+	result, err := s.db.Exec("DELETE FROM pantry_items WHERE user_id = $1 AND ingredient_id = $2", userID, ingredientID)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to remove pantry item", err)
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		return errors.NewNotFoundError("Ingredient is not in your pantry")
+	}
+	return nil
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
@@ -0,0 +1,226 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ngthecoder/go_web_api/internal/errors"
+	"github.com/ngthecoder/go_web_api/internal/recipes"
+)
+
+const (
+	maxDisplayNameLength = 50
+	// publicProfileRecipes is how many of a user's most recent recipes the
+	// public profile lists.
+	publicProfileRecipes = 20
+)
+
+func defaultProfileSettings() ProfileSettings {
+	return ProfileSettings{
+		ShowJoinDate:    true,
+		ShowRecipes:     true,
+		ShowCollections: true,
+		ShowStats:       true,
+		ShowFollows:     true,
+	}
+}
+
+// getProfileSettings returns what the user shows on their public profile.
+// Users who never changed their settings get the defaults.
+func (s *UserService) getProfileSettings(userID string) (ProfileSettings, error) {
+	settings := defaultProfileSettings()
+	err := s.db.QueryRow(
+		`SELECT display_name, show_join_date, show_recipes, show_collections, show_stats, show_follows
+		FROM profile_settings WHERE user_id = $1`, userID,
+	).Scan(&settings.DisplayName, &settings.ShowJoinDate, &settings.ShowRecipes,
+		&settings.ShowCollections, &settings.ShowStats, &settings.ShowFollows)
+	if err != nil && err != sql.ErrNoRows {
+		return ProfileSettings{}, errors.NewInternalServerError("Database error", err)
+	}
+	return settings, nil
+}
+
+// updateProfileSettings changes the settings set in the request and leaves
+// the others as they are.
+func (s *UserService) updateProfileSettings(userID string, request UpdateProfileSettingsRequest) (ProfileSettings, error) {
+	settings, err := s.getProfileSettings(userID)
+	if err != nil {
+		return ProfileSettings{}, err
+	}
+
+	if request.DisplayName != nil {
+		settings.DisplayName = strings.TrimSpace(*request.DisplayName)
+		if utf8.RuneCountInString(settings.DisplayName) > maxDisplayNameLength {
+			return ProfileSettings{}, errors.NewValidationError("Invalid profile settings", []errors.FieldError{{
+				Field:   "display_name",
+				Code:    "too_long",
+				Message: fmt.Sprintf("Display name must be at most %d characters", maxDisplayNameLength),
+			}})
+		}
+	}
+	for _, setting := range []struct {
+		value  *bool
+		target *bool
+	}{
+		{request.ShowJoinDate, &settings.ShowJoinDate},
+		{request.ShowRecipes, &settings.ShowRecipes},
+		{request.ShowCollections, &settings.ShowCollections},
+		{request.ShowStats, &settings.ShowStats},
+		{request.ShowFollows, &settings.ShowFollows},
+	} {
+		if setting.value != nil {
+			*setting.target = *setting.value
+		}
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO profile_settings (user_id, display_name, show_join_date, show_recipes, show_collections, show_stats, show_follows, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (user_id) DO UPDATE SET
+			display_name = EXCLUDED.display_name,
+			show_join_date = EXCLUDED.show_join_date,
+			show_recipes = EXCLUDED.show_recipes,
+			show_collections = EXCLUDED.show_collections,
+			show_stats = EXCLUDED.show_stats,
+			show_follows = EXCLUDED.show_follows,
+			updated_at = EXCLUDED.updated_at`,
+		userID, settings.DisplayName, settings.ShowJoinDate, settings.ShowRecipes,
+		settings.ShowCollections, settings.ShowStats, settings.ShowFollows, time.Now().UTC(),
+	)
+	if err != nil {
+		return ProfileSettings{}, errors.NewInternalServerError("Failed to update profile settings", err)
+	}
+
+	return settings, nil
+}
+
+// getPublicProfile returns what viewerID may see of a user's profile. The
+// owner always sees every section; others see those the owner shows. viewerID
+// is empty for anonymous visitors.
+func (s *UserService) getPublicProfile(viewerID, username string) (PublicProfile, error) {
+	userID, err := s.userIDByUsername(username)
+	if err != nil {
+		return PublicProfile{}, err
+	}
+
+	settings, err := s.getProfileSettings(userID)
+	if err != nil {
+		return PublicProfile{}, err
+	}
+	isOwner := viewerID == userID
+
+	var profile PublicProfile
+	var joinedAt time.Time
+	err = s.db.QueryRow("SELECT username, created_at FROM users WHERE id = $1", userID).Scan(&profile.Username, &joinedAt)
+	if err != nil {
+		return PublicProfile{}, errors.NewInternalServerError("Database error", err)
+	}
+	profile.DisplayName = settings.DisplayName
+	if profile.DisplayName == "" {
+		profile.DisplayName = profile.Username
+	}
+
+	if settings.ShowJoinDate || isOwner {
+		profile.JoinedAt = &joinedAt
+	}
+
+	if settings.ShowRecipes || isOwner {
+		profile.Recipes, err = s.authoredRecipes(userID)
+		if err != nil {
+			return PublicProfile{}, err
+		}
+	}
+
+	if settings.ShowCollections || isOwner {
+		collections, err := s.getCollections(userID)
+		if err != nil {
+			return PublicProfile{}, err
+		}
+		profile.Collections = []Collection{}
+		for _, collection := range collections {
+			if collection.IsPublic {
+				profile.Collections = append(profile.Collections, collection)
+			}
+		}
+	}
+
+	if settings.ShowStats || isOwner {
+		var stats ProfileStats
+		err := s.db.QueryRow(`
+			SELECT
+				(SELECT COUNT(*) FROM user_liked_recipes ulr JOIN recipes r ON r.id = ulr.recipe_id WHERE r.author_id = $1 AND r.hidden_at IS NULL),
+				(SELECT COUNT(*) FROM recipe_reviews rr JOIN recipes r ON r.id = rr.recipe_id
+					WHERE r.author_id = $1 AND r.hidden_at IS NULL AND rr.hidden_at IS NULL)`,
+			userID,
+		).Scan(&stats.LikesReceived, &stats.ReviewsReceived)
+		if err != nil {
+			return PublicProfile{}, errors.NewInternalServerError("Database error", err)
+		}
+		profile.Stats = &stats
+	}
+
+	if settings.ShowFollows || isOwner {
+		var followers, following int
+		err := s.db.QueryRow(`
+			SELECT
+				(SELECT COUNT(*) FROM follows f JOIN users u ON u.id = f.follower_id WHERE f.followee_id = $1 AND u.delete_after IS NULL),
+				(SELECT COUNT(*) FROM follows f JOIN users u ON u.id = f.followee_id WHERE f.follower_id = $1 AND u.delete_after IS NULL)`,
+			userID,
+		).Scan(&followers, &following)
+		if err != nil {
+			return PublicProfile{}, errors.NewInternalServerError("Database error", err)
+		}
+		profile.FollowerCount = &followers
+		profile.FollowingCount = &following
+	}
+
+	if viewerID != "" && !isOwner {
+		err := s.db.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM follows WHERE follower_id = $1 AND followee_id = $2)",
+			viewerID, userID,
+		).Scan(&profile.IsFollowing)
+		if err != nil {
+			return PublicProfile{}, errors.NewInternalServerError("Database error", err)
+		}
+	}
+
+	return profile, nil
+}
+
+func (s *UserService) authoredRecipes(userID string) ([]recipes.Recipe, error) {
+	rows, err := s.db.Query(`
+		SELECT r.id, r.name, r.category, r.prep_time_minutes, r.cook_time_minutes, r.servings, r.difficulty, r.instructions, r.description,
+			CASE WHEN r.rating_count > 0 THEN r.rating_sum * 1.0 / r.rating_count ELSE 0 END as average_rating, r.rating_count
+		FROM recipes r
+		WHERE r.author_id = $1 AND r.hidden_at IS NULL
+		ORDER BY r.created_at DESC, r.id DESC
+		LIMIT $2`,
+		userID, publicProfileRecipes,
+	)
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer rows.Close()
+
+	recipesList := []recipes.Recipe{}
+	for rows.Next() {
+		var recipe recipes.Recipe
+		err := rows.Scan(&recipe.ID, &recipe.Name, &recipe.Category,
+			&recipe.PrepTimeMinutes, &recipe.CookTimeMinutes,
+			&recipe.Servings, &recipe.Difficulty,
+			&recipe.Instructions, &recipe.Description,
+			&recipe.AverageRating, &recipe.RatingCount)
+		if err != nil {
+			return nil, errors.NewInternalServerError("Data scanning error", err)
+		}
+		recipesList = append(recipesList, recipe)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.NewInternalServerError("Data scanning error", err)
+	}
+
+	return recipesList, nil
+}
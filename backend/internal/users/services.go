@@ -2,26 +2,55 @@ package users
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/ngthecoder/go_web_api/internal/auth"
 	"github.com/ngthecoder/go_web_api/internal/errors"
+	"github.com/ngthecoder/go_web_api/internal/mail"
 	"github.com/ngthecoder/go_web_api/internal/recipes"
 )
 
+const (
+	defaultDeletionGracePeriod = 30 * 24 * time.Hour
+	// maxBulkLikeChanges is how many recipes one bulk request may add and
+	// remove together.
+	maxBulkLikeChanges = 100
+)
+
 type UserService struct {
-	db *sql.DB
+	db                  *sql.DB
+	mailer              mail.Mailer
+	linkBaseURL         string
+	deletionGracePeriod time.Duration
 }
 
 func NewUserService(db *sql.DB) *UserService {
 	return &UserService{
-		db: db,
+		db:                  db,
+		mailer:              mail.LogMailer{},
+		deletionGracePeriod: defaultDeletionGracePeriod,
 	}
 }
 
+// SetDeletionGracePeriod sets how long a deleted account can still be
+// restored before it is purged.
+func (s *UserService) SetDeletionGracePeriod(gracePeriod time.Duration) {
+	s.deletionGracePeriod = gracePeriod
+}
+
+// SetMailer sets how account emails are sent. Links in them point at pages
+// under linkBaseURL, the address of the frontend.
+func (s *UserService) SetMailer(mailer mail.Mailer, linkBaseURL string) {
+	s.mailer = mailer
+	s.linkBaseURL = strings.TrimRight(linkBaseURL, "/")
+}
+
 func (s *UserService) getUserProfile(userID string) (UserProfile, error) {
 	var userProfile UserProfile
-	err := s.db.QueryRow("SELECT id, username, email, created_at, updated_at FROM users WHERE id = $1", userID).
-		Scan(&userProfile.ID, &userProfile.Username, &userProfile.Email, &userProfile.CreatedAt, &userProfile.UpdatedAt)
+	err := s.db.QueryRow("SELECT id, username, email, role, created_at, updated_at FROM users WHERE id = $1", userID).
+		Scan(&userProfile.ID, &userProfile.Username, &userProfile.Email, &userProfile.Role, &userProfile.CreatedAt, &userProfile.UpdatedAt)
 
 	if err == sql.ErrNoRows {
 		return UserProfile{}, errors.NewNotFoundError("User not found")
@@ -30,86 +59,303 @@ func (s *UserService) getUserProfile(userID string) (UserProfile, error) {
 		return UserProfile{}, errors.NewInternalServerError("Database scanning error", err)
 	}
 
+	userProfile.PendingEmail, err = s.pendingEmail(userID)
+	if err != nil {
+		return UserProfile{}, errors.NewInternalServerError("Database error", err)
+	}
+
 	return userProfile, nil
 }
 
-func (s *UserService) getLikedRecipes(userID string) ([]recipes.Recipe, error) {
+// likedRecipesFilter builds the WHERE clause shared by the liked recipes
+// count and page, with the same filters as the recipe list.
+func likedRecipesFilter(userID, search, category, difficulty string, maxTime int) (string, []interface{}) {
+	conditions := []string{"ulr.user_id = $1", "r.hidden_at IS NULL"}
+	args := []interface{}{userID}
+	placeholderNum := 2
+
+	if search != "" {
+		conditions = append(conditions, fmt.Sprintf("(r.name LIKE $%d OR r.instructions LIKE $%d OR r.description LIKE $%d)", placeholderNum, placeholderNum+1, placeholderNum+2))
+		searchTerm := "%" + search + "%"
+		args = append(args, searchTerm, searchTerm, searchTerm)
+		placeholderNum += 3
+	}
+
+	if category != "" {
+		conditions = append(conditions, fmt.Sprintf("r.category = $%d", placeholderNum))
+		args = append(args, category)
+		placeholderNum++
+	}
+
+	if difficulty != "" {
+		conditions = append(conditions, fmt.Sprintf("r.difficulty = $%d", placeholderNum))
+		args = append(args, difficulty)
+		placeholderNum++
+	}
+
+	if maxTime > 0 {
+		conditions = append(conditions, fmt.Sprintf("(r.prep_time_minutes + r.cook_time_minutes) <= $%d", placeholderNum))
+		args = append(args, maxTime)
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// getLikedRecipes pages through the recipes a user likes that match the
+// filters, along with how many match in total.
+func (s *UserService) getLikedRecipes(userID, search, category, difficulty, sort, order string, maxTime, limit, offset int) ([]LikedRecipe, int, error) {
+	where, args := likedRecipesFilter(userID, search, category, difficulty, maxTime)
+
+	var total int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM user_liked_recipes ulr JOIN recipes r ON ulr.recipe_id = r.id"+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.NewInternalServerError("Database error", err)
+	}
+
+	orderByClause := ""
+	switch sort {
+	case "name":
+		orderByClause = "r.name"
+	case "prep_time":
+		orderByClause = "r.prep_time_minutes"
+	case "cook_time":
+		orderByClause = "r.cook_time_minutes"
+	case "total_time":
+		orderByClause = "(r.prep_time_minutes + r.cook_time_minutes)"
+	default:
+		orderByClause = "ulr.created_at"
+	}
+
 	query := `
-		SELECT r.id, r.name, r.category, r.prep_time_minutes, r.cook_time_minutes, r.servings, r.difficulty, r.instructions, r.description
+		SELECT r.id, r.name, r.category, r.prep_time_minutes, r.cook_time_minutes, r.servings, r.difficulty, r.instructions, r.description,
+			CASE WHEN r.rating_count > 0 THEN r.rating_sum * 1.0 / r.rating_count ELSE 0 END as average_rating, r.rating_count,
+			ulr.created_at
 		FROM user_liked_recipes ulr
-		JOIN recipes r on ulr.recipe_id = r.id
-		WHERE ulr.user_id = $1;
-	`
-	rows, err := s.db.Query(query, userID)
+		JOIN recipes r on ulr.recipe_id = r.id` + where +
+		" ORDER BY " + orderByClause + " " + strings.ToUpper(order) + ", r.id" +
+		fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+	rows, err := s.db.Query(query, append(args, limit, offset)...)
 	if err != nil {
-		return nil, errors.NewInternalServerError("Database error", err)
+		return nil, 0, errors.NewInternalServerError("Database error", err)
 	}
 	defer rows.Close()
 
-	var recipesList []recipes.Recipe
+	recipesList := []LikedRecipe{}
 	for rows.Next() {
-		var recipe recipes.Recipe
+		var recipe LikedRecipe
+		var likedAt sql.NullTime
 		err := rows.Scan(&recipe.ID, &recipe.Name, &recipe.Category,
 			&recipe.PrepTimeMinutes, &recipe.CookTimeMinutes,
 			&recipe.Servings, &recipe.Difficulty,
-			&recipe.Instructions, &recipe.Description)
+			&recipe.Instructions, &recipe.Description,
+			&recipe.AverageRating, &recipe.RatingCount, &likedAt)
 		if err != nil {
-			return nil, errors.NewInternalServerError("Data scanning error", err)
+			return nil, 0, errors.NewInternalServerError("Data scanning error", err)
 		}
+		recipe.IsLiked = true
+		recipe.LikedAt = likedAt.Time
 		recipesList = append(recipesList, recipe)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, errors.NewInternalServerError("Data scanning error", err)
+	}
 
-	return recipesList, nil
+	return recipesList, total, nil
 }
 
-func (s *UserService) addLikedRecipe(userID string, recipeID int) error {
+// likeRecipe adds a like within tx and reports what happened. Only database
+// failures are returned as errors.
+func likeRecipe(tx *sql.Tx, userID string, recipeID int) (string, error) {
 	var exists bool
-	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = $1)", recipeID).Scan(&exists)
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = $1 AND hidden_at IS NULL)", recipeID).Scan(&exists)
 	if err != nil {
-		return errors.NewInternalServerError("Database error", err)
+		return "", err
 	}
 	if !exists {
-		return errors.NewNotFoundError("Recipe not found")
+		return LikeStatusRecipeNotFound, nil
 	}
 
-	err = s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM user_liked_recipes WHERE user_id = $1 AND recipe_id = $2)", userID, recipeID).Scan(&exists)
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM user_liked_recipes WHERE user_id = $1 AND recipe_id = $2)", userID, recipeID).Scan(&exists)
 	if err != nil {
-		return errors.NewInternalServerError("Database error", err)
+		return "", err
 	}
 	if exists {
-		return errors.NewConflictError("Recipe already in liked list")
+		return LikeStatusAlreadyLiked, nil
+	}
+
+	likedAt := time.Now().UTC()
+	_, err = tx.Exec("INSERT INTO user_liked_recipes (user_id, recipe_id, created_at) VALUES ($1, $2, $3);", userID, recipeID, likedAt)
+	if err != nil {
+		return "", err
+	}
+	if err := recipes.RecordLike(tx, recipeID, likedAt); err != nil {
+		return "", err
+	}
+
+	return LikeStatusAdded, nil
+}
+
+// unlikeRecipe removes a like within tx and reports what happened. Only
+// database failures are returned as errors.
+func unlikeRecipe(tx *sql.Tx, userID string, recipeID int) (string, error) {
+	var likedAt sql.NullTime
+	err := tx.QueryRow("SELECT created_at FROM user_liked_recipes WHERE user_id = $1 AND recipe_id = $2", userID, recipeID).Scan(&likedAt)
+	if err == sql.ErrNoRows {
+		return LikeStatusNotLiked, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.Exec("DELETE FROM user_liked_recipes WHERE user_id = $1 AND recipe_id = $2;", userID, recipeID); err != nil {
+		return "", err
+	}
+	if err := recipes.RecordUnlike(tx, recipeID, likedAt.Time); err != nil {
+		return "", err
+	}
+
+	return LikeStatusRemoved, nil
+}
+
+func (s *UserService) addLikedRecipe(userID string, recipeID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
 	}
+	defer tx.Rollback()
 
-	_, err = s.db.Exec("INSERT INTO user_liked_recipes (user_id, recipe_id, created_at) VALUES ($1, $2, CURRENT_TIMESTAMP);", userID, recipeID)
+	status, err := likeRecipe(tx, userID, recipeID)
 	if err != nil {
 		return errors.NewInternalServerError("Failed to add liked recipe", err)
 	}
+	switch status {
+	case LikeStatusRecipeNotFound:
+		return errors.NewNotFoundError("Recipe not found")
+	case LikeStatusAlreadyLiked:
+		return errors.NewConflictError("Recipe already in liked list")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.NewInternalServerError("Failed to add liked recipe", err)
+	}
 
 	return nil
 }
 
 func (s *UserService) removeLikedRecipe(userID string, recipeID int) error {
-	removeRecipeQuery := `DELETE FROM user_liked_recipes WHERE user_id = $1 AND recipe_id = $2;`
-	result, err := s.db.Exec(removeRecipeQuery, userID, recipeID)
+	tx, err := s.db.Begin()
 	if err != nil {
 		return errors.NewInternalServerError("Database error", err)
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	status, err := unlikeRecipe(tx, userID, recipeID)
 	if err != nil {
-		return errors.NewInternalServerError("Failed to check affected rows", err)
+		return errors.NewInternalServerError("Failed to remove liked recipe", err)
 	}
-	if rowsAffected == 0 {
+	if status == LikeStatusNotLiked {
 		return errors.NewNotFoundError("Recipe not in liked list")
 	}
 
+	if err := tx.Commit(); err != nil {
+		return errors.NewInternalServerError("Failed to remove liked recipe", err)
+	}
+
 	return nil
 }
 
+// bulkUpdateLikedRecipes applies every add and remove in one transaction.
+// Recipes that cannot be changed are reported in the results rather than
+// failing the request; a database error rolls back the lot.
+func (s *UserService) bulkUpdateLikedRecipes(userID string, request BulkLikedRecipesRequest) ([]BulkLikeResult, error) {
+	var fields []errors.FieldError
+	if len(request.Add)+len(request.Remove) == 0 {
+		fields = append(fields, errors.FieldError{Field: "add", Code: "required", Message: "Nothing to add or remove"})
+	}
+	if len(request.Add)+len(request.Remove) > maxBulkLikeChanges {
+		fields = append(fields, errors.FieldError{
+			Field:   "add",
+			Code:    "too_many",
+			Message: fmt.Sprintf("At most %d recipes can be changed at once", maxBulkLikeChanges),
+		})
+	}
+	adding := make(map[int]bool, len(request.Add))
+	for _, recipeID := range request.Add {
+		adding[recipeID] = true
+	}
+	for _, recipeID := range request.Remove {
+		if adding[recipeID] {
+			fields = append(fields, errors.FieldError{
+				Field:   "remove",
+				Code:    "conflict",
+				Message: fmt.Sprintf("Recipe %d is both added and removed", recipeID),
+			})
+			break
+		}
+	}
+	if len(fields) > 0 {
+		return nil, errors.NewValidationError("Invalid liked recipes changes", fields)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	results := make([]BulkLikeResult, 0, len(request.Add)+len(request.Remove))
+	for _, recipeID := range request.Add {
+		status, err := likeRecipe(tx, userID, recipeID)
+		if err != nil {
+			return nil, errors.NewInternalServerError("Failed to update liked recipes", err)
+		}
+		results = append(results, BulkLikeResult{RecipeID: recipeID, Action: "add", Status: status})
+	}
+	for _, recipeID := range request.Remove {
+		status, err := unlikeRecipe(tx, userID, recipeID)
+		if err != nil {
+			return nil, errors.NewInternalServerError("Failed to update liked recipes", err)
+		}
+		results = append(results, BulkLikeResult{RecipeID: recipeID, Action: "remove", Status: status})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.NewInternalServerError("Failed to update liked recipes", err)
+	}
+
+	return results, nil
+}
+
 func (s *UserService) updateUserProfile(userID string, username, email string) (UserProfile, error) {
+	var currentUsername, currentEmail string
+	err := s.db.QueryRow("SELECT username, email FROM users WHERE id = $1", userID).Scan(&currentUsername, &currentEmail)
+	if err == sql.ErrNoRows {
+		return UserProfile{}, errors.NewNotFoundError("User not found")
+	}
+	if err != nil {
+		return UserProfile{}, errors.NewInternalServerError("Database error", err)
+	}
+
+	var fields []errors.FieldError
+	// Usernames from before the current rules may be kept as they are; only
+	// a new username has to follow them.
+	if username != currentUsername {
+		username, err = auth.NormalizeUsername(username)
+		if err != nil {
+			fields = append(fields, auth.NewIdentityFieldError("username", err))
+		}
+	}
+	email, err = auth.NormalizeEmail(email)
+	if err != nil {
+		fields = append(fields, auth.NewIdentityFieldError("email", err))
+	}
+	if len(fields) > 0 {
+		return UserProfile{}, errors.NewValidationError("Invalid username or email", fields)
+	}
+
 	var exists bool
-	err := s.db.QueryRow(
-		"SELECT EXISTS(SELECT 1 FROM users WHERE (username = $1 OR email = $2) AND id != $3)",
+	err = s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM users WHERE (LOWER(username) = LOWER($1) OR LOWER(email) = $2) AND id != $3)",
 		username, email, userID,
 	).Scan(&exists)
 
@@ -121,17 +367,27 @@ func (s *UserService) updateUserProfile(userID string, username, email string) (
 	}
 
 	_, err = s.db.Exec(
-		"UPDATE users SET username = $1, email = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
-		username, email, userID,
+		"UPDATE users SET username = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		username, userID,
 	)
 	if err != nil {
 		return UserProfile{}, errors.NewInternalServerError("Failed to update profile", err)
 	}
 
+	// A new email only takes effect once confirmed from that address;
+	// submitting the current one again cancels a pending change.
+	if email != currentEmail {
+		if err := s.requestEmailChange(userID, currentEmail, email); err != nil {
+			return UserProfile{}, err
+		}
+	} else if err := s.cancelPendingEmailChange(userID); err != nil {
+		return UserProfile{}, errors.NewInternalServerError("Database error", err)
+	}
+
 	return s.getUserProfile(userID)
 }
 
-func (s *UserService) changePassword(userID string, currentPassword, newPassword string) error {
+func (s *UserService) changePassword(userID string, currentPassword, newPassword string, currentSessionID string) error {
 	var storedEncodedPasswordHash string
 	err := s.db.QueryRow("SELECT password_hash FROM users WHERE id = $1", userID).Scan(&storedEncodedPasswordHash)
 	if err != nil {
@@ -154,7 +410,13 @@ func (s *UserService) changePassword(userID string, currentPassword, newPassword
 		return errors.NewInternalServerError("Failed to hash password", err)
 	}
 
-	_, err = s.db.Exec(
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
 		"UPDATE users SET password_hash = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
 		newEncodedPasswordHash, userID,
 	)
@@ -162,31 +424,304 @@ func (s *UserService) changePassword(userID string, currentPassword, newPassword
 		return errors.NewInternalServerError("Failed to update password", err)
 	}
 
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = $1 AND id != $2", userID, currentSessionID)
+	if err != nil {
+		return errors.NewInternalServerError("Failed to end other sessions", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.NewInternalServerError("Failed to update password", err)
+	}
+
 	return nil
 }
 
-func (s *UserService) deleteAccount(userID string, password string) error {
+// recentSignInWindow is how fresh the session must be for an account without
+// a password to confirm its own deletion.
+const recentSignInWindow = 10 * time.Minute
+
+// deleteAccount schedules the account for removal once the grace period has
+// passed. Until then it cannot sign in but can be restored. Accounts with a
+// password confirm with it; accounts that only sign in through an identity
+// provider confirm by having signed in moments ago.
+func (s *UserService) deleteAccount(userID, sessionID, password string) (time.Time, error) {
 	var storedEncodedPasswordHash string
-	err := s.db.QueryRow("SELECT password_hash FROM users WHERE id = $1", userID).Scan(&storedEncodedPasswordHash)
+	var deleteAfter sql.NullTime
+	err := s.db.QueryRow("SELECT password_hash, delete_after FROM users WHERE id = $1", userID).Scan(&storedEncodedPasswordHash, &deleteAfter)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return errors.NewNotFoundError("User not found")
+			return time.Time{}, errors.NewNotFoundError("User not found")
+		}
+		return time.Time{}, errors.NewInternalServerError("Database error", err)
+	}
+
+	if storedEncodedPasswordHash == "" {
+		if err := s.requireRecentSignIn(userID, sessionID); err != nil {
+			return time.Time{}, err
 		}
+	} else {
+		if password == "" {
+			return time.Time{}, errors.NewBadRequestError("Password is required")
+		}
+		verified, err := auth.VerifyPasswordHash(password, storedEncodedPasswordHash)
+		if err != nil {
+			return time.Time{}, errors.NewInternalServerError("Failed to verify password", err)
+		}
+		if !verified {
+			return time.Time{}, errors.NewBadRequestError("Password is incorrect")
+		}
+	}
+
+	if deleteAfter.Valid {
+		return deleteAfter.Time, nil
+	}
+
+	scheduledFor := time.Now().UTC().Add(s.deletionGracePeriod)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return time.Time{}, errors.NewInternalServerError("Database error", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET delete_after = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", scheduledFor, userID)
+	if err != nil {
+		return time.Time{}, errors.NewInternalServerError("Failed to delete account", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = $1", userID); err != nil {
+		return time.Time{}, errors.NewInternalServerError("Failed to end sessions", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, errors.NewInternalServerError("Failed to delete account", err)
+	}
+
+	return scheduledFor, nil
+}
+
+func (s *UserService) requireRecentSignIn(userID, sessionID string) error {
+	var createdAt time.Time
+	err := s.db.QueryRow("SELECT created_at FROM sessions WHERE id = $1 AND user_id = $2", sessionID, userID).Scan(&createdAt)
+	if err != nil && err != sql.ErrNoRows {
 		return errors.NewInternalServerError("Database error", err)
 	}
+	if err == sql.ErrNoRows || time.Since(createdAt) > recentSignInWindow {
+		return errors.NewForbiddenError(fmt.Sprintf("Sign in again with your identity provider, then delete the account within %d minutes", int(recentSignInWindow.Minutes())))
+	}
+	return nil
+}
 
-	verified, err := auth.VerifyPasswordHash(password, storedEncodedPasswordHash)
+// authoredRecipeTables lists every table holding rows that hang off a recipe.
+// recipe_similarities also points at recipes from similar_recipe_id and is
+// cleared separately.
+var authoredRecipeTables = []string{
+	"recipe_ingredients",
+	"user_liked_recipes",
+	"recipe_like_buckets",
+	"recipe_similarities",
+	"recipe_reviews",
+	"recipe_comments",
+	"collection_recipes",
+	"recipe_notes",
+	"recipe_ingredient_tweaks",
+	"recipe_revisions",
+}
+
+// deleteAuthoredRecipes removes the recipes userID wrote or forked, with
+// everything attached to them. Forks of those recipes stay, no longer linked
+// to their original.
+func deleteAuthoredRecipes(tx *sql.Tx, userID string) error {
+	const authored = "SELECT id FROM recipes WHERE author_id = $1"
+
+	// Reports about the recipes, or about reviews and comments on them, have
+	// nothing left to point at.
+	_, err := tx.Exec(`
+		DELETE FROM content_reports
+		WHERE (content_type = 'recipe' AND content_id IN (SELECT CAST(id AS TEXT) FROM recipes WHERE author_id = $1))
+			OR (content_type = 'review' AND content_id IN (SELECT id FROM recipe_reviews WHERE recipe_id IN (`+authored+`)))
+			OR (content_type = 'comment' AND content_id IN (SELECT id FROM recipe_comments WHERE recipe_id IN (`+authored+`)))`,
+		userID,
+	)
 	if err != nil {
-		return errors.NewInternalServerError("Failed to verify password", err)
+		return err
 	}
-	if !verified {
-		return errors.NewBadRequestError("Password is incorrect")
+
+	for _, table := range authoredRecipeTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE recipe_id IN ("+authored+")", userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM recipe_similarities WHERE similar_recipe_id IN ("+authored+")", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE recipes SET forked_from = NULL WHERE forked_from IN ("+authored+")", userID); err != nil {
+		return err
 	}
 
-	_, err = s.db.Exec("DELETE FROM users WHERE id = $1", userID)
+	_, err = tx.Exec("DELETE FROM recipes WHERE author_id = $1", userID)
+	return err
+}
+
+// ownedTables lists every table holding rows that belong to a user, so that
+// purging an account removes them even where no foreign key cascades.
+var ownedTables = []string{
+	"user_liked_recipes",
+	"sessions",
+	"api_keys",
+	"user_identities",
+	"email_changes",
+	"data_exports",
+	"recipe_reviews",
+	"collections",
+	"profile_settings",
+	"recipe_notes",
+	"recipe_ingredient_tweaks",
+	"pantry_items",
+}
+
+// PurgeExpiredAccounts permanently removes accounts whose deletion grace
+// period has ended, together with everything they own.
+func (s *UserService) PurgeExpiredAccounts() (int, error) {
+	rows, err := s.db.Query("SELECT id, email FROM users WHERE delete_after <= $1", time.Now().UTC())
 	if err != nil {
-		return errors.NewInternalServerError("Failed to delete account", err)
+		return 0, err
 	}
 
-	return nil
+	type expiredAccount struct {
+		id    string
+		email string
+	}
+	var expired []expiredAccount
+	for rows.Next() {
+		var account expiredAccount
+		if err := rows.Scan(&account.id, &account.email); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, account)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, account := range expired {
+		if err := s.purgeAccount(account.id, account.email); err != nil {
+			return purged, fmt.Errorf("failed to purge user %s: %w", account.id, err)
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+func (s *UserService) purgeAccount(userID, email string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Take the user's reviews out of the recipes' rating totals before the
+	// reviews themselves go.
+	_, err = tx.Exec(`
+		UPDATE recipes SET
+			rating_count = rating_count - 1,
+			rating_sum = rating_sum - (SELECT rating FROM recipe_reviews WHERE recipe_id = recipes.id AND user_id = $1)
+		WHERE id IN (SELECT recipe_id FROM recipe_reviews WHERE user_id = $1 AND hidden_at IS NULL)`, userID)
+	if err != nil {
+		return err
+	}
+
+	// Likewise take the user's likes out of the recipes' like counters.
+	rows, err := tx.Query("SELECT recipe_id, created_at FROM user_liked_recipes WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	likedAt := make(map[int]time.Time)
+	for rows.Next() {
+		var recipeID int
+		var createdAt sql.NullTime
+		if err := rows.Scan(&recipeID, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		likedAt[recipeID] = createdAt.Time
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for recipeID, createdAt := range likedAt {
+		if err := recipes.RecordUnlike(tx, recipeID, createdAt); err != nil {
+			return err
+		}
+	}
+
+	// Comments are blanked rather than deleted so that replies from other
+	// users keep their place in the thread.
+	_, err = tx.Exec(
+		"UPDATE recipe_comments SET user_id = NULL, body = '', deleted_at = COALESCE(deleted_at, $1) WHERE user_id = $2",
+		time.Now().UTC(), userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := deleteAuthoredRecipes(tx, userID); err != nil {
+		return err
+	}
+	// Edits the user made to other people's recipes stay in their history.
+	if _, err := tx.Exec("UPDATE recipe_revisions SET author_id = NULL WHERE author_id = $1", userID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM follows WHERE follower_id = $1 OR followee_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM collection_recipes WHERE collection_id IN (SELECT id FROM collections WHERE user_id = $1)", userID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM content_reports WHERE reporter_id = $1", userID); err != nil {
+		return err
+	}
+	// Moderation history stays on record without the people in it, both for
+	// actions the user took as a moderator and for those taken against them.
+	if _, err := tx.Exec("UPDATE moderation_actions SET moderator_id = NULL WHERE moderator_id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE moderation_actions SET user_id = NULL WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	for _, table := range ownedTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = $1", userID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM login_failures WHERE key = $1", "account:"+email); err != nil {
+		return err
+	}
+
+	// Re-checked so an account restored since it was selected survives.
+	result, err := tx.Exec("DELETE FROM users WHERE id = $1 AND delete_after <= $2", userID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return nil
+	}
+
+	return tx.Commit()
 }
@@ -1,8 +1,18 @@
 package users
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ngthecoder/go_web_api/internal/auth"
 	_ "github.com/mattn/go-sqlite3"
@@ -21,8 +31,12 @@ func setupTestDB(t *testing.T) *sql.DB {
 			username TEXT UNIQUE NOT NULL,
 			email TEXT UNIQUE NOT NULL,
 			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'user',
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			delete_after DATETIME,
+			suspended_until DATETIME,
+			email_verified_at DATETIME
 		);
 	`)
 	if err != nil {
@@ -40,7 +54,15 @@ func setupTestDB(t *testing.T) *sql.DB {
 			servings INTEGER,
 			difficulty TEXT,
 			instructions TEXT,
-			description TEXT
+			description TEXT,
+			rating_count INTEGER NOT NULL DEFAULT 0,
+			rating_sum INTEGER NOT NULL DEFAULT 0,
+			like_count INTEGER NOT NULL DEFAULT 0,
+			trending_score REAL NOT NULL DEFAULT 0,
+			author_id TEXT,
+			forked_from INTEGER,
+			hidden_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		);
 	`)
 	if err != nil {
@@ -62,9 +84,161 @@ func setupTestDB(t *testing.T) *sql.DB {
 		t.Fatalf("Failed to create user_liked_recipes table: %v", err)
 	}
 
+	// Create sessions table
+	_, err = db.Exec(`
+		CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			ip_address TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_seen_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create sessions table: %v", err)
+	}
+
+	// Create email_changes table
+	_, err = db.Exec(`
+		CREATE TABLE email_changes (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			old_email TEXT NOT NULL,
+			new_email TEXT NOT NULL,
+			confirm_token_hash TEXT UNIQUE NOT NULL,
+			revert_token_hash TEXT UNIQUE,
+			created_at DATETIME NOT NULL,
+			confirmed_at DATETIME,
+			reverted_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create email_changes table: %v", err)
+	}
+
+	// Create the remaining tables an account owns rows in
+	_, err = db.Exec(`
+		CREATE TABLE api_keys (
+			id TEXT PRIMARY KEY, user_id TEXT NOT NULL, name TEXT NOT NULL, prefix TEXT NOT NULL, scopes TEXT NOT NULL,
+			expires_at DATETIME, last_used_at DATETIME, created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE user_identities (
+			provider TEXT NOT NULL, subject TEXT NOT NULL, user_id TEXT NOT NULL, email TEXT NOT NULL, created_at DATETIME NOT NULL
+		);
+		CREATE TABLE recipe_reviews (
+			id TEXT PRIMARY KEY, user_id TEXT NOT NULL, recipe_id INTEGER NOT NULL, rating INTEGER NOT NULL,
+			review TEXT NOT NULL DEFAULT '', created_at DATETIME NOT NULL, updated_at DATETIME NOT NULL, hidden_at DATETIME
+		);
+		CREATE TABLE recipe_comments (
+			id TEXT PRIMARY KEY, recipe_id INTEGER NOT NULL, user_id TEXT, parent_id TEXT, root_id TEXT NOT NULL,
+			body TEXT NOT NULL, created_at DATETIME NOT NULL, edited_at DATETIME, deleted_at DATETIME, hidden_at DATETIME
+		);
+		CREATE TABLE collections (
+			id TEXT PRIMARY KEY, user_id TEXT NOT NULL, name TEXT NOT NULL, description TEXT NOT NULL DEFAULT '',
+			is_public BOOLEAN NOT NULL DEFAULT FALSE, created_at DATETIME NOT NULL, updated_at DATETIME NOT NULL
+		);
+		CREATE TABLE collection_recipes (
+			collection_id TEXT NOT NULL, recipe_id INTEGER NOT NULL, position INTEGER NOT NULL, added_at DATETIME NOT NULL,
+			PRIMARY KEY (collection_id, recipe_id)
+		);
+		CREATE TABLE follows (
+			follower_id TEXT NOT NULL, followee_id TEXT NOT NULL, created_at DATETIME NOT NULL,
+			PRIMARY KEY (follower_id, followee_id)
+		);
+		CREATE TABLE profile_settings (
+			user_id TEXT PRIMARY KEY, display_name TEXT NOT NULL DEFAULT '',
+			show_join_date BOOLEAN NOT NULL DEFAULT TRUE, show_recipes BOOLEAN NOT NULL DEFAULT TRUE,
+			show_collections BOOLEAN NOT NULL DEFAULT TRUE, show_stats BOOLEAN NOT NULL DEFAULT TRUE,
+			show_follows BOOLEAN NOT NULL DEFAULT TRUE, updated_at DATETIME NOT NULL
+		);
+		CREATE TABLE recipe_like_buckets (
+			recipe_id INTEGER NOT NULL, bucket_start DATETIME NOT NULL, likes INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (recipe_id, bucket_start)
+		);
+		CREATE TABLE recipe_notes (
+			user_id TEXT NOT NULL, recipe_id INTEGER NOT NULL, note TEXT NOT NULL DEFAULT '', updated_at DATETIME NOT NULL,
+			PRIMARY KEY (user_id, recipe_id)
+		);
+		CREATE TABLE recipe_ingredient_tweaks (
+			user_id TEXT NOT NULL, recipe_id INTEGER NOT NULL, ingredient_id INTEGER NOT NULL,
+			quantity REAL, unit TEXT, substitute_ingredient_id INTEGER,
+			PRIMARY KEY (user_id, recipe_id, ingredient_id)
+		);
+		CREATE TABLE recipe_revisions (
+			id TEXT PRIMARY KEY, recipe_id INTEGER NOT NULL, revision INTEGER NOT NULL, author_id TEXT,
+			summary TEXT NOT NULL DEFAULT '', snapshot TEXT NOT NULL, reverted_from INTEGER, created_at DATETIME NOT NULL
+		);
+		CREATE TABLE ingredients (id INTEGER PRIMARY KEY, name TEXT NOT NULL, category TEXT NOT NULL);
+		CREATE TABLE recipe_ingredients (
+			recipe_id INTEGER NOT NULL, ingredient_id INTEGER NOT NULL, quantity REAL NOT NULL, unit TEXT NOT NULL, notes TEXT,
+			PRIMARY KEY (recipe_id, ingredient_id)
+		);
+		CREATE TABLE recipe_similarities (
+			recipe_id INTEGER NOT NULL, similar_recipe_id INTEGER NOT NULL, score REAL NOT NULL,
+			PRIMARY KEY (recipe_id, similar_recipe_id)
+		);
+		CREATE TABLE pantry_items (
+			user_id TEXT NOT NULL, ingredient_id INTEGER NOT NULL, quantity REAL NOT NULL, unit TEXT NOT NULL,
+			expires_at DATETIME, created_at DATETIME NOT NULL, updated_at DATETIME NOT NULL,
+			PRIMARY KEY (user_id, ingredient_id)
+		);
+		CREATE TABLE content_reports (
+			id TEXT PRIMARY KEY, reporter_id TEXT NOT NULL, content_type TEXT NOT NULL, content_id TEXT NOT NULL,
+			reason TEXT NOT NULL, details TEXT NOT NULL DEFAULT '', status TEXT NOT NULL DEFAULT 'open',
+			created_at DATETIME NOT NULL, resolved_at DATETIME
+		);
+		CREATE TABLE moderation_actions (
+			id TEXT PRIMARY KEY, moderator_id TEXT, user_id TEXT, action TEXT NOT NULL,
+			content_type TEXT NOT NULL DEFAULT '', content_id TEXT NOT NULL DEFAULT '', reason TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL
+		);
+		CREATE TABLE login_failures (key TEXT PRIMARY KEY, failures INTEGER NOT NULL DEFAULT 0);
+		CREATE TABLE data_exports (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			format TEXT NOT NULL,
+			status TEXT NOT NULL,
+			error TEXT,
+			archive BLOB,
+			download_token_hash TEXT UNIQUE,
+			link_expires_at DATETIME,
+			created_at DATETIME NOT NULL,
+			completed_at DATETIME,
+			expires_at DATETIME
+		);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create account tables: %v", err)
+	}
+
 	return db
 }
 
+type sentMail struct {
+	to, subject, body string
+}
+
+type recordingMailer struct {
+	sent []sentMail
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.sent = append(m.sent, sentMail{to, subject, body})
+	return nil
+}
+
+// linkToken extracts the token from the link in a message body.
+func linkToken(t *testing.T, body string) string {
+	_, token, found := strings.Cut(body, "?token=")
+	if !found {
+		t.Fatalf("No link in message: %q", body)
+	}
+	return strings.Fields(token)[0]
+}
+
 func seedTestUser(t *testing.T, db *sql.DB, userID, username, email, password string) {
 	hashedPassword, err := auth.HashPassword(password)
 	if err != nil {
@@ -127,10 +301,11 @@ func TestUpdateUserProfile(t *testing.T) {
 	defer db.Close()
 
 	service := NewUserService(db)
+	service.SetMailer(&recordingMailer{}, "https://app.example.com")
 
 	seedTestUser(t, db, "user-123", "testuser", "test@example.com", "password123")
 
-	// Test successful update
+	// Test successful update; the new email waits for confirmation
 	profile, err := service.updateUserProfile("user-123", "newusername", "new@example.com")
 	if err != nil {
 		t.Fatalf("updateUserProfile() failed: %v", err)
@@ -139,8 +314,11 @@ func TestUpdateUserProfile(t *testing.T) {
 	if profile.Username != "newusername" {
 		t.Errorf("Expected username 'newusername', got '%s'", profile.Username)
 	}
-	if profile.Email != "new@example.com" {
-		t.Errorf("Expected email 'new@example.com', got '%s'", profile.Email)
+	if profile.Email != "test@example.com" {
+		t.Errorf("Expected email 'test@example.com', got '%s'", profile.Email)
+	}
+	if profile.PendingEmail != "new@example.com" {
+		t.Errorf("Expected pending email 'new@example.com', got '%s'", profile.PendingEmail)
 	}
 
 	// Test duplicate username/email conflict
@@ -155,6 +333,135 @@ func TestUpdateUserProfile(t *testing.T) {
 	if err == nil {
 		t.Error("updateUserProfile() should fail when email is taken")
 	}
+
+	// Identities are compared case-insensitively
+	_, err = service.updateUserProfile("user-123", "OtherUser", "test@example.com")
+	if err == nil {
+		t.Error("updateUserProfile() should fail when username differs only in case")
+	}
+
+	_, err = service.updateUserProfile("user-123", "newusername", "Other@Example.com")
+	if err == nil {
+		t.Error("updateUserProfile() should fail when email differs only in case")
+	}
+
+	// Emails are normalized, usernames keep their case
+	profile, err = service.updateUserProfile("user-123", "NewUserName", " New@Example.COM ")
+	if err != nil {
+		t.Fatalf("updateUserProfile() failed: %v", err)
+	}
+	if profile.Username != "NewUserName" || profile.PendingEmail != "new@example.com" {
+		t.Errorf("Profile = %s <%s>, want NewUserName <new@example.com>", profile.Username, profile.PendingEmail)
+	}
+
+	// Submitting the current email cancels the pending change
+	profile, err = service.updateUserProfile("user-123", "NewUserName", "test@example.com")
+	if err != nil {
+		t.Fatalf("updateUserProfile() failed: %v", err)
+	}
+	if profile.PendingEmail != "" {
+		t.Errorf("Expected no pending email, got '%s'", profile.PendingEmail)
+	}
+
+	_, err = service.updateUserProfile("user-123", "bad name!", "test@example.com")
+	if err == nil {
+		t.Error("updateUserProfile() should reject usernames with disallowed characters")
+	}
+
+	// A legacy username that breaks the current rules can be kept
+	seedTestUser(t, db, "user-789", "old name", "legacy@example.com", "password123")
+	profile, err = service.updateUserProfile("user-789", "old name", "legacy@example.com")
+	if err != nil {
+		t.Fatalf("updateUserProfile() should keep a legacy username: %v", err)
+	}
+	if profile.Username != "old name" {
+		t.Errorf("Expected username 'old name', got '%s'", profile.Username)
+	}
+}
+
+func TestEmailChangeConfirmAndRevert(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	mailer := &recordingMailer{}
+	service := NewUserService(db)
+	service.SetMailer(mailer, "https://app.example.com/")
+
+	seedTestUser(t, db, "user-123", "testuser", "old@example.com", "password123")
+
+	_, err := service.updateUserProfile("user-123", "testuser", "new@example.com")
+	if err != nil {
+		t.Fatalf("updateUserProfile() failed: %v", err)
+	}
+
+	if len(mailer.sent) != 1 || mailer.sent[0].to != "new@example.com" {
+		t.Fatalf("Expected a confirmation mail to new@example.com, got %+v", mailer.sent)
+	}
+	if !strings.Contains(mailer.sent[0].body, "https://app.example.com/confirm-email?token=") {
+		t.Errorf("Confirmation mail has no confirm link: %q", mailer.sent[0].body)
+	}
+	confirmToken := linkToken(t, mailer.sent[0].body)
+
+	_, err = service.confirmEmailChange("not-a-token")
+	if err == nil {
+		t.Error("confirmEmailChange() should fail for an unknown token")
+	}
+
+	profile, err := service.confirmEmailChange(confirmToken)
+	if err != nil {
+		t.Fatalf("confirmEmailChange() failed: %v", err)
+	}
+	if profile.Email != "new@example.com" || profile.PendingEmail != "" {
+		t.Errorf("After confirming, email = %s (pending %q), want new@example.com", profile.Email, profile.PendingEmail)
+	}
+
+	_, err = service.confirmEmailChange(confirmToken)
+	if err == nil {
+		t.Error("confirmEmailChange() should not accept a token twice")
+	}
+
+	if len(mailer.sent) != 2 || mailer.sent[1].to != "old@example.com" {
+		t.Fatalf("Expected a notification to old@example.com, got %+v", mailer.sent)
+	}
+	revertToken := linkToken(t, mailer.sent[1].body)
+
+	// Reverting signs out every device
+	db.Exec("INSERT INTO sessions (id, user_id, user_agent, ip_address, created_at, last_seen_at) VALUES ('s1', 'user-123', '', '', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)")
+
+	if err := service.revertEmailChange(revertToken); err != nil {
+		t.Fatalf("revertEmailChange() failed: %v", err)
+	}
+
+	profile, err = service.getUserProfile("user-123")
+	if err != nil {
+		t.Fatalf("getUserProfile() failed: %v", err)
+	}
+	if profile.Email != "old@example.com" {
+		t.Errorf("After reverting, email = %s, want old@example.com", profile.Email)
+	}
+
+	var sessions int
+	db.QueryRow("SELECT COUNT(*) FROM sessions WHERE user_id = 'user-123'").Scan(&sessions)
+	if sessions != 0 {
+		t.Errorf("Sessions after revert = %d, want 0", sessions)
+	}
+
+	if err := service.revertEmailChange(revertToken); err == nil {
+		t.Error("revertEmailChange() should not accept a token twice")
+	}
+
+	// Expired revert links are refused
+	_, err = service.updateUserProfile("user-123", "testuser", "third@example.com")
+	if err != nil {
+		t.Fatalf("updateUserProfile() failed: %v", err)
+	}
+	if _, err := service.confirmEmailChange(linkToken(t, mailer.sent[2].body)); err != nil {
+		t.Fatalf("confirmEmailChange() failed: %v", err)
+	}
+	db.Exec("UPDATE email_changes SET confirmed_at = $1 WHERE new_email = 'third@example.com'", time.Now().UTC().Add(-emailChangeRevertLifetime-time.Hour))
+	if err := service.revertEmailChange(linkToken(t, mailer.sent[3].body)); err == nil {
+		t.Error("revertEmailChange() should refuse an expired link")
+	}
 }
 
 func TestLikedRecipes(t *testing.T) {
@@ -168,7 +475,7 @@ func TestLikedRecipes(t *testing.T) {
 	seedTestRecipe(t, db, 2, "Recipe Two")
 
 	// Test getting empty liked recipes
-	recipes, err := service.getLikedRecipes("user-123")
+	recipes, _, err := service.getLikedRecipes("user-123", "", "", "", "liked_at", "desc", 0, 10, 0)
 	if err != nil {
 		t.Fatalf("getLikedRecipes() failed: %v", err)
 	}
@@ -182,7 +489,7 @@ func TestLikedRecipes(t *testing.T) {
 		t.Fatalf("addLikedRecipe() failed: %v", err)
 	}
 
-	recipes, err = service.getLikedRecipes("user-123")
+	recipes, _, err = service.getLikedRecipes("user-123", "", "", "", "liked_at", "desc", 0, 10, 0)
 	if err != nil {
 		t.Fatalf("getLikedRecipes() failed: %v", err)
 	}
@@ -192,6 +499,12 @@ func TestLikedRecipes(t *testing.T) {
 	if recipes[0].Name != "Recipe One" {
 		t.Errorf("Expected recipe name 'Recipe One', got '%s'", recipes[0].Name)
 	}
+	var likeCount, bucketLikes int
+	db.QueryRow("SELECT like_count FROM recipes WHERE id = 1").Scan(&likeCount)
+	db.QueryRow("SELECT COALESCE(SUM(likes), 0) FROM recipe_like_buckets WHERE recipe_id = 1").Scan(&bucketLikes)
+	if likeCount != 1 || bucketLikes != 1 {
+		t.Errorf("like_count, bucket likes = %v, %v, want 1, 1", likeCount, bucketLikes)
+	}
 
 	// Test adding duplicate liked recipe (should fail)
 	err = service.addLikedRecipe("user-123", 1)
@@ -211,13 +524,18 @@ func TestLikedRecipes(t *testing.T) {
 		t.Fatalf("removeLikedRecipe() failed: %v", err)
 	}
 
-	recipes, err = service.getLikedRecipes("user-123")
+	recipes, _, err = service.getLikedRecipes("user-123", "", "", "", "liked_at", "desc", 0, 10, 0)
 	if err != nil {
 		t.Fatalf("getLikedRecipes() failed: %v", err)
 	}
 	if len(recipes) != 0 {
 		t.Errorf("Expected 0 liked recipes after removal, got %d", len(recipes))
 	}
+	db.QueryRow("SELECT like_count FROM recipes WHERE id = 1").Scan(&likeCount)
+	db.QueryRow("SELECT COALESCE(SUM(likes), 0) FROM recipe_like_buckets WHERE recipe_id = 1").Scan(&bucketLikes)
+	if likeCount != 0 || bucketLikes != 0 {
+		t.Errorf("like_count, bucket likes after removal = %v, %v, want 0, 0", likeCount, bucketLikes)
+	}
 
 	// Test removing non-existent liked recipe (should fail)
 	err = service.removeLikedRecipe("user-123", 1)
@@ -226,6 +544,72 @@ func TestLikedRecipes(t *testing.T) {
 	}
 }
 
+func TestBulkAndPagedLikedRecipes(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewUserService(db)
+	seedTestUser(t, db, "user-123", "testuser", "test@example.com", "password123")
+	seedTestRecipe(t, db, 1, "Carrot Soup")
+	seedTestRecipe(t, db, 2, "Apple Pie")
+	seedTestRecipe(t, db, 3, "Bean Stew")
+	db.Exec("UPDATE recipes SET category = 'Dessert', cook_time_minutes = 60 WHERE id = 2")
+
+	for _, recipeID := range []int{1, 3} {
+		if err := service.addLikedRecipe("user-123", recipeID); err != nil {
+			t.Fatalf("addLikedRecipe() failed: %v", err)
+		}
+	}
+
+	results, err := service.bulkUpdateLikedRecipes("user-123", BulkLikedRecipesRequest{
+		Add:    []int{1, 2, 999},
+		Remove: []int{3, 4},
+	})
+	if err != nil {
+		t.Fatalf("bulkUpdateLikedRecipes() failed: %v", err)
+	}
+	var statuses []string
+	for _, result := range results {
+		statuses = append(statuses, fmt.Sprintf("%s %d %s", result.Action, result.RecipeID, result.Status))
+	}
+	want := "[add 1 already_liked add 2 added add 999 recipe_not_found remove 3 removed remove 4 not_liked]"
+	if fmt.Sprint(statuses) != want {
+		t.Errorf("Bulk results = %v, want %v", statuses, want)
+	}
+
+	var likeCount int
+	db.QueryRow("SELECT like_count FROM recipes WHERE id = 3").Scan(&likeCount)
+	if likeCount != 0 {
+		t.Errorf("like_count of removed recipe = %v, want 0", likeCount)
+	}
+
+	if _, err := service.bulkUpdateLikedRecipes("user-123", BulkLikedRecipesRequest{Add: []int{1}, Remove: []int{1}}); err == nil {
+		t.Error("bulkUpdateLikedRecipes() should fail for a recipe both added and removed")
+	}
+	if _, err := service.bulkUpdateLikedRecipes("user-123", BulkLikedRecipesRequest{}); err == nil {
+		t.Error("bulkUpdateLikedRecipes() should fail with no changes")
+	}
+
+	byName, total, err := service.getLikedRecipes("user-123", "", "", "", "name", "asc", 0, 1, 0)
+	if err != nil {
+		t.Fatalf("getLikedRecipes() failed: %v", err)
+	}
+	if total != 2 || len(byName) != 1 || byName[0].Name != "Apple Pie" {
+		t.Errorf("First page by name = %v of %v, want [Apple Pie] of 2", byName, total)
+	}
+	if !byName[0].IsLiked || byName[0].LikedAt.IsZero() {
+		t.Errorf("Liked recipe IsLiked, LikedAt = %v, %v, want true and set", byName[0].IsLiked, byName[0].LikedAt)
+	}
+
+	quick, total, err := service.getLikedRecipes("user-123", "", "Dinner", "", "liked_at", "desc", 45, 10, 0)
+	if err != nil {
+		t.Fatalf("getLikedRecipes() failed: %v", err)
+	}
+	if total != 1 || len(quick) != 1 || quick[0].ID != 1 {
+		t.Errorf("Filtered liked recipes = %v of %v, want [Carrot Soup] of 1", quick, total)
+	}
+}
+
 func TestChangePassword(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
@@ -235,71 +619,690 @@ func TestChangePassword(t *testing.T) {
 	seedTestUser(t, db, "user-123", "testuser", "test@example.com", "oldpassword")
 
 	// Test with wrong current password
-	err := service.changePassword("user-123", "wrongpassword", "newpassword")
+	err := service.changePassword("user-123", "wrongpassword", "newpassword", "")
 	if err == nil {
 		t.Error("changePassword() should fail with wrong current password")
 	}
 
 	// Test successful password change
-	err = service.changePassword("user-123", "oldpassword", "newpassword")
+	err = service.changePassword("user-123", "oldpassword", "newpassword", "")
 	if err != nil {
 		t.Fatalf("changePassword() failed: %v", err)
 	}
 
 	// Verify new password works (by trying to change again)
-	err = service.changePassword("user-123", "newpassword", "anotherpassword")
+	err = service.changePassword("user-123", "newpassword", "anotherpassword", "")
 	if err != nil {
 		t.Error("changePassword() should work with new password")
 	}
 
 	// Verify old password no longer works
-	err = service.changePassword("user-123", "oldpassword", "something")
+	err = service.changePassword("user-123", "oldpassword", "something", "")
 	if err == nil {
 		t.Error("changePassword() should fail with old password after change")
 	}
 
 	// Test non-existent user
-	err = service.changePassword("non-existent", "password", "newpassword")
+	err = service.changePassword("non-existent", "password", "newpassword", "")
 	if err == nil {
 		t.Error("changePassword() should fail for non-existent user")
 	}
 }
 
+func TestChangePasswordEndsOtherSessions(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewUserService(db)
+
+	seedTestUser(t, db, "user-123", "testuser", "test@example.com", "oldpassword")
+	seedTestUser(t, db, "user-456", "otheruser", "other@example.com", "password123")
+
+	for _, session := range []struct{ id, userID string }{
+		{"session-current", "user-123"},
+		{"session-other", "user-123"},
+		{"session-someone-else", "user-456"},
+	} {
+		_, err := db.Exec(
+			"INSERT INTO sessions (id, user_id, user_agent, ip_address, created_at, last_seen_at) VALUES (?, ?, '', '', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)",
+			session.id, session.userID,
+		)
+		if err != nil {
+			t.Fatalf("Failed to seed session: %v", err)
+		}
+	}
+
+	err := service.changePassword("user-123", "oldpassword", "newpassword", "session-current")
+	if err != nil {
+		t.Fatalf("changePassword() failed: %v", err)
+	}
+
+	rows, err := db.Query("SELECT id FROM sessions ORDER BY id")
+	if err != nil {
+		t.Fatalf("Failed to query sessions: %v", err)
+	}
+	defer rows.Close()
+
+	var remaining []string
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		remaining = append(remaining, id)
+	}
+
+	if len(remaining) != 2 || remaining[0] != "session-current" || remaining[1] != "session-someone-else" {
+		t.Errorf("Expected only the current session and other users' sessions to remain, got %v", remaining)
+	}
+}
+
 func TestDeleteAccount(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
 
 	service := NewUserService(db)
+	service.SetDeletionGracePeriod(7 * 24 * time.Hour)
 
 	seedTestUser(t, db, "user-123", "testuser", "test@example.com", "password123")
+	seedTestRecipe(t, db, 1, "Pasta")
+	db.Exec("INSERT INTO user_liked_recipes (user_id, recipe_id) VALUES ('user-123', 1)")
+	db.Exec("INSERT INTO sessions (id, user_id, user_agent, ip_address, created_at, last_seen_at) VALUES ('s1', 'user-123', '', '', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)")
+	db.Exec("INSERT INTO recipe_reviews (id, user_id, recipe_id, rating, created_at, updated_at) VALUES ('r1', 'user-123', 1, 2, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)")
+	db.Exec("UPDATE recipes SET rating_count = 2, rating_sum = 7 WHERE id = 1")
+	db.Exec("INSERT INTO recipe_comments (id, recipe_id, user_id, root_id, body, created_at) VALUES ('c1', 1, 'user-123', 'c1', 'Tasty', CURRENT_TIMESTAMP)")
+	db.Exec("INSERT INTO moderation_actions (id, moderator_id, user_id, action, created_at) VALUES ('m1', NULL, 'user-123', 'suspend', CURRENT_TIMESTAMP)")
+	// A recipe the user wrote, with a fork of it by someone else
+	seedTestRecipe(t, db, 2, "My Soup")
+	seedTestRecipe(t, db, 3, "Their Soup")
+	db.Exec("UPDATE recipes SET author_id = 'user-123' WHERE id = 2")
+	db.Exec("UPDATE recipes SET author_id = 'someone-else', forked_from = 2 WHERE id = 3")
+	db.Exec("INSERT INTO recipe_ingredients (recipe_id, ingredient_id, quantity, unit) VALUES (2, 1, 1, 'cup')")
+	db.Exec("INSERT INTO recipe_revisions (id, recipe_id, revision, author_id, snapshot, created_at) VALUES ('rv1', 2, 1, 'user-123', '{}', CURRENT_TIMESTAMP)")
+	db.Exec("INSERT INTO recipe_similarities (recipe_id, similar_recipe_id, score) VALUES (1, 2, 0.5)")
+	db.Exec("INSERT INTO content_reports (id, reporter_id, content_type, content_id, reason, created_at) VALUES ('rep1', 'someone-else', 'recipe', '2', 'spam', CURRENT_TIMESTAMP)")
 
 	// Test with wrong password
-	err := service.deleteAccount("user-123", "wrongpassword")
+	_, err := service.deleteAccount("user-123", "", "wrongpassword")
 	if err == nil {
 		t.Error("deleteAccount() should fail with wrong password")
 	}
 
-	// Verify user still exists
-	_, err = service.getUserProfile("user-123")
+	// Test successful deletion; the account is only scheduled for removal
+	deleteAfter, err := service.deleteAccount("user-123", "", "password123")
 	if err != nil {
-		t.Error("User should still exist after failed deletion")
+		t.Fatalf("deleteAccount() failed: %v", err)
+	}
+	if wait := time.Until(deleteAfter); wait < 6*24*time.Hour || wait > 7*24*time.Hour {
+		t.Errorf("deleteAccount() scheduled removal in %v, want 7 days", wait)
 	}
 
-	// Test successful deletion
-	err = service.deleteAccount("user-123", "password123")
+	// Deleting again keeps the original date
+	again, err := service.deleteAccount("user-123", "", "password123")
+	if err != nil || !again.Equal(deleteAfter) {
+		t.Errorf("Second deleteAccount() = %v, %v; want %v", again, err, deleteAfter)
+	}
+
+	var sessions int
+	db.QueryRow("SELECT COUNT(*) FROM sessions WHERE user_id = 'user-123'").Scan(&sessions)
+	if sessions != 0 {
+		t.Errorf("Sessions after deletion = %d, want 0", sessions)
+	}
+
+	// Nothing is purged during the grace period
+	purged, err := service.PurgeExpiredAccounts()
 	if err != nil {
-		t.Fatalf("deleteAccount() failed: %v", err)
+		t.Fatalf("PurgeExpiredAccounts() failed: %v", err)
+	}
+	if purged != 0 {
+		t.Errorf("PurgeExpiredAccounts() = %d during the grace period, want 0", purged)
+	}
+	if _, err := service.getUserProfile("user-123"); err != nil {
+		t.Error("User should still exist during the grace period")
 	}
 
-	// Verify user no longer exists
-	_, err = service.getUserProfile("user-123")
-	if err == nil {
-		t.Error("User should not exist after deletion")
+	// Once it ends, the account and everything it owns are removed
+	db.Exec("UPDATE users SET delete_after = $1 WHERE id = 'user-123'", time.Now().UTC().Add(-time.Minute))
+	seedTestUser(t, db, "user-456", "otheruser", "other@example.com", "password123")
+
+	purged, err = service.PurgeExpiredAccounts()
+	if err != nil {
+		t.Fatalf("PurgeExpiredAccounts() failed: %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("PurgeExpiredAccounts() = %d, want 1", purged)
+	}
+	if _, err := service.getUserProfile("user-123"); err == nil {
+		t.Error("User should not exist after the purge")
+	}
+	if _, err := service.getUserProfile("user-456"); err != nil {
+		t.Error("Accounts not scheduled for deletion must survive the purge")
+	}
+
+	var likes int
+	db.QueryRow("SELECT COUNT(*) FROM user_liked_recipes WHERE user_id = 'user-123'").Scan(&likes)
+	if likes != 0 {
+		t.Errorf("Liked recipes after purge = %d, want 0", likes)
+	}
+
+	// The purged review no longer counts towards the recipe's rating
+	var ratingCount, ratingSum int
+	db.QueryRow("SELECT rating_count, rating_sum FROM recipes WHERE id = 1").Scan(&ratingCount, &ratingSum)
+	if ratingCount != 1 || ratingSum != 5 {
+		t.Errorf("Recipe rating after purge = %d/%d, want 1/5", ratingCount, ratingSum)
+	}
+
+	// Comments stay as blank placeholders so replies keep their thread
+	var commentBody string
+	var commentAuthor sql.NullString
+	err = db.QueryRow("SELECT user_id, body FROM recipe_comments WHERE id = 'c1'").Scan(&commentAuthor, &commentBody)
+	if err != nil || commentAuthor.Valid || commentBody != "" {
+		t.Errorf("Comment after purge = %v %q, %v; want an anonymous blank comment", commentAuthor, commentBody, err)
+	}
+
+	// Recipes the user wrote go with everything attached to them
+	var leftovers int
+	db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM recipes WHERE id = 2) +
+		(SELECT COUNT(*) FROM recipe_ingredients WHERE recipe_id = 2) +
+		(SELECT COUNT(*) FROM recipe_revisions WHERE recipe_id = 2) +
+		(SELECT COUNT(*) FROM recipe_similarities WHERE similar_recipe_id = 2) +
+		(SELECT COUNT(*) FROM content_reports WHERE id = 'rep1')`).Scan(&leftovers)
+	if leftovers != 0 {
+		t.Errorf("Rows left over from the user's recipe = %d, want 0", leftovers)
+	}
+	var forkedFrom sql.NullInt64
+	err = db.QueryRow("SELECT forked_from FROM recipes WHERE id = 3").Scan(&forkedFrom)
+	if err != nil || forkedFrom.Valid {
+		t.Errorf("Fork of a purged recipe = %v, %v; want kept and unlinked", forkedFrom, err)
+	}
+
+	// Actions taken against the user stay on record without them
+	var actionTarget sql.NullString
+	err = db.QueryRow("SELECT user_id FROM moderation_actions WHERE id = 'm1'").Scan(&actionTarget)
+	if err != nil || actionTarget.Valid {
+		t.Errorf("Moderation action after purge = %v, %v; want kept with no user", actionTarget, err)
 	}
 
 	// Test deleting non-existent user
-	err = service.deleteAccount("non-existent", "password")
+	_, err = service.deleteAccount("non-existent", "", "password")
 	if err == nil {
 		t.Error("deleteAccount() should fail for non-existent user")
 	}
+
+	// Accounts without a password confirm with a fresh sign-in instead
+	db.Exec("INSERT INTO users (id, username, email, password_hash) VALUES ('user-oidc', 'oidcuser', 'oidc@example.com', '')")
+	db.Exec("INSERT INTO sessions (id, user_id, user_agent, ip_address, created_at, last_seen_at) VALUES ('s-old', 'user-oidc', '', '', $1, $1)", time.Now().UTC().Add(-time.Hour))
+	db.Exec("INSERT INTO sessions (id, user_id, user_agent, ip_address, created_at, last_seen_at) VALUES ('s-new', 'user-oidc', '', '', $1, $1)", time.Now().UTC())
+
+	_, err = service.deleteAccount("user-oidc", "s-old", "")
+	if err == nil {
+		t.Error("deleteAccount() should require a recent sign-in for accounts without a password")
+	}
+	if _, err := service.deleteAccount("user-oidc", "s-new", ""); err != nil {
+		t.Errorf("deleteAccount() right after signing in failed: %v", err)
+	}
+}
+
+func TestCollections(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewUserService(db)
+
+	seedTestUser(t, db, "user-123", "testuser", "test@example.com", "password123")
+	seedTestUser(t, db, "user-456", "otheruser", "other@example.com", "password123")
+	seedTestRecipe(t, db, 1, "Pasta")
+	seedTestRecipe(t, db, 2, "Salad")
+	seedTestRecipe(t, db, 3, "Soup")
+
+	weeknight, err := service.createCollection("user-123", "Weeknight", "Quick dinners", false)
+	if err != nil {
+		t.Fatalf("createCollection() failed: %v", err)
+	}
+	if weeknight.ShareURL != "" {
+		t.Errorf("Private collection ShareURL = %q, want none", weeknight.ShareURL)
+	}
+	if _, err := service.createCollection("user-123", "weeknight", "", false); err == nil {
+		t.Error("createCollection() should reject a duplicate name")
+	}
+	holiday, err := service.createCollection("user-123", "Holiday", "", true)
+	if err != nil {
+		t.Fatalf("createCollection() failed: %v", err)
+	}
+
+	// A recipe can be in several collections
+	for _, recipeID := range []int{1, 2, 3} {
+		if err := service.addCollectionRecipe("user-123", weeknight.ID, recipeID); err != nil {
+			t.Fatalf("addCollectionRecipe() failed: %v", err)
+		}
+	}
+	if err := service.addCollectionRecipe("user-123", holiday.ID, 1); err != nil {
+		t.Fatalf("addCollectionRecipe() to a second collection failed: %v", err)
+	}
+	if err := service.addCollectionRecipe("user-123", weeknight.ID, 1); err == nil {
+		t.Error("addCollectionRecipe() should reject a recipe already in the collection")
+	}
+	if err := service.addCollectionRecipe("user-456", weeknight.ID, 1); err == nil {
+		t.Error("addCollectionRecipe() should not let another user change the collection")
+	}
+
+	if err := service.reorderCollection("user-123", weeknight.ID, []int{3, 1}); err == nil {
+		t.Error("reorderCollection() should require every recipe")
+	}
+	if err := service.reorderCollection("user-123", weeknight.ID, []int{3, 1, 2}); err != nil {
+		t.Fatalf("reorderCollection() failed: %v", err)
+	}
+
+	collection, err := service.getCollection("user-123", weeknight.ID)
+	if err != nil {
+		t.Fatalf("getCollection() failed: %v", err)
+	}
+	var order []int
+	for _, recipe := range collection.Recipes {
+		order = append(order, recipe.ID)
+	}
+	if fmt.Sprint(order) != "[3 1 2]" {
+		t.Errorf("Collection order = %v, want [3 1 2]", order)
+	}
+
+	// Only public collections can be read by others, including anonymous visitors
+	if _, err := service.getCollection("", weeknight.ID); err == nil {
+		t.Error("getCollection() should hide a private collection from anonymous visitors")
+	}
+	if _, err := service.getCollection("user-456", weeknight.ID); err == nil {
+		t.Error("getCollection() should hide a private collection from other users")
+	}
+	// The owner's API keys see only what an anonymous visitor would.
+	handler := NewUserHandler(service, auth.DefaultPasswordPolicy())
+	keyContext := context.WithValue(context.WithValue(context.Background(), "user_id", "user-123"), "api_key_id", "key-1")
+	rec := httptest.NewRecorder()
+	handler.SharedCollectionHandler(rec, httptest.NewRequest(http.MethodGet, "/api/collections/"+weeknight.ID, nil).WithContext(keyContext))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Private collection via API key status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	shared, err := service.getCollection("", holiday.ID)
+	if err != nil || len(shared.Recipes) != 1 || shared.Owner != "testuser" {
+		t.Errorf("Shared collection = %+v, %v; want one recipe by testuser", shared, err)
+	}
+
+	private := false
+	if _, err := service.updateCollection("user-123", holiday.ID, UpdateCollectionRequest{IsPublic: &private}); err != nil {
+		t.Fatalf("updateCollection() failed: %v", err)
+	}
+	if _, err := service.getCollection("", holiday.ID); err == nil {
+		t.Error("getCollection() should hide a collection made private")
+	}
+
+	if err := service.removeCollectionRecipe("user-123", weeknight.ID, 1); err != nil {
+		t.Fatalf("removeCollectionRecipe() failed: %v", err)
+	}
+	if err := service.deleteCollection("user-123", holiday.ID); err != nil {
+		t.Fatalf("deleteCollection() failed: %v", err)
+	}
+
+	collections, err := service.getCollections("user-123")
+	if err != nil {
+		t.Fatalf("getCollections() failed: %v", err)
+	}
+	if len(collections) != 1 || collections[0].RecipeCount != 2 {
+		t.Errorf("getCollections() = %+v, want Weeknight with 2 recipes", collections)
+	}
+
+	var orphans int
+	db.QueryRow("SELECT COUNT(*) FROM collection_recipes WHERE collection_id = $1", holiday.ID).Scan(&orphans)
+	if orphans != 0 {
+		t.Errorf("Recipes left in deleted collection = %d, want 0", orphans)
+	}
+}
+
+func TestPantry(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewUserService(db)
+
+	seedTestUser(t, db, "user-123", "testuser", "test@example.com", "password123")
+	seedTestUser(t, db, "user-456", "otheruser", "other@example.com", "password123")
+	db.Exec("INSERT INTO ingredients (id, name, category) VALUES (1, 'Flour', 'grain'), (2, 'Milk', 'dairy')")
+
+	if _, err := service.addPantryItem("user-123", PantryItemRequest{IngredientID: 1, Quantity: 0, Unit: "g"}); err == nil {
+		t.Error("addPantryItem() should reject a quantity that is not positive")
+	}
+	if _, err := service.addPantryItem("user-123", PantryItemRequest{IngredientID: 99, Quantity: 1, Unit: "g"}); err == nil {
+		t.Error("addPantryItem() should reject an unknown ingredient")
+	}
+
+	flour, err := service.addPantryItem("user-123", PantryItemRequest{IngredientID: 1, Quantity: 500, Unit: " g "})
+	if err != nil {
+		t.Fatalf("addPantryItem() failed: %v", err)
+	}
+	if flour.Name != "Flour" || flour.Unit != "g" || flour.ExpiresAt != nil {
+		t.Errorf("addPantryItem() = %+v, want 500 g of Flour with no expiry", flour)
+	}
+	if _, err := service.addPantryItem("user-123", PantryItemRequest{IngredientID: 1, Quantity: 1, Unit: "kg"}); err == nil {
+		t.Error("addPantryItem() should reject an ingredient already in the pantry")
+	}
+
+	expired := time.Now().Add(-time.Hour)
+	if _, err := service.addPantryItem("user-123", PantryItemRequest{IngredientID: 2, Quantity: 1, Unit: "l", ExpiresAt: &expired}); err != nil {
+		t.Fatalf("addPantryItem() failed: %v", err)
+	}
+
+	items, err := service.getPantry("user-123")
+	if err != nil {
+		t.Fatalf("getPantry() failed: %v", err)
+	}
+	if len(items) != 2 || items[0].IngredientID != 2 || !items[0].Expired || items[1].Expired {
+		t.Errorf("getPantry() = %+v, want expired Milk before Flour", items)
+	}
+
+	updated, err := service.updatePantryItem("user-123", 1, PantryItemRequest{Quantity: 250, Unit: "g"})
+	if err != nil {
+		t.Fatalf("updatePantryItem() failed: %v", err)
+	}
+	if updated.Quantity != 250 {
+		t.Errorf("Updated quantity = %v, want 250", updated.Quantity)
+	}
+	if _, err := service.updatePantryItem("user-456", 1, PantryItemRequest{Quantity: 1, Unit: "g"}); err == nil {
+		t.Error("updatePantryItem() should not change another user's pantry")
+	}
+
+	if err := service.removePantryItem("user-123", 2); err != nil {
+		t.Fatalf("removePantryItem() failed: %v", err)
+	}
+	if err := service.removePantryItem("user-123", 2); err == nil {
+		t.Error("removePantryItem() should fail for an ingredient not in the pantry")
+	}
+
+	items, _ = service.getPantry("user-456")
+	if len(items) != 0 {
+		t.Errorf("Other user's pantry = %+v, want empty", items)
+	}
+}
+
+func TestFollowsAndFeed(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewUserService(db)
+
+	seedTestUser(t, db, "user-1", "reader", "reader@example.com", "password123")
+	seedTestUser(t, db, "user-2", "chef", "chef@example.com", "password123")
+	seedTestUser(t, db, "user-3", "stranger", "stranger@example.com", "password123")
+
+	if err := service.follow("user-1", "reader"); err == nil {
+		t.Error("follow() should not allow following yourself")
+	}
+	if err := service.follow("user-1", "nobody"); err == nil {
+		t.Error("follow() should fail for an unknown user")
+	}
+	if err := service.follow("user-1", "Chef"); err != nil {
+		t.Fatalf("follow() failed: %v", err)
+	}
+	if err := service.follow("user-1", "chef"); err != nil {
+		t.Errorf("Following twice should be harmless, got %v", err)
+	}
+
+	followers, total, err := service.followList("", "chef", true, 10, 0)
+	if err != nil || total != 1 || followers[0].Username != "reader" {
+		t.Errorf("followList(followers) = %+v, %d, %v; want reader", followers, total, err)
+	}
+	following, total, err := service.followList("", "reader", false, 10, 0)
+	if err != nil || total != 1 || following[0].Username != "chef" {
+		t.Errorf("followList(following) = %+v, %d, %v; want chef", following, total, err)
+	}
+
+	// Activity from the followed user, one item a minute, plus noise from
+	// someone not followed and a private collection.
+	base := time.Now().UTC().Add(-time.Hour)
+	db.Exec("INSERT INTO recipes (id, name, author_id, created_at) VALUES (1, 'Chef Pasta', 'user-2', $1)", base)
+	db.Exec("INSERT INTO recipes (id, name, author_id, created_at) VALUES (2, 'Stranger Soup', 'user-3', $1)", base.Add(time.Minute))
+	db.Exec("INSERT INTO recipe_reviews (id, user_id, recipe_id, rating, review, created_at, updated_at) VALUES ('rev-1', 'user-2', 2, 4, 'Nice', $1, $1)", base.Add(2*time.Minute))
+	db.Exec("INSERT INTO collections (id, user_id, name, is_public, created_at, updated_at) VALUES ('col-1', 'user-2', 'Public', 1, $1, $1)", base.Add(3*time.Minute))
+	db.Exec("INSERT INTO collections (id, user_id, name, is_public, created_at, updated_at) VALUES ('col-2', 'user-2', 'Private', 0, $1, $1)", base.Add(4*time.Minute))
+
+	items, cursor, err := service.getFeed("user-1", "", 2)
+	if err != nil {
+		t.Fatalf("getFeed() failed: %v", err)
+	}
+	if len(items) != 2 || items[0].Type != FeedItemCollection || items[1].Type != FeedItemReview || cursor == "" {
+		t.Fatalf("First feed page = %+v, cursor %q; want the collection then the review", items, cursor)
+	}
+	if items[1].Rating == nil || *items[1].Rating != 4 || items[1].Username != "chef" {
+		t.Errorf("Review item = %+v, want chef's 4-star review", items[1])
+	}
+
+	items, cursor, err = service.getFeed("user-1", cursor, 2)
+	if err != nil {
+		t.Fatalf("getFeed() second page failed: %v", err)
+	}
+	if len(items) != 1 || items[0].Type != FeedItemRecipe || items[0].Title != "Chef Pasta" || cursor != "" {
+		t.Errorf("Second feed page = %+v, cursor %q; want only the recipe and no further page", items, cursor)
+	}
+
+	// Sections hidden from the public profile stay out of the feed
+	hide := false
+	if _, err := service.updateProfileSettings("user-2", UpdateProfileSettingsRequest{ShowRecipes: &hide, ShowCollections: &hide}); err != nil {
+		t.Fatalf("updateProfileSettings() failed: %v", err)
+	}
+	items, _, err = service.getFeed("user-1", "", 10)
+	if err != nil || len(items) != 1 || items[0].Type != FeedItemReview {
+		t.Errorf("Feed with recipes and collections hidden = %+v, %v; want only the review", items, err)
+	}
+
+	if _, _, err := service.getFeed("user-1", "not-a-cursor", 2); err == nil {
+		t.Error("getFeed() should reject a malformed cursor")
+	}
+
+	if err := service.unfollow("user-1", "chef"); err != nil {
+		t.Fatalf("unfollow() failed: %v", err)
+	}
+	if items, _, _ := service.getFeed("user-1", "", 10); len(items) != 0 {
+		t.Errorf("Feed after unfollowing = %d items, want 0", len(items))
+	}
+}
+
+func TestPublicProfile(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewUserService(db)
+
+	seedTestUser(t, db, "user-1", "chef", "chef@example.com", "password123")
+	seedTestUser(t, db, "user-2", "fan", "fan@example.com", "password123")
+	seedTestRecipe(t, db, 1, "Chef Pasta")
+	seedTestRecipe(t, db, 2, "Site Soup")
+	db.Exec("UPDATE recipes SET author_id = 'user-1' WHERE id = 1")
+	service.addLikedRecipe("user-2", 1)
+	service.addLikedRecipe("user-2", 2)
+	db.Exec("INSERT INTO recipe_reviews (id, user_id, recipe_id, rating, created_at, updated_at) VALUES ('rev-1', 'user-2', 1, 5, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)")
+	service.createCollection("user-1", "Favourites", "", true)
+	service.createCollection("user-1", "Drafts", "", false)
+	service.follow("user-2", "chef")
+
+	// Everything is visible by default
+	profile, err := service.getPublicProfile("user-2", "CHEF")
+	if err != nil {
+		t.Fatalf("getPublicProfile() failed: %v", err)
+	}
+	if profile.DisplayName != "chef" || profile.JoinedAt == nil || !profile.IsFollowing {
+		t.Errorf("Profile = %+v, want username as display name, join date and is_following", profile)
+	}
+	if len(profile.Recipes) != 1 || profile.Recipes[0].Name != "Chef Pasta" {
+		t.Errorf("Profile recipes = %+v, want only Chef Pasta", profile.Recipes)
+	}
+	if len(profile.Collections) != 1 || profile.Collections[0].Name != "Favourites" {
+		t.Errorf("Profile collections = %+v, want only the public one", profile.Collections)
+	}
+	if profile.Stats == nil || profile.Stats.LikesReceived != 1 || profile.Stats.ReviewsReceived != 1 {
+		t.Errorf("Profile stats = %+v, want 1 like and 1 review", profile.Stats)
+	}
+	if profile.FollowerCount == nil || *profile.FollowerCount != 1 {
+		t.Errorf("Profile follower count = %v, want 1", profile.FollowerCount)
+	}
+
+	displayName := "  Head Chef "
+	hidden := false
+	settings, err := service.updateProfileSettings("user-1", UpdateProfileSettingsRequest{
+		DisplayName: &displayName,
+		ShowRecipes: &hidden,
+		ShowStats:   &hidden,
+		ShowFollows: &hidden,
+	})
+	if err != nil {
+		t.Fatalf("updateProfileSettings() failed: %v", err)
+	}
+	if settings.DisplayName != "Head Chef" || settings.ShowRecipes || !settings.ShowCollections {
+		t.Errorf("updateProfileSettings() = %+v, want only the given settings changed", settings)
+	}
+
+	profile, err = service.getPublicProfile("", "chef")
+	if err != nil {
+		t.Fatalf("getPublicProfile() failed: %v", err)
+	}
+	if profile.DisplayName != "Head Chef" || profile.Recipes != nil || profile.Stats != nil || profile.FollowerCount != nil {
+		t.Errorf("Anonymous view = %+v, want hidden sections left out", profile)
+	}
+	if len(profile.Collections) != 1 {
+		t.Errorf("Anonymous view collections = %d, want 1", len(profile.Collections))
+	}
+	if _, _, err := service.followList("user-2", "chef", true, 10, 0); err == nil {
+		t.Error("followList() should refuse hidden follows to others")
+	}
+	if _, _, err := service.followList("user-1", "chef", true, 10, 0); err != nil {
+		t.Errorf("followList() should show hidden follows to their owner, got %v", err)
+	}
+
+	// The owner still sees everything
+	profile, _ = service.getPublicProfile("user-1", "chef")
+	if len(profile.Recipes) != 1 || profile.Stats == nil {
+		t.Errorf("Owner view = %+v, want every section", profile)
+	}
+
+	// ...but not through one of their API keys
+	handler := NewUserHandler(service, auth.DefaultPasswordPolicy())
+	keyContext := context.WithValue(context.WithValue(context.Background(), "user_id", "user-1"), "api_key_id", "key-1")
+	rec := httptest.NewRecorder()
+	handler.PublicUserHandler(rec, httptest.NewRequest(http.MethodGet, "/api/users/chef", nil).WithContext(keyContext))
+	var keyView PublicProfile
+	if err := json.NewDecoder(rec.Body).Decode(&keyView); err != nil || keyView.Recipes != nil || keyView.Stats != nil {
+		t.Errorf("API key view = %+v, %v; want hidden sections left out", keyView, err)
+	}
+
+	if _, err := service.getPublicProfile("", "nobody"); err == nil {
+		t.Error("getPublicProfile() should fail for an unknown user")
+	}
+}
+
+func readExportArchive(t *testing.T, archive []byte) map[string]string {
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("Export is not a zip archive: %v", err)
+	}
+
+	files := make(map[string]string)
+	for _, file := range reader.File {
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", file.Name, err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		files[file.Name] = string(content)
+	}
+	return files
+}
+
+func TestDataExport(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	service := NewUserService(db)
+
+	seedTestUser(t, db, "user-123", "testuser", "test@example.com", "password123")
+	seedTestRecipe(t, db, 1, "Pasta")
+	service.addLikedRecipe("user-123", 1)
+
+	for _, format := range []string{ExportFormatJSON, ExportFormatCSV} {
+		exportID := "export-" + format
+		db.Exec(
+			"INSERT INTO data_exports (id, user_id, format, status, created_at) VALUES ($1, 'user-123', $2, $3, $4)",
+			exportID, format, ExportStatusPending, time.Now().UTC(),
+		)
+
+		export, err := service.getExport("user-123", exportID)
+		if err != nil {
+			t.Fatalf("getExport() failed: %v", err)
+		}
+		if export.Status != ExportStatusPending || export.DownloadURL != "" {
+			t.Errorf("Pending export = %+v, want no download link", export)
+		}
+
+		if err := service.buildExport(exportID, "user-123", format); err != nil {
+			t.Fatalf("buildExport(%s) failed: %v", format, err)
+		}
+
+		// Exports belong to their user
+		if _, err := service.getExport("user-456", exportID); err == nil {
+			t.Error("getExport() should not find another user's export")
+		}
+
+		export, err = service.getExport("user-123", exportID)
+		if err != nil {
+			t.Fatalf("getExport() failed: %v", err)
+		}
+		if export.Status != ExportStatusReady || export.ExpiresAt == nil {
+			t.Fatalf("Export = %+v, want ready with an expiry", export)
+		}
+		_, token, found := strings.Cut(export.DownloadURL, "?token=")
+		if !found {
+			t.Fatalf("DownloadURL = %q, want a token link", export.DownloadURL)
+		}
+
+		archive, _, err := service.downloadExport(token)
+		if err != nil {
+			t.Fatalf("downloadExport() failed: %v", err)
+		}
+		files := readExportArchive(t, archive)
+
+		if format == ExportFormatJSON {
+			var data map[string][]map[string]interface{}
+			if err := json.Unmarshal([]byte(files["data.json"]), &data); err != nil {
+				t.Fatalf("data.json is not valid JSON: %v", err)
+			}
+			if len(data["profile"]) != 1 || data["profile"][0]["email"] != "test@example.com" {
+				t.Errorf("profile = %v, want the user's profile", data["profile"])
+			}
+			if len(data["liked_recipes"]) != 1 || data["liked_recipes"][0]["recipe_name"] != "Pasta" || data["liked_recipes"][0]["liked_at"] == nil {
+				t.Errorf("liked_recipes = %v, want Pasta with a timestamp", data["liked_recipes"])
+			}
+		} else {
+			if !strings.HasPrefix(files["liked_recipes.csv"], "recipe_id,recipe_name,category,liked_at\n1,Pasta,Dinner,") {
+				t.Errorf("liked_recipes.csv = %q", files["liked_recipes.csv"])
+			}
+			if !strings.Contains(files["profile.csv"], "test@example.com") {
+				t.Errorf("profile.csv = %q, want the user's email", files["profile.csv"])
+			}
+		}
+
+		// A newer link replaces the old one, and links expire
+		if _, err := service.getExport("user-123", exportID); err != nil {
+			t.Fatalf("getExport() failed: %v", err)
+		}
+		if _, _, err := service.downloadExport(token); err == nil {
+			t.Error("downloadExport() should refuse a superseded link")
+		}
+	}
+
+	if _, _, err := service.downloadExport("not-a-token"); err == nil {
+		t.Error("downloadExport() should refuse an unknown token")
+	}
+
+	db.Exec("UPDATE data_exports SET expires_at = $1", time.Now().UTC().Add(-time.Minute))
+	purged, err := service.PurgeExpiredExports()
+	if err != nil {
+		t.Fatalf("PurgeExpiredExports() failed: %v", err)
+	}
+	if purged != 2 {
+		t.Errorf("PurgeExpiredExports() = %d, want 2", purged)
+	}
 }
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,6 +14,8 @@ import (
 	"github.com/ngthecoder/go_web_api/internal/auth"
 	"github.com/ngthecoder/go_web_api/internal/database"
 	"github.com/ngthecoder/go_web_api/internal/ingredients"
+	"github.com/ngthecoder/go_web_api/internal/mail"
+	"github.com/ngthecoder/go_web_api/internal/moderation"
 	"github.com/ngthecoder/go_web_api/internal/recipes"
 	"github.com/ngthecoder/go_web_api/internal/stats"
 	"github.com/ngthecoder/go_web_api/internal/users"
@@ -29,8 +32,9 @@ func enableCORS(allowedOrigins []string, next http.HandlerFunc) http.HandlerFunc
 		}
 
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -54,6 +58,18 @@ func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// splitByMethod sends GET requests to read and every other method to write, so
+// a path can allow anonymous reads while requiring sign-in for changes.
+func splitByMethod(read, write http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			read(w, r)
+			return
+		}
+		write(w, r)
+	}
+}
+
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	err := database.DB.Ping()
 	if err != nil {
@@ -88,6 +104,159 @@ func getDatabaseConfig() database.Config {
 	}
 }
 
+// getOIDCProviderConfigs reads OIDC_PROVIDERS, a comma-separated list of
+// provider names, and for each name the OIDC_<NAME>_ISSUER, _CLIENT_ID,
+// _CLIENT_SECRET, _REDIRECT_URL and optional _SCOPES variables.
+func getOIDCProviderConfigs() []auth.OIDCProviderConfig {
+	var configs []auth.OIDCProviderConfig
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		config := auth.OIDCProviderConfig{
+			Name:         name,
+			IssuerURL:    os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+		}
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			config.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+		}
+
+		if config.IssuerURL == "" || config.ClientID == "" || config.RedirectURL == "" {
+			log.Fatalf("Incomplete configuration for OIDC provider %s", name)
+		}
+		configs = append(configs, config)
+	}
+
+	return configs
+}
+
+func getPasswordPolicy() *auth.PasswordPolicy {
+	policy := auth.DefaultPasswordPolicy()
+
+	if minLength := os.Getenv("PASSWORD_MIN_LENGTH"); minLength != "" {
+		n, err := strconv.Atoi(minLength)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid PASSWORD_MIN_LENGTH: %q", minLength)
+		}
+		policy.MinLength = n
+	}
+
+	if classes := os.Getenv("PASSWORD_REQUIRED_CLASSES"); classes != "" {
+		for _, class := range strings.Split(classes, ",") {
+			class = strings.TrimSpace(class)
+			if !auth.IsValidCharacterClass(class) {
+				log.Fatalf("Invalid PASSWORD_REQUIRED_CLASSES entry: %q", class)
+			}
+			policy.RequiredClasses = append(policy.RequiredClasses, class)
+		}
+	}
+
+	if os.Getenv("PASSWORD_ALLOW_IDENTITY") == "true" {
+		policy.ForbidIdentity = false
+	}
+
+	blocklistFile := os.Getenv("PASSWORD_BLOCKLIST_FILE")
+	if blocklistFile == "" {
+		blocklistFile = "config/password_blocklist.txt"
+	}
+	count, err := policy.LoadBlocklist(blocklistFile)
+	if err != nil {
+		log.Printf("Warning: failed to load password blocklist %s: %v", blocklistFile, err)
+	} else {
+		log.Printf("Loaded %d blocked passwords from %s", count, blocklistFile)
+	}
+
+	return policy
+}
+
+// getMailer returns an SMTP mailer when SMTP_HOST is set, and otherwise one
+// that only logs messages.
+func getMailer() mail.Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Println("SMTP_HOST not set; outgoing email will be logged instead of sent")
+		return mail.LogMailer{}
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		log.Fatal("Missing MAIL_FROM attribute")
+	}
+
+	return &mail.SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+	}
+}
+
+// runPurges permanently removes accounts whose deletion grace period has
+// ended and data exports past their retention, checking every interval.
+func runPurges(userService *users.UserService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := userService.PurgeExpiredAccounts()
+		if err != nil {
+			log.Printf("Warning: account purge failed: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d deleted accounts", purged)
+		}
+
+		if _, err := userService.PurgeExpiredExports(); err != nil {
+			log.Printf("Warning: data export purge failed: %v", err)
+		}
+
+		<-ticker.C
+	}
+}
+
+// runSimilarityRebuilds refreshes the recipe similarities behind
+// recommendations every interval.
+func runSimilarityRebuilds(recipesService *recipes.RecipesService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pairs, err := recipesService.RebuildRecipeSimilarities()
+		if err != nil {
+			log.Printf("Warning: recipe similarity rebuild failed: %v", err)
+		} else {
+			log.Printf("Rebuilt recipe similarities: %d pairs", pairs)
+		}
+
+		<-ticker.C
+	}
+}
+
+// runTrendingRefreshes decays the recipe trending scores every interval.
+func runTrendingRefreshes(recipesService *recipes.RecipesService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := recipesService.RefreshTrendingScores(); err != nil {
+			log.Printf("Warning: trending score refresh failed: %v", err)
+		}
+
+		<-ticker.C
+	}
+}
+
 func main() {
 	err := godotenv.Load()
 	if err != nil {
@@ -126,15 +295,68 @@ func main() {
 	authService := auth.NewAuthService(database.DB, jwtSecret)
 	authHandler := auth.NewAuthHandler(authService)
 
+	if trusted := os.Getenv("TRUSTED_PROXIES"); trusted != "" {
+		proxies, err := auth.ParseTrustedProxies(trusted)
+		if err != nil {
+			log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+		}
+		authHandler.SetTrustedProxies(proxies)
+		log.Printf("Trusting X-Forwarded-For from %d proxy ranges", len(proxies))
+	}
+
+	passwordPolicy := getPasswordPolicy()
+	authService.SetPasswordPolicy(passwordPolicy)
+
+	if adminEmail := os.Getenv("ADMIN_EMAIL"); adminEmail != "" {
+		promoted, err := authService.BootstrapAdmin(adminEmail)
+		if err != nil {
+			log.Fatalf("Failed to bootstrap admin: %v", err)
+		}
+		if promoted {
+			log.Printf("Granted admin role to %s", adminEmail)
+		} else {
+			log.Printf("ADMIN_EMAIL set but no account uses %s; register it and restart to grant admin", adminEmail)
+		}
+	}
+
+	for _, config := range getOIDCProviderConfigs() {
+		authService.ConfigureOIDCProvider(config)
+		log.Printf("Enabled OIDC provider %s", config.Name)
+	}
+
+	appBaseURL := os.Getenv("APP_BASE_URL")
+	if appBaseURL == "" {
+		appBaseURL = allowedOrigins[0]
+	}
+
 	userService := users.NewUserService(database.DB)
-	userHandler := users.NewUserHandler(userService)
+	userService.SetMailer(getMailer(), appBaseURL)
+
+	if graceDays := os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"); graceDays != "" {
+		days, err := strconv.Atoi(graceDays)
+		if err != nil || days < 0 {
+			log.Fatalf("Invalid ACCOUNT_DELETION_GRACE_DAYS: %q", graceDays)
+		}
+		userService.SetDeletionGracePeriod(time.Duration(days) * 24 * time.Hour)
+	}
+	go runPurges(userService, time.Hour)
+	userHandler := users.NewUserHandler(userService, passwordPolicy)
 
 	recipesService := recipes.NewRecipesService(database.DB)
 	recipesHandler := recipes.NewRecipesHandler(recipesService)
 
+	go runSimilarityRebuilds(recipesService, time.Hour)
+	// The first refresh runs straight away, scoring any like buckets the
+	// migrations backfilled.
+	go runTrendingRefreshes(recipesService, 15*time.Minute)
+
 	ingredientsService := ingredients.NewIngredientsService(database.DB)
 	ingredientsHandler := ingredients.NewIngredientsHandler(ingredientsService)
 
+	moderationService := moderation.NewModerationService(database.DB)
+	moderationService.SetMailer(getMailer())
+	moderationHandler := moderation.NewModerationHandler(moderationService)
+
 	statsService := stats.NewStatsService(database.DB)
 	statsHandler := stats.NewStatsHandler(statsService)
 
@@ -142,19 +364,64 @@ func main() {
 
 	http.HandleFunc("/api/auth/register", loggingMiddleware(enableCORS(allowedOrigins, authHandler.RegisterHandler)))
 	http.HandleFunc("/api/auth/login", loggingMiddleware(enableCORS(allowedOrigins, authHandler.LoginHandler)))
-
-	http.HandleFunc("/api/user/profile", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.GetProfile))))
-	http.HandleFunc("/api/user/liked-recipes", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.GetLikedRecipes))))
-	http.HandleFunc("/api/user/liked-recipes/add", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.AddLikedRecipe))))
-	http.HandleFunc("/api/user/liked-recipes/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.RemoveLikedRecipe))))
-	http.HandleFunc("/api/user/profile/update", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.UpdateProfile))))
+	http.HandleFunc("/api/auth/restore", loggingMiddleware(enableCORS(allowedOrigins, authHandler.RestoreAccountHandler)))
+
+	http.HandleFunc("/api/auth/oidc/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.OIDCHandler)))
+
+	http.HandleFunc("/api/user/profile", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.GetProfile, auth.ScopeProfileRead))))
+	http.HandleFunc("/api/user/liked-recipes", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.GetLikedRecipes, auth.ScopeLikesRead))))
+	http.HandleFunc("/api/user/liked-recipes/bulk", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.BulkLikedRecipes, auth.ScopeLikesWrite))))
+	http.HandleFunc("/api/user/liked-recipes/add", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.AddLikedRecipe, auth.ScopeLikesWrite))))
+	http.HandleFunc("/api/user/liked-recipes/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.RemoveLikedRecipe, auth.ScopeLikesWrite))))
+	http.HandleFunc("/api/user/profile/update", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.UpdateProfile, auth.ScopeProfileWrite))))
+	http.HandleFunc("/api/user/profile/settings", loggingMiddleware(enableCORS(allowedOrigins, splitByMethod(
+		authHandler.AuthMiddleware(userHandler.ProfileSettingsHandler, auth.ScopeProfileRead),
+		authHandler.AuthMiddleware(userHandler.ProfileSettingsHandler, auth.ScopeProfileWrite),
+	))))
 	http.HandleFunc("/api/user/password", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.ChangePassword))))
 	http.HandleFunc("/api/user/account", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.DeleteAccount))))
-
-	http.HandleFunc("/api/recipes", loggingMiddleware(enableCORS(allowedOrigins, authHandler.OptionalAuthMiddleware(recipesHandler.AllRecipesHandler))))
-	http.HandleFunc("/api/recipes/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.OptionalAuthMiddleware(recipesHandler.RecipeDetailHandler))))
-	http.HandleFunc("/api/recipes/find-by-ingredients", loggingMiddleware(enableCORS(allowedOrigins, authHandler.OptionalAuthMiddleware(recipesHandler.FindRecipesByIngredientsHandler))))
-	http.HandleFunc("/api/recipes/shopping-list/", loggingMiddleware(enableCORS(allowedOrigins, recipesHandler.ShoppingListHandler)))
+	http.HandleFunc("/api/user/email/confirm", loggingMiddleware(enableCORS(allowedOrigins, userHandler.ConfirmEmailChange)))
+	http.HandleFunc("/api/user/email/revert", loggingMiddleware(enableCORS(allowedOrigins, userHandler.RevertEmailChange)))
+	http.HandleFunc("/api/user/export", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.RequestExport))))
+	http.HandleFunc("/api/user/export/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.ExportStatus))))
+	http.HandleFunc("/api/user/export/download", loggingMiddleware(enableCORS(allowedOrigins, userHandler.DownloadExport)))
+
+	http.HandleFunc("/api/user/collections", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.CollectionsHandler))))
+	http.HandleFunc("/api/user/collections/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.CollectionHandler))))
+	http.HandleFunc("/api/user/pantry", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.PantryHandler))))
+	http.HandleFunc("/api/user/pantry/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.PantryItemHandler))))
+	http.HandleFunc("/api/user/recommendations", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(recipesHandler.RecommendationsHandler, auth.ScopeLikesRead))))
+	http.HandleFunc("/api/user/feed", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(userHandler.FeedHandler))))
+	http.HandleFunc("/api/users/", loggingMiddleware(enableCORS(allowedOrigins, splitByMethod(
+		authHandler.OptionalAuthMiddleware(userHandler.PublicUserHandler, auth.ScopeRecipesRead),
+		authHandler.AuthMiddleware(userHandler.PublicUserHandler),
+	))))
+	http.HandleFunc("/api/collections/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.OptionalAuthMiddleware(userHandler.SharedCollectionHandler, auth.ScopeRecipesRead))))
+
+	http.HandleFunc("/api/user/api-keys", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(authHandler.APIKeysHandler))))
+	http.HandleFunc("/api/user/api-keys/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(authHandler.RevokeAPIKeyHandler))))
+
+	http.HandleFunc("/api/user/sessions", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(authHandler.SessionsHandler))))
+	http.HandleFunc("/api/user/sessions/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(authHandler.RevokeSessionHandler))))
+
+	http.HandleFunc("/api/user/identities", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(authHandler.IdentitiesHandler))))
+	http.HandleFunc("/api/user/identities/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(authHandler.IdentityHandler))))
+
+	http.HandleFunc("/api/admin/users/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.RequireRole(auth.RoleAdmin, authHandler.UpdateUserRoleHandler))))
+	http.HandleFunc("/api/admin/moderation/queue", loggingMiddleware(enableCORS(allowedOrigins, authHandler.RequireRole(auth.RoleAdmin, moderationHandler.QueueHandler))))
+	http.HandleFunc("/api/admin/moderation/content/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.RequireRole(auth.RoleAdmin, moderationHandler.ContentHandler))))
+	http.HandleFunc("/api/admin/moderation/users/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.RequireRole(auth.RoleAdmin, moderationHandler.UserHandler))))
+
+	http.HandleFunc("/api/reports", loggingMiddleware(enableCORS(allowedOrigins, authHandler.AuthMiddleware(moderationHandler.ReportHandler))))
+
+	http.HandleFunc("/api/recipes", loggingMiddleware(enableCORS(allowedOrigins, authHandler.OptionalAuthMiddleware(recipesHandler.AllRecipesHandler, auth.ScopeRecipesRead))))
+	http.HandleFunc("/api/recipes/", loggingMiddleware(enableCORS(allowedOrigins, splitByMethod(
+		authHandler.OptionalAuthMiddleware(recipesHandler.RecipeDetailHandler, auth.ScopeRecipesRead),
+		authHandler.AuthMiddleware(recipesHandler.RecipeDetailHandler),
+	))))
+	http.HandleFunc("/api/recipes/trending", loggingMiddleware(enableCORS(allowedOrigins, authHandler.OptionalAuthMiddleware(recipesHandler.TrendingRecipesHandler, auth.ScopeRecipesRead))))
+	http.HandleFunc("/api/recipes/find-by-ingredients", loggingMiddleware(enableCORS(allowedOrigins, authHandler.OptionalAuthMiddleware(recipesHandler.FindRecipesByIngredientsHandler, auth.ScopeRecipesRead))))
+	http.HandleFunc("/api/recipes/shopping-list/", loggingMiddleware(enableCORS(allowedOrigins, authHandler.OptionalAuthMiddleware(recipesHandler.ShoppingListHandler, auth.ScopeRecipesRead))))
 
 	http.HandleFunc("/api/ingredients", loggingMiddleware(enableCORS(allowedOrigins, ingredientsHandler.AllIngredientsHandler)))
 	http.HandleFunc("/api/ingredients/", loggingMiddleware(enableCORS(allowedOrigins, ingredientsHandler.IngredientDetailsHandler)))
@@ -19,9 +19,15 @@ interface Recipe {
   description: string;
 }
 
+const PAGE_SIZE = 12;
+
 export default function LikedRecipesPage() {
   const { token } = useAuth();
   const [likedRecipes, setLikedRecipes] = useState<Recipe[]>([]);
+  const [total, setTotal] = useState(0);
+  const [totalPages, setTotalPages] = useState(0);
+  const [hasNext, setHasNext] = useState(false);
+  const [currentPage, setCurrentPage] = useState(1);
   const [loading, setLoading] = useState(true);
   const [error, setError] = useState<string | null>(null);
 
@@ -33,7 +39,11 @@ export default function LikedRecipesPage() {
       }
 
       try {
-        const response = await fetch(API_ENDPOINTS.likedRecipes, {
+        const params = new URLSearchParams();
+        params.set('page', currentPage.toString());
+        params.set('limit', PAGE_SIZE.toString());
+
+        const response = await fetch(`${API_ENDPOINTS.likedRecipes}?${params}`, {
           headers: {
             'Authorization': `Bearer ${token}`
           }
@@ -44,11 +54,10 @@ export default function LikedRecipesPage() {
         }
 
         const data = await response.json();
-        if (Array.isArray(data)) {
-          setLikedRecipes(data);
-        } else {
-          setLikedRecipes([]);
-        }
+        setLikedRecipes(Array.isArray(data.recipes) ? data.recipes : []);
+        setTotal(data.total ?? 0);
+        setTotalPages(data.total_pages ?? 0);
+        setHasNext(Boolean(data.has_next));
       } catch (err) {
         setError(err instanceof Error ? err.message : 'Something went wrong');
         console.error('Error fetching liked recipes:', err);
@@ -58,11 +67,21 @@ export default function LikedRecipesPage() {
     };
 
     fetchLikedRecipes();
-  }, [token]);
+  }, [token, currentPage]);
+
+  const handlePageChange = (newPage: number) => {
+    setLoading(true);
+    setCurrentPage(newPage);
+    window.scrollTo({ top: 0, behavior: 'smooth' });
+  };
 
   const handleLikeChange = (recipeId: number, isLiked: boolean) => {
     if (!isLiked) {
       setLikedRecipes(prev => prev.filter(recipe => recipe.id !== recipeId));
+      setTotal(prev => Math.max(0, prev - 1));
+      if (likedRecipes.length === 1 && currentPage > 1) {
+        handlePageChange(currentPage - 1);
+      }
     }
   };
 
@@ -72,7 +91,7 @@ export default function LikedRecipesPage() {
         <div className="mb-6">
           <h1 className="text-3xl font-bold mb-2">My Liked Recipes</h1>
           <p className="text-gray-600">
-            {loading ? 'Loading...' : `You have ${likedRecipes?.length} liked recipe${likedRecipes?.length !== 1 ? 's' : ''}`}
+            {loading ? 'Loading...' : `You have ${total} liked recipe${total !== 1 ? 's' : ''}`}
           </p>
         </div>
 
@@ -143,6 +162,47 @@ export default function LikedRecipesPage() {
             ))}
           </div>
         )}
+
+        {!loading && totalPages > 1 && (
+          <div className="mt-8 flex justify-center items-center space-x-2">
+            <button
+              onClick={() => handlePageChange(currentPage - 1)}
+              disabled={currentPage === 1}
+              className="px-4 py-2 border rounded disabled:opacity-50 disabled:cursor-not-allowed hover:bg-gray-50"
+            >
+              Previous
+            </button>
+
+            <div className="flex space-x-1">
+              {Array.from({ length: Math.min(totalPages, 5) }, (_, i) => {
+                const pageNum = Math.max(1, currentPage - 2) + i;
+                if (pageNum > totalPages) return null;
+
+                return (
+                  <button
+                    key={pageNum}
+                    onClick={() => handlePageChange(pageNum)}
+                    className={`px-3 py-2 border rounded ${
+                      currentPage === pageNum
+                        ? 'bg-blue-600 text-white'
+                        : 'hover:bg-gray-50'
+                    }`}
+                  >
+                    {pageNum}
+                  </button>
+                );
+              })}
+            </div>
+
+            <button
+              onClick={() => handlePageChange(currentPage + 1)}
+              disabled={!hasNext}
+              className="px-4 py-2 border rounded disabled:opacity-50 disabled:cursor-not-allowed hover:bg-gray-50"
+            >
+              Next
+            </button>
+          </div>
+        )}
       </div>
     </ProtectedRoute>
   );